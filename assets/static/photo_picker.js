@@ -0,0 +1,31 @@
+// Photo pickers find images of the media library by titles, credits or
+// names. The empty option and the selected photo are kept.
+(function () {
+  document.querySelectorAll("input[data-photo-search]").forEach(function (input) {
+    var select = input.form.querySelector("select[name=" + input.dataset.photoSelect + "]");
+    var timer;
+    input.addEventListener("input", function () {
+      clearTimeout(timer);
+      var q = input.value.trim();
+      timer = setTimeout(function () {
+        var url = input.dataset.photoSearch + "?q=" + encodeURIComponent(q);
+        fetch(url, { credentials: "same-origin" }).then(function (resp) { return resp.json(); }).then(function (photos) {
+          Array.prototype.slice.call(select.options).forEach(function (option) {
+            if (option.value && !option.selected) {
+              select.removeChild(option);
+            }
+          });
+          photos.forEach(function (photo) {
+            if (photo.ID === select.value) {
+              return;
+            }
+            var option = document.createElement("option");
+            option.value = photo.ID;
+            option.textContent = photo.Title || photo.URL;
+            select.appendChild(option);
+          });
+        });
+      }, 200);
+    });
+  });
+})();
@@ -5,8 +5,7 @@ go 1.13
 require (
 	bitbucket.org/iharsuvorau/wander v1.0.0
 	github.com/Machiel/slugify v1.0.1
-	github.com/davidbyttow/govips v0.0.0-20190304175058-d272f04c0fea // indirect
-	github.com/globalsign/mgo v0.0.0-20181015135952-eeefdecb41b8
+	github.com/davidbyttow/govips v0.0.0-20190304175058-d272f04c0fea
 	github.com/gorilla/mux v1.7.3
 	github.com/gorilla/schema v1.1.0
 	github.com/gorilla/securecookie v1.1.1
@@ -15,11 +14,11 @@ require (
 	github.com/pelletier/go-toml v1.6.0 // indirect
 	github.com/russross/blackfriday v1.5.2
 	github.com/stretchr/testify v1.4.0 // indirect
-	golang.org/x/text v0.3.2
+	go.mongodb.org/mongo-driver v1.13.1
+	golang.org/x/text v0.7.0
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	gopkg.in/gomail.v2 v2.0.0-20160411212932-81ebce5c23df
-	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
 	gopkg.in/yaml.v2 v2.2.7 // indirect
 )
 
@@ -3,32 +3,37 @@
 package main
 
 import (
+	"context"
 	"encoding/xml"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path"
+	"time"
 
 	"github.com/bahna/magazine/webserver/cms"
-	"github.com/globalsign/mgo"
-	"github.com/globalsign/mgo/bson"
+	"github.com/bahna/magazine/webserver/mongo"
+	"go.mongodb.org/mongo-driver/bson"
+	mongodb "go.mongodb.org/mongo-driver/mongo"
 )
 
 func main() {
-	dbhost := flag.String("dbhost", "192.168.99.100", "database host")
+	dbhost := flag.String("dbhost", "192.168.99.100", "database host or mongodb:// URI")
 	dbname := flag.String("dbname", "magazine", "database name")
 	outpath := flag.String("out", "./", "output directory for sitemap.xml")
 	prefix := flag.String("prefix", "", "global prefix to the relative URL document location")
+	dbtimeout := flag.Duration("dbtimeout", time.Minute, "timeout of database operations")
 	flag.Parse()
 
-	session, err := mgo.Dial(*dbhost)
+	ctx := context.Background()
+	client, err := mongo.Dial(ctx, *dbhost, *dbtimeout)
 	if err != nil {
 		log.Fatalf("failed to dial the database server at %s: %v", *dbhost, err)
 	}
-	defer session.Close()
+	defer client.Disconnect(ctx)
 
-	items, err := collectItems(session.DB(*dbname), *prefix)
+	items, err := collectItems(ctx, client.Database(*dbname), *prefix)
 	if err != nil {
 		log.Fatalf("failed to collect items: %v", err)
 	}
@@ -39,32 +44,33 @@ func main() {
 	}
 }
 
-func collectItems(dbs *mgo.Database, prefix string) (items []Item, err error) {
+func collectItems(ctx context.Context, dbs *mongodb.Database, prefix string) (items []Item, err error) {
 	items = []Item{}
 
-	topics, err := cms.AllTopics(dbs, bson.M{"public": true})
+	topics, err := cms.AllTopics(ctx, dbs, bson.M{"public": true})
 	if err != nil {
 		return
 	}
 	for _, v := range topics {
 		items = append(items, Item{
-			Loc:        fmt.Sprintf("%s/%s/%s", prefix, v.Language, v.Slug),
+			Loc:        fmt.Sprintf("%s/%s/%s", prefix, v.Language, v.Path),
 			ChangeFreq: "daily",
 		})
 	}
 
-	content, err := cms.AllContent(dbs, bson.M{"public": true})
+	content, err := cms.AllContent(ctx, dbs, bson.M{"public": true})
 	if err != nil {
 		return
 	}
 	for _, v := range content {
-		if err = cms.GetTopicsForContent(dbs, v); err != nil {
+		if err = cms.GetTopicsForContent(ctx, dbs, v); err != nil {
 			return
 		}
 
-		for _, t := range v.Topics {
+		// other topics redirect to the primary one
+		if t := v.PrimaryTopic(); t != nil {
 			items = append(items, Item{
-				Loc:     fmt.Sprintf("%s/%s/%s/%s", prefix, v.Language, t.Slug, v.Slug),
+				Loc:     fmt.Sprintf("%s/%s/%s/%s", prefix, v.Language, t.Path, v.Slug),
 				Lastmod: v.Published.Format("2006-01-02"),
 			})
 		}
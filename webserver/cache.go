@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bahna/magazine/webserver/cms"
+	"github.com/bahna/magazine/webserver/pagecache"
+	"github.com/bahna/magazine/webserver/store"
+	"github.com/gorilla/mux"
+)
+
+// maxCachedPages limits memory used by the page cache.
+const maxCachedPages = 10000
+
+// newPageCache returns a cache of public pages which are outdated when
+// scheduled content is published.
+func newPageCache(ttl time.Duration, s *store.Stores) *pagecache.Cache {
+	return pagecache.New(ttl, maxCachedPages, func() (time.Time, error) {
+		return s.Content.NextScheduled(context.Background(), time.Now())
+	})
+}
+
+// CachePages serves public pages to anonymous visitors from the page
+// cache. Pages of logged in users show their names and admin links, so
+// they are rendered every time.
+func CachePages(app *application) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return app.Pages.Handler(next, func(r *http.Request) bool {
+			_, ok := r.Context().Value("uid").(string)
+			return ok
+		})
+	}
+}
+
+// invalidatePages removes cached pages of the languages or all pages if
+// no languages are given. Call it after data shown on public pages is
+// changed.
+func invalidatePages(app *application, langs ...string) {
+	prefixes := make([]string, 0, len(langs))
+	for _, l := range langs {
+		prefixes = append(prefixes, "/"+l+"/")
+	}
+	app.Pages.Invalidate(prefixes...)
+
+	// versions of pages depend on invalidation times, they are
+	// saved for the exporter and restarted servers
+	if len(prefixes) == 0 {
+		prefixes = append(prefixes, "")
+	}
+	now := time.Now()
+	for _, p := range prefixes {
+		if err := app.Store.Invalidations.Save(context.Background(), p, now); err != nil {
+			log.Printf("failed to save the invalidation time of %q: %v", p, err)
+		}
+	}
+}
+
+// restoreInvalidations loads invalidation times saved by other
+// processes into the page cache.
+func restoreInvalidations(ctx context.Context, app *application) error {
+	times, err := app.Store.Invalidations.All(ctx)
+	if err != nil {
+		return err
+	}
+	for p, t := range times {
+		app.Pages.Restore(p, t)
+	}
+	return nil
+}
+
+// pageVersion identifies a version of a public page by content shown on
+// it. It sets validators of the page, so that browsers and proxies
+// revalidate pages instead of downloading them again, and surrogate
+// keys, so that a CDN in front of the website can purge pages by IDs.
+type pageVersion struct {
+	modified time.Time
+	hash     hash.Hash64
+	keys     []string
+	private  bool
+	maxAge   time.Duration
+}
+
+// newPageVersion starts a version of the page requested by r in the
+// language. Pages of logged in users differ from public ones and are
+// versioned separately.
+func newPageVersion(app *application, r *http.Request, lang string) *pageVersion {
+	v := &pageVersion{
+		// edits which don't change timestamps of content, like
+		// renamed topics, invalidate cached pages
+		modified: LatestTime(app.Started, app.Pages.Modified(r.URL.Path)),
+		hash:     fnv.New64a(),
+		keys:     []string{"lang-" + lang},
+		maxAge:   app.Pages.TTL,
+	}
+	fmt.Fprintf(v.hash, "%s %d", lang, v.modified.UnixNano())
+	if uid, ok := r.Context().Value("uid").(string); ok {
+		v.private = true
+		fmt.Fprintf(v.hash, " %s", uid)
+	}
+	return v
+}
+
+// Content adds content shown on the page with its dependent content.
+func (v *pageVersion) Content(items ...*cms.Content) {
+	for _, c := range items {
+		if c == nil {
+			continue
+		}
+		v.modified = LatestTime(v.modified, c.Updated, c.Published)
+		fmt.Fprintf(v.hash, " %s %d %d", c.ID.Hex(), c.Updated.UnixNano(), c.Published.UnixNano())
+		v.keys = append(v.keys, "content-"+c.ID.Hex())
+		v.Content(c.Children...)
+	}
+}
+
+// Topic adds the topic which page is shown.
+func (v *pageVersion) Topic(t *cms.Topic) {
+	fmt.Fprintf(v.hash, " %s", t.ID.Hex())
+	v.keys = append(v.keys, "topic-"+t.ID.Hex())
+}
+
+// NotModified sets caching headers of the page and responds with 304
+// Not Modified if the client has the current version. Handlers return
+// without rendering the page in that case.
+func (v *pageVersion) NotModified(w http.ResponseWriter, r *http.Request) bool {
+	h := w.Header()
+	// the language is taken from the path, but LangMust falls back
+	// on the cookie and Accept-Language, and logged in users get
+	// their own pages
+	h.Set("Vary", "Cookie, Accept-Language")
+	h.Set("ETag", fmt.Sprintf(`W/"%x"`, v.hash.Sum64()))
+	h.Set("Last-Modified", v.modified.UTC().Format(http.TimeFormat))
+	if v.private {
+		h.Set("Cache-Control", "private, no-cache")
+	} else {
+		// browsers revalidate pages every time, shared caches keep
+		// them as long as the page cache does and are purged by
+		// surrogate keys
+		h.Set("Cache-Control", fmt.Sprintf("public, max-age=0, s-maxage=%d", int(v.maxAge.Seconds())))
+		h.Set("Surrogate-Key", strings.Join(v.keys, " "))
+	}
+	if pagecache.NotModified(r, h) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
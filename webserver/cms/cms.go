@@ -3,26 +3,34 @@
 package cms
 
 import (
+	"errors"
 	"net/mail"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/bahna/magazine/webserver/user"
-	"github.com/globalsign/mgo/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// ErrTopicCycle is returned when a topic is made a subsection of
+// itself or of its own subsection.
+var ErrTopicCycle = errors.New("topic cannot be nested into itself")
+
+// ErrTopicLanguage is returned when a topic and its parent or
+// subsections have different languages.
+var ErrTopicLanguage = errors.New("topic must have the language of its parent and subsections")
+
 // Content represents a piece of content which belongs to one or several topics
 // and one or several authors.
 type Content struct {
-	ID bson.ObjectId `bson:"_id"`
+	ID primitive.ObjectID `bson:"_id"`
 	// Weight is the priority of the content. The bigger is more important.
 	Weight int
 	// Public shows if the content is public or not.
 	Public bool
 	// Promoted helps to define special content, which should be treated specially.
 	Promoted bool
-	// Page indicates if that piece of content is a separate page.
-	// TODO: must be changed for ContentType Page. Update: orgsite, infocenter.
-	Page bool
 	// Language is two-letter language code of a content's language.
 	// https://docs.mongodb.com/manual/tutorial/specify-language-for-text-index/#specify-default-language-text-index
 	// two letter code: http://docs.mongodb.org/manual/reference/text-search-languages/#text-search-languages
@@ -37,6 +45,12 @@ type Content struct {
 	Type ContentType
 	// Slug is a transliterated title and is used for URL composition and resultion.
 	Slug string
+	// SlugLocked keeps the slug when the title is changed. Editors lock
+	// slugs of published content or set them by hand.
+	SlugLocked bool
+	// OldSlugs are previous slugs of the content. Old URLs are
+	// redirected to the current one.
+	OldSlugs []string
 
 	Created   time.Time
 	Updated   time.Time
@@ -48,22 +62,45 @@ type Content struct {
 	PageTitle       string
 	PageDescription string
 
+	// RelatedPinned are shown first among related content in the given
+	// order, RelatedExcluded are never shown as related content.
+	RelatedPinned   []primitive.ObjectID
+	RelatedExcluded []primitive.ObjectID
+	// Related contains recommended content for the material page.
+	Related []*Content `bson:"-"`
+
 	// ParentID is used to specifye the parent content.
-	ParentID *bson.ObjectId
+	ParentID *primitive.ObjectID
 	// Children contains all dependent content which has .ID as .ParentID in itself.
 	Children []*Content `bson:"-"`
 
-	// TopicIDs specifies to which topics this content belongs.
-	// For this application we restrict the amount of topics to one
-	// so that we can use the only topic to generate a unique URL
-	// for a piece of content.
-	TopicIDs []bson.ObjectId
+	// PrimaryTopicID is the topic used to generate the canonical URL
+	// of the content. Content saved before the field was introduced
+	// uses the first topic of TopicIDs.
+	PrimaryTopicID primitive.ObjectID `bson:",omitempty"`
+	// TopicIDs specifies to which topics this content belongs. The
+	// primary topic goes first followed by secondary topics.
+	TopicIDs []primitive.ObjectID
 	Topics   []*Topic `bson:"-"` // do not store in database
 
+	// TagIDs are free-form tags of the content.
+	TagIDs []primitive.ObjectID
+	Tags   []*Tag `bson:"-"`
+
 	// AuthorIDs specifies authors of the content.
-	AuthorIDs []bson.ObjectId
+	AuthorIDs []primitive.ObjectID
 	Authors   []*user.User `bson:"-"` // do not store in database
 
+	// Credits are contributors without user accounts, e.g. guest
+	// authors and translators.
+	Credits []*Credit
+
+	// AuthorNames and TopicTitles duplicate names of authors and titles of
+	// topics, so they can be included into the full-text search index.
+	// Use UpdateSearchFields to keep them in sync.
+	AuthorNames string
+	TopicTitles string
+
 	Title string
 	Lede  string
 	Body  string
@@ -74,9 +111,7 @@ type Content struct {
 	// CoverInternal is displayed at the material page.
 	CoverInternal string
 
-	Images []struct {
-		URL, Caption, LinkTo, Credits string // TODO: finish with Credits
-	}
+	Images []Image
 
 	// EventStart is a field for events.
 	EventStart time.Time
@@ -156,9 +191,89 @@ func (t ContentType) String() string {
 	return "Unknown ContentType"
 }
 
+// CanonicalTopicID returns the ID of the primary topic.
+func (c *Content) CanonicalTopicID() primitive.ObjectID {
+	if !c.PrimaryTopicID.IsZero() {
+		return c.PrimaryTopicID
+	}
+	if len(c.TopicIDs) > 0 {
+		return c.TopicIDs[0]
+	}
+	return primitive.NilObjectID
+}
+
+// PrimaryTopic returns the primary topic from loaded topics of the
+// content. It is used to compose URLs in templates.
+func (c *Content) PrimaryTopic() *Topic {
+	id := c.CanonicalTopicID()
+	for _, t := range c.Topics {
+		if t.ID == id {
+			return t
+		}
+	}
+	if len(c.Topics) > 0 {
+		return c.Topics[0]
+	}
+	return nil
+}
+
+// ContributorIDs returns IDs of credited contributors.
+func (c *Content) ContributorIDs() []primitive.ObjectID {
+	ids := make([]primitive.ObjectID, len(c.Credits))
+	for i, v := range c.Credits {
+		ids[i] = v.ContributorID
+	}
+	return ids
+}
+
+// Image is an image of content, e.g. a photo of a photoreport.
+type Image struct {
+	URL, Caption, LinkTo, Credits string // TODO: finish with Credits
+	// Width of the original image is set with credits, it limits
+	// widths of resized versions. Height and the dominant color are
+	// set with it for placeholders.
+	Width, Height int    `bson:"-"`
+	Color         string `bson:"-"`
+}
+
+// fileURL matches URLs of uploaded files, their optimized and resized
+// versions, which are named by IDs of files.
+var fileURL = regexp.MustCompile(`/(?:files/(?:optimized/)?|img/)([0-9a-f]{24})`)
+
+// FileIDs returns IDs of uploaded files used by the content in covers,
+// the lede, the body and images.
+func (c *Content) FileIDs() []string {
+	var ids []string
+	for _, s := range append([]string{c.CoverExternal, c.CoverInternal, c.Lede, c.Body}, imageURLs(c)...) {
+		for _, m := range fileURL.FindAllStringSubmatch(s, -1) {
+			if !hasString(ids, m[1]) {
+				ids = append(ids, m[1])
+			}
+		}
+	}
+	return ids
+}
+
+func imageURLs(c *Content) []string {
+	urls := make([]string, len(c.Images))
+	for i, v := range c.Images {
+		urls[i] = v.URL
+	}
+	return urls
+}
+
+func hasString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 // Topic represents a section of content grouped by a theme.
 type Topic struct {
-	ID     bson.ObjectId `bson:"_id"`
+	ID     primitive.ObjectID `bson:"_id"`
 	Title  string
 	Weight int
 	Public bool
@@ -167,6 +282,20 @@ type Topic struct {
 	// Slug is a transliterated title and is used for URL composition and resolution.
 	Slug string
 
+	// ParentID refers to the parent topic of a subsection.
+	ParentID *primitive.ObjectID
+	// Path consists of slugs of the topic and its ancestors separated by
+	// slashes, e.g. "culture/music". It is used in URLs and must be
+	// updated with UpdateTopicPaths after slugs or parents are changed.
+	Path string
+	// OldPaths are previous paths of the topic. Old URLs are
+	// redirected to the current one.
+	OldPaths []string
+	// Ancestors are parent topics starting from the root, Children are
+	// public subtopics. Both are loaded on demand.
+	Ancestors []*Topic `bson:"-"`
+	Children  []*Topic `bson:"-"`
+
 	// https://docs.mongodb.com/manual/tutorial/specify-language-for-text-index/#specify-default-language-text-index
 	Language string
 	// LanguageOverride is used for "be". We use .Language attribute in the UI and for searching and navigating
@@ -175,9 +304,23 @@ type Topic struct {
 	LanguageOverride string `bson:"language_override,omitempty"`
 }
 
+// Under checks if the topic is the same as o or is nested into o.
+func (t *Topic) Under(o *Topic) bool {
+	return t.ID == o.ID || strings.HasPrefix(t.Path, o.Path+"/")
+}
+
+// Tag is a free-form label of content. Tags unlike topics are created
+// by editors on the fly while editing content.
+type Tag struct {
+	ID       primitive.ObjectID `bson:"_id"`
+	Language string
+	Title    string
+	Slug     string
+}
+
 // Message represents a message from a website user.
 type Message struct {
-	ID       bson.ObjectId `bson:"_id"`
+	ID       primitive.ObjectID `bson:"_id"`
 	Created  time.Time
 	Status   MessageStatus
 	FullName string
@@ -185,6 +328,146 @@ type Message struct {
 	Message  string
 }
 
+// SearchMiss is a search query which has found nothing. Editors use
+// such queries to find out what readers are looking for.
+type SearchMiss struct {
+	ID       primitive.ObjectID `bson:"_id"`
+	Query    string
+	Language string
+	Count    int
+	First    time.Time
+	Last     time.Time
+}
+
+// Author is a public profile of a user who has written content. Unlike
+// user.User it has no emails, roles and other private fields, so it
+// is safe to render it on public pages.
+type Author struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	Slug      string
+	FirstName string
+	LastName  string
+	// Bio is a biography in the language of a page.
+	Bio      string
+	PhotoURL string
+	Links    []string
+	// Count is an amount of public content of the author.
+	Count int
+}
+
+// AuthorRoles are roles of users who can have public author pages.
+var AuthorRoles = []user.Role{user.Administrator, user.Author}
+
+// CanBeAuthor reports whether the user can have a public author page.
+func CanBeAuthor(u *user.User) bool {
+	for _, r := range u.Roles {
+		for _, v := range AuthorRoles {
+			if r == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NewAuthor returns a public profile of the user with the biography
+// in the language.
+func NewAuthor(u *user.User, lang string) *Author {
+	return &Author{
+		ID:        u.ID,
+		Slug:      u.Slug,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Bio:       u.Bio[lang],
+		Links:     u.Links,
+	}
+}
+
+// Contributor is a person credited for content who has no user
+// account, e.g. a guest author or a translator. A contributor can be
+// linked to a user account later.
+type Contributor struct {
+	ID   primitive.ObjectID `bson:"_id"`
+	Name string
+	// Role is the usual role of the contributor, it is preselected
+	// when the contributor is credited.
+	Role CreditRole
+	// Bio is a biography by languages.
+	Bio     map[string]string
+	PhotoID *primitive.ObjectID
+	// UserID links the contributor to a user account.
+	UserID  *primitive.ObjectID
+	Created time.Time
+
+	// AuthorSlug is the slug of the author page of the linked user,
+	// it is loaded on demand.
+	AuthorSlug string `bson:"-"`
+}
+
+// Credit credits a contributor for content in a role.
+type Credit struct {
+	ContributorID primitive.ObjectID
+	Role          CreditRole
+	Contributor   *Contributor `bson:"-"`
+}
+
+// CreditRole is a kind of work a contributor has done for content.
+type CreditRole int
+
+const (
+	// AuthorCredit is for a text author.
+	AuthorCredit CreditRole = iota
+	// TranslatorCredit is for a translator.
+	TranslatorCredit
+	// PhotographerCredit is for a photographer.
+	PhotographerCredit
+	// IllustratorCredit is for an illustrator.
+	IllustratorCredit
+)
+
+// CreditRoles is a list of available roles.
+var CreditRoles = []CreditRole{
+	AuthorCredit,
+	TranslatorCredit,
+	PhotographerCredit,
+	IllustratorCredit,
+}
+
+func (r CreditRole) String() string {
+	switch r {
+	case AuthorCredit:
+		return "credit_author"
+	case TranslatorCredit:
+		return "credit_translator"
+	case PhotographerCredit:
+		return "credit_photographer"
+	case IllustratorCredit:
+		return "credit_illustrator"
+	}
+	return "Unknown CreditRole"
+}
+
+// DuplicateSlug is a slug used by several items of content of the same
+// language and primary topic. Such content is found by the slug
+// nondeterministically, so one of the slugs must be changed.
+type DuplicateSlug struct {
+	Language string
+	Slug     string
+	Topic    *Topic
+	Content  []*Content
+}
+
+// Redirect is a manual redirect rule set by editors, e.g. for URLs of
+// the previous version of the website.
+type Redirect struct {
+	ID      primitive.ObjectID `bson:"_id"`
+	From    string
+	To      string
+	Hits    int
+	Created time.Time
+	LastHit time.Time
+}
+
 // MessageStatus represents a message status in the CMS.
 type MessageStatus int
 
@@ -1,139 +1,219 @@
 package cms
 
-// The file contains specialized functions for dealing with the
-// database. The main package for database operations is
-// "bitbucker.org/iharsuvorau/mongo".
-
-// TODO: refactor all other references to use cms/db instead.
-
 import (
+	"context"
 	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/bahna/magazine/webserver/mongo"
 	"github.com/bahna/magazine/webserver/user"
-	"github.com/globalsign/mgo"
-	"github.com/globalsign/mgo/bson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	mongodb "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // AllTopics returs topics sorted by weight.
-func AllTopics(db *mgo.Database, query interface{}) ([]*Topic, error) {
-	db.Session.Refresh()
+func AllTopics(ctx context.Context, db *mongodb.Database, query interface{}) ([]*Topic, error) {
 	items := []*Topic{}
-	err := db.C("topics").Find(query).Sort("-weight").All(&items)
+	err := mongo.All(ctx, db.Collection("topics"), query, &items, options.Find().SetSort(mongo.Sort("-weight")))
 	return items, err
 }
 
 // AllUsers returns all users from a database.
-func AllUsers(col *mgo.Collection, query interface{}) (items []*user.User, err error) {
-	col.Database.Session.Refresh()
-	err = col.Find(query).All(&items)
+func AllUsers(ctx context.Context, col *mongodb.Collection, query interface{}) (items []*user.User, err error) {
+	err = mongo.All(ctx, col, query, &items)
 	return
 }
 
 // AllContent returns all content from a database.
-func AllContent(db *mgo.Database, query interface{}) (items []*Content, err error) {
-	db.Session.Refresh()
-	if err = db.C("content").Find(query).Sort("-weight", "-created").All(&items); err != nil {
+func AllContent(ctx context.Context, db *mongodb.Database, query interface{}) (items []*Content, err error) {
+	opts := options.Find().SetSort(mongo.Sort("-weight", "-created"))
+	if err = mongo.All(ctx, db.Collection("content"), query, &items, opts); err != nil {
 		return
 	}
 
-	for _, v := range items {
-		v.Authors = []*user.User{}
-		u := new(user.User)
-		for _, id := range v.AuthorIDs {
-			if err = mongo.GetID(db.C("users"), id.Hex(), u); err != nil {
-				return
-			}
-		}
-		v.Authors = append(v.Authors, u)
-	}
+	err = LoadRelations(ctx, db, items)
 	return
 }
 
 // AllContentSorted returns all content from a database sorted by the
 // specified field: "-eventstart" or "eventstart".
-func AllContentSorted(db *mgo.Database, query interface{}, sortField string) (items []*Content, err error) {
-	db.Session.Refresh()
-	if err = db.C("content").Find(query).Sort(sortField).All(&items); err != nil {
+func AllContentSorted(ctx context.Context, db *mongodb.Database, query interface{}, sortField string) (items []*Content, err error) {
+	opts := options.Find().SetSort(mongo.Sort(sortField))
+	if err = mongo.All(ctx, db.Collection("content"), query, &items, opts); err != nil {
 		return
 	}
 
-	for _, v := range items {
-		v.Authors = []*user.User{}
-		u := new(user.User)
-		for _, id := range v.AuthorIDs {
-			if err = mongo.GetID(db.C("users"), id.Hex(), u); err != nil {
-				return
-			}
-		}
-		v.Authors = append(v.Authors, u)
-	}
+	err = LoadRelations(ctx, db, items)
 	return
 }
 
 // AllContentLimited returns limited amount of content from a database.
-func AllContentLimited(db *mgo.Database, query interface{}, limit int) (items []*Content, err error) {
-	db.Session.Refresh()
-	if limit == 0 {
-		if err = db.C("content").Find(query).Sort("-weight", "-published").All(&items); err != nil {
-			return
-		}
-	} else {
-		if err = db.C("content").Find(query).Sort("-weight", "-published").Limit(limit).All(&items); err != nil {
-			return
-		}
+func AllContentLimited(ctx context.Context, db *mongodb.Database, query interface{}, limit int) (items []*Content, err error) {
+	// zero limit means no limit
+	opts := options.Find().SetSort(mongo.Sort("-weight", "-published")).SetLimit(int64(limit))
+	if err = mongo.All(ctx, db.Collection("content"), query, &items, opts); err != nil {
+		return
 	}
 
-	for _, v := range items {
-		err = GetAuthorsForContent(db, v)
-		if err != nil {
-			return
-		}
-		err = GetTopicsForContent(db, v)
-		if err != nil {
-			return
+	err = LoadRelations(ctx, db, items)
+	return
+}
+
+// ContentByIDs returns content with the IDs in the same order as the
+// IDs are given. Missing IDs are skipped.
+func ContentByIDs(ctx context.Context, db *mongodb.Database, ids []primitive.ObjectID) (items []*Content, err error) {
+
+	found := []*Content{}
+	if err = mongo.All(ctx, db.Collection("content"), bson.M{"_id": bson.M{"$in": ids}}, &found); err != nil {
+		return
+	}
+
+	byID := make(map[primitive.ObjectID]*Content, len(found))
+	for _, v := range found {
+		byID[v.ID] = v
+	}
+
+	items = make([]*Content, 0, len(found))
+	for _, id := range ids {
+		if v, ok := byID[id]; ok {
+			items = append(items, v)
 		}
 	}
+	err = LoadRelations(ctx, db, items)
 	return
 }
 
-// SearchContent matches the query only for the Content collection. It sorts results by the mongo score.
-func SearchContent(db *mgo.Database, query interface{}, limit int) (items []*Content, err error) {
-	db.Session.Refresh()
-	if limit == 0 {
-		if err = db.C("content").Find(query).Select(bson.M{"score": bson.M{"$meta": "textScore"}}).Sort("$textScore:score").All(&items); err != nil {
-			return
-		}
-	} else {
-		if err = db.C("content").Find(query).Select(bson.M{"score": bson.M{"$meta": "textScore"}}).Sort("$textScore:score").Limit(limit).All(&items); err != nil {
-			return
-		}
+// AllContentTitles returns content matched by the query with only
+// IDs, titles and languages loaded. It is used to list content in forms.
+func AllContentTitles(ctx context.Context, col *mongodb.Collection, query interface{}) (items []*Content, err error) {
+	err = mongo.All(ctx, col, query, &items, options.Find().
+		SetProjection(bson.M{"title": 1, "language": 1}).
+		SetSort(mongo.Sort("-published")))
+	return
+}
+
+// ContentYears returns years of publication of the content matched by
+// the query in descending order.
+func ContentYears(ctx context.Context, col *mongodb.Collection, query interface{}) (years []int, err error) {
+
+	result := []struct {
+		Year int `bson:"_id"`
+	}{}
+	err = aggregate(ctx, col, []bson.M{
+		{"$match": mongo.Query(query)},
+		{"$group": bson.M{"_id": bson.M{"$year": "$published"}}},
+		{"$sort": bson.M{"_id": -1}},
+	}, &result)
+	if err != nil {
+		return
 	}
 
-	for _, v := range items {
-		err = GetAuthorsForContent(db, v)
+	for _, v := range result {
+		years = append(years, v.Year)
+	}
+	return
+}
+
+// UpdateSearchFields recalculates Content.AuthorNames and
+// Content.TopicTitles for the content matched by the query. Call it
+// after authors or topics of the content are changed.
+func UpdateSearchFields(ctx context.Context, db *mongodb.Database, query interface{}) error {
+
+	items := []*Content{}
+	opts := options.Find().SetProjection(bson.M{"authorids": 1, "credits": 1, "topicids": 1})
+	if err := mongo.All(ctx, db.Collection("content"), query, &items, opts); err != nil {
+		return err
+	}
+
+	for _, c := range items {
+		authors, topics, err := SearchNames(ctx, db, c.AuthorIDs, c.ContributorIDs(), c.TopicIDs)
 		if err != nil {
-			return
+			return err
 		}
-		err = GetTopicsForContent(db, v)
+		_, err = db.Collection("content").UpdateByID(ctx, c.ID, bson.M{"$set": bson.M{
+			"authornames": authors,
+			"topictitles": topics,
+		}})
 		if err != nil {
-			return
+			return err
 		}
 	}
+	return nil
+}
+
+// SearchNames returns space separated names of authors and
+// contributors and titles of topics to store them with the content for
+// the full-text search.
+func SearchNames(ctx context.Context, db *mongodb.Database, authorIDs, contributorIDs, topicIDs []primitive.ObjectID) (authors, topics string, err error) {
+
+	uu := []*user.User{}
+	if err = mongo.All(ctx, db.Collection("users"), bson.M{"_id": bson.M{"$in": authorIDs}}, &uu); err != nil {
+		return
+	}
+	names := make([]string, len(uu))
+	for i, u := range uu {
+		names[i] = u.FirstName + " " + u.LastName
+	}
+
+	cc := []*Contributor{}
+	if err = mongo.All(ctx, db.Collection("contributors"), bson.M{"_id": bson.M{"$in": contributorIDs}}, &cc); err != nil {
+		return
+	}
+	for _, v := range cc {
+		names = append(names, v.Name)
+	}
+
+	tt := []*Topic{}
+	if err = mongo.All(ctx, db.Collection("topics"), bson.M{"_id": bson.M{"$in": topicIDs}}, &tt); err != nil {
+		return
+	}
+	titles := make([]string, len(tt))
+	for i, t := range tt {
+		titles[i] = t.Title
+	}
+
+	return strings.Join(names, " "), strings.Join(titles, " "), nil
+}
+
+// LogSearchMiss stores the query which has found nothing or increments
+// its counter if the query has been stored before.
+func LogSearchMiss(ctx context.Context, col *mongodb.Collection, lang, query string) error {
+	now := time.Now()
+	_, err := col.UpdateOne(ctx, bson.M{
+		"language": lang,
+		"query":    strings.ToLower(strings.TrimSpace(query)),
+	}, bson.M{
+		"$inc": bson.M{"count": 1},
+		"$set": bson.M{"last": now},
+		"$setOnInsert": bson.M{
+			"_id":   primitive.NewObjectID(),
+			"first": now,
+		},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+// AllSearchMisses returns search queries with no results, the most
+// frequent first.
+func AllSearchMisses(ctx context.Context, col *mongodb.Collection, query interface{}, limit int) (items []*SearchMiss, err error) {
+	err = mongo.All(ctx, col, query, &items, options.Find().
+		SetSort(mongo.Sort("-count", "-last")).
+		SetLimit(int64(limit)))
 	return
 }
 
 // AllContentByPage returns content items by page.
-func AllContentByPage(col *mgo.Collection, query interface{}, perpage, page int) (items []*Content, prev, next int, err error) {
-	col.Database.Session.Refresh()
+func AllContentByPage(ctx context.Context, col *mongodb.Collection, query interface{}, perpage, page int) (items []*Content, prev, next int, err error) {
 
 	// TODO: sort by updated
-	q := col.Find(query).Sort("-weight", "-published")
 	viewed := (page - 1) * perpage
 
 	var total int
-	total, err = q.Count()
+	total, err = mongo.Count(ctx, col, query)
 	if err != nil {
 		return
 	}
@@ -145,77 +225,557 @@ func AllContentByPage(col *mgo.Collection, query interface{}, perpage, page int)
 		prev = page - 1
 	}
 
-	err = q.Limit(perpage).Skip(viewed).All(&items)
+	err = mongo.All(ctx, col, query, &items, options.Find().
+		SetSort(mongo.Sort("-weight", "-published")).
+		SetLimit(int64(perpage)).
+		SetSkip(int64(viewed)))
 	if err != nil {
 		return
 	}
 
-	for _, v := range items {
-		err = GetAuthorsForContent(col.Database, v)
-		if err != nil {
-			return
+	err = LoadRelations(ctx, col.Database(), items)
+	return
+}
+
+// LoadRelations loads authors and topics of the content. Each
+// collection is queried once for all the items, so lists of content
+// take the same amount of queries regardless of their length.
+func LoadRelations(ctx context.Context, db *mongodb.Database, items []*Content) error {
+	if err := loadAuthors(ctx, db, items); err != nil {
+		return err
+	}
+	return loadTopics(ctx, db, items)
+}
+
+// loadAuthors sets Content.Authors in the order of Content.AuthorIDs.
+// Removed users are skipped.
+func loadAuthors(ctx context.Context, db *mongodb.Database, items []*Content) error {
+
+	ids := []primitive.ObjectID{}
+	for _, c := range items {
+		ids = append(ids, c.AuthorIDs...)
+	}
+
+	byID := map[primitive.ObjectID]*user.User{}
+	if len(ids) > 0 {
+		uu := []*user.User{}
+		if err := mongo.All(ctx, db.Collection("users"), bson.M{"_id": bson.M{"$in": ids}}, &uu); err != nil {
+			return err
 		}
-		err = GetTopicsForContent(col.Database, v)
-		if err != nil {
-			return
+		for _, u := range uu {
+			byID[u.ID] = u
 		}
 	}
 
-	return
+	for _, c := range items {
+		c.Authors = make([]*user.User, 0, len(c.AuthorIDs))
+		for _, id := range c.AuthorIDs {
+			if u, ok := byID[id]; ok {
+				c.Authors = append(c.Authors, u)
+			}
+		}
+	}
+	return nil
+}
+
+// loadTopics sets Content.Topics in the order of Content.TopicIDs.
+// Removed topics are skipped.
+func loadTopics(ctx context.Context, db *mongodb.Database, items []*Content) error {
+
+	ids := []primitive.ObjectID{}
+	for _, c := range items {
+		ids = append(ids, c.TopicIDs...)
+	}
+
+	byID := map[primitive.ObjectID]*Topic{}
+	if len(ids) > 0 {
+		tt := []*Topic{}
+		if err := mongo.All(ctx, db.Collection("topics"), bson.M{"_id": bson.M{"$in": ids}}, &tt); err != nil {
+			return err
+		}
+		for _, t := range tt {
+			byID[t.ID] = t
+		}
+	}
+
+	for _, c := range items {
+		c.Topics = make([]*Topic, 0, len(c.TopicIDs))
+		for _, id := range c.TopicIDs {
+			if t, ok := byID[id]; ok {
+				c.Topics = append(c.Topics, t)
+			}
+		}
+	}
+	return nil
 }
 
 // GetAuthorsForContent fetches authors for the provided content.
-func GetAuthorsForContent(db *mgo.Database, c *Content) (err error) {
-	db.Session.Refresh()
-	c.Authors = []*user.User{}
-	u := new(user.User)
-	for _, id := range c.AuthorIDs {
-		if err = mongo.GetID(db.C("users"), id.Hex(), u); err != nil {
+func GetAuthorsForContent(ctx context.Context, db *mongodb.Database, c *Content) error {
+	return loadAuthors(ctx, db, []*Content{c})
+}
+
+// GetCreditsForContent loads contributors of the credits of the
+// content. Credits of removed contributors are skipped.
+func GetCreditsForContent(ctx context.Context, db *mongodb.Database, c *Content) (err error) {
+	if len(c.Credits) == 0 {
+		return
+	}
+
+	cc := []*Contributor{}
+	if err = mongo.All(ctx, db.Collection("contributors"), bson.M{"_id": bson.M{"$in": c.ContributorIDs()}}, &cc); err != nil {
+		return
+	}
+
+	byID := make(map[primitive.ObjectID]*Contributor, len(cc))
+	var userIDs []primitive.ObjectID
+	for _, v := range cc {
+		byID[v.ID] = v
+		if v.UserID != nil {
+			userIDs = append(userIDs, *v.UserID)
+		}
+	}
+
+	// linked users with public profiles
+	if len(userIDs) > 0 {
+		uu := []*user.User{}
+		err = mongo.All(ctx, db.Collection("users"), bson.M{
+			"_id":  bson.M{"$in": userIDs},
+			"slug": bson.M{"$gt": ""},
+		}, &uu, options.Find().SetProjection(bson.M{"slug": 1}))
+		if err != nil {
 			return
 		}
-		c.Authors = append(c.Authors, u)
+		slugs := make(map[primitive.ObjectID]string, len(uu))
+		for _, u := range uu {
+			slugs[u.ID] = u.Slug
+		}
+		for _, v := range cc {
+			if v.UserID != nil {
+				v.AuthorSlug = slugs[*v.UserID]
+			}
+		}
+	}
+
+	credits := make([]*Credit, 0, len(c.Credits))
+	for _, v := range c.Credits {
+		if v.Contributor = byID[v.ContributorID]; v.Contributor != nil {
+			credits = append(credits, v)
+		}
 	}
+	c.Credits = credits
+	return
+}
+
+// AllContributors returns contributors sorted by names.
+func AllContributors(ctx context.Context, col *mongodb.Collection, query interface{}) (items []*Contributor, err error) {
+	err = mongo.All(ctx, col, query, &items, options.Find().SetSort(mongo.Sort("name")))
 	return
 }
 
 // GetChildrenContent finds all dependent content and updates the parent.
-func GetChildrenContent(db *mgo.Database, c *Content) (err error) {
-	db.Session.Refresh()
+func GetChildrenContent(ctx context.Context, db *mongodb.Database, c *Content) error {
+	return LoadChildren(ctx, db, []*Content{c})
+}
+
+// LoadChildren sets public dependent content of the items with one
+// query for all of them.
+func LoadChildren(ctx context.Context, db *mongodb.Database, items []*Content) error {
+	ids := make([]primitive.ObjectID, len(items))
+	for i, c := range items {
+		ids[i] = c.ID
+	}
 
-	c.Children, err = AllContentLimited(db, bson.M{
-		"parentid": c.ID,
+	children, err := AllContentLimited(ctx, db, bson.M{
+		"parentid": bson.M{"$in": ids},
 		"public":   true,
 		"$or": []bson.M{
 			bson.M{"scheduled": bson.M{"$lt": time.Now()}},
 			bson.M{"scheduled": (time.Time{})},
 		},
 	}, 0)
+	if err != nil {
+		return err
+	}
 
-	return
+	byParent := map[primitive.ObjectID][]*Content{}
+	for _, v := range children {
+		byParent[*v.ParentID] = append(byParent[*v.ParentID], v)
+	}
+	for _, c := range items {
+		c.Children = byParent[c.ID]
+	}
+	return nil
 }
 
 // GetTopic returst a single topic by ID.
-func GetTopic(db *mgo.Database, idStr string) (*Topic, error) {
-	db.Session.Refresh()
-	id := bson.ObjectIdHex(idStr)
-	if !id.Valid() {
-		return nil, fmt.Errorf("invalid ID")
-	}
+func GetTopic(ctx context.Context, db *mongodb.Database, idStr string) (*Topic, error) {
 	t := new(Topic)
-	err := db.C("topics").FindId(id).One(&t)
+	err := mongo.GetID(ctx, db.Collection("topics"), idStr, t)
 	return t, err
 }
 
+// GetTagsForContent loads tags of the content.
+func GetTagsForContent(ctx context.Context, db *mongodb.Database, c *Content) (err error) {
+	c.Tags = []*Tag{}
+	if len(c.TagIDs) == 0 {
+		return
+	}
+	err = mongo.All(ctx, db.Collection("tags"), bson.M{"_id": bson.M{"$in": c.TagIDs}}, &c.Tags,
+		options.Find().SetSort(mongo.Sort("title")))
+	return
+}
+
+// SaveTags creates missing tags of the language by their titles and
+// returns IDs of all given tags. Tags are found by titles ignoring
+// case, because slugs of existing tags may have been made by another
+// transliteration scheme, and then by slugs.
+func SaveTags(ctx context.Context, col *mongodb.Collection, lang string, titles []string, slugify func(string) string) (ids []primitive.ObjectID, err error) {
+	seen := map[string]bool{}
+	seenIDs := map[primitive.ObjectID]bool{}
+	for _, title := range titles {
+		title = strings.TrimSpace(title)
+		slug := slugify(title)
+		if len(slug) == 0 || seen[slug] {
+			continue
+		}
+		seen[slug] = true
+
+		t := new(Tag)
+		err = col.FindOne(ctx, bson.M{
+			"language": lang,
+			"title":    primitive.Regex{Pattern: "^" + regexp.QuoteMeta(title) + "$", Options: "i"},
+		}).Decode(t)
+		if err == mongodb.ErrNoDocuments {
+			selector := bson.M{"language": lang, "slug": slug}
+			err = col.FindOneAndUpdate(ctx, selector, bson.M{"$setOnInsert": bson.M{
+				"_id":   primitive.NewObjectID(),
+				"title": title,
+			}}, options.FindOneAndUpdate().
+				SetUpsert(true).
+				SetReturnDocument(options.After)).Decode(t)
+		}
+		if err != nil {
+			return
+		}
+		if !seenIDs[t.ID] {
+			seenIDs[t.ID] = true
+			ids = append(ids, t.ID)
+		}
+	}
+	return
+}
+
+// FindTags returns up to limit tags of the language with a word
+// beginning with the prefix.
+func FindTags(ctx context.Context, col *mongodb.Collection, lang, prefix string, limit int) (items []*Tag, err error) {
+	items = []*Tag{}
+	err = mongo.All(ctx, col, bson.M{
+		"language": lang,
+		"title":    primitive.Regex{Pattern: `(^|\s)` + regexp.QuoteMeta(prefix), Options: "i"},
+	}, &items, options.Find().SetSort(mongo.Sort("title")).SetLimit(int64(limit)))
+	return
+}
+
 // GetTopicsForContent retrieves content from the database by .TopicIDs.
-func GetTopicsForContent(db *mgo.Database, c *Content) (err error) {
-	db.Session.Refresh()
-	c.Topics = []*Topic{}
-	for _, id := range c.TopicIDs {
-		t := new(Topic)
-		if err = mongo.GetID(db.C("topics"), id.Hex(), t); err != nil {
+func GetTopicsForContent(ctx context.Context, db *mongodb.Database, c *Content) error {
+	return loadTopics(ctx, db, []*Content{c})
+}
+
+// UpdateTopicPaths recalculates Topic.Path for all topics from slugs
+// of the topics and their ancestors. A parent which does not exist or
+// makes a cycle is dropped, so the topic becomes a root one.
+func UpdateTopicPaths(ctx context.Context, db *mongodb.Database) error {
+
+	items := []*Topic{}
+	if err := mongo.All(ctx, db.Collection("topics"), nil, &items); err != nil {
+		return err
+	}
+	byID := make(map[primitive.ObjectID]*Topic, len(items))
+	for _, t := range items {
+		byID[t.ID] = t
+	}
+
+	for _, t := range items {
+		path := TopicPath(t, byID)
+		if path == t.Path {
+			continue
+		}
+		update := bson.M{"$set": bson.M{"path": path, "oldpaths": OldTopicPaths(t, path)}}
+		if _, err := db.Collection("topics").UpdateByID(ctx, t.ID, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TopicPath returns the path of the topic made of slugs of the topic
+// and its ancestors found in byID.
+func TopicPath(t *Topic, byID map[primitive.ObjectID]*Topic) string {
+	slugs := []string{t.Slug}
+	seen := map[primitive.ObjectID]bool{t.ID: true}
+	parent := t.ParentID
+	for parent != nil {
+		p, ok := byID[*parent]
+		if !ok || seen[p.ID] {
+			break
+		}
+		seen[p.ID] = true
+		slugs = append([]string{p.Slug}, slugs...)
+		parent = p.ParentID
+	}
+	return strings.Join(slugs, "/")
+}
+
+// OldTopicPaths returns previous paths of the topic after its path is
+// changed to path. Previous paths are kept to redirect old URLs.
+func OldTopicPaths(t *Topic, path string) []string {
+	old := []string{}
+	for _, v := range append(t.OldPaths, t.Path) {
+		if len(v) > 0 && v != path && !contains(old, v) {
+			old = append(old, v)
+		}
+	}
+	return old
+}
+
+// TopicAncestors loads parents of the topic into Topic.Ancestors
+// starting from the root.
+func TopicAncestors(ctx context.Context, db *mongodb.Database, t *Topic) error {
+	t.Ancestors = []*Topic{}
+	seen := map[primitive.ObjectID]bool{t.ID: true}
+	parent := t.ParentID
+	for parent != nil && !seen[*parent] {
+		p := new(Topic)
+		if err := db.Collection("topics").FindOne(ctx, bson.M{"_id": *parent}).Decode(p); err != nil {
+			if err == mongodb.ErrNoDocuments {
+				return nil
+			}
+			return err
+		}
+		seen[p.ID] = true
+		t.Ancestors = append([]*Topic{p}, t.Ancestors...)
+		parent = p.ParentID
+	}
+	return nil
+}
+
+// DescendantTopicIDs returns IDs of all subsections of the topic at any
+// depth.
+func DescendantTopicIDs(ctx context.Context, db *mongodb.Database, id primitive.ObjectID) (ids []primitive.ObjectID, err error) {
+	seen := map[primitive.ObjectID]bool{id: true}
+	queue := []primitive.ObjectID{id}
+	for len(queue) > 0 {
+		children := []*Topic{}
+		err = mongo.All(ctx, db.Collection("topics"), bson.M{"parentid": bson.M{"$in": queue}}, &children,
+			options.Find().SetProjection(bson.M{"_id": 1}))
+		if err != nil {
 			return
 		}
-		c.Topics = append(c.Topics, t)
+		queue = queue[:0]
+		for _, c := range children {
+			if seen[c.ID] {
+				continue
+			}
+			seen[c.ID] = true
+			ids = append(ids, c.ID)
+			queue = append(queue, c.ID)
+		}
 	}
 	return
 }
+
+// OrderTopics sets weights of the topics so that AllTopics returns
+// them in the given order.
+func OrderTopics(ctx context.Context, col *mongodb.Collection, ids []primitive.ObjectID) error {
+	for i, id := range ids {
+		if _, err := col.UpdateByID(ctx, id, bson.M{"$set": bson.M{"weight": len(ids) - i}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllRedirects returns manual redirect rules sorted by the source path.
+func AllRedirects(ctx context.Context, col *mongodb.Collection) (items []*Redirect, err error) {
+	items = []*Redirect{}
+	err = mongo.All(ctx, col, nil, &items, options.Find().SetSort(mongo.Sort("from")))
+	return
+}
+
+// SaveRedirect creates a redirect rule or changes the target of the
+// rule with the same source path.
+func SaveRedirect(ctx context.Context, col *mongodb.Collection, from, to string) error {
+	_, err := col.UpdateOne(ctx, bson.M{"from": from}, bson.M{
+		"$set": bson.M{"to": to},
+		"$setOnInsert": bson.M{
+			"_id":     primitive.NewObjectID(),
+			"created": time.Now(),
+		},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+// HitRedirect increments the counter of hits of the redirect rule.
+func HitRedirect(ctx context.Context, col *mongodb.Collection, id primitive.ObjectID) error {
+	_, err := col.UpdateByID(ctx, id, bson.M{
+		"$inc": bson.M{"hits": 1},
+		"$set": bson.M{"lasthit": time.Now()},
+	})
+	return err
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SetPrimaryTopics sets Content.PrimaryTopicID for content saved before
+// the field was introduced.
+func SetPrimaryTopics(ctx context.Context, db *mongodb.Database) error {
+
+	items := []*Content{}
+	err := mongo.All(ctx, db.Collection("content"), bson.M{
+		"primarytopicid": bson.M{"$exists": false},
+		"topicids.0":     bson.M{"$exists": true},
+	}, &items, options.Find().SetProjection(bson.M{"topicids": 1}))
+	if err != nil {
+		return err
+	}
+
+	for _, c := range items {
+		_, err = db.Collection("content").UpdateByID(ctx, c.ID, bson.M{"$set": bson.M{"primarytopicid": c.TopicIDs[0]}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DuplicateSlugs returns slugs used by several items of content of the
+// same language and primary topic.
+func DuplicateSlugs(ctx context.Context, db *mongodb.Database) (items []*DuplicateSlug, err error) {
+
+	result := []struct {
+		ID struct {
+			Language       string
+			PrimaryTopicID primitive.ObjectID
+			Slug           string
+		} `bson:"_id"`
+		ContentIDs []primitive.ObjectID
+	}{}
+	err = aggregate(ctx, db.Collection("content"), []bson.M{
+		{"$match": bson.M{"primarytopicid": bson.M{"$exists": true}}},
+		{"$group": bson.M{
+			"_id": bson.M{
+				"language":       "$language",
+				"primarytopicid": "$primarytopicid",
+				"slug":           "$slug",
+			},
+			"contentids": bson.M{"$push": "$_id"},
+			"count":      bson.M{"$sum": 1},
+		}},
+		{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+		{"$sort": bson.D{{Key: "_id.language", Value: 1}, {Key: "_id.slug", Value: 1}}},
+	}, &result)
+	if err != nil {
+		return
+	}
+
+	items = []*DuplicateSlug{}
+	for _, v := range result {
+		d := &DuplicateSlug{
+			Language: v.ID.Language,
+			Slug:     v.ID.Slug,
+			Topic:    new(Topic),
+		}
+		err = db.Collection("topics").FindOne(ctx, bson.M{"_id": v.ID.PrimaryTopicID}).Decode(d.Topic)
+		if err != nil && err != mongodb.ErrNoDocuments {
+			return
+		}
+		d.Content, err = AllContentTitles(ctx, db.Collection("content"), bson.M{"_id": bson.M{"$in": v.ContentIDs}})
+		if err != nil {
+			return
+		}
+		items = append(items, d)
+	}
+	return
+}
+
+// AuthorCounts returns amounts of the content matched by the query by
+// IDs of its authors.
+func AuthorCounts(ctx context.Context, col *mongodb.Collection, query interface{}) (map[primitive.ObjectID]int, error) {
+
+	counts := []struct {
+		ID    primitive.ObjectID `bson:"_id"`
+		Count int
+	}{}
+	err := aggregate(ctx, col, []bson.M{
+		{"$match": mongo.Query(query)},
+		{"$unwind": "$authorids"},
+		{"$group": bson.M{"_id": "$authorids", "count": bson.M{"$sum": 1}}},
+	}, &counts)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[primitive.ObjectID]int, len(counts))
+	for _, v := range counts {
+		byID[v.ID] = v.Count
+	}
+	return byID, nil
+}
+
+// UniqueUserSlug returns the slug if it is not taken by other users,
+// otherwise the slug with the least free numeric suffix.
+func UniqueUserSlug(ctx context.Context, col *mongodb.Collection, slug string, except primitive.ObjectID) (string, error) {
+	for i := 1; ; i++ {
+		s := slug
+		if i > 1 {
+			s = fmt.Sprintf("%s-%d", slug, i)
+		}
+		n, err := mongo.Count(ctx, col, bson.M{"slug": s, "_id": bson.M{"$ne": except}})
+		if err != nil || n == 0 {
+			return s, err
+		}
+	}
+}
+
+// SetUserSlugs sets unique slugs made of names to authors and
+// administrators without slugs, see CanBeAuthor.
+func SetUserSlugs(ctx context.Context, db *mongodb.Database, slugify func(string) string) error {
+	col := db.Collection("users")
+
+	uu := []*user.User{}
+	err := mongo.All(ctx, col, bson.M{
+		"slug":  bson.M{"$in": []interface{}{nil, ""}},
+		"roles": bson.M{"$in": AuthorRoles},
+	}, &uu)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range uu {
+		slug, err := UniqueUserSlug(ctx, col, slugify(u.FirstName+" "+u.LastName), u.ID)
+		if err != nil {
+			return err
+		}
+		if _, err = col.UpdateByID(ctx, u.ID, bson.M{"$set": bson.M{"slug": slug}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// aggregate runs the pipeline on the collection and fetches the result
+// into the slice pointed by dst.
+func aggregate(ctx context.Context, col *mongodb.Collection, pipeline []bson.M, dst interface{}) error {
+	cur, err := col.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	return cur.All(ctx, dst)
+}
@@ -0,0 +1,222 @@
+package cms
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bahna/magazine/webserver/mongo"
+	"github.com/bahna/magazine/webserver/user"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
+	mongodb "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The benchmarks need a MongoDB server, e.g.:
+//
+//	MONGO_URL=mongodb://localhost go test -run - -bench . ./cms
+//
+// A temporary database is filled with fixtures and dropped afterwards.
+// Besides time, the benchmarks report database queries per loaded list
+// of content, which must not depend on the length of the list.
+
+const (
+	benchUsers    = 100
+	benchTopics   = 40
+	benchContent  = 5000
+	benchSeries   = 100
+	benchChildren = 10
+)
+
+// sentOps counts commands sent to the database by benchmarks.
+var sentOps int64
+
+func benchDB(b *testing.B) (db *mongodb.Database, teardown func()) {
+	url := os.Getenv("MONGO_URL")
+	if len(url) == 0 {
+		b.Skip("MONGO_URL is not set")
+	}
+
+	ctx := context.Background()
+	client, err := mongo.Dial(ctx, url, time.Minute, options.Client().SetMonitor(&event.CommandMonitor{
+		Started: func(context.Context, *event.CommandStartedEvent) {
+			atomic.AddInt64(&sentOps, 1)
+		},
+	}))
+	if err != nil {
+		b.Fatal(err)
+	}
+	db = client.Database(fmt.Sprintf("magazine_bench_%d", time.Now().UnixNano()))
+	teardown = func() {
+		db.Drop(ctx)
+		client.Disconnect(ctx)
+	}
+
+	if err = fillBenchDB(ctx, db); err != nil {
+		teardown()
+		b.Fatal(err)
+	}
+	return
+}
+
+// fillBenchDB inserts users, topics and content with several authors
+// and topics each, including series with children.
+func fillBenchDB(ctx context.Context, db *mongodb.Database) error {
+	rnd := rand.New(rand.NewSource(1))
+	pick := func(ids []primitive.ObjectID) []primitive.ObjectID {
+		res := []primitive.ObjectID{}
+		for _, i := range rnd.Perm(len(ids))[:1+rnd.Intn(3)] {
+			res = append(res, ids[i])
+		}
+		return res
+	}
+
+	userIDs := make([]primitive.ObjectID, benchUsers)
+	users := []interface{}{}
+	for i := range userIDs {
+		userIDs[i] = primitive.NewObjectID()
+		users = append(users, &user.User{
+			ID:        userIDs[i],
+			FirstName: fmt.Sprintf("First%d", i),
+			LastName:  fmt.Sprintf("Last%d", i),
+		})
+	}
+	if _, err := db.Collection("users").InsertMany(ctx, users); err != nil {
+		return err
+	}
+
+	topicIDs := make([]primitive.ObjectID, benchTopics)
+	topics := []interface{}{}
+	for i := range topicIDs {
+		topicIDs[i] = primitive.NewObjectID()
+		topics = append(topics, &Topic{
+			ID:       topicIDs[i],
+			Title:    fmt.Sprintf("Topic %d", i),
+			Slug:     fmt.Sprintf("topic-%d", i),
+			Path:     fmt.Sprintf("topic-%d", i),
+			Public:   true,
+			Language: "ru",
+		})
+	}
+	if _, err := db.Collection("topics").InsertMany(ctx, topics); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	content := func(i int, t ContentType, parentID *primitive.ObjectID) *Content {
+		ids := pick(topicIDs)
+		return &Content{
+			ID:             primitive.NewObjectID(),
+			Public:         true,
+			Language:       "ru",
+			Type:           t,
+			Slug:           fmt.Sprintf("content-%d", i),
+			Title:          fmt.Sprintf("Content %d", i),
+			Created:        now.Add(-time.Duration(i) * time.Hour),
+			Published:      now.Add(-time.Duration(i) * time.Hour),
+			EventStart:     now.Add(time.Duration(i) * time.Hour),
+			ParentID:       parentID,
+			PrimaryTopicID: ids[0],
+			TopicIDs:       ids,
+			AuthorIDs:      pick(userIDs),
+		}
+	}
+
+	types := []ContentType{Article, Article, Article, Photoreport, Audio, Research, Event, Page}
+	docs := []interface{}{}
+	for i := 0; i < benchContent; i++ {
+		docs = append(docs, content(i, types[i%len(types)], nil))
+	}
+	for i := 0; i < benchSeries; i++ {
+		series := content(benchContent+i, ArticleSeries, nil)
+		docs = append(docs, series)
+		for j := 0; j < benchChildren; j++ {
+			docs = append(docs, content(benchContent+benchSeries*(j+1)+i, Article, &series.ID))
+		}
+	}
+	_, err := db.Collection("content").InsertMany(ctx, docs)
+	return err
+}
+
+// benchQueries runs f b.N times and reports database queries per run.
+func benchQueries(b *testing.B, f func() error) {
+	sent := atomic.LoadInt64(&sentOps)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := f(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(atomic.LoadInt64(&sentOps)-sent)/float64(b.N), "queries/op")
+}
+
+func publicContent(query bson.M) bson.M {
+	query["language"] = "ru"
+	query["public"] = true
+	return query
+}
+
+func BenchmarkAllContentByPage(b *testing.B) {
+	db, teardown := benchDB(b)
+	defer teardown()
+	ctx := context.Background()
+
+	benchQueries(b, func() error {
+		_, _, _, err := AllContentByPage(ctx, db.Collection("content"), publicContent(bson.M{}), 20, 3)
+		return err
+	})
+}
+
+func BenchmarkAllContentLimited(b *testing.B) {
+	db, teardown := benchDB(b)
+	defer teardown()
+	ctx := context.Background()
+
+	benchQueries(b, func() error {
+		_, err := AllContentLimited(ctx, db, publicContent(bson.M{}), 100)
+		return err
+	})
+}
+
+// BenchmarkIndexPage loads the lists of the index page.
+func BenchmarkIndexPage(b *testing.B) {
+	db, teardown := benchDB(b)
+	defer teardown()
+	ctx := context.Background()
+
+	benchQueries(b, func() error {
+		if _, _, _, err := AllContentByPage(ctx, db.Collection("content"), publicContent(bson.M{
+			"type": bson.M{"$in": []ContentType{Article, Photoreport, Banner}},
+		}), 20, 1); err != nil {
+			return err
+		}
+		if _, err := AllContent(ctx, db, publicContent(bson.M{"type": Page})); err != nil {
+			return err
+		}
+		series, err := AllContent(ctx, db, publicContent(bson.M{"type": ArticleSeries}))
+		if err != nil {
+			return err
+		}
+		if err = LoadChildren(ctx, db, series); err != nil {
+			return err
+		}
+		if _, err = AllContentSorted(ctx, db, publicContent(bson.M{"type": Event}), "eventstart"); err != nil {
+			return err
+		}
+		for _, t := range []ContentType{Audio, Research} {
+			if _, err = AllContent(ctx, db, publicContent(bson.M{"type": t})); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
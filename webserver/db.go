@@ -1,221 +1,869 @@
-// The file extends bitbucket.org/iharsuvorau/mongo API with private database API.
-
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
 	"time"
 
 	"github.com/bahna/magazine/webserver/cms"
+	"github.com/bahna/magazine/webserver/file"
+	"github.com/bahna/magazine/webserver/related"
+	"github.com/bahna/magazine/webserver/search"
+	"github.com/bahna/magazine/webserver/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	mongodb "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/text/language"
-	"github.com/globalsign/mgo"
-	"github.com/globalsign/mgo/bson"
 )
 
 // ensureIndexes creates mongo indexes.
-func ensureIndexes(session *mgo.Session, name string) (err error) {
+func ensureIndexes(ctx context.Context, db *mongodb.Database) (err error) {
 	// Do not use DefaultLanguage in indexes because it won't
 	// let you save documents with outher languages.
 	// Just use the .Language attribute.
 
-	content := mgo.Index{
-		Key: []string{
-			"$text:title",
-			"$text:body",
-			"$text:description",
+	content := mongodb.IndexModel{
+		Keys: bson.D{
+			{Key: "title", Value: "text"},
+			{Key: "lede", Value: "text"},
+			{Key: "body", Value: "text"},
+			{Key: "authornames", Value: "text"},
+			{Key: "topictitles", Value: "text"},
+		},
+		Options: options.Index().
+			SetName("search").
+			SetWeights(bson.M{
+				"title":       10,
+				"authornames": 5,
+				"topictitles": 5,
+				"lede":        3,
+				"body":        1,
+			}).
+			SetDefaultLanguage("ru").
+			SetLanguageOverride("language_override"),
+	}
+
+	topics := []mongodb.IndexModel{
+		{
+			Keys: bson.D{{Key: "name", Value: "text"}},
+			Options: options.Index().
+				SetUnique(true).
+				SetDefaultLanguage("ru").
+				SetLanguageOverride("language_override"),
 		},
-		DefaultLanguage:  "ru",
-		LanguageOverride: "language_override",
+		{Keys: bson.D{{Key: "parentid", Value: 1}}},
 	}
 
-	topics := mgo.Index{
-		Key: []string{
-			"$text:name",
+	users := []mongodb.IndexModel{
+		{
+			Keys:    bson.D{{Key: "email", Value: "text"}},
+			Options: options.Index().SetUnique(true).SetDefaultLanguage("en"),
+		},
+		// authors are found by slugs, users without public profiles
+		// don't have them
+		{
+			Keys: bson.D{{Key: "slug", Value: 1}},
+			Options: options.Index().
+				SetName("slugs").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"slug": bson.M{"$gt": ""}}),
 		},
-		Unique:           true,
-		DefaultLanguage:  "ru",
-		LanguageOverride: "language_override",
 	}
 
-	users := mgo.Index{
-		Key: []string{
-			"$text:email",
+	indexes := map[string][]mongodb.IndexModel{
+		"topics":       topics,
+		"users":        users,
+		"contributors": {{Keys: bson.D{{Key: "userid", Value: 1}}}},
+		// images of content are found by URLs of originals and
+		// optimized versions
+		"files": {
+			{Keys: bson.D{{Key: "url", Value: 1}}},
+			{Keys: bson.D{{Key: "optimized.url", Value: 1}}},
+		},
+		"tags":         {uniqueIndex("language", "slug")},
+		"translations": {uniqueIndex("language", "messageid")},
+		// queries which haven't been repeated for a while are
+		// removed, so that random queries don't pile up
+		"searchmisses": {
+			uniqueIndex("language", "query"),
+			{
+				Keys:    bson.D{{Key: "last", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(int32(searchMissTTL.Seconds())),
+			},
 		},
-		Unique:          true,
-		DefaultLanguage: "en",
+		"redirects": {uniqueIndex("from")},
 	}
 
-	err = session.DB(name).C("content").EnsureIndex(content)
+	// a collection can have only one text index, so the previous
+	// version of the index must be removed before creating a new one
+	err = dropTextIndexes(ctx, db.Collection("content"), "search")
 	if err != nil {
 		return
 	}
-	err = session.DB(name).C("topics").EnsureIndex(topics)
+	_, err = db.Collection("content").Indexes().CreateMany(ctx, []mongodb.IndexModel{
+		content,
+		{Keys: bson.D{{Key: "credits.contributorid", Value: 1}}},
+	})
 	if err != nil {
 		return
 	}
-	err = session.DB(name).C("users").EnsureIndex(users)
+	for col, models := range indexes {
+		if _, err = db.Collection(col).Indexes().CreateMany(ctx, models); err != nil {
+			return
+		}
+	}
+
 	return
 }
 
-func getPages(db *mgo.Database, lang language.Tag) (pages []*cms.Content, err error) {
-	pages, err = cms.AllContent(db, bson.M{
-		"language": lang.String(),
-		"public":   true,
-		// "page":     true,
-		"type": cms.Page,
-		"$or": []bson.M{
-			bson.M{"scheduled": bson.M{"$lt": time.Now()}},
-			bson.M{"scheduled": (time.Time{})},
+// searchMissTTL is how long search queries with no results are kept
+// after they were searched for the last time.
+const searchMissTTL = 90 * 24 * time.Hour
+
+// errDuplicateSlugs is returned by ensureSlugIndex when content slugs
+// are not unique.
+var errDuplicateSlugs = errors.New("content slugs are not unique, run \"magazine-server duplicates\" to list them")
+
+// errDuplicateTopicPaths is returned by ensureSlugIndex when topic
+// paths are not unique.
+var errDuplicateTopicPaths = errors.New("topic paths are not unique, run \"magazine-server migrate up\" to rename topics")
+
+// ensureSlugIndex creates the unique indexes of content slugs in primary
+// topics and of topic paths. Content and topics are found by slugs and
+// paths, so the server must not start until duplicates are cleaned up,
+// see uniqueSlug and uniqueTopicSlug.
+func ensureSlugIndex(ctx context.Context, db *mongodb.Database) error {
+	_, err := db.Collection("content").Indexes().CreateOne(ctx, mongodb.IndexModel{
+		Keys: bson.D{
+			{Key: "language", Value: 1},
+			{Key: "primarytopicid", Value: 1},
+			{Key: "slug", Value: 1},
 		},
+		Options: options.Index().
+			SetName("slugs").
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"primarytopicid": bson.M{"$exists": true}}),
 	})
+	if mongodb.IsDuplicateKeyError(err) {
+		return errDuplicateSlugs
+	}
 	if err != nil {
+		return err
+	}
+
+	// the previous index of paths has the same keys, but isn't unique
+	topics := db.Collection("topics")
+	if err = dropIndex(ctx, topics, "language_1_path_1"); err != nil {
+		return err
+	}
+	model := uniqueIndex("language", "path")
+	model.Options.SetName("paths")
+	_, err = topics.Indexes().CreateOne(ctx, model)
+	if mongodb.IsDuplicateKeyError(err) {
+		return errDuplicateTopicPaths
+	}
+	return err
+}
+
+// dropIndex removes the index of the collection by its name if it
+// exists.
+func dropIndex(ctx context.Context, col *mongodb.Collection, name string) error {
+	cur, err := col.Indexes().List(ctx)
+	if err != nil {
+		return err
+	}
+	indexes := []struct {
+		Name string
+	}{}
+	if err = cur.All(ctx, &indexes); err != nil {
+		return err
+	}
+	for _, v := range indexes {
+		if v.Name == name {
+			_, err = col.Indexes().DropOne(ctx, name)
+			return err
+		}
+	}
+	return nil
+}
+
+// uniqueIndex returns a unique ascending index of the keys.
+func uniqueIndex(keys ...string) mongodb.IndexModel {
+	d := make(bson.D, len(keys))
+	for i, k := range keys {
+		d[i] = bson.E{Key: k, Value: 1}
+	}
+	return mongodb.IndexModel{Keys: d, Options: options.Index().SetUnique(true)}
+}
+
+// dropTextIndexes removes text indexes of the collection except the
+// index with the keep name.
+func dropTextIndexes(ctx context.Context, col *mongodb.Collection, keep string) error {
+	indexes := []struct {
+		Name string
+		Key  bson.D
+	}{}
+	cur, err := col.Indexes().List(ctx)
+	if err != nil {
+		return err
+	}
+	if err = cur.All(ctx, &indexes); err != nil {
+		return err
+	}
+	for _, v := range indexes {
+		if v.Name == keep {
+			continue
+		}
+		for _, k := range v.Key {
+			if k.Value == "text" {
+				if _, err = col.Indexes().DropOne(ctx, v.Name); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// updateSearch recalculates search fields of the content matched by the
+// query and updates the content in the search index. Content which is
+// not public is removed from the index.
+func updateSearch(ctx context.Context, s *store.Stores, backend search.Backend, q store.ContentQuery) (err error) {
+	if err = s.Content.UpdateSearchFields(ctx, q); err != nil {
 		return
 	}
 
-	for _, c := range pages {
-		err = cms.GetTopicsForContent(db, c)
-		if err != nil {
-			return
+	items, err := s.Content.Find(ctx, q)
+	if err != nil {
+		return
+	}
+
+	var docs []*search.Document
+	var removed []string
+	for _, c := range items {
+		if c.Public {
+			docs = append(docs, searchDocument(c))
+		} else {
+			removed = append(removed, c.ID.Hex())
 		}
 	}
 
+	if len(removed) > 0 {
+		if err = backend.Delete(removed...); err != nil {
+			return
+		}
+	}
+	if len(docs) > 0 {
+		err = backend.Index(docs...)
+	}
 	return
 }
 
-func getSeries(db *mgo.Database, lang language.Tag) (cc []*cms.Content, err error) {
-	cc, err = cms.AllContent(db, bson.M{
-		"language": lang.String(),
-		"public":   true,
-		"type":     cms.ArticleSeries,
-		"$or": []bson.M{
-			bson.M{"scheduled": bson.M{"$lt": time.Now()}},
-			bson.M{"scheduled": (time.Time{})},
-		},
-	})
+// reindexing serializes rebuilds of the search index.
+var reindexing sync.Mutex
+
+// rebuildSearchIndex removes everything from the search index and
+// indexes all public content again.
+func rebuildSearchIndex(ctx context.Context, s *store.Stores, backend search.Backend) (n int, err error) {
+	reindexing.Lock()
+	defer reindexing.Unlock()
+
+	items, err := s.Content.Find(ctx, store.ContentQuery{Public: true})
 	if err != nil {
 		return
 	}
 
-	for _, c := range cc {
-		err = cms.GetChildrenContent(db, c)
+	docs := make([]*search.Document, len(items))
+	for i, c := range items {
+		docs[i] = searchDocument(c)
+	}
+	if err = backend.Reset(); err != nil {
+		return
+	}
+	if err = backend.Index(docs...); err != nil {
+		return
+	}
+	return len(docs), nil
+}
+
+// updateSuggestions rebuilds search suggestions of all languages from
+// public topics and content.
+func updateSuggestions(ctx context.Context, s *store.Stores, sug *search.Suggester, langs []language.Tag) (err error) {
+	for _, lang := range langs {
+		topics, err := s.Topics.All(ctx, store.TopicQuery{Language: lang.String()})
 		if err != nil {
-			return
+			return err
 		}
-		// limit children for the main page to the last 3 items
-		if len(c.Children) > 3 {
-			c.Children = c.Children[:3]
+
+		var completions []*search.Completion
+		var texts []string
+		paths := make(map[primitive.ObjectID]string, len(topics))
+		for _, t := range topics {
+			if !t.Public {
+				continue
+			}
+			paths[t.ID] = t.Path
+			completions = append(completions, &search.Completion{
+				Title: t.Title,
+				URL:   "/" + lang.String() + "/" + t.Path + "/",
+				Topic: true,
+			})
+			texts = append(texts, t.Title)
 		}
 
-		err = cms.GetTopicsForContent(db, c)
+		items, err := s.Content.Find(ctx, store.ContentQuery{Language: lang.String(), Public: true})
 		if err != nil {
-			return
+			return err
 		}
 
-		err = cms.GetAuthorsForContent(db, c)
-		if err != nil {
-			return
+		now := time.Now()
+		for _, c := range items {
+			topicPath := paths[c.CanonicalTopicID()]
+			if len(topicPath) == 0 {
+				continue
+			}
+			completions = append(completions, &search.Completion{
+				Title:     c.Title,
+				URL:       "/" + lang.String() + "/" + topicPath + "/" + c.Slug + "/",
+				Scheduled: c.Scheduled,
+			})
+			// words of unpublished content must not leak into suggestions
+			if c.Scheduled.Before(now) {
+				texts = append(texts, c.Title, c.Lede, c.Body, c.AuthorNames)
+			}
 		}
-	}
 
+		sug.Update(lang.String(), completions, texts)
+	}
 	return
 }
 
-func getCertainContent(db *mgo.Database, lang language.Tag, ctype cms.ContentType) (cc []*cms.Content, err error) {
-	cc, err = cms.AllContent(db, bson.M{
-		"language": lang.String(),
-		"public":   true,
-		"type":     ctype,
-		"$or": []bson.M{
-			bson.M{"scheduled": bson.M{"$lt": time.Now()}},
-			bson.M{"scheduled": (time.Time{})},
-		},
-	})
-	if err != nil {
+// suggestionsDelay is how long edits are collected before search
+// suggestions are rebuilt.
+const suggestionsDelay = 10 * time.Second
+
+// suggestionUpdates rebuilds search suggestions in the background once
+// for edits made within the delay, so saves don't wait for all public
+// content to be read.
+type suggestionUpdates struct {
+	app   *application
+	delay time.Duration
+
+	mu    sync.Mutex
+	timer *time.Timer
+	// running serializes rebuilds, so an older rebuild doesn't
+	// overwrite a newer one.
+	running sync.Mutex
+}
+
+// Schedule rebuilds suggestions after the delay unless a rebuild is
+// already scheduled.
+func (u *suggestionUpdates) Schedule() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.timer != nil {
 		return
 	}
+	u.timer = time.AfterFunc(u.delay, func() {
+		u.mu.Lock()
+		u.timer = nil
+		u.mu.Unlock()
 
-	for _, c := range cc {
-		err = cms.GetTopicsForContent(db, c)
+		u.running.Lock()
+		defer u.running.Unlock()
+		err := updateSuggestions(context.Background(), u.app.Store, u.app.Suggester, u.app.Langs)
 		if err != nil {
-			return
+			log.Printf("failed to update search suggestions: %v", err)
 		}
+	})
+}
 
-		err = cms.GetAuthorsForContent(db, c)
+// relatedItems returns a function which loads public content of a
+// language for the related content engine.
+func relatedItems(s *store.Stores) related.LoadFunc {
+	return func(ctx context.Context, lang string) ([]*related.Item, error) {
+		items, err := s.Content.Find(ctx, store.ContentQuery{Language: lang, Public: true})
 		if err != nil {
-			return
+			return nil, err
 		}
-	}
 
-	return
+		res := make([]*related.Item, len(items))
+		for i, c := range items {
+			res[i] = &related.Item{
+				ID:        c.ID.Hex(),
+				Title:     c.Title,
+				Lede:      c.Lede,
+				Body:      c.Body,
+				TopicIDs:  hexIDs(c.TopicIDs),
+				AuthorIDs: hexIDs(c.AuthorIDs),
+				Published: c.Published,
+				Scheduled: c.Scheduled,
+			}
+		}
+		return res, nil
+	}
 }
 
-func getEvents(db *mgo.Database, lang language.Tag) (cc []*cms.Content, err error) {
-	cc, err = cms.AllContentSorted(db, bson.M{
-		"language": lang.String(),
-		"public":   true,
-		"type":     cms.Event,
-		"$or": []bson.M{
-			bson.M{"scheduled": bson.M{"$lt": time.Now()}},
-			bson.M{"scheduled": (time.Time{})},
-		},
-		"eventstart": bson.M{"$gte": time.Now()},
-	},
-		"eventstart")
+// reloadTranslations reloads UI translations with the messages edited
+// by administrators.
+func reloadTranslations(ctx context.Context, s *store.Stores) error {
+	messages, err := s.Translations.All(ctx)
 	if err != nil {
-		return
+		return err
 	}
+	return translations.Reload(messages)
+}
 
-	for _, c := range cc {
-		err = cms.GetTopicsForContent(db, c)
+// uniqueSlug returns the slug if it is not taken in the language and
+// the primary topic, otherwise the slug with the least free numeric
+// suffix, e.g. "title-2". Slugs of subsections of the topic are taken
+// too, their paths would hide the content.
+func uniqueSlug(ctx context.Context, s *store.Stores, lang string, topicID primitive.ObjectID, slug string, except primitive.ObjectID) (string, error) {
+	subsections := map[string]bool{}
+	if !topicID.IsZero() {
+		tt, err := s.Topics.All(ctx, store.TopicQuery{Language: lang, ParentID: topicID})
 		if err != nil {
-			return
+			return "", err
+		}
+		for _, t := range tt {
+			subsections[t.Slug] = true
 		}
+	}
+	for i := 1; ; i++ {
+		v := slug
+		if i > 1 {
+			v = fmt.Sprintf("%s-%d", slug, i)
+		}
+		if subsections[v] {
+			continue
+		}
+		cc, err := s.Content.Find(ctx, store.ContentQuery{Language: lang, Slug: v})
+		if err != nil {
+			return "", err
+		}
+		taken := false
+		for _, c := range cc {
+			if c.ID != except && c.PrimaryTopicID == topicID {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			return v, nil
+		}
+	}
+}
 
-		err = cms.GetAuthorsForContent(db, c)
+// uniqueUserSlug returns the slug if no other user has it, otherwise
+// the slug with the least free numeric suffix.
+func uniqueUserSlug(ctx context.Context, s store.UserStore, slug string, except primitive.ObjectID) (string, error) {
+	for i := 1; ; i++ {
+		v := slug
+		if i > 1 {
+			v = fmt.Sprintf("%s-%d", slug, i)
+		}
+		u, err := s.FindBySlug(ctx, v)
+		if err == store.ErrNotFound || err == nil && u.ID == except {
+			return v, nil
+		}
 		if err != nil {
-			return
+			return "", err
+		}
+	}
+}
+
+// checkTopicTree returns cms.ErrTopicCycle if the parent of the topic
+// is the topic itself or one of its subsections and
+// cms.ErrTopicLanguage if the parent or subsections have another
+// language.
+func checkTopicTree(ctx context.Context, s store.TopicStore, t *cms.Topic) error {
+	children, err := s.All(ctx, store.TopicQuery{ParentID: t.ID})
+	if err != nil {
+		return err
+	}
+	for _, c := range children {
+		if c.Language != t.Language {
+			return cms.ErrTopicLanguage
 		}
 	}
+	if t.ParentID == nil {
+		return nil
+	}
 
+	if t.ID == *t.ParentID {
+		return cms.ErrTopicCycle
+	}
+	ids, err := s.Descendants(ctx, t.ID)
+	if err != nil {
+		return err
+	}
+	for _, v := range ids {
+		if v == *t.ParentID {
+			return cms.ErrTopicCycle
+		}
+	}
+	parent, err := s.Get(ctx, *t.ParentID)
+	if err != nil {
+		return err
+	}
+	if parent.Language != t.Language {
+		return cms.ErrTopicLanguage
+	}
+	return nil
+}
+
+// errReservedTopicSlug is returned by uniqueTopicSlug for root topics
+// which paths would be taken by other pages.
+var errReservedTopicSlug = errors.New("the title of a root topic is taken by other pages, choose another one")
+
+// uniqueTopicSlug returns the slug of the topic if it is not taken by
+// other subsections or content of its parent, otherwise the slug with
+// the least free numeric suffix, so that paths of topics are unique and
+// don't hide content.
+func uniqueTopicSlug(ctx context.Context, s *store.Stores, t *cms.Topic) (string, error) {
+	if t.ParentID == nil && reservedSlugs[t.Slug] {
+		return "", errReservedTopicSlug
+	}
+	tt, err := s.Topics.All(ctx, store.TopicQuery{Language: t.Language})
+	if err != nil {
+		return "", err
+	}
+	taken := map[string]bool{}
+	for _, v := range tt {
+		if v.ID == t.ID {
+			continue
+		}
+		if (v.ParentID == nil && t.ParentID == nil) || (v.ParentID != nil && t.ParentID != nil && *v.ParentID == *t.ParentID) {
+			taken[v.Slug] = true
+		}
+	}
+	for i := 1; ; i++ {
+		v := t.Slug
+		if i > 1 {
+			v = fmt.Sprintf("%s-%d", t.Slug, i)
+		}
+		if taken[v] {
+			continue
+		}
+		if t.ParentID == nil {
+			return v, nil
+		}
+		cc, err := s.Content.Find(ctx, store.ContentQuery{Language: t.Language, PrimaryTopicID: *t.ParentID, Slug: v, Limit: 1})
+		if err != nil {
+			return "", err
+		}
+		if len(cc) == 0 {
+			return v, nil
+		}
+	}
+}
+
+// publicAuthors returns authors of published content of the language
+// with amounts of their content sorted by names.
+func publicAuthors(ctx context.Context, s *store.Stores, lang string) ([]*cms.Author, error) {
+	counts, err := s.Content.AuthorCounts(ctx, store.ContentQuery{Language: lang, Published: true})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, 0, len(counts))
+	for id := range counts {
+		ids = append(ids, id)
+	}
+	uu, err := s.Users.ByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	aa := []*cms.Author{}
+	for _, u := range uu {
+		// users without slugs have no public pages
+		if len(u.Slug) == 0 || !cms.CanBeAuthor(u) {
+			continue
+		}
+		a := cms.NewAuthor(u, lang)
+		a.Count = counts[u.ID]
+		if a.PhotoURL, err = photoURL(ctx, s.Files, u.PhotoID); err != nil {
+			return nil, err
+		}
+		aa = append(aa, a)
+	}
+	return aa, nil
+}
+
+// getAuthor returns the public profile of the user by the slug. Only
+// authors and administrators with published content of the language
+// have public profiles, ErrNotFound is returned for other users.
+func getAuthor(ctx context.Context, s *store.Stores, lang, slug string) (*cms.Author, error) {
+	u, err := s.Users.FindBySlug(ctx, slug)
+	if err != nil {
+		return nil, err
+	}
+	if !cms.CanBeAuthor(u) {
+		return nil, store.ErrNotFound
+	}
+	n, err := s.Content.Count(ctx, store.ContentQuery{Language: lang, Published: true, AuthorID: u.ID})
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, store.ErrNotFound
+	}
+	a := cms.NewAuthor(u, lang)
+	a.Count = n
+	a.PhotoURL, err = photoURL(ctx, s.Files, u.PhotoID)
+	return a, err
+}
+
+// currentPhotos returns the photo for the photo picker, other photos
+// are found in the media library on demand.
+func currentPhotos(ctx context.Context, s store.FileStore, id *primitive.ObjectID) ([]*file.File, error) {
+	if id == nil {
+		return []*file.File{}, nil
+	}
+	f, err := s.Get(ctx, *id)
+	if err == store.ErrNotFound {
+		return []*file.File{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []*file.File{f}, nil
+}
+
+// photoURL returns the URL of the photo or an empty string if there is
+// no photo or it was removed.
+func photoURL(ctx context.Context, s store.FileStore, id *primitive.ObjectID) (string, error) {
+	if id == nil {
+		return "", nil
+	}
+	f, err := s.Get(ctx, *id)
+	if err == store.ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return f.URL, nil
+}
+
+// findContent returns published content of the topic by its slug,
+// moved is true if the slug is a previous one. Slugs are unique in
+// primary topics only, so content of which the topic is primary wins
+// over content listing it as a secondary topic.
+func findContent(ctx context.Context, s store.ContentStore, topicID primitive.ObjectID, slug string) (c *cms.Content, moved bool, err error) {
+	topicIDs := []primitive.ObjectID{topicID}
+	queries := []store.ContentQuery{
+		{Published: true, PrimaryTopicID: topicID, Slug: slug},
+		{Published: true, TopicIDs: topicIDs, Slug: slug},
+		// the slug has been changed or set for the page
+		{Published: true, PrimaryTopicID: topicID, OldSlug: slug},
+		{Published: true, TopicIDs: topicIDs, OldSlug: slug},
+	}
+	for i, q := range queries {
+		c, err = s.FindOne(ctx, q)
+		if err != store.ErrNotFound {
+			return c, i > 1, err
+		}
+	}
 	return
 }
 
-func getPosts(db *mgo.Database, lang language.Tag, limit int) (cc []*cms.Content, err error) {
-	findParams := bson.M{
-		"language": lang.String(),
-		"public":   true,
-		"$or": []bson.M{
-			bson.M{"scheduled": bson.M{"$lt": time.Now()}},
-			bson.M{"scheduled": (time.Time{})},
-		},
+// getRelated loads public content related to the content.
+func getRelated(ctx context.Context, s *store.Stores, engine *related.Engine, c *cms.Content, n int) (cc []*cms.Content, err error) {
+	ids, err := engine.Related(ctx, c.Language, c.ID.Hex(), hexIDs(c.RelatedPinned), hexIDs(c.RelatedExcluded), n)
+	if err != nil {
+		return
 	}
 
-	if limit > 0 {
-		cc, err = cms.AllContentLimited(db, findParams, limit)
-	} else {
-		cc, err = cms.AllContentLimited(db, findParams, 0)
+	oids := make([]primitive.ObjectID, len(ids))
+	for i, id := range ids {
+		oids[i] = objectIDHex(id)
 	}
+	items, err := s.Content.ByIDs(ctx, oids)
 	if err != nil {
 		return
 	}
 
-	for _, c := range cc {
-		err = cms.GetAuthorsForContent(db, c)
-		if err != nil {
-			return
+	// pinned content can be hidden after it was pinned
+	now := time.Now()
+	for _, v := range items {
+		if v.Public && len(v.Topics) > 0 && (v.Scheduled.IsZero() || v.Scheduled.Before(now)) {
+			cc = append(cc, v)
 		}
-		err = cms.GetTopicsForContent(db, c)
-		if err != nil {
-			return
+	}
+	return
+}
+
+// objectIDHex returns the ID from its hex representation or the zero ID
+// if the string is not a valid ID.
+func objectIDHex(s string) primitive.ObjectID {
+	id, _ := primitive.ObjectIDFromHex(s)
+	return id
+}
+
+func hexIDs(ids []primitive.ObjectID) []string {
+	res := make([]string, len(ids))
+	for i, id := range ids {
+		res[i] = id.Hex()
+	}
+	return res
+}
+
+// searchDocument prepares the content for the search index.
+func searchDocument(c *cms.Content) *search.Document {
+	return &search.Document{
+		ID:        c.ID.Hex(),
+		Language:  c.Language,
+		Title:     c.Title,
+		Lede:      c.Lede,
+		Body:      c.Body,
+		Authors:   c.AuthorNames,
+		Topics:    c.TopicTitles,
+		TopicIDs:  hexIDs(c.TopicIDs),
+		AuthorIDs: hexIDs(c.AuthorIDs),
+		Type:      int(c.Type),
+		Scheduled: c.Scheduled,
+		Published: c.Published,
+	}
+}
+
+func getPages(ctx context.Context, s *store.Stores, lang language.Tag) ([]*cms.Content, error) {
+	return s.Content.Find(ctx, store.ContentQuery{
+		Language:  lang.String(),
+		Published: true,
+		Types:     []cms.ContentType{cms.Page},
+		Order:     store.ByCreated,
+	})
+}
+
+func getSeries(ctx context.Context, s *store.Stores, lang language.Tag) (cc []*cms.Content, err error) {
+	cc, err = s.Content.Find(ctx, store.ContentQuery{
+		Language:  lang.String(),
+		Published: true,
+		Types:     []cms.ContentType{cms.ArticleSeries},
+		Order:     store.ByCreated,
+	})
+	if err != nil {
+		return
+	}
+
+	if err = s.Content.LoadChildren(ctx, cc); err != nil {
+		return
+	}
+	for _, c := range cc {
+		// limit children for the main page to the last 3 items
+		if len(c.Children) > 3 {
+			c.Children = c.Children[:3]
 		}
 	}
 
 	return
 }
 
-func getTopics(db *mgo.Database, lang language.Tag) ([]*cms.Topic, error) {
-	return cms.AllTopics(db, bson.M{
-		"language": lang.String(),
-		"public":   true,
-		"page":     false,
+func getCertainContent(ctx context.Context, s *store.Stores, lang language.Tag, ctype cms.ContentType) ([]*cms.Content, error) {
+	return s.Content.Find(ctx, store.ContentQuery{
+		Language:  lang.String(),
+		Published: true,
+		Types:     []cms.ContentType{ctype},
+		Order:     store.ByCreated,
 	})
 }
+
+func getEvents(ctx context.Context, s *store.Stores, lang language.Tag) ([]*cms.Content, error) {
+	return s.Content.Find(ctx, store.ContentQuery{
+		Language:    lang.String(),
+		Published:   true,
+		Types:       []cms.ContentType{cms.Event},
+		EventsAfter: time.Now(),
+		Order:       store.ByEventStart,
+	})
+}
+
+func getPosts(ctx context.Context, s *store.Stores, lang language.Tag, limit int) ([]*cms.Content, error) {
+	return s.Content.Find(ctx, store.ContentQuery{
+		Language:  lang.String(),
+		Published: true,
+		Limit:     limit,
+	})
+}
+
+func getTopics(ctx context.Context, s *store.Stores, lang language.Tag) ([]*cms.Topic, error) {
+	return s.Topics.All(ctx, store.TopicQuery{
+		Language: lang.String(),
+		Public:   true,
+	})
+}
+
+// setTopicFamily fills Ancestors and Children of the topic from the
+// list of public topics.
+func setTopicFamily(t *cms.Topic, tt []*cms.Topic) {
+	byID := make(map[primitive.ObjectID]*cms.Topic, len(tt))
+	for _, v := range tt {
+		byID[v.ID] = v
+	}
+
+	t.Ancestors = []*cms.Topic{}
+	seen := map[primitive.ObjectID]bool{t.ID: true}
+	for parent := t.ParentID; parent != nil && !seen[*parent]; {
+		p, ok := byID[*parent]
+		if !ok {
+			break
+		}
+		seen[p.ID] = true
+		t.Ancestors = append([]*cms.Topic{p}, t.Ancestors...)
+		parent = p.ParentID
+	}
+
+	t.Children = []*cms.Topic{}
+	for _, v := range tt {
+		if v.ParentID != nil && *v.ParentID == t.ID {
+			t.Children = append(t.Children, v)
+		}
+	}
+}
+
+// sortTopicTree orders topics so that every topic is followed by its
+// subsections. Topics of the same parent keep their order.
+func sortTopicTree(tt []*cms.Topic) []*cms.Topic {
+	ids := make(map[primitive.ObjectID]bool, len(tt))
+	for _, t := range tt {
+		ids[t.ID] = true
+	}
+
+	children := map[primitive.ObjectID][]*cms.Topic{}
+	roots := []*cms.Topic{}
+	for _, t := range tt {
+		if t.ParentID == nil || !ids[*t.ParentID] {
+			roots = append(roots, t)
+			continue
+		}
+		children[*t.ParentID] = append(children[*t.ParentID], t)
+	}
+
+	sorted := make([]*cms.Topic, 0, len(tt))
+	seen := map[primitive.ObjectID]bool{}
+	var walk func([]*cms.Topic)
+	walk = func(level []*cms.Topic) {
+		for _, t := range level {
+			if seen[t.ID] {
+				continue
+			}
+			seen[t.ID] = true
+			sorted = append(sorted, t)
+			walk(children[t.ID])
+		}
+	}
+	walk(roots)
+	// topics of a broken hierarchy go last
+	for _, t := range tt {
+		if !seen[t.ID] {
+			sorted = append(sorted, t)
+		}
+	}
+	return sorted
+}
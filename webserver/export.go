@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bahna/magazine/webserver/store"
+)
+
+// exportManifest is saved with exported pages to export only changed
+// pages next time.
+type exportManifest struct {
+	Pages map[string]*exportedPage `json:"pages"`
+}
+
+// exportedPage is a page written by the previous export, Links are
+// website links found on the page, so that the website is walked
+// without rendering unchanged pages.
+type exportedPage struct {
+	ETag  string   `json:"etag,omitempty"`
+	Links []string `json:"links"`
+}
+
+const exportManifestName = ".export.json"
+
+// excludedPaths are dynamic pages of languages which can't be exported.
+var excludedPaths = []string{"admin", "login", "logout", "signup", "restore", "search", "mailchimp"}
+
+var (
+	attrLinkRe = regexp.MustCompile(`\b(href|src|data-href|action|srcset)="([^"]*)"`)
+	cssLinkRe  = regexp.MustCompile(`url\((["']?)([^"')]*)`)
+)
+
+// exporter writes public pages of the website as static HTML files,
+// which can be served by any web server as a mirror of the website.
+type exporter struct {
+	app     *application
+	handler http.Handler
+	dir     string
+	// origin is a URL of the website, links to pages which are not
+	// exported lead there.
+	origin string
+	// full exports all pages, otherwise only changed ones are written.
+	full bool
+
+	prev, next *exportManifest
+	queue      []string
+	seen       map[string]bool
+	files      map[string]bool
+
+	written, unchanged, removed, copied int
+}
+
+// exportCommand runs the "export" subcommand.
+func exportCommand(app *application, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	full := fs.Bool("full", false, "write all pages, use it after templates or translations are changed")
+	origin := fs.String("origin", "", "URL of the website for links to pages which are not exported, e.g. https://bahna.land")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: magazine-server export [-full] [-origin URL] dir")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("export directory is not specified")
+	}
+
+	// the exporter keeps its own track of changes, templates and
+	// translations are expected to be the same as before, other edits
+	// are known by invalidation times saved by the server
+	app.Pages.TTL = 0
+	app.Started = time.Time{}
+	if err := restoreInvalidations(context.Background(), app); err != nil {
+		return fmt.Errorf("failed to load page invalidation times: %v", err)
+	}
+
+	e := &exporter{
+		app:     app,
+		handler: Recover(app.Router),
+		dir:     fs.Arg(0),
+		origin:  strings.TrimRight(*origin, "/"),
+		full:    *full,
+		next:    &exportManifest{Pages: make(map[string]*exportedPage)},
+		seen:    make(map[string]bool),
+		files:   make(map[string]bool),
+	}
+	if err := e.run(context.Background()); err != nil {
+		return err
+	}
+	log.Printf("exported %d pages to %s: %d written, %d unchanged, %d removed, %d files copied",
+		len(e.next.Pages), e.dir, e.written, e.unchanged, e.removed, e.copied)
+	return nil
+}
+
+func (e *exporter) run(ctx context.Context) error {
+	if err := os.MkdirAll(e.dir, 0755); err != nil {
+		return err
+	}
+	e.prev = &exportManifest{Pages: make(map[string]*exportedPage)}
+	if b, err := ioutil.ReadFile(filepath.Join(e.dir, exportManifestName)); err == nil {
+		if err = json.Unmarshal(b, e.prev); err != nil {
+			return fmt.Errorf("failed to read the export manifest: %v", err)
+		}
+	}
+
+	// pages are found by links starting from the languages, content
+	// and topics which are not linked from lists are added explicitly
+	e.enqueue("/")
+	for _, lang := range e.app.Langs {
+		l := lang.String()
+		e.enqueue("/" + l + "/")
+		e.enqueue("/" + l + "/authors/")
+		tt, err := e.app.Store.Topics.All(ctx, store.TopicQuery{Language: l, Public: true})
+		if err != nil {
+			return err
+		}
+		for _, t := range tt {
+			e.enqueue("/" + l + "/" + t.Path + "/")
+		}
+		cc, err := e.app.Store.Content.Find(ctx, store.ContentQuery{Language: l, Published: true})
+		if err != nil {
+			return err
+		}
+		for _, c := range cc {
+			if t := c.PrimaryTopic(); t != nil {
+				e.enqueue(fmt.Sprintf("/%s/%s/%s/", l, t.Path, c.Slug))
+			}
+		}
+	}
+	for len(e.queue) > 0 {
+		u := e.queue[0]
+		e.queue = e.queue[1:]
+		if err := e.page(u); err != nil {
+			return fmt.Errorf("failed to export %s: %v", u, err)
+		}
+	}
+
+	// pages which are not public anymore
+	for u := range e.prev.Pages {
+		if _, ok := e.next.Pages[u]; ok {
+			continue
+		}
+		err := os.Remove(filepath.Join(e.dir, exportFile(u)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		e.removed++
+	}
+
+	if err := e.copyAssets(); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(e.next, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(e.dir, exportManifestName), b, 0644)
+}
+
+// enqueue adds the page to the queue once.
+func (e *exporter) enqueue(u string) {
+	if !e.seen[u] {
+		e.seen[u] = true
+		e.queue = append(e.queue, u)
+	}
+}
+
+// page renders and writes the page at the URL.
+func (e *exporter) page(u string) error {
+	name := filepath.Join(e.dir, exportFile(u))
+	r := httptest.NewRequest("GET", u, nil)
+	prev, ok := e.prev.Pages[u]
+	if ok && len(prev.ETag) > 0 && !e.full {
+		if _, err := os.Stat(name); err == nil {
+			r.Header.Set("If-None-Match", prev.ETag)
+		}
+	}
+	rec := httptest.NewRecorder()
+	e.handler.ServeHTTP(rec, r)
+	// the router redirects between URLs with and without trailing
+	// slashes, which are the same page in the mirror
+	for i := 0; i < 3 && isRedirect(rec.Code); i++ {
+		loc, err := r.URL.Parse(rec.Header().Get("Location"))
+		if err != nil {
+			break
+		}
+		if key, ok := exportKey(loc, e.app); !ok || key != u {
+			break
+		}
+		header := r.Header
+		r = httptest.NewRequest("GET", loc.RequestURI(), nil)
+		r.Header = header
+		rec = httptest.NewRecorder()
+		e.handler.ServeHTTP(rec, r)
+	}
+
+	var body []byte
+	exported := &exportedPage{ETag: rec.Header().Get("ETag")}
+	switch {
+	case rec.Code == http.StatusOK:
+		body = e.rewrite(u, rec.Body.Bytes(), exported)
+	case rec.Code == http.StatusNotModified:
+		e.unchanged++
+		e.next.Pages[u] = prev
+		for _, l := range prev.Links {
+			e.link(l)
+		}
+		return nil
+	case isRedirect(rec.Code):
+		// moved pages are kept as redirects to not break links to
+		// the mirror
+		to := e.rewriteLink(u, rec.Header().Get("Location"), exported)
+		body = []byte(fmt.Sprintf(redirectHTML, html.EscapeString(to), html.EscapeString(to)))
+	default:
+		log.Printf("export: %s responded with %d, skipped", u, rec.Code)
+		return nil
+	}
+	e.next.Pages[u] = exported
+
+	if old, err := ioutil.ReadFile(name); err == nil && bytes.Equal(old, body) {
+		e.unchanged++
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	e.written++
+	return ioutil.WriteFile(name, body, 0644)
+}
+
+func isRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+const redirectHTML = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta http-equiv="refresh" content="0; url=%s"></head>
+<body><a href="%s">&rarr;</a></body></html>
+`
+
+// rewrite makes links of the page at the URL relative, so that the
+// mirror works at any address, and records website links into p.
+func (e *exporter) rewrite(u string, body []byte, p *exportedPage) []byte {
+	body = attrLinkRe.ReplaceAllFunc(body, func(b []byte) []byte {
+		m := attrLinkRe.FindSubmatch(b)
+		v := html.UnescapeString(string(m[2]))
+		if string(m[1]) == "srcset" {
+			candidates := strings.Split(v, ",")
+			for i, c := range candidates {
+				f := strings.Fields(c)
+				if len(f) > 0 {
+					f[0] = e.rewriteLink(u, f[0], p)
+					candidates[i] = strings.Join(f, " ")
+				}
+			}
+			v = strings.Join(candidates, ", ")
+		} else {
+			v = e.rewriteLink(u, v, p)
+		}
+		return []byte(fmt.Sprintf(`%s="%s"`, m[1], html.EscapeString(v)))
+	})
+	return cssLinkRe.ReplaceAllFunc(body, func(b []byte) []byte {
+		m := cssLinkRe.FindSubmatch(b)
+		return []byte(fmt.Sprintf("url(%s%s", m[1], e.rewriteLink(u, string(m[2]), p)))
+	})
+}
+
+// rewriteLink returns a link to the same page or file in the mirror
+// relative to the page at the URL.
+func (e *exporter) rewriteLink(u, link string, p *exportedPage) string {
+	ref, err := url.Parse(link)
+	if err != nil || len(ref.Scheme) > 0 || len(ref.Host) > 0 || (len(ref.Path) == 0 && len(ref.RawQuery) == 0) {
+		// external links and fragments
+		return link
+	}
+	base, err := url.Parse(u)
+	if err != nil {
+		return link
+	}
+	target := base.ResolveReference(ref)
+	key, ok := exportKey(target, e.app)
+	if !ok {
+		if len(e.origin) > 0 {
+			return e.origin + target.RequestURI()
+		}
+		return link
+	}
+
+	p.Links = append(p.Links, key)
+	e.link(key)
+
+	to := exportFile(key)
+	if strings.HasSuffix(to, "index.html") {
+		to = strings.TrimSuffix(to, "index.html")
+	}
+	rel := relativePath(path.Dir(exportFile(u)), to)
+	if len(target.Fragment) > 0 {
+		rel += "#" + target.Fragment
+	}
+	return rel
+}
+
+// link queues a page or records a file found by the link. Static
+// files are copied all together.
+func (e *exporter) link(key string) {
+	switch {
+	case strings.HasPrefix(key, "/files/"), strings.HasPrefix(key, "/img/"):
+		e.files[key] = true
+	case strings.HasSuffix(strings.SplitN(key, "?", 2)[0], "/"):
+		e.enqueue(key)
+	}
+}
+
+// copyAssets copies static files and files referenced by pages which
+// are changed since the previous export.
+func (e *exporter) copyAssets() error {
+	err := filepath.Walk(e.app.Config.StaticDir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(e.app.Config.StaticDir, name)
+		if err != nil {
+			return err
+		}
+		return e.copyFile(name, filepath.Join(e.dir, "static", rel))
+	})
+	if err != nil {
+		return err
+	}
+	for name := range favicons {
+		err = e.copyFile(filepath.Join(e.app.Config.StaticDir, name), filepath.Join(e.dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for key := range e.files {
+		if strings.HasPrefix(key, "/img/") {
+			if err = e.image(key); err != nil {
+				return err
+			}
+			continue
+		}
+		rel := strings.TrimPrefix(key, "/files/")
+		err = e.copyFile(filepath.Join(e.app.Config.FilesDir, filepath.FromSlash(rel)), filepath.Join(e.dir, "files", filepath.FromSlash(rel)))
+		if os.IsNotExist(err) {
+			log.Printf("export: %s is missing", key)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// image writes the resized image unless it is already exported. URLs
+// of crops change with their versions, so an exported file never
+// changes.
+func (e *exporter) image(key string) error {
+	name := filepath.Join(e.dir, filepath.FromSlash(exportFile(key)))
+	if _, err := os.Stat(name); err == nil {
+		return nil
+	}
+	rec := httptest.NewRecorder()
+	e.handler.ServeHTTP(rec, httptest.NewRequest("GET", key, nil))
+	if rec.Code != http.StatusOK {
+		log.Printf("export: %s responded with %d, skipped", key, rec.Code)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	e.copied++
+	return ioutil.WriteFile(name, rec.Body.Bytes(), 0644)
+}
+
+// copyFile copies the file unless the destination has the same size
+// and modification time.
+func (e *exporter) copyFile(src, dst string) error {
+	si, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if di, err := os.Stat(dst); err == nil && di.Size() == si.Size() && di.ModTime().Equal(si.ModTime()) {
+		return nil
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	e.copied++
+	return os.Chtimes(dst, si.ModTime(), si.ModTime())
+}
+
+// exportKey returns a key of the exported page or file at the URL,
+// which is its path with the page number of lists, ok is false if the
+// URL is not exported.
+func exportKey(u *url.URL, app *application) (key string, ok bool) {
+	p := path.Clean(u.Path)
+	if strings.HasPrefix(p, "/static/") || strings.HasPrefix(p, "/files/") || strings.HasPrefix(p, "/img/") {
+		return p, true
+	}
+	if _, ok := favicons[strings.TrimPrefix(p, "/")]; ok {
+		return p, true
+	}
+	if p == "/" {
+		return p, true
+	}
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	known := false
+	for _, l := range app.Langs {
+		if segments[0] == l.String() {
+			known = true
+		}
+	}
+	if !known {
+		return "", false
+	}
+	if len(segments) > 1 {
+		for _, v := range excludedPaths {
+			if segments[1] == v {
+				return "", false
+			}
+		}
+	}
+	key = p + "/"
+	if n, err := strconv.Atoi(u.Query().Get("p")); err == nil && n > 1 {
+		key += "?p=" + strconv.Itoa(n)
+	}
+	return key, true
+}
+
+// exportFile returns a slash separated path of the exported page or
+// file relative to the export directory.
+func exportFile(key string) string {
+	p, query := key, ""
+	if i := strings.Index(key, "?"); i >= 0 {
+		p, query = key[:i], key[i+1:]
+	}
+	if !strings.HasSuffix(p, "/") {
+		return strings.TrimPrefix(p, "/")
+	}
+	p = strings.TrimPrefix(p, "/")
+	if v, err := url.ParseQuery(query); err == nil && len(v.Get("p")) > 0 {
+		p += "page/" + v.Get("p") + "/"
+	}
+	return p + "index.html"
+}
+
+// relativePath returns a slash separated path to the target relative
+// to the directory, both are relative to the same root.
+func relativePath(dir, target string) string {
+	if dir == "." {
+		dir = ""
+	}
+	from := strings.Split(dir, "/")
+	if len(dir) == 0 {
+		from = nil
+	}
+	to := strings.Split(target, "/")
+	i := 0
+	for i < len(from) && i < len(to)-1 && from[i] == to[i] {
+		i++
+	}
+	rel := strings.Repeat("../", len(from)-i) + strings.Join(to[i:], "/")
+	if len(rel) == 0 {
+		return "./"
+	}
+	return rel
+}
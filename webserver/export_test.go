@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bahna/magazine/webserver/store"
+)
+
+func TestExport(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	dir, err := ioutil.TempDir("", "export")
+	check(t, err)
+	defer os.RemoveAll(dir)
+
+	s.app.Config.StaticDir = "../assets/static"
+	export := func(args ...string) {
+		t.Helper()
+		check(t, exportCommand(s.app, append(args, dir)))
+	}
+	read := func(name string) string {
+		t.Helper()
+		b, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		check(t, err)
+		return string(b)
+	}
+
+	export()
+	tests := []struct {
+		file, want string
+	}{
+		{"index.html", `url=ru/`},
+		{"ru/index.html", `href="culture/muzyka/concert/"`},
+		{"ru/index.html", `href="../static/basscss.min.css"`},
+		{"ru/culture/muzyka/concert/index.html", `href="../../../"`},
+		{"ru/culture/muzyka/concert/index.html", "The orchestra played all night."},
+		{"static/basscss.min.css", ""},
+		{"favicon.ico", ""},
+	}
+	for _, tt := range tests {
+		if got := read(tt.file); !strings.Contains(got, tt.want) {
+			t.Errorf("%s doesn't contain %q", tt.file, tt.want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ru", "culture", "muzyka", "draft")); !os.IsNotExist(err) {
+		t.Errorf("unpublished content is exported: %v", err)
+	}
+
+	// unchanged pages are not rendered again
+	stat, err := os.Stat(filepath.Join(dir, "ru", "culture", "muzyka", "concert", "index.html"))
+	check(t, err)
+	export()
+	restat, err := os.Stat(filepath.Join(dir, "ru", "culture", "muzyka", "concert", "index.html"))
+	check(t, err)
+	if !restat.ModTime().Equal(stat.ModTime()) {
+		t.Error("unchanged content is written again")
+	}
+
+	// pages are written again after edits of data shown on them, the
+	// exporter knows about them by invalidation times saved by the
+	// server running in another process
+	music, err := s.app.Store.Topics.Get(context.Background(), s.music.ID)
+	check(t, err)
+	music.Title = "Live music"
+	check(t, s.app.Store.Topics.Save(context.Background(), music))
+	check(t, s.app.Store.Invalidations.Save(context.Background(), "/ru/", time.Now()))
+	export()
+	if got := read("ru/culture/muzyka/concert/index.html"); !strings.Contains(got, "Live music") {
+		t.Error("the renamed topic is not exported")
+	}
+
+	// changed content is written, unpublished content is removed
+	c, err := s.app.Store.Content.FindOne(context.Background(), store.ContentQuery{Slug: "concert"})
+	check(t, err)
+	c.Updated = time.Now()
+	c.Body = "The orchestra played till the morning."
+	check(t, s.app.Store.Content.Save(context.Background(), c))
+	export()
+	if got := read("ru/culture/muzyka/concert/index.html"); !strings.Contains(got, "till the morning") {
+		t.Error("changed content is not exported")
+	}
+
+	c.Public = false
+	c.Updated = time.Now()
+	check(t, s.app.Store.Content.Save(context.Background(), c))
+	export()
+	if _, err := os.Stat(filepath.Join(dir, "ru", "culture", "muzyka", "concert", "index.html")); !os.IsNotExist(err) {
+		t.Errorf("unpublished content is kept: %v", err)
+	}
+}
@@ -4,26 +4,32 @@ package file
 // API uses the wander package which requires VIPS to be installed.
 
 import (
-	"errors"
+	"context"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
-	"mime/multipart"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/bahna/magazine/webserver/cms"
+	"github.com/bahna/magazine/webserver/imaging"
 	"github.com/bahna/magazine/webserver/mongo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	mongodb "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 
 	// NOTE: there is a strange behaviour while trying to "go generate" when this file is present
 	// because of an import of "bitbucket.org/iharsuvorau/wander" which in imports
 	// "github.com/davidbyttow/govips/pkg/vips".
 	// To resolve the issue just remove the content of the file while executing "go generate".
 	"bitbucket.org/iharsuvorau/wander"
-	"github.com/globalsign/mgo"
-	"github.com/globalsign/mgo/bson"
 )
 
 const (
@@ -33,7 +39,7 @@ const (
 
 // File is used for file uploads.
 type File struct {
-	ID    bson.ObjectId `bson:"_id"`
+	ID    primitive.ObjectID `bson:"_id"`
 	Title string
 	// Credits field contains information about a file source or a name of an author.
 	Credits string
@@ -41,6 +47,25 @@ type File struct {
 	URL     string
 	Size    int64
 	Created time.Time
+	// Filename is the name of the uploaded file on the computer of
+	// the editor, files are searched by it.
+	Filename string `bson:",omitempty"`
+	// Folder groups files in the media library.
+	Folder string `bson:",omitempty"`
+	// Width and Height of images in pixels, zero if unknown.
+	Width, Height int
+	// Focus is the point of interest of images, crops are made around
+	// it. Nil means the center.
+	Focus *imaging.Point `bson:",omitempty"`
+	// Crops are areas of images chosen by editors for named crops,
+	// other crops are made around Focus.
+	Crops map[string]imaging.Rect `bson:",omitempty"`
+	// Color is the dominant color of images as #rrggbb, it is shown
+	// while they are loading.
+	Color string `bson:",omitempty"`
+	// Metadata are read from EXIF of images on upload, before it is
+	// stripped from the file.
+	Metadata *imaging.Metadata `bson:",omitempty"`
 
 	// Optimized can contain several URLs to optimized versions of a file from
 	// the original File.URL field. Usually, it is used for images to store several
@@ -53,44 +78,138 @@ type OptimizedImage struct {
 	Size int64
 }
 
-// UploadFromForm dumps a file to a file system and upserts into a mongo database.
-func UploadFromForm(col *mgo.Collection, fh *multipart.FileHeader, outputDir, caption, credits string, optimize bool) error {
-	var kind int
-	var canBeOptimized bool
-	var optimizedURLs []string
-
-	for _, v := range fh.Header["Content-Type"] {
-		if strings.Contains(v, "image") {
-			kind = ImageKind
-			canBeOptimized = true
-			break
+// Upload describes a file being uploaded.
+type Upload struct {
+	// Filename is the name of the file on the computer of the editor,
+	// its extension must match the contents.
+	Filename               string
+	Title, Credits, Folder string
+	// Optimize makes optimized versions of images.
+	Optimize bool
+}
+
+// UploadsDir returns the directory of files being uploaded in the files
+// directory, it is hidden from visitors.
+func UploadsDir(filesDir string) string {
+	return filepath.Join(filesDir, ".uploads")
+}
+
+// WriteTemp writes the file being uploaded from r to a temporary file in
+// the uploads directory and returns its name, so that the file isn't
+// kept in memory.
+func WriteTemp(filesDir string, r io.Reader) (string, error) {
+	dir := UploadsDir(filesDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(dir, "upload")
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Validate checks that the type of the uploaded file sniffed from its
+// contents is allowed and matches the extension of the name, see
+// Allowlist.Check.
+func Validate(temp, name string, types *Allowlist) error {
+	mimeType, err := SniffFile(temp)
+	if err != nil {
+		return err
+	}
+	_, _, err = types.Check(mimeType, name)
+	return err
+}
+
+// Add moves the uploaded file from the temporary file into the files
+// directory and returns its record, which is to be saved by the caller.
+// The kind of the file is decided by its contents, which must be allowed
+// by the types, see Validate. Locations and names are stripped from
+// images and SVG images are sanitized before they are moved, empty
+// credits are taken from EXIF.
+func Add(temp, outputDir string, types *Allowlist, u Upload) (*File, error) {
+	defer os.Remove(temp)
+	stat, err := os.Stat(temp)
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() == 0 {
+		return nil, fmt.Errorf("empty file")
+	}
+	mimeType, err := SniffFile(temp)
+	if err != nil {
+		return nil, err
+	}
+	kind, ext, err := types.Check(mimeType, u.Filename)
+	if err != nil {
+		return nil, err
+	}
+	if mimeType == "image/svg+xml" {
+		if err = sanitizeSVGFile(temp); err != nil {
+			return nil, err
+		}
+		if stat, err = os.Stat(temp); err != nil {
+			return nil, err
 		}
 	}
-	id := bson.NewObjectId()
-	ext := path.Ext(fh.Filename)
-	name := id.Hex() + ext
-	url := fmt.Sprintf("/files/%s", name)
-	filename := path.Join(outputDir, name)
 
-	if f, err := fh.Open(); err == nil {
-		b, err := ioutil.ReadAll(f)
+	f := &File{
+		ID:       primitive.NewObjectID(),
+		Title:    u.Title,
+		Credits:  u.Credits,
+		Size:     stat.Size(),
+		Created:  time.Now(),
+		Filename: u.Filename,
+		Folder:   u.Folder,
+		Kind:     kind,
+	}
+	if kind == ImageKind {
+		// optimized versions are made from the stripped file
+		meta, err := imaging.Sanitize(temp)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("failed to strip image metadata: %v", err)
 		}
-		if len(b) == 0 {
-			return fmt.Errorf("empty file")
+		if len(f.Credits) == 0 && meta != nil {
+			f.Credits = meta.Credits()
 		}
-		if err = writeFileFromBytes(b, filename); err != nil {
-			return err
+		f.Metadata = meta
+		if stat, err = os.Stat(temp); err != nil {
+			return nil, err
 		}
-		if err = f.Close(); err != nil {
-			return err
-		}
-	} else {
-		return err
+		f.Size = stat.Size()
+	}
+
+	name := f.ID.Hex() + ext
+	f.URL = "/files/" + name
+	filename := filepath.Join(outputDir, name)
+	if err = os.Chmod(temp, 0644); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(temp, filename); err != nil {
+		return nil, err
+	}
+	if f.Kind != ImageKind {
+		return f, nil
+	}
+
+	// resized versions are made on request up to the width
+	if f.Width, f.Height, err = imaging.Size(filename); err != nil {
+		return nil, fmt.Errorf("failed to read image dimensions: %v", err)
+	}
+	if f.Color, err = imaging.Color(filename); err != nil {
+		return nil, fmt.Errorf("failed to find image color: %v", err)
 	}
 
-	if canBeOptimized && optimize {
+	if u.Optimize {
 		// NOTE: to use wander.optimizeVips make sure the libvips pkg is installed:
 		// https://bitbucket.org/iharsuvorau/bahna/downloads/
 		optimizedMap, err := wander.Optimize(wander.OptimizeVips, wander.Config{
@@ -100,64 +219,34 @@ func UploadFromForm(col *mgo.Collection, fh *multipart.FileHeader, outputDir, ca
 			Formats:      []string{"jpg", "webp"},
 		}, filename)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		optimizedURLs = optimizedMap[path.Base(filename)]
-	}
-
-	var optimized = make([]*OptimizedImage, len(optimizedURLs))
-	for i, v := range optimizedURLs {
-		var size int64
-		fn := path.Join(outputDir, v)
-		if f, err := os.Open(fn); err != nil {
-			return fmt.Errorf("failed to open an optimized image: %v", err)
-		} else {
-			stat, err := f.Stat()
+		for _, v := range optimizedMap[path.Base(filename)] {
+			stat, err := os.Stat(path.Join(outputDir, v))
 			if err != nil {
-				return fmt.Errorf("failed to get optimized image stats: %v", err)
-			}
-			size = stat.Size()
-			if err = f.Close(); err != nil {
-				return fmt.Errorf("failed to close optimized image: %v", err)
+				return nil, fmt.Errorf("failed to get optimized image stats: %v", err)
 			}
-		}
-		optimized[i] = &OptimizedImage{
-			URL:  path.Join("/", "files", v),
-			Size: size,
+			f.Optimized = append(f.Optimized, &OptimizedImage{
+				URL:  path.Join("/", "files", v),
+				Size: stat.Size(),
+			})
 		}
 	}
-
-	col.Database.Session.Refresh()
-	_, err := col.UpsertId(id, &File{
-		ID:        id,
-		Title:     caption,
-		Credits:   credits,
-		Kind:      kind,
-		URL:       url,
-		Size:      fh.Size,
-		Optimized: optimized,
-		Created:   time.Now(),
-	})
-
-	return err
+	return f, nil
 }
 
 // AllFiles returns files from a database.
-func AllFiles(col *mgo.Collection, query interface{}) ([]*File, error) {
-	col.Database.Session.Refresh()
+func AllFiles(ctx context.Context, col *mongodb.Collection, query interface{}, opts ...*options.FindOptions) ([]*File, error) {
 	items := []*File{}
-	err := col.Find(query).All(&items)
+	err := mongo.All(ctx, col, query, &items, opts...)
 	return items, err
 }
 
 // AllFilesByPage returns files by page.
-func AllFilesByPage(col *mgo.Collection, query interface{}, perpage, page int) (items []*File, prev, next, total int, err error) {
-	col.Database.Session.Refresh()
-
-	q := col.Find(query).Sort("-created")
+func AllFilesByPage(ctx context.Context, col *mongodb.Collection, query interface{}, perpage, page int) (items []*File, prev, next, total int, err error) {
 	viewed := (page - 1) * perpage
 
-	total, err = q.Count()
+	total, err = mongo.Count(ctx, col, query)
 	if err != nil {
 		return
 	}
@@ -169,7 +258,10 @@ func AllFilesByPage(col *mgo.Collection, query interface{}, perpage, page int) (
 		prev = page - 1
 	}
 
-	err = q.Limit(perpage).Skip(viewed).All(&items)
+	err = mongo.All(ctx, col, query, &items, options.Find().
+		SetSort(mongo.Sort("-created")).
+		SetLimit(int64(perpage)).
+		SetSkip(int64(viewed)))
 	if err != nil {
 		return
 	}
@@ -177,85 +269,110 @@ func AllFilesByPage(col *mgo.Collection, query interface{}, perpage, page int) (
 	return
 }
 
-// RemoveFile deletes a file from a file system and a database.
-func RemoveFile(col *mgo.Collection, idStr string, filesDir string) error {
-	var id bson.ObjectId
-	if id = bson.ObjectIdHex(idStr); !id.Valid() {
-		return errors.New("invalid ID")
-	}
-
-	file := new(File)
-	col.Database.Session.Refresh()
-
-	err := col.FindId(id).One(file)
-	if err != nil {
-		return err
-	}
-
-	filename := path.Join(filesDir, id.Hex()+path.Ext(file.URL))
-
-	if err = col.RemoveId(id); err != nil {
-		return err
-	}
-
-	paths, err := filepath.Glob(path.Join(path.Dir(filename), "optimized", id.Hex()+"*"))
+// Remove deletes the file and its optimized versions from the files
+// directory. Files which are already missing are skipped.
+func (f *File) Remove(filesDir string) error {
+	paths, err := filepath.Glob(filepath.Join(filesDir, "optimized", f.ID.Hex()+"*"))
 	if err != nil {
 		return err
 	}
-	paths = append(paths, filename)
+	paths = append(paths, f.Name(filesDir))
 	for _, v := range paths {
-		if err = os.Remove(v); err != nil {
+		if err = os.Remove(v); err != nil && !os.IsNotExist(err) {
 			return err
 		}
 	}
-
 	return nil
 }
 
-// writeFileFromBytes writes bytes to a file, it creates directories if needed.
-func writeFileFromBytes(b []byte, filepath string) error {
-	err := ioutil.WriteFile(filepath, b, 0666)
-	if err != nil {
-		if strings.Contains(err.Error(), "no such file or directory") {
-			if err = os.Mkdir(path.Dir(filepath), 0777); err != nil {
-				return err
-			}
+// Name returns a path of the uploaded file in the files directory.
+func (f *File) Name(filesDir string) string {
+	return filepath.Join(filesDir, filepath.FromSlash(strings.TrimPrefix(f.URL, "/files/")))
+}
 
-			// one more try
-			if err = ioutil.WriteFile(filepath, b, 0666); err != nil {
-				return err
-			}
-		} else {
-			return err
-		}
+// CropVersion returns a short hash of the focus and crops set by
+// editors, it is empty for images cropped around the center. URLs of
+// crops include it, so that caches don't keep crops after changes.
+func (f *File) CropVersion() string {
+	if f.Focus == nil && len(f.Crops) == 0 {
+		return ""
 	}
-	return nil
+	h := fnv.New32a()
+	if f.Focus != nil {
+		fmt.Fprintf(h, "%v;", *f.Focus)
+	}
+	names := make([]string, 0, len(f.Crops))
+	for name := range f.Crops {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "%s:%v;", name, f.Crops[name])
+	}
+	return strconv.FormatUint(uint64(h.Sum32()), 36)
+}
+
+// CropArea returns the area of the image for the named crop, the
+// dimensions of the image must be known.
+func (f *File) CropArea(name string) imaging.Rect {
+	if r, ok := f.Crops[name]; ok {
+		return r
+	}
+	c, ok := imaging.CropByName(name)
+	if !ok {
+		return imaging.Rect{}
+	}
+	focus := imaging.Center
+	if f.Focus != nil {
+		focus = *f.Focus
+	}
+	return c.Area(f.Width, f.Height, focus)
 }
 
 // GetImagesForContent fetches images for the provided content which are located
-// in the Content.Images attribute only.
-func GetImagesForContent(db *mgo.Database, c *cms.Content) (err error) {
-	db.Session.Refresh()
-	col := db.C("files")
+// in the Content.Images attribute only. Images are found by URLs of
+// originals or optimized versions with a single query.
+func GetImagesForContent(ctx context.Context, db *mongodb.Database, c *cms.Content) (err error) {
+	col := db.Collection("files")
 
 	if len(c.Images) == 0 {
 		return
 	}
 
+	urls := make([]string, len(c.Images))
 	for i, v := range c.Images {
-		img := new(File)
-		err = mongo.GetOne(col, bson.M{"url": v.URL}, img)
-		if err != nil {
-			if err == mgo.ErrNotFound {
-				err = mongo.GetOne(col, bson.M{"optimized.url": v.URL}, img)
-				if err != nil {
-					err = fmt.Errorf("image %v not found: %v", v.URL, err)
-					return
-				}
-				err = nil
-			}
+		urls[i] = v.URL
+	}
+
+	ff := []*File{}
+	err = mongo.All(ctx, col, bson.M{"$or": []bson.M{
+		{"url": bson.M{"$in": urls}},
+		{"optimized.url": bson.M{"$in": urls}},
+	}}, &ff)
+	if err != nil {
+		return
+	}
+
+	byURL := make(map[string]*File, len(ff))
+	for _, f := range ff {
+		for _, v := range f.Optimized {
+			byURL[v.URL] = f
+		}
+	}
+	// originals take precedence over optimized versions
+	for _, f := range ff {
+		byURL[f.URL] = f
+	}
+
+	for i, v := range c.Images {
+		img, ok := byURL[v.URL]
+		if !ok {
+			return fmt.Errorf("image %v not found: %v", v.URL, mongodb.ErrNoDocuments)
 		}
 		c.Images[i].Credits = img.Credits
+		c.Images[i].Width = img.Width
+		c.Images[i].Height = img.Height
+		c.Images[i].Color = img.Color
 	}
 
 	return
@@ -0,0 +1,174 @@
+package file
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	ErrUploadNotFound = errors.New("upload not found")
+	ErrOffsetMismatch = errors.New("upload offset mismatch")
+	ErrUploadTooLarge = errors.New("upload is larger than declared")
+)
+
+// Resumable is an upload sent in chunks, which is resumed from its
+// offset after a failure. Its data and description are kept in the
+// uploads directory until it is complete.
+type Resumable struct {
+	ID string
+	// Length is the declared size of the file.
+	Length int64
+	Upload
+	Created time.Time
+
+	// Offset is the amount of received bytes.
+	Offset int64 `json:"-"`
+	dir    string
+}
+
+// locks serialize chunks of the same upload.
+var locks sync.Map
+
+// NewResumable starts an upload of the file of the length.
+func NewResumable(filesDir string, length int64, u Upload) (*Resumable, error) {
+	r := &Resumable{
+		ID:      primitive.NewObjectID().Hex(),
+		Length:  length,
+		Upload:  u,
+		Created: time.Now(),
+		dir:     UploadsDir(filesDir),
+	}
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(r.data(), nil, 0644); err != nil {
+		return nil, err
+	}
+	return r, ioutil.WriteFile(r.info(), b, 0644)
+}
+
+// OpenResumable returns the upload with the ID.
+func OpenResumable(filesDir, id string) (*Resumable, error) {
+	if !primitive.IsValidObjectID(id) {
+		return nil, ErrUploadNotFound
+	}
+	r := &Resumable{dir: UploadsDir(filesDir)}
+	b, err := ioutil.ReadFile(filepath.Join(r.dir, id+".json"))
+	if os.IsNotExist(err) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, r); err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(r.data())
+	if err != nil {
+		return nil, err
+	}
+	r.Offset = stat.Size()
+	return r, nil
+}
+
+func (r *Resumable) info() string {
+	return filepath.Join(r.dir, r.ID+".json")
+}
+
+func (r *Resumable) data() string {
+	return filepath.Join(r.dir, r.ID+".part")
+}
+
+// Append writes the chunk starting at the offset, which must be the
+// amount of received bytes. The received part of the chunk is kept if
+// it is interrupted. Uploads larger than declared must be cancelled.
+func (r *Resumable) Append(offset int64, chunk io.Reader) error {
+	l, _ := locks.LoadOrStore(r.ID, new(sync.Mutex))
+	mu := l.(*sync.Mutex)
+	mu.Lock()
+	defer mu.Unlock()
+
+	f, err := os.OpenFile(r.data(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if r.Offset = stat.Size(); offset != r.Offset {
+		return ErrOffsetMismatch
+	}
+	// a byte more than declared reveals larger chunks
+	n, err := io.Copy(f, io.LimitReader(chunk, r.Length-r.Offset+1))
+	r.Offset += n
+	if err == nil && r.Offset > r.Length {
+		err = ErrUploadTooLarge
+	}
+	return err
+}
+
+// Done reports whether all bytes are received.
+func (r *Resumable) Done() bool {
+	return r.Offset == r.Length
+}
+
+// Complete adds the received file to the files directory, see Add.
+func (r *Resumable) Complete(outputDir string, types *Allowlist) (*File, error) {
+	if !r.Done() {
+		return nil, errors.New("upload is not complete")
+	}
+	defer locks.Delete(r.ID)
+	if err := os.Remove(r.info()); err != nil {
+		return nil, err
+	}
+	return Add(r.data(), outputDir, types, r.Upload)
+}
+
+// Cancel removes the upload.
+func (r *Resumable) Cancel() error {
+	defer locks.Delete(r.ID)
+	os.Remove(r.data())
+	return os.Remove(r.info())
+}
+
+// RemoveStaleUploads removes uploads which haven't received data for
+// the duration, e.g. abandoned ones.
+func RemoveStaleUploads(filesDir string, age time.Duration) error {
+	dir := UploadsDir(filesDir)
+	ff, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fi := range ff {
+		name := fi.Name()
+		if filepath.Ext(name) == ".json" || time.Since(fi.ModTime()) < age {
+			// descriptions are removed with data
+			continue
+		}
+		if filepath.Ext(name) == ".part" {
+			os.Remove(filepath.Join(dir, strings.TrimSuffix(name, ".part")+".json"))
+		}
+		if err = os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
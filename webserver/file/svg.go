@@ -0,0 +1,139 @@
+package file
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+var ErrInvalidSVG = errors.New("invalid SVG image")
+
+// unsafeSVGElements run scripts or embed documents.
+var unsafeSVGElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"handler":       true,
+	"listener":      true,
+}
+
+// safeSVGImages are data URLs which may be referenced by images.
+var safeSVGImages = []string{"data:image/png", "data:image/jpeg", "data:image/gif", "data:image/webp"}
+
+// SanitizeSVG removes scripts, event handlers, embedded documents and
+// links to other documents from the SVG image. Comments and DOCTYPE with
+// its entities are removed too.
+func SanitizeSVG(b []byte) ([]byte, error) {
+	d := xml.NewDecoder(bytes.NewReader(b))
+	d.Entity = xml.HTMLEntity
+	var out bytes.Buffer
+	// open elements are checked as raw tokens aren't, skip is the
+	// depth of elements in a removed element
+	var open []xml.Name
+	var skip int
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, ErrInvalidSVG
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			open = append(open, t.Name)
+			if skip > 0 || unsafeSVGElements[strings.ToLower(t.Name.Local)] {
+				skip++
+				continue
+			}
+			out.WriteString("<" + qualifiedName(t.Name))
+			for _, a := range t.Attr {
+				if !safeSVGAttr(a) {
+					continue
+				}
+				out.WriteString(" " + qualifiedName(a.Name) + `="`)
+				xml.EscapeText(&out, []byte(a.Value))
+				out.WriteString(`"`)
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			if len(open) == 0 || open[len(open)-1] != t.Name {
+				return nil, ErrInvalidSVG
+			}
+			open = open[:len(open)-1]
+			if skip > 0 {
+				skip--
+				continue
+			}
+			out.WriteString("</" + qualifiedName(t.Name) + ">")
+		case xml.CharData:
+			if skip == 0 {
+				xml.EscapeText(&out, t)
+			}
+		case xml.ProcInst:
+			if t.Target == "xml" {
+				out.WriteString("<?xml " + string(t.Inst) + "?>")
+			}
+		}
+	}
+	if len(open) > 0 {
+		return nil, ErrInvalidSVG
+	}
+	return out.Bytes(), nil
+}
+
+// sanitizeSVGFile sanitizes the SVG image in place, see SanitizeSVG.
+func sanitizeSVGFile(name string) error {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if b, err = SanitizeSVG(b); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, b, 0644)
+}
+
+func qualifiedName(n xml.Name) string {
+	if len(n.Space) > 0 {
+		return n.Space + ":" + n.Local
+	}
+	return n.Local
+}
+
+// safeSVGAttr reports whether the attribute neither handles events nor
+// links to other documents or scripts. Links to elements of the image
+// and embedded raster images are safe.
+func safeSVGAttr(a xml.Attr) bool {
+	name := strings.ToLower(a.Name.Local)
+	if strings.HasPrefix(name, "on") {
+		return false
+	}
+	// browsers ignore whitespace and control characters in schemes
+	v := strings.ToLower(strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, a.Value))
+	if strings.Contains(v, "javascript:") || strings.Contains(v, "vbscript:") || strings.Contains(v, "data:text/html") {
+		return false
+	}
+	if name != "href" {
+		return true
+	}
+	if strings.HasPrefix(v, "#") {
+		return true
+	}
+	for _, prefix := range safeSVGImages {
+		if strings.HasPrefix(v, prefix) {
+			return true
+		}
+	}
+	return false
+}
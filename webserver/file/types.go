@@ -0,0 +1,252 @@
+package file
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+var (
+	ErrTypeNotAllowed    = errors.New("files of this type can't be uploaded")
+	ErrExtensionMismatch = errors.New("file extension doesn't match its contents")
+)
+
+// Allowlist lists types of files which can be uploaded for each kind of
+// files. Keys are MIME types sniffed from contents, see Sniff, values
+// are extensions allowed for them. The first extension is given to files
+// without one.
+type Allowlist struct {
+	// Images are resized and stripped of metadata.
+	Images map[string][]string
+	// Files are stored as they are, except that SVG images are
+	// sanitized.
+	Files map[string][]string
+}
+
+// DefaultAllowlist allows common images, audio, video and documents.
+// SVG images are files, because they aren't resized.
+var DefaultAllowlist = Allowlist{
+	Images: map[string][]string{
+		"image/jpeg": {".jpg", ".jpeg"},
+		"image/png":  {".png"},
+		"image/gif":  {".gif"},
+		"image/webp": {".webp"},
+	},
+	Files: map[string][]string{
+		"image/svg+xml":   {".svg"},
+		"application/pdf": {".pdf"},
+		"audio/mpeg":      {".mp3"},
+		"audio/mp4":       {".m4a"},
+		"audio/flac":      {".flac"},
+		"audio/wave":      {".wav"},
+		"application/ogg": {".ogg", ".oga", ".opus", ".ogv"},
+		"video/mp4":       {".mp4", ".m4v", ".m4a"},
+		"video/quicktime": {".mov"},
+		"video/webm":      {".webm"},
+		"text/plain":      {".txt", ".csv", ".srt", ".vtt"},
+		// office documents are zip archives or OLE files
+		"application/zip":           {".zip", ".docx", ".xlsx", ".pptx", ".odt", ".ods", ".odp", ".epub"},
+		"application/x-ole-storage": {".doc", ".xls", ".ppt"},
+	},
+}
+
+// ReadAllowlist reads the allowlist from the JSON file, kinds which
+// aren't set there are allowed by DefaultAllowlist.
+func ReadAllowlist(name string) (*Allowlist, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var a Allowlist
+	if err = json.Unmarshal(b, &a); err != nil {
+		return nil, err
+	}
+	if a.Images == nil {
+		a.Images = DefaultAllowlist.Images
+	}
+	if a.Files == nil {
+		a.Files = DefaultAllowlist.Files
+	}
+	return &a, nil
+}
+
+// Kind returns the kind of files with the extension of the name, ok is
+// false if such files can't be uploaded.
+func (a *Allowlist) Kind(name string) (kind int, ok bool) {
+	ext := strings.ToLower(path.Ext(name))
+	for _, k := range []int{ImageKind, FileKind} {
+		for _, exts := range a.kind(k) {
+			if hasString(exts, ext) {
+				return k, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Check returns the kind of the file of the sniffed MIME type and the
+// extension it is stored with. It returns ErrTypeNotAllowed if the type
+// isn't allowed and ErrExtensionMismatch if the extension of the name
+// isn't one of the type.
+func (a *Allowlist) Check(mimeType, name string) (kind int, ext string, err error) {
+	for _, k := range []int{ImageKind, FileKind} {
+		exts, ok := a.kind(k)[mimeType]
+		if !ok || len(exts) == 0 {
+			continue
+		}
+		ext = strings.ToLower(path.Ext(name))
+		if len(ext) == 0 {
+			return k, exts[0], nil
+		}
+		if !hasString(exts, ext) {
+			return 0, "", ErrExtensionMismatch
+		}
+		return k, ext, nil
+	}
+	return 0, "", ErrTypeNotAllowed
+}
+
+func (a *Allowlist) kind(k int) map[string][]string {
+	if k == ImageKind {
+		return a.Images
+	}
+	return a.Files
+}
+
+func hasString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffLen is the amount of bytes read to sniff types of files.
+const sniffLen = 512
+
+var oleSignature = []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}
+
+// Sniff returns the MIME type of the file by its first bytes without
+// parameters, see http.DetectContentType. It also recognizes SVG images,
+// audio and video formats unknown to the standard library and OLE files
+// of older office documents.
+func Sniff(b []byte) string {
+	if len(b) > sniffLen {
+		b = b[:sniffLen]
+	}
+	switch {
+	case len(b) >= 12 && string(b[:4]) == "RIFF" && string(b[8:12]) == "WEBP":
+		return "image/webp"
+	case len(b) >= 12 && string(b[4:8]) == "ftyp":
+		// ISO media files by their major brands
+		switch string(b[8:12]) {
+		case "avif", "avis":
+			return "image/avif"
+		case "M4A ", "M4B ":
+			return "audio/mp4"
+		case "qt  ":
+			return "video/quicktime"
+		}
+		return "video/mp4"
+	case bytes.HasPrefix(b, []byte("fLaC")):
+		return "audio/flac"
+	case len(b) >= 2 && b[0] == 0xff && b[1]&0xe6 == 0xe2:
+		// a frame of MPEG audio layer III without ID3 tags
+		return "audio/mpeg"
+	case bytes.HasPrefix(b, oleSignature):
+		return "application/x-ole-storage"
+	case isSVG(b):
+		return "image/svg+xml"
+	}
+	t, _, err := mime.ParseMediaType(http.DetectContentType(b))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return t
+}
+
+// SniffFile returns the MIME type of the file, see Sniff.
+func SniffFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return Sniff(b[:n]), nil
+}
+
+// isSVG reports whether the first element of the XML document is svg.
+func isSVG(b []byte) bool {
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	if !bytes.Contains(b, []byte("<svg")) {
+		return false
+	}
+	d := xml.NewDecoder(bytes.NewReader(b))
+	d.Strict = false
+	for {
+		t, err := d.RawToken()
+		if err != nil {
+			return false
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			return t.Name.Local == "svg"
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				return false
+			}
+		}
+	}
+}
+
+// servedTypes are types of files which are opened by browsers, other
+// files are downloaded.
+var servedTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".svg":  "image/svg+xml",
+	".pdf":  "application/pdf",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".flac": "audio/flac",
+	".wav":  "audio/wav",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".opus": "audio/ogg",
+	".ogv":  "video/ogg",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+	".txt":  "text/plain; charset=utf-8",
+	".srt":  "text/plain; charset=utf-8",
+	".vtt":  "text/vtt; charset=utf-8",
+}
+
+// ServedType returns the Content-Type of the uploaded file served to
+// visitors by its extension, inline is false if the file is to be
+// downloaded rather than opened, e.g. HTML uploaded before validation.
+func ServedType(name string) (contentType string, inline bool) {
+	if t, ok := servedTypes[strings.ToLower(path.Ext(name))]; ok {
+		return t, true
+	}
+	return "application/octet-stream", false
+}
@@ -0,0 +1,98 @@
+package file
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSniff(t *testing.T) {
+	tests := []struct {
+		b, want string
+	}{
+		{"\xff\xd8\xff\xe0\x00\x10JFIF", "image/jpeg"},
+		{"RIFF\x00\x00\x00\x00WEBPVP8 ", "image/webp"},
+		{"\x00\x00\x00\x18ftypM4A \x00\x00\x00\x00", "audio/mp4"},
+		{"\x00\x00\x00\x18ftypisom\x00\x00\x00\x00", "video/mp4"},
+		{"\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00", "video/quicktime"},
+		{"ID3\x04\x00", "audio/mpeg"},
+		{"\xff\xfb\x90\x64", "audio/mpeg"},
+		{"fLaC\x00\x00\x00\x22", "audio/flac"},
+		{"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", "application/x-ole-storage"},
+		{"%PDF-1.4", "application/pdf"},
+		{"\xef\xbb\xbf<?xml version=\"1.0\"?>\n<!-- logo -->\n<svg xmlns=\"http://www.w3.org/2000/svg\">", "image/svg+xml"},
+		{"<html><body><svg></svg></body></html>", "text/html"},
+		{"Overture", "text/plain"},
+		{"MZ\x90\x00\x03\x00\x00\x00", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		if got := Sniff([]byte(tt.b)); got != tt.want {
+			t.Errorf("Sniff(%q) = %s, want %s", tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	tests := []struct {
+		mimeType, name string
+		kind           int
+		ext            string
+		err            error
+	}{
+		{"image/jpeg", "Photo.JPEG", ImageKind, ".jpeg", nil},
+		{"image/png", "scan", ImageKind, ".png", nil},
+		{"audio/mp4", "song.m4a", FileKind, ".m4a", nil},
+		{"image/png", "photo.jpg", 0, "", ErrExtensionMismatch},
+		{"text/html", "page.txt", 0, "", ErrTypeNotAllowed},
+	}
+	for _, tt := range tests {
+		kind, ext, err := DefaultAllowlist.Check(tt.mimeType, tt.name)
+		if kind != tt.kind || ext != tt.ext || err != tt.err {
+			t.Errorf("Check(%s, %s) = %d, %s, %v", tt.mimeType, tt.name, kind, ext, err)
+		}
+	}
+	if kind, ok := DefaultAllowlist.Kind("report.PDF"); !ok || kind != FileKind {
+		t.Errorf("PDF is %d, %v", kind, ok)
+	}
+	if _, ok := DefaultAllowlist.Kind("setup.exe"); ok {
+		t.Error("executables are allowed")
+	}
+}
+
+func TestSanitizeSVG(t *testing.T) {
+	svg := `<?xml version="1.0"?>
+<!DOCTYPE svg [<!ENTITY x "y">]>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" onload="alert(1)">
+<!-- comment -->
+<script>alert(2)</script>
+<foreignObject><iframe src="https://example.com"></iframe></foreignObject>
+<style>circle { fill: red }</style>
+<a xlink:href="java&#x09;script:alert(3)"><circle r="5" OnClick="alert(4)"/></a>
+<use href="#c"/><use xlink:href="https://example.com/sprite.svg#icon"/>
+<image href="data:image/png;base64,AAAA" width="1"/>
+</svg>`
+	b, err := SanitizeSVG([]byte(svg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(b)
+	for _, bad := range []string{"alert", "iframe", "example.com", "DOCTYPE", "comment"} {
+		if strings.Contains(got, bad) {
+			t.Errorf("%s is kept: %s", bad, got)
+		}
+	}
+	for _, want := range []string{
+		`<?xml version="1.0"?>`,
+		`<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink">`,
+		`<style>circle { fill: red }</style>`,
+		`<circle r="5"></circle>`,
+		`<use href="#c"></use>`,
+		`<image href="data:image/png;base64,AAAA" width="1"></image>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%s is lost: %s", want, got)
+		}
+	}
+	if _, err = SanitizeSVG([]byte("<svg><g></svg>")); err != ErrInvalidSVG {
+		t.Errorf("broken SVG: got %v", err)
+	}
+}
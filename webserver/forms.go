@@ -1,17 +1,50 @@
 package main
 
 import (
+	"reflect"
+	"strings"
 	"time"
 
 	"github.com/bahna/magazine/webserver/cms"
 	"github.com/bahna/magazine/webserver/user"
-	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/schema"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// newFormDecoder returns a decoder of forms which understands IDs.
+// Empty and invalid IDs are decoded as zero IDs, so that optional
+// selects can be left blank.
+func newFormDecoder() *schema.Decoder {
+	d := schema.NewDecoder()
+	d.RegisterConverter(primitive.NilObjectID, func(s string) reflect.Value {
+		id, _ := primitive.ObjectIDFromHex(s)
+		return reflect.ValueOf(id)
+	})
+	return d
+}
+
 type userForm struct {
 	ID, Email, FirstName, LastName, Password, PasswordConfirm string
 
 	Roles []user.Role
+
+	// public profile
+	Slug    string
+	PhotoID *primitive.ObjectID
+	Links   string
+	Bio     []struct {
+		Language, Text string
+	}
+}
+
+// splitLines returns non-empty trimmed lines of the text.
+func splitLines(s string) (lines []string) {
+	for _, v := range strings.Split(s, "\n") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			lines = append(lines, v)
+		}
+	}
+	return
 }
 
 type userChangePassForm struct {
@@ -19,13 +52,14 @@ type userChangePassForm struct {
 }
 
 type contentForm struct {
-	ID       bson.ObjectId `bson:"_id"`
-	Weight   int
-	Public   bool
-	Promoted bool
-	Slug     string
-	Language string
-	Type     cms.ContentType
+	ID         primitive.ObjectID `bson:"_id"`
+	Weight     int
+	Public     bool
+	Promoted   bool
+	Slug       string
+	SlugLocked bool
+	Language   string
+	Type       cms.ContentType
 
 	// we use it only for schema.Decoder to not complain about invalid path,
 	// this field must be always handled automatically and not from a user form
@@ -37,10 +71,15 @@ type contentForm struct {
 	PageTitle       string
 	PageDescription string
 
-	ParentID *bson.ObjectId
+	ParentID *primitive.ObjectID
 
-	AuthorIDs []*bson.ObjectId
-	TopicIDs  []*bson.ObjectId
+	AuthorIDs      []*primitive.ObjectID
+	Credits        []*cms.Credit
+	PrimaryTopicID primitive.ObjectID
+	TopicIDs       []*primitive.ObjectID
+
+	RelatedPinned   []*primitive.ObjectID
+	RelatedExcluded []*primitive.ObjectID
 
 	Title, Lede, Body, CoverExternal, CoverInternal string
 
@@ -54,3 +93,83 @@ type contentForm struct {
 
 	Payload map[string]interface{}
 }
+
+// contentTopics returns IDs of topics of content with the primary topic
+// going first. The first secondary topic becomes primary if the primary
+// topic is not set.
+func contentTopics(primary primitive.ObjectID, secondary []primitive.ObjectID) []primitive.ObjectID {
+	ids := []primitive.ObjectID{}
+	if !primary.IsZero() {
+		ids = append(ids, primary)
+	}
+	for _, id := range secondary {
+		if !id.IsZero() && id != primary {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// objectIDs returns IDs selected in the form without empty ones.
+func objectIDs(ids []*primitive.ObjectID) []primitive.ObjectID {
+	res := []primitive.ObjectID{}
+	for _, id := range ids {
+		if id != nil && !id.IsZero() {
+			res = append(res, *id)
+		}
+	}
+	return res
+}
+
+// contentCredits returns credits without empty rows of the form and
+// repeated contributors in the same role.
+func contentCredits(credits []*cms.Credit) []*cms.Credit {
+	cc := []*cms.Credit{}
+	seen := map[cms.Credit]bool{}
+	for _, v := range credits {
+		if v == nil || v.ContributorID.IsZero() {
+			continue
+		}
+		k := cms.Credit{ContributorID: v.ContributorID, Role: v.Role}
+		if !seen[k] {
+			seen[k] = true
+			cc = append(cc, v)
+		}
+	}
+	return cc
+}
+
+type contributorForm struct {
+	ID      primitive.ObjectID
+	Name    string
+	Role    cms.CreditRole
+	PhotoID *primitive.ObjectID
+	UserID  *primitive.ObjectID
+	Bio     []struct {
+		Language, Text string
+	}
+}
+
+// splitTags splits comma separated tag titles.
+func splitTags(s string) (tags []string) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			tags = append(tags, v)
+		}
+	}
+	return
+}
+
+// slugHistory returns previous slugs of content after its slug is
+// changed from current to next.
+func slugHistory(old []string, current, next string) []string {
+	history := []string{}
+	seen := map[string]bool{next: true, "": true}
+	for _, v := range append(old, current) {
+		if !seen[v] {
+			seen[v] = true
+			history = append(history, v)
+		}
+	}
+	return history
+}
@@ -1,22 +1,24 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"html/template"
 	"math"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 	"unicode/utf8"
 
-	"github.com/Machiel/slugify"
 	"github.com/bahna/magazine/webserver/cms"
-	"github.com/bahna/magazine/webserver/file"
+	"github.com/bahna/magazine/webserver/imaging"
+	"github.com/bahna/magazine/webserver/slugifier"
 	"github.com/bahna/magazine/webserver/user"
 	"github.com/nicksnyder/go-i18n/i18n"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"golang.org/x/text/language"
 	"golang.org/x/text/language/display"
-	"github.com/globalsign/mgo/bson"
 )
 
 func generateTmplFuncs(app *application) template.FuncMap {
@@ -40,6 +42,9 @@ func generateTmplFuncs(app *application) template.FuncMap {
 		"joinUsers":    JoinUsers,
 		"joinTopics":   JoinTopics,
 		"srcset":       Srcset,
+		"sizes":        Sizes,
+		"percent":      Percent,
+		"cropURL":      CropURL(app.CropVersions),
 		"bytesToMb":    BytesToMb,
 		"dayNumber":    DayNumber,
 		"month":        Month,
@@ -47,6 +52,7 @@ func generateTmplFuncs(app *application) template.FuncMap {
 
 		"mapTopicsToStyles": mapTopicsToStyles,
 		"cutLine":           cutLine,
+		"highlight":         Highlight,
 	}
 	return template.FuncMap(m)
 }
@@ -100,7 +106,7 @@ func Increment(a int) int {
 	return a + 1
 }
 
-func ObjectIDToString(id bson.ObjectId) string {
+func ObjectIDToString(id primitive.ObjectID) string {
 	return id.Hex()
 }
 
@@ -113,7 +119,7 @@ func HasRole(s []user.Role, a int) bool {
 	return false
 }
 
-func HasID(s []bson.ObjectId, id bson.ObjectId) bool {
+func HasID(s []primitive.ObjectID, id primitive.ObjectID) bool {
 	for _, v := range s {
 		if v.Hex() == id.Hex() {
 			return true
@@ -168,39 +174,63 @@ func PubDate(c *cms.Content) string {
 	return c.Published.Format(layout)
 }
 
-func Translit(slug *slugify.Slugifier) func(s string) string {
+func Translit(slug *slugifier.Slugifier) func(s string) string {
 	return func(s string) string {
 		return slug.Slugify(s)
 	}
 }
 
-// Srcset returns strings for HTML srcset attribute.
-func Srcset(f *file.File) ([]string, error) {
-	if f.Kind != file.ImageKind {
-		return nil, errors.New("the file must be an image")
+// Srcset returns a value of the srcset attribute with resized versions
+// of the uploaded image at the URL in the format, an empty format keeps
+// the original one. Versions are limited by the width of the original
+// image, zero width means unknown. It returns an empty string for other
+// images.
+func Srcset(src string, width int, format string) string {
+	set := []string{}
+	for _, w := range imaging.WidthsUpTo(width) {
+		u, ok := imageURL(src, imaging.Params{Width: w, Format: format})
+		if !ok {
+			return ""
+		}
+		set = append(set, fmt.Sprintf("%s %dw", u, w))
 	}
+	return strings.Join(set, ", ")
+}
 
-	if len(f.Optimized) == 0 {
-		return []string{f.URL}, nil
+// CropURL returns a function which returns a URL of the named crop of
+// the uploaded image at the URL resized to the width, crops follow the
+// focus of the image set by editors. The URL has the version of crops
+// of the image, so it changes with them. Other images are returned as
+// is.
+func CropURL(versions *cropVersions) func(src, crop string, width int) string {
+	return func(src, crop string, width int) string {
+		p := imaging.Params{Width: width, Crop: crop}
+		if id, ok := imageID(src); ok {
+			p.Version = versions.Get(id)
+		}
+		if u, ok := imageURL(src, p); ok {
+			return u
+		}
+		return src
 	}
+}
 
-	//log.Printf("file img: %+v", img)
+// mdBreakpoint is the width of the md- classes of basscss.
+const mdBreakpoint = "52em"
 
-	set := []string{}
-	comma := ", "
-	suffix := ""
-	for i, v := range f.Optimized {
-		if i == len(f.Optimized)-1 {
-			comma = ""
-		}
-		if strings.Contains(v.URL, "@2x") {
-			suffix = " 2x"
-		}
-		set = append(set, v.URL+suffix+comma)
+// Sizes returns a value of the sizes attribute of an image which takes
+// the amount of columns of the 12 column grid on medium and larger
+// screens and the whole width on small ones.
+func Sizes(columns int) string {
+	if columns <= 0 || columns >= 12 {
+		return "100vw"
 	}
+	return fmt.Sprintf("(min-width: %s) %.4gvw, 100vw", mdBreakpoint, float64(columns)*100/12)
+}
 
-	//log.Printf("srcset: %+v", set)
-	return set, nil
+// Percent formats a fraction as a percent for number inputs.
+func Percent(f float64) string {
+	return strconv.FormatFloat(math.Round(f*1000)/10, 'f', -1, 64)
 }
 
 func BytesToMb(i int64) string {
@@ -236,3 +266,93 @@ func JoinTopics(topics []*cms.Topic, delim string) string {
 	}
 	return strings.Join(s, delim)
 }
+
+// markdownSyntax matches images, links and formatting characters of
+// Markdown which must not appear in search snippets.
+var markdownSyntax = regexp.MustCompile(`!\[[^\]]*\]\([^)]*\)|\]\([^)]*\)|[#*_>\[\]` + "`" + `]+`)
+
+// Highlight returns a snippet of the text around the first word from
+// the search query with all query words wrapped into <mark>. Words are
+// matched by their beginning to catch different word forms.
+func Highlight(text, query string, n int) template.HTML {
+	text = strings.Join(strings.Fields(markdownSyntax.ReplaceAllString(text, " ")), " ")
+	rr := []rune(text)
+	lower := []rune(strings.ToLower(text))
+	if len(lower) != len(rr) {
+		lower = rr // lowercasing changed the length, match case-sensitively
+	}
+
+	var terms [][]rune
+	for _, w := range strings.Fields(strings.ToLower(query)) {
+		w = strings.Trim(w, `"-+.,:;!?()«»`)
+		t := []rune(w)
+		if len(t) > 5 {
+			t = t[:len(t)-2] // a rough stem
+		}
+		if len(t) > 1 {
+			terms = append(terms, t)
+		}
+	}
+
+	// marks[i] is the length of a term matched at i
+	marks := make(map[int]int)
+	first := -1
+	for i := range lower {
+		if i > 0 && (unicode.IsLetter(lower[i-1]) || unicode.IsDigit(lower[i-1])) {
+			continue // match beginnings of words only
+		}
+		for _, t := range terms {
+			if hasRunePrefix(lower[i:], t) {
+				marks[i] = len(t)
+				if first < 0 {
+					first = i
+				}
+				break
+			}
+		}
+	}
+
+	start := 0
+	if first > n/3 {
+		start = first - n/3
+		for start < first && !unicode.IsSpace(rr[start]) {
+			start++
+		}
+	}
+	end := start + n
+	if end > len(rr) {
+		end = len(rr)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := start; i < end; {
+		if l, ok := marks[i]; ok {
+			b.WriteString("<mark>")
+			b.WriteString(template.HTMLEscapeString(string(rr[i : i+l])))
+			b.WriteString("</mark>")
+			i += l
+			continue
+		}
+		b.WriteString(template.HTMLEscapeString(string(rr[i])))
+		i++
+	}
+	if end < len(rr) {
+		b.WriteString("…")
+	}
+	return template.HTML(b.String())
+}
+
+func hasRunePrefix(s, prefix []rune) bool {
+	if len(s) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if s[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"html/template"
+	"testing"
+)
+
+func TestHighlight(t *testing.T) {
+	const words = "aaa bbb ccc ddd eee fff ggg hhh"
+
+	tests := []struct {
+		name, text, query string
+		n                 int
+		want              template.HTML
+	}{
+		{"markdown", "## Concert in **the** [park](http://example.com)", "park", 100, "Concert in the <mark>park</mark>"},
+		{"image", "![Stage](/files/1.jpg) Concert", "stage concert", 100, "<mark>Conce</mark>rt"},
+		{"case", "Concert in the park", "CONCERT", 100, "<mark>Conce</mark>rt in the park"},
+		{"stem", "Канцэрты ў парку", "канцэрт парку", 100, "<mark>Канцэ</mark>рты ў <mark>парку</mark>"},
+		{"word beginnings", "superconcert concert", "concert", 100, "superconcert <mark>conce</mark>rt"},
+		{"short words", "a concert", "a", 100, "a concert"},
+		{"punctuation", "Concert in the park", `"park",`, 100, "Concert in the <mark>park</mark>"},
+		{"escaping", "Tom & <Jerry", "jerry", 100, "Tom &amp; &lt;<mark>Jerry</mark>"},
+		{"no match", words, "zzz", 7, "aaa bbb…"},
+		{"trailing ellipsis", words, "aaa", 8, "<mark>aaa</mark> bbb …"},
+		{"leading ellipsis", words, "hhh", 9, "… <mark>hhh</mark>"},
+		{"both ellipses", words, "eee", 9, "… <mark>eee</mark> fff …"},
+	}
+	for _, tt := range tests {
+		if got := Highlight(tt.text, tt.query, tt.n); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -2,31 +2,40 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"log"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bahna/magazine/webserver/cms"
 	"github.com/bahna/magazine/webserver/file"
+	"github.com/bahna/magazine/webserver/imaging"
+	"github.com/bahna/magazine/webserver/locale"
 	"github.com/bahna/magazine/webserver/mail"
-	"github.com/bahna/magazine/webserver/mongo"
+	"github.com/bahna/magazine/webserver/pagecache"
+	"github.com/bahna/magazine/webserver/search"
+	"github.com/bahna/magazine/webserver/store"
 	"github.com/bahna/magazine/webserver/user"
-	"github.com/globalsign/mgo/bson"
 	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"golang.org/x/text/language"
 )
 
 // topicWithAmount is a wrapper struct to extend cms.Topic type with
-// Amount field.
+// Amount field and the Depth of nesting.
 type topicWithAmount struct {
 	*cms.Topic
 	Amount int
+	Depth  int
 }
 
 func adminDeleteHandler(app *application) http.Handler {
@@ -36,25 +45,69 @@ func adminDeleteHandler(app *application) http.Handler {
 		colname := vars["colname"]
 		id := vars["id"]
 
+		// files aren't deleted here, adminDeleteFileHandler checks
+		// their usage and removes them from the disk
+		deletes := map[string]func(context.Context, primitive.ObjectID) error{
+			"content":      app.Store.Content.Delete,
+			"topics":       app.Store.Topics.Delete,
+			"users":        app.Store.Users.Delete,
+			"contributors": app.Store.Contributors.Delete,
+			"redirects":    app.Store.Redirects.Delete,
+		}
+		del, ok := deletes[colname]
+		if !ok || !primitive.IsValidObjectID(id) {
+			http.NotFound(w, r)
+			return
+		}
+
 		// TODO: add check for dependent items
 		switch colname {
 		case "users":
-			// get user
-			u := new(user.User)
-			err := mongo.GetID(app.Db.C("users"), id, u)
+			u, err := app.Store.Users.Get(r.Context(), objectIDHex(id))
 			Check(err)
 			// check dependent content
-			items, err := cms.AllContentLimited(app.Db, bson.M{"authorids": u.ID}, 0)
+			n, err := app.Store.Content.Count(r.Context(), store.ContentQuery{AuthorID: u.ID})
+			Check(err)
+			if n > 0 {
+				err = ErrDependentContentExist
+				Check(err)
+				return
+			}
+		case "contributors":
+			n, err := app.Store.Content.Count(r.Context(), store.ContentQuery{ContributorIDs: []primitive.ObjectID{objectIDHex(id)}})
+			Check(err)
+			if n > 0 {
+				err = ErrDependentContentExist
+				Check(err)
+				return
+			}
+		case "topics":
+			// subsections must be moved or removed first
+			tt, err := app.Store.Topics.All(r.Context(), store.TopicQuery{ParentID: objectIDHex(id)})
 			Check(err)
-			if len(items) > 0 {
+			if len(tt) > 0 {
 				err = ErrDependentContentExist
 				Check(err)
 				return
 			}
 		}
 
-		err := mongo.Delete(app.Db.C(colname), id)
+		err := del(r.Context(), objectIDHex(id))
 		Check(err)
+		invalidatePages(app)
+
+		switch colname {
+		case "content":
+			err = app.Search.Delete(id)
+			Check(err)
+			app.SuggestionUpdates.Schedule()
+			app.Related.Invalidate()
+		case "topics":
+			app.SuggestionUpdates.Schedule()
+		case "redirects":
+			err = app.Redirects.Reload(r.Context())
+			Check(err)
+		}
 
 		url, err := app.Router.Get(colname).URL("lang", lang.String())
 		Check(err)
@@ -70,6 +123,11 @@ func adminIndexHandler(app *application) http.Handler {
 		page := Page{
 			CurrentUser: app.CurrentUser,
 			Language:    lang,
+			Data: struct {
+				PageCache pagecache.Stats
+			}{
+				PageCache: app.Pages.Stats(),
+			},
 		}
 		Render(app.Templates["admin/index"], lang, w, page)
 	})
@@ -80,17 +138,18 @@ func adminListTopicsHandler(app *application) http.Handler {
 		vars := mux.Vars(r)
 		lang := LangMust(app.LangMatcher, vars["lang"], r)
 
-		app.Db.Session.Refresh()
-		topics, err := cms.AllTopics(app.Db, nil)
+		topics, err := app.Store.Topics.All(r.Context(), store.TopicQuery{})
 		Check(err)
+		topics = sortTopicTree(topics)
 
 		tt := make([]topicWithAmount, len(topics))
 		for i, v := range topics {
-			n, err := app.Db.C("content").Find(bson.M{"topicids": v.ID}).Count()
+			n, err := app.Store.Content.Count(r.Context(), store.ContentQuery{TopicIDs: []primitive.ObjectID{v.ID}})
 			Check(err)
 			tt[i] = topicWithAmount{
 				Topic:  v,
 				Amount: n,
+				Depth:  strings.Count(v.Path, "/"),
 			}
 		}
 
@@ -114,12 +173,18 @@ func adminNewTopicHandler(app *application) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		lang := LangMust(app.LangMatcher, vars["lang"], r)
+
+		tt, err := app.Store.Topics.All(r.Context(), store.TopicQuery{})
+		Check(err)
+
 		page := Page{
 			CurrentUser: app.CurrentUser,
 			Language:    lang,
 			Data: struct {
+				Parents            []*cms.Topic
 				AvailableLanguages []language.Tag
 			}{
+				Parents:            sortTopicTree(tt),
 				AvailableLanguages: app.Langs,
 			},
 		}
@@ -132,18 +197,35 @@ func adminEditTopicHandler(app *application) http.Handler {
 		vars := mux.Vars(r)
 		lang := LangMust(app.LangMatcher, vars["lang"], r)
 
-		app.Db.Session.Refresh()
-		t, err := cms.GetTopic(app.Db, vars["id"])
+		if !primitive.IsValidObjectID(vars["id"]) {
+			http.NotFound(w, r)
+			return
+		}
+		t, err := app.Store.Topics.Get(r.Context(), objectIDHex(vars["id"]))
+		Check(err)
+
+		// the topic and its subsections can't be its parents
+		descendants, err := app.Store.Topics.Descendants(r.Context(), t.ID)
 		Check(err)
+		all, err := app.Store.Topics.All(r.Context(), store.TopicQuery{})
+		Check(err)
+		tt := []*cms.Topic{}
+		for _, v := range all {
+			if v.ID != t.ID && !HasID(descendants, v.ID) {
+				tt = append(tt, v)
+			}
+		}
 
 		page := Page{
 			CurrentUser: app.CurrentUser,
 			Language:    lang,
 			Data: struct {
 				Topic              *cms.Topic
+				Parents            []*cms.Topic
 				AvailableLanguages []language.Tag
 			}{
 				Topic:              t,
+				Parents:            sortTopicTree(tt),
 				AvailableLanguages: app.Langs,
 			},
 		}
@@ -164,15 +246,48 @@ func adminSaveTopicHandler(app *application) http.Handler {
 			t.LanguageOverride = "ru"
 		}
 
-		// new item doesn't have an ID
-		if t.ID == bson.ObjectId("") {
-			t.ID = bson.NewObjectId()
+		// new item doesn't have an ID, existing one keeps its place
+		// which is changed by dragging in the list of topics
+		langs := []string{t.Language}
+		if t.ID.IsZero() {
+			t.ID = primitive.NewObjectID()
+		} else {
+			old, err := app.Store.Topics.Get(r.Context(), t.ID)
+			Check(err)
+			langs = append(langs, old.Language)
+			t.Weight = old.Weight
+			// UpdateTopicPaths moves the current path to the old ones
+			// if the slug or the parent is changed
+			t.Path = old.Path
+			t.OldPaths = old.OldPaths
+		}
+
+		if t.ParentID != nil && t.ParentID.IsZero() {
+			t.ParentID = nil
+		}
+		err = checkTopicTree(r.Context(), app.Store.Topics, t)
+		if err == cms.ErrTopicCycle || err == cms.ErrTopicLanguage {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+		Check(err)
 
-		t.Slug = app.Transliterator.Slugify(t.Title)
+		t.Slug = app.Transliterator.SlugifyLang(t.Language, t.Title)
+		t.Slug, err = uniqueTopicSlug(r.Context(), app.Store, t)
+		if err == errReservedTopicSlug {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		Check(err)
 
-		err = mongo.Save(app.Db.C("topics"), bson.M{"_id": t.ID}, t)
+		err = app.Store.Topics.Save(r.Context(), t)
+		Check(err)
+		err = app.Store.Topics.UpdatePaths(r.Context())
 		Check(err)
+		invalidatePages(app, langs...)
+		err = updateSearch(r.Context(), app.Store, app.Search, store.ContentQuery{TopicIDs: []primitive.ObjectID{t.ID}})
+		Check(err)
+		app.SuggestionUpdates.Schedule()
 
 		vars := mux.Vars(r)
 		lang := LangMust(app.LangMatcher, vars["lang"], r)
@@ -184,6 +299,30 @@ func adminSaveTopicHandler(app *application) http.Handler {
 	})
 }
 
+// adminOrderTopicsHandler saves the order of topics dragged in the
+// list of topics. IDs are posted in the new order.
+func adminOrderTopicsHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		Check(err)
+
+		ids := make([]primitive.ObjectID, 0, len(r.PostForm["ID"]))
+		for _, s := range r.PostForm["ID"] {
+			if !primitive.IsValidObjectID(s) {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			ids = append(ids, objectIDHex(s))
+		}
+
+		err = app.Store.Topics.Order(r.Context(), ids)
+		Check(err)
+		invalidatePages(app)
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
 func adminListContentHandler(app *application) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -196,8 +335,8 @@ func adminListContentHandler(app *application) http.Handler {
 		var tt []*cms.Topic
 		var currentType cms.ContentType
 
-		if s := r.Form.Get("topic"); len(s) > 0 {
-			t, err = cms.GetTopic(app.Db, s)
+		if s := r.Form.Get("topic"); primitive.IsValidObjectID(s) {
+			t, err = app.Store.Topics.Get(r.Context(), objectIDHex(s))
 			Check(err)
 		}
 
@@ -207,16 +346,15 @@ func adminListContentHandler(app *application) http.Handler {
 			currentType = cms.ContentType(n)
 		}
 
-		app.Db.Session.Refresh()
-		tt, err = cms.AllTopics(app.Db, nil)
+		tt, err = app.Store.Topics.All(r.Context(), store.TopicQuery{})
 		Check(err)
 
 		// get content by topic if specified
-		var q bson.M
+		var q store.ContentQuery
 		if t != nil {
-			q = bson.M{"topicids": t.ID}
+			q.TopicIDs = []primitive.ObjectID{t.ID}
 		}
-		cc, err := cms.AllContentLimited(app.Db, q, 0)
+		cc, err := app.Store.Content.Find(r.Context(), q)
 		Check(err)
 
 		page := Page{
@@ -252,8 +390,8 @@ func adminFilterContentHandler(app *application) http.Handler {
 		var tt []*cms.Topic
 		var currentType *cms.ContentType
 
-		if s := r.Form.Get("topic"); len(s) > 0 {
-			t, err = cms.GetTopic(app.Db, s)
+		if s := r.Form.Get("topic"); primitive.IsValidObjectID(s) {
+			t, err = app.Store.Topics.Get(r.Context(), objectIDHex(s))
 			Check(err)
 		}
 
@@ -264,25 +402,18 @@ func adminFilterContentHandler(app *application) http.Handler {
 			currentType = &ct
 		}
 
-		app.Db.Session.Refresh()
-		tt, err = cms.AllTopics(app.Db, nil)
+		tt, err = app.Store.Topics.All(r.Context(), store.TopicQuery{})
 		Check(err)
 
-		var q interface{}
-
-		and := []bson.M{}
+		var q store.ContentQuery
 		if t != nil {
-			and = append(and, bson.M{"topicids": t.ID})
+			q.TopicIDs = []primitive.ObjectID{t.ID}
 		}
 		if currentType != nil {
-			and = append(and, bson.M{"type": currentType})
-		}
-
-		if len(and) > 0 {
-			q = bson.M{"$and": and}
+			q.Types = []cms.ContentType{*currentType}
 		}
 
-		cc, err := cms.AllContentLimited(app.Db, q, 0)
+		cc, err := app.Store.Content.Find(r.Context(), q)
 		Check(err)
 
 		page := Page{
@@ -306,23 +437,24 @@ func adminFilterContentHandler(app *application) http.Handler {
 	})
 }
 
+// seriesQuery selects series which content can be added to.
+var seriesQuery = store.ContentQuery{Types: []cms.ContentType{cms.ArticleSeries}, Public: true}
+
 func adminNewContentHandler(app *application) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		lang := LangMust(app.LangMatcher, vars["lang"], r)
 
-		app.Db.Session.Refresh()
+		uu, err := app.Store.Users.All(r.Context())
+		Check(err)
 
-		uu, err := cms.AllUsers(app.Db.C("users"), nil)
+		tt, err := app.Store.Topics.All(r.Context(), store.TopicQuery{})
 		Check(err)
 
-		tt, err := cms.AllTopics(app.Db, nil)
+		cc, err := app.Store.Contributors.All(r.Context())
 		Check(err)
 
-		series, err := cms.AllContent(app.Db, bson.M{
-			"type":   cms.ArticleSeries,
-			"public": true,
-		})
+		series, err := app.Store.Content.Find(r.Context(), seriesQuery)
 		Check(err)
 
 		page := Page{
@@ -334,12 +466,20 @@ func adminNewContentHandler(app *application) http.Handler {
 				AvailableLanguages []language.Tag
 				ContentTypes       []cms.ContentType
 				ContentParents     []*cms.Content
+				Contributors       []*cms.Contributor
+				CreditRoles        []cms.CreditRole
+				Credits            []*cms.Credit
+				Error              string
 			}{
 				Users:              uu,
 				Topics:             tt,
 				AvailableLanguages: app.Langs,
 				ContentTypes:       cms.ContentTypes,
 				ContentParents:     series,
+				Contributors:       cc,
+				CreditRoles:        cms.CreditRoles,
+				Credits:            []*cms.Credit{{}, {}},
+				Error:              r.URL.Query().Get("error"),
 			},
 		}
 		Render(app.Templates["admin/content/new"], lang, w, page)
@@ -352,20 +492,39 @@ func adminEditContentHandler(app *application) http.Handler {
 		lang := LangMust(app.LangMatcher, vars["lang"], r)
 
 		if r.Method == "GET" {
-			c := new(cms.Content)
-			err := mongo.GetID(app.Db.C("content"), vars["id"], c)
+			c, err := app.Store.Content.Get(r.Context(), objectIDHex(vars["id"]))
+			Check(err)
 
-			uu, err := cms.AllUsers(app.Db.C("users"), nil)
+			c.Tags, err = app.Store.Tags.ByIDs(r.Context(), c.TagIDs)
 			Check(err)
 
-			tt, err := cms.AllTopics(app.Db, nil)
+			// blank rows to credit more contributors
+			c.Credits = append(c.Credits, &cms.Credit{}, &cms.Credit{})
+
+			uu, err := app.Store.Users.All(r.Context())
+			Check(err)
+
+			tt, err := app.Store.Topics.All(r.Context(), store.TopicQuery{})
+			Check(err)
+
+			cc, err := app.Store.Contributors.All(r.Context())
+			Check(err)
+
+			series, err := app.Store.Content.Find(r.Context(), seriesQuery)
 			Check(err)
 
-			series, err := cms.AllContent(app.Db, bson.M{
-				"type":   cms.ArticleSeries,
-				"public": true,
+			// candidates to pin or exclude from related content
+			titles, err := app.Store.Content.Titles(r.Context(), store.ContentQuery{
+				Language: c.Language,
+				Public:   true,
 			})
 			Check(err)
+			rc := []*cms.Content{}
+			for _, v := range titles {
+				if v.ID != c.ID {
+					rc = append(rc, v)
+				}
+			}
 
 			log.Printf("series: %+v, query: type %v lang %v", series, cms.ArticleSeries, lang.String())
 
@@ -379,6 +538,10 @@ func adminEditContentHandler(app *application) http.Handler {
 					AvailableLanguages []language.Tag
 					ContentTypes       []cms.ContentType
 					ContentParents     []*cms.Content
+					RelatedCandidates  []*cms.Content
+					Contributors       []*cms.Contributor
+					CreditRoles        []cms.CreditRole
+					Error              string
 				}{
 					Content:            c,
 					Users:              uu,
@@ -386,6 +549,10 @@ func adminEditContentHandler(app *application) http.Handler {
 					AvailableLanguages: app.Langs,
 					ContentTypes:       cms.ContentTypes,
 					ContentParents:     series,
+					RelatedCandidates:  rc,
+					Contributors:       cc,
+					CreditRoles:        cms.CreditRoles,
+					Error:              r.URL.Query().Get("error"),
 				},
 			}
 			Render(app.Templates["admin/content/edit"], lang, w, page)
@@ -409,11 +576,49 @@ func adminEditContentHandler(app *application) http.Handler {
 
 		r.PostForm.Set("Created", r.PostFormValue("Created")+":00+03:00")
 
+		// tags are created from titles separately from the content
+		tags := splitTags(r.PostFormValue("Tags"))
+		r.PostForm.Del("Tags")
+
 		cf := new(contentForm)
 		err = app.FormDecoder.Decode(cf, r.PostForm)
 		Check(err)
 
-		slug := app.Transliterator.Slugify(cf.Title)
+		var secondary []primitive.ObjectID
+		for _, id := range cf.TopicIDs {
+			if id != nil {
+				secondary = append(secondary, *id)
+			}
+		}
+		topicIDs := contentTopics(cf.PrimaryTopicID, secondary)
+
+		tagIDs, err := app.Store.Tags.Create(r.Context(), cf.Language, tags, app.Transliterator.For(cf.Language))
+		Check(err)
+
+		c, err := app.Store.Content.Get(r.Context(), objectIDHex(vars["id"]))
+		Check(err)
+		oldLanguage := c.Language
+
+		// a locked slug is kept or set by hand, otherwise it follows
+		// the title
+		slug := app.Transliterator.SlugifyLang(cf.Language, cf.Title)
+		if cf.SlugLocked {
+			slug = c.Slug
+			if s := app.Transliterator.SlugifyLang(cf.Language, cf.Slug); len(s) > 0 {
+				slug = s
+			}
+		}
+
+		// a taken slug gets a suffix, an editor is notified if the
+		// slug has been set by hand
+		var primaryTopicID primitive.ObjectID
+		if len(topicIDs) > 0 {
+			primaryTopicID = topicIDs[0]
+		}
+		free, err := uniqueSlug(r.Context(), app.Store, cf.Language, primaryTopicID, slug, c.ID)
+		Check(err)
+		slugTaken := cf.SlugLocked && free != slug
+		slug = free
 
 		// var lede, body string
 		// if body, err = typograf.Typogrify(cf.Body); err != nil {
@@ -438,52 +643,71 @@ func adminEditContentHandler(app *application) http.Handler {
 			pageDescription = cf.PageDescription
 		}
 
-		var parentID *bson.ObjectId
-		if cf.ParentID.Valid() {
+		var parentID *primitive.ObjectID
+		if cf.ParentID != nil && !cf.ParentID.IsZero() {
 			parentID = cf.ParentID
 		}
 
-		cnt := map[string]interface{}{
-			"weight":          cf.Weight,
-			"public":          cf.Public,
-			"type":            cf.Type,
-			"promoted":        cf.Promoted,
-			"language":        cf.Language,
-			"scheduled":       cf.Scheduled,
-			"updated":         updated,
-			"published":       pubtime,
-			"slug":            slug,
-			"pageslug":        cf.PageSlug,
-			"pagetitle":       pageTitle,
-			"pagedescription": pageDescription,
-			"parentid":        parentID,
-			"authorids":       cf.AuthorIDs,
-			"topicids":        cf.TopicIDs,
-			"title":           cf.Title,
-			"lede":            cf.Lede,
-			"body":            cf.Body,
-			"coverexternal":   cf.CoverExternal,
-			"coverinternal":   cf.CoverInternal,
-			"payload":         cf.Payload,
-			"images":          cf.Images,
-			"eventstart":      cf.EventStart,
-			"location":        cf.Location,
-			"linkto":          cf.LinkTo,
-		}
+		c.Weight = cf.Weight
+		c.Public = cf.Public
+		c.Type = cf.Type
+		c.Promoted = cf.Promoted
+		c.Language = cf.Language
+		c.Scheduled = cf.Scheduled
+		c.Updated = updated
+		c.Published = pubtime
+		c.OldSlugs = slugHistory(c.OldSlugs, c.Slug, slug)
+		c.Slug = slug
+		c.SlugLocked = cf.SlugLocked
+		c.PageSlug = cf.PageSlug
+		c.PageTitle = pageTitle
+		c.PageDescription = pageDescription
+		c.ParentID = parentID
+		c.AuthorIDs = objectIDs(cf.AuthorIDs)
+		c.Credits = contentCredits(cf.Credits)
+		c.TopicIDs = topicIDs
+		c.PrimaryTopicID = primaryTopicID
+		c.TagIDs = tagIDs
+		c.RelatedPinned = objectIDs(cf.RelatedPinned)
+		c.RelatedExcluded = objectIDs(cf.RelatedExcluded)
+		c.Title = cf.Title
+		c.Lede = cf.Lede
+		c.Body = cf.Body
+		c.CoverExternal = cf.CoverExternal
+		c.CoverInternal = cf.CoverInternal
+		c.Payload = cf.Payload
+		c.Images = make([]cms.Image, len(cf.Images))
+		for i, v := range cf.Images {
+			c.Images[i] = cms.Image{URL: v.URL, Caption: v.Caption, LinkTo: v.LinkTo}
+		}
+		c.EventStart = cf.EventStart
+		c.Location = cf.Location
+		c.LinkTo = cf.LinkTo
 
 		// be is unsupported by mongodb and causes language_override error
 		if cf.Language == "be" {
-			cnt["language_override"] = "ru"
+			c.LanguageOverride = "ru"
 		}
 
-		c := new(cms.Content)
-		err = mongo.GetID(app.Db.C("content"), vars["id"], c)
+		err = app.Store.Content.Save(r.Context(), c)
+		if err == store.ErrDuplicate {
+			// the slug has been taken by content saved meanwhile
+			http.Redirect(w, r, r.URL.Path+"?error=slug_taken", http.StatusSeeOther)
+			return
+		}
 		Check(err)
-		err = mongo.UpdateID(app.Db.C("content"), vars["id"], cnt, c)
+		err = updateSearch(r.Context(), app.Store, app.Search, store.ContentQuery{IDs: []primitive.ObjectID{c.ID}})
 		Check(err)
+		app.SuggestionUpdates.Schedule()
+		app.Related.Invalidate()
+		invalidatePages(app, oldLanguage, c.Language)
 
 		//url, err := app.Router.Get("content").URL("lang", lang.String())
 		//Check(err)
+		if slugTaken {
+			http.Redirect(w, r, r.URL.Path+"?error=slug_taken", http.StatusSeeOther)
+			return
+		}
 		http.Redirect(w, r, r.URL.String(), http.StatusSeeOther)
 	})
 }
@@ -506,17 +730,38 @@ func adminCreateContentHandler(app *application) http.Handler {
 
 		// TODO: parse cover as image
 
+		// tags are created from titles separately from the content
+		tags := splitTags(r.PostFormValue("Tags"))
+		r.PostForm.Del("Tags")
+
 		c := new(cms.Content)
 		err = app.FormDecoder.Decode(c, r.PostForm)
 		Check(err)
+
+		c.TopicIDs = contentTopics(c.PrimaryTopicID, c.TopicIDs)
+		if len(c.TopicIDs) > 0 {
+			c.PrimaryTopicID = c.TopicIDs[0]
+		}
+
+		c.TagIDs, err = app.Store.Tags.Create(r.Context(), c.Language, tags, app.Transliterator.For(c.Language))
+		Check(err)
+		c.Credits = contentCredits(c.Credits)
 		// be is unsupported by mongodb and causes language_override error
 		if c.Language == "be" {
 			c.LanguageOverride = "ru"
 		}
 
-		c.ID = bson.NewObjectId()
+		c.ID = primitive.NewObjectID()
 		c.Created = time.Now()
-		c.Slug = app.Transliterator.Slugify(c.Title)
+		if s := app.Transliterator.SlugifyLang(c.Language, c.Slug); c.SlugLocked && len(s) > 0 {
+			c.Slug = s
+		} else {
+			c.Slug = app.Transliterator.SlugifyLang(c.Language, c.Title)
+		}
+		slug, err := uniqueSlug(r.Context(), app.Store, c.Language, c.PrimaryTopicID, c.Slug, c.ID)
+		Check(err)
+		slugTaken := c.SlugLocked && slug != c.Slug
+		c.Slug = slug
 
 		c.Published = LatestTime(c.Created, c.Scheduled)
 
@@ -528,14 +773,29 @@ func adminCreateContentHandler(app *application) http.Handler {
 			c.PageDescription = c.Lede
 		}
 
-		if !c.ParentID.Valid() {
+		if c.ParentID != nil && c.ParentID.IsZero() {
 			c.ParentID = nil
 		}
 
-		err = mongo.Save(app.Db.C("content"), bson.M{"_id": c.ID}, c)
+		lang := LangMust(app.LangMatcher, vars["lang"], r)
+		err = app.Store.Content.Save(r.Context(), c)
+		if err == store.ErrDuplicate {
+			// the slug has been taken by content saved meanwhile
+			http.Redirect(w, r, fmt.Sprintf("/%s/admin/content/new?error=slug_taken", lang.String()), http.StatusSeeOther)
+			return
+		}
+		Check(err)
+		err = updateSearch(r.Context(), app.Store, app.Search, store.ContentQuery{IDs: []primitive.ObjectID{c.ID}})
 		Check(err)
+		app.SuggestionUpdates.Schedule()
+		app.Related.Invalidate()
+		invalidatePages(app, c.Language)
 
-		lang := LangMust(app.LangMatcher, vars["lang"], r)
+		if slugTaken {
+			// the editor fixes the slug set by hand
+			http.Redirect(w, r, fmt.Sprintf("/%s/admin/content/edit/%s?error=slug_taken", lang.String(), c.ID.Hex()), http.StatusSeeOther)
+			return
+		}
 		url, err := app.Router.Get("content").URL("lang", lang.String())
 		Check(err)
 		http.Redirect(w, r, url.String(), http.StatusSeeOther)
@@ -547,7 +807,7 @@ func adminUsersHandler(app *application) http.Handler {
 		vars := mux.Vars(r)
 		lang := LangMust(app.LangMatcher, vars["lang"], r)
 
-		uu, err := cms.AllUsers(app.Db.C("users"), nil)
+		uu, err := app.Store.Users.All(r.Context())
 		Check(err)
 		page := Page{
 			CurrentUser: app.CurrentUser,
@@ -594,8 +854,12 @@ func adminCreateUserHandler(app *application) http.Handler {
 
 		u, err := user.New(uf.Password, uf.Email, uf.FirstName, uf.LastName, uf.Roles, app.Config.Secret)
 		Check(err)
+		if cms.CanBeAuthor(u) {
+			u.Slug, err = uniqueUserSlug(r.Context(), app.Store.Users, app.Transliterator.Slugify(u.FirstName+" "+u.LastName), u.ID)
+			Check(err)
+		}
 
-		err = mongo.Save(app.Db.C("users"), bson.M{"_id": u.ID}, u)
+		err = app.Store.Users.Save(r.Context(), u)
 		Check(err)
 
 		url, err := app.Router.Get("users").URL("lang", lang.String())
@@ -610,19 +874,25 @@ func adminEditUserHandler(app *application) http.Handler {
 		lang := LangMust(app.LangMatcher, vars["lang"], r)
 
 		if r.Method == "GET" {
-			u := new(user.User)
-			err := mongo.GetID(app.Db.C("users"), vars["id"], u)
+			u, err := app.Store.Users.Get(r.Context(), objectIDHex(vars["id"]))
+			Check(err)
+
+			photos, err := currentPhotos(r.Context(), app.Store.Files, u.PhotoID)
 			Check(err)
 
 			page := Page{
 				CurrentUser: app.CurrentUser,
 				Language:    lang,
 				Data: struct {
-					Roles []user.Role
-					User  *user.User
+					Roles              []user.Role
+					User               *user.User
+					Photos             []*file.File
+					AvailableLanguages []language.Tag
 				}{
-					Roles: user.Roles,
-					User:  u,
+					Roles:              user.Roles,
+					User:               u,
+					Photos:             photos,
+					AvailableLanguages: app.Langs,
 				},
 			}
 			Render(app.Templates["admin/users/edit"], lang, w, page)
@@ -640,15 +910,48 @@ func adminEditUserHandler(app *application) http.Handler {
 				Check(user.ErrPasswordMatch)
 			}
 
-			u := new(user.User)
-			err = mongo.GetID(app.Db.C("users"), uf.ID, u)
-			err = mongo.UpdateID(app.Db.C("users"), uf.ID, map[string]interface{}{
-				"email.address": uf.Email,
-				"firstname":     uf.FirstName,
-				"lastname":      uf.LastName,
-				"roles":         uf.Roles,
-			}, u)
+			u, err := app.Store.Users.Get(r.Context(), objectIDHex(uf.ID))
+			Check(err)
+
+			// only authors and administrators have public pages
+			u.Roles = uf.Roles
+			var slug string
+			if cms.CanBeAuthor(u) {
+				slug = app.Transliterator.Slugify(uf.Slug)
+				if len(slug) == 0 {
+					slug = app.Transliterator.Slugify(uf.FirstName + " " + uf.LastName)
+				}
+				slug, err = uniqueUserSlug(r.Context(), app.Store.Users, slug, u.ID)
+				Check(err)
+			}
+
+			bio := map[string]string{}
+			for _, v := range uf.Bio {
+				if s := strings.TrimSpace(v.Text); len(s) > 0 {
+					bio[v.Language] = s
+				}
+			}
+
+			var photoID *primitive.ObjectID
+			if uf.PhotoID != nil && !uf.PhotoID.IsZero() {
+				photoID = uf.PhotoID
+			}
+
+			u.Email.Address = uf.Email
+			u.FirstName = uf.FirstName
+			u.LastName = uf.LastName
+			u.Roles = uf.Roles
+			u.Slug = slug
+			u.Bio = bio
+			u.PhotoID = photoID
+			u.Links = splitLines(uf.Links)
+			err = app.Store.Users.Save(r.Context(), u)
+			Check(err)
+			invalidatePages(app)
+
+			err = updateSearch(r.Context(), app.Store, app.Search, store.ContentQuery{AuthorID: u.ID})
 			Check(err)
+			app.SuggestionUpdates.Schedule()
 
 			url, err := app.Router.Get("users").URL("lang", lang.String())
 			Check(err)
@@ -662,8 +965,7 @@ func adminUserPassChangeHandler(app *application) http.Handler {
 		vars := mux.Vars(r)
 		lang := LangMust(app.LangMatcher, vars["lang"], r)
 
-		u := new(user.User)
-		err := mongo.GetID(app.Db.C("users"), vars["id"], u)
+		u, err := app.Store.Users.Get(r.Context(), objectIDHex(vars["id"]))
 		Check(err)
 
 		if r.Method == "GET" {
@@ -705,10 +1007,8 @@ func adminUserPassChangeHandler(app *application) http.Handler {
 			newPassHash, err := user.MakeMAC([]byte(newPass), app.Config.Secret)
 			Check(err)
 
-			updatedUser := new(user.User)
-			err = mongo.UpdateID(app.Db.C("users"), uf.ID, map[string]interface{}{
-				"passwordhash": newPassHash,
-			}, updatedUser)
+			u.PasswordHash = newPassHash
+			err = app.Store.Users.Save(r.Context(), u)
 			Check(err)
 
 			url, err := app.Router.Get("adminIndex").URL("lang", lang.String())
@@ -718,6 +1018,119 @@ func adminUserPassChangeHandler(app *application) http.Handler {
 	})
 }
 
+func adminTranslationsHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		lang := LangMust(app.LangMatcher, vars["lang"], r)
+
+		onlyUntranslated := len(r.URL.Query().Get("untranslated")) > 0
+
+		entries := []*locale.Entry{}
+		var untranslated int
+		for _, e := range translations.Entries() {
+			var missing bool
+			for _, v := range e.Values {
+				if v.Untranslated {
+					missing = true
+					break
+				}
+			}
+			if missing {
+				untranslated++
+			}
+			if onlyUntranslated && !missing {
+				continue
+			}
+			entries = append(entries, e)
+		}
+
+		page := Page{
+			CurrentUser: app.CurrentUser,
+			Language:    lang,
+			Data: struct {
+				Languages        []string
+				Entries          []*locale.Entry
+				OnlyUntranslated bool
+				Untranslated     int
+			}{
+				Languages:        translations.Tags,
+				Entries:          entries,
+				OnlyUntranslated: onlyUntranslated,
+				Untranslated:     untranslated,
+			},
+		}
+		Render(app.Templates["admin/translations/index"], lang, w, page)
+	})
+}
+
+func adminSaveTranslationHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		lang := LangMust(app.LangMatcher, vars["lang"], r)
+
+		err := r.ParseForm()
+		Check(err)
+
+		msgLang := r.PostForm.Get("Language")
+		msgID := r.PostForm.Get("MessageID")
+		if len(msgLang) == 0 || len(msgID) == 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if !translations.HasTag(msgLang) {
+			http.Error(w, "unknown language", http.StatusBadRequest)
+			return
+		}
+
+		err = app.Store.Translations.Save(r.Context(), msgLang, msgID, r.PostForm.Get("Value"))
+		Check(err)
+
+		err = reloadTranslations(r.Context(), app.Store)
+		Check(err)
+		invalidatePages(app)
+
+		url, err := app.Router.Get("translations").URL("lang", lang.String())
+		Check(err)
+		// keep the filter of the list and scroll to the edited message
+		if len(r.URL.RawQuery) > 0 {
+			url.RawQuery = r.URL.RawQuery
+		}
+		url.Fragment = msgID
+		http.Redirect(w, r, url.String(), http.StatusSeeOther)
+	})
+}
+
+func adminReloadTranslationsHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		lang := LangMust(app.LangMatcher, vars["lang"], r)
+
+		err := reloadTranslations(r.Context(), app.Store)
+		Check(err)
+		invalidatePages(app)
+
+		url, err := app.Router.Get("translations").URL("lang", lang.String())
+		Check(err)
+		http.Redirect(w, r, url.String(), http.StatusSeeOther)
+	})
+}
+
+func adminExportTranslationsHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tag := mux.Vars(r)["tag"]
+
+		b, err := translations.Export(tag)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", tag+".all.json"))
+		w.Write(b)
+	})
+}
+
 func indexHandler(app *application) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -737,24 +1150,11 @@ func indexHandler(app *application) http.Handler {
 		} else {
 			pageNo = 1
 		}
-		findParams := bson.M{
-			"language": lang.String(),
-			"public":   true,
-			"$and": []bson.M{
-				bson.M{"$or": []bson.M{
-
-					bson.M{"scheduled": bson.M{"$lt": time.Now()}},
-					bson.M{"scheduled": (time.Time{})},
-				}},
-				bson.M{"$or": []bson.M{
-
-					bson.M{"type": cms.Photoreport},
-					bson.M{"type": cms.Article},
-					bson.M{"type": cms.Banner},
-				}},
-			},
-		}
-		cc, prev, next, err := cms.AllContentByPage(app.Db.C("content"), findParams, 20, pageNo)
+		cc, prev, next, err := app.Store.Content.Page(r.Context(), store.ContentQuery{
+			Language:  lang.String(),
+			Published: true,
+			Types:     []cms.ContentType{cms.Photoreport, cms.Article, cms.Banner},
+		}, 20, pageNo)
 		Check(err)
 		// filter different types of content
 		mainThread := []*cms.Content{}
@@ -767,24 +1167,32 @@ func indexHandler(app *application) http.Handler {
 			}
 		}
 
-		topics, err := getTopics(app.Db, lang)
+		topics, err := getTopics(r.Context(), app.Store, lang)
 		Check(err)
 
-		pages, err := getPages(app.Db, lang)
+		pages, err := getPages(r.Context(), app.Store, lang)
 		Check(err)
 
-		series, err := getSeries(app.Db, lang)
+		series, err := getSeries(r.Context(), app.Store, lang)
 		Check(err)
 
-		events, err := getEvents(app.Db, lang)
+		events, err := getEvents(r.Context(), app.Store, lang)
 		Check(err)
 
-		audio, err := getCertainContent(app.Db, lang, cms.Audio)
+		audio, err := getCertainContent(r.Context(), app.Store, lang, cms.Audio)
 		Check(err)
 
-		research, err := getCertainContent(app.Db, lang, cms.Research)
+		research, err := getCertainContent(r.Context(), app.Store, lang, cms.Research)
 		Check(err)
 
+		v := newPageVersion(app, r, lang.String())
+		for _, cc := range [][]*cms.Content{mainThread, events, pages, audio, series, research} {
+			v.Content(cc...)
+		}
+		if v.NotModified(w, r) {
+			return
+		}
+
 		page := Page{
 			Language:    lang,
 			CurrentUser: u,
@@ -821,10 +1229,15 @@ func indexHandler(app *application) http.Handler {
 	})
 }
 
+// maxSearchPages limits page numbers of search results, farther pages
+// are clamped to the last one.
+const maxSearchPages = 50
+
 func searchHandler(app *application) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		lang := LangMust(app.LangMatcher, vars["lang"], r)
+		perpage := 20
 
 		u, err := LoginUser(app, r)
 		if err != nil {
@@ -833,40 +1246,113 @@ func searchHandler(app *application) http.Handler {
 		}
 
 		q := r.URL.Query()
-		searchQuery := q.Get("q")
+		searchQuery := strings.TrimSpace(q.Get("q"))
 		if len(searchQuery) == 0 {
 			http.Error(w, "empty search query", http.StatusBadRequest)
 			return
 		}
 
-		cc, err := cms.SearchContent(app.Db, bson.M{
-			"language": lang.String(),
-			"$text": bson.M{
-				"$search": searchQuery,
-			},
-		}, 0)
+		// page numbers are clamped, other parameters come from links
+		// and forms, invalid values are rejected
+		pageNo := 1
+		if s := q.Get("p"); len(s) > 0 {
+			if pageNo, err = strconv.Atoi(s); err != nil {
+				http.Error(w, "invalid page number", http.StatusBadRequest)
+				return
+			}
+			if pageNo < 1 {
+				pageNo = 1
+			} else if pageNo > maxSearchPages {
+				pageNo = maxSearchPages
+			}
+		}
+
+		// public content available for filters
+		published := store.ContentQuery{Language: lang.String(), Published: true}
+
+		sq := &search.Query{
+			Text:     searchQuery,
+			Language: lang.String(),
+			Offset:   (pageNo - 1) * perpage,
+			Limit:    perpage,
+		}
+
+		var f searchFilter
+		if s := q.Get("topic"); primitive.IsValidObjectID(s) {
+			f.TopicID = objectIDHex(s)
+			sq.TopicID = s
+		}
+		if s := q.Get("author"); primitive.IsValidObjectID(s) {
+			f.AuthorID = objectIDHex(s)
+			sq.AuthorID = s
+		}
+		if s := q.Get("type"); len(s) > 0 {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 || n >= len(cms.ContentTypes) {
+				http.Error(w, "invalid content type", http.StatusBadRequest)
+				return
+			}
+			ct := cms.ContentType(n)
+			f.Type = &ct
+			sq.Type = &n
+		}
+		if s := q.Get("year"); len(s) > 0 {
+			f.Year, err = strconv.Atoi(s)
+			if err != nil || f.Year < 1 || f.Year > time.Now().Year()+1 {
+				http.Error(w, "invalid year", http.StatusBadRequest)
+				return
+			}
+			sq.Year = f.Year
+		}
+
+		res, err := app.Search.Search(r.Context(), sq)
+		if err == search.ErrEmptyQuery {
+			// the query has no words to search for, e.g. only punctuation
+			res, err = &search.Result{}, nil
+		}
 		Check(err)
 
-		tt, err := getTopics(app.Db, lang)
+		ids := make([]primitive.ObjectID, 0, len(res.IDs))
+		for _, id := range res.IDs {
+			ids = append(ids, objectIDHex(id))
+		}
+		cc, err := app.Store.Content.ByIDs(r.Context(), ids)
 		Check(err)
 
-		// filter different types of content
-		mainThread := []*cms.Content{}
-		events := []*cms.Content{}
-		audio := []*cms.Content{}
-		pages := []*cms.Content{}
+		total := res.Total
+		var prev, next int
+		if total > pageNo*perpage {
+			next = pageNo + 1
+		}
+		if pageNo > 1 {
+			prev = pageNo - 1
+		}
 
-		for _, v := range cc {
-			if v.Type == cms.Event {
-				events = append(events, v)
-			} else if v.Type == cms.Page {
-				pages = append(pages, v)
-			} else if v.Type == cms.Audio {
-				audio = append(audio, v)
-			} else {
-				mainThread = append(mainThread, v)
+		var didYouMean string
+		if total == 0 {
+			if err = app.Store.SearchMisses.Log(r.Context(), lang.String(), searchQuery); err != nil {
+				log.Printf("failed to log a search query: %v", err)
 			}
+			didYouMean = app.Suggester.DidYouMean(lang.String(), searchQuery)
+		}
+
+		tt, err := getTopics(r.Context(), app.Store, lang)
+		Check(err)
+
+		pp, err := getPages(r.Context(), app.Store, lang)
+		Check(err)
+
+		years, err := app.Store.Content.Years(r.Context(), published)
+		Check(err)
+
+		counts, err := app.Store.Content.AuthorCounts(r.Context(), published)
+		Check(err)
+		authorIDs := make([]primitive.ObjectID, 0, len(counts))
+		for id := range counts {
+			authorIDs = append(authorIDs, id)
 		}
+		authors, err := app.Store.Users.ByIDs(r.Context(), authorIDs)
+		Check(err)
 
 		page := Page{
 			Language:    lang,
@@ -875,36 +1361,348 @@ func searchHandler(app *application) http.Handler {
 				AvailableLanguages                    []language.Tag
 				Topics                                []*cms.Topic
 				Topic                                 *cms.Topic
-				MainThread                            []*cms.Content
-				Events                                []*cms.Content
 				Pages                                 []*cms.Content
-				Audio                                 []*cms.Content
+				Results                               []*cms.Content
+				Total                                 int
 				CurrentPageNo, NextPageNo, PrevPageNo int
 				SearchQuery                           string
+				DidYouMean                            string
+				Filter                                searchFilter
+				Types                                 []cms.ContentType
+				Years                                 []int
+				Authors                               []*user.User
 			}{
 				AvailableLanguages: app.Langs,
 				Topics:             tt,
-				MainThread:         mainThread,
-				Pages:              pages,
-				Audio:              audio,
-				Events:             events,
-				Topic:              nil,
+				Pages:              pp,
+				Results:            cc,
+				Total:              total,
+				CurrentPageNo:      pageNo,
+				NextPageNo:         next,
+				PrevPageNo:         prev,
 				SearchQuery:        searchQuery,
+				DidYouMean:         didYouMean,
+				Filter:             f,
+				Types:              cms.ContentTypes,
+				Years:              years,
+				Authors:            authors,
 			},
 		}
-		Render(app.Templates["index"], lang, w, page)
+		Render(app.Templates["search"], lang, w, page)
 	})
 }
 
-func signupHandler(app *application) http.Handler {
+// searchSuggestHandler returns titles of topics and content which
+// complete the query as JSON.
+func searchSuggestHandler(app *application) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		lang := LangMust(app.LangMatcher, vars["lang"], r)
-		url, err := app.Router.Get("index").URL("lang", lang.String())
-		Check(err)
 
-		if r.Method == "GET" {
-			currentUser, err := LoginUser(app, r)
+		completions := app.Suggester.Complete(lang.String(), r.URL.Query().Get("q"), 10)
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		err := json.NewEncoder(w).Encode(completions)
+		Check(err)
+	})
+}
+
+// searchFilter keeps filters of the search page.
+type searchFilter struct {
+	TopicID  primitive.ObjectID
+	AuthorID primitive.ObjectID
+	Type     *cms.ContentType
+	Year     int
+}
+
+// HasType checks if the filter is set to the content type.
+func (f searchFilter) HasType(t cms.ContentType) bool {
+	return f.Type != nil && *f.Type == t
+}
+
+// Query returns URL query values of the filter with the search query
+// to compose links to other result pages.
+func (f searchFilter) Query(searchQuery string, pageNo int) template.URL {
+	v := url.Values{}
+	v.Set("q", searchQuery)
+	if !f.TopicID.IsZero() {
+		v.Set("topic", f.TopicID.Hex())
+	}
+	if !f.AuthorID.IsZero() {
+		v.Set("author", f.AuthorID.Hex())
+	}
+	if f.Type != nil {
+		v.Set("type", strconv.Itoa(int(*f.Type)))
+	}
+	if f.Year > 0 {
+		v.Set("year", strconv.Itoa(f.Year))
+	}
+	if pageNo > 1 {
+		v.Set("p", strconv.Itoa(pageNo))
+	}
+	return template.URL(v.Encode())
+}
+
+func adminSearchMissesHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		lang := LangMust(app.LangMatcher, vars["lang"], r)
+
+		misses, err := app.Store.SearchMisses.All(r.Context(), 500)
+		Check(err)
+
+		page := Page{
+			CurrentUser: app.CurrentUser,
+			Language:    lang,
+			Data: struct {
+				SearchMisses []*cms.SearchMiss
+				Indexed      string
+			}{
+				SearchMisses: misses,
+				Indexed:      r.URL.Query().Get("indexed"),
+			},
+		}
+		Render(app.Templates["admin/search/misses"], lang, w, page)
+	})
+}
+
+// adminReindexHandler rebuilds the search index in the running server,
+// so it isn't written by another process.
+func adminReindexHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		lang := LangMust(app.LangMatcher, vars["lang"], r)
+
+		n, err := rebuildSearchIndex(r.Context(), app.Store, app.Search)
+		Check(err)
+
+		url, err := app.Router.Get("searchMisses").URL("lang", lang.String())
+		Check(err)
+		http.Redirect(w, r, url.String()+"?indexed="+strconv.Itoa(n), http.StatusSeeOther)
+	})
+}
+
+// adminDuplicateSlugsHandler lists content which can't be found by
+// its URL because of duplicate slugs.
+func adminDuplicateSlugsHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		lang := LangMust(app.LangMatcher, vars["lang"], r)
+
+		dd, err := app.Store.Content.DuplicateSlugs(r.Context())
+		Check(err)
+
+		page := Page{
+			CurrentUser: app.CurrentUser,
+			Language:    lang,
+			Data: struct {
+				Duplicates []*cms.DuplicateSlug
+			}{
+				Duplicates: dd,
+			},
+		}
+		Render(app.Templates["admin/content/duplicates"], lang, w, page)
+	})
+}
+
+func adminRedirectsHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		lang := LangMust(app.LangMatcher, vars["lang"], r)
+
+		rr, err := app.Store.Redirects.All(r.Context())
+		Check(err)
+
+		page := Page{
+			CurrentUser: app.CurrentUser,
+			Language:    lang,
+			Data: struct {
+				Redirects []*cms.Redirect
+			}{
+				Redirects: rr,
+			},
+		}
+		Render(app.Templates["admin/redirects"], lang, w, page)
+	})
+}
+
+// adminSaveRedirectHandler creates a redirect rule or changes the
+// target of the existing rule with the same source path.
+func adminSaveRedirectHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		Check(err)
+
+		from := redirectPath(r.PostFormValue("From"))
+		to := strings.TrimSpace(r.PostFormValue("To"))
+		if len(to) == 0 || from == "/" || from == redirectPath(to) {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		err = app.Store.Redirects.Save(r.Context(), from, to)
+		Check(err)
+		err = app.Redirects.Reload(r.Context())
+		Check(err)
+
+		vars := mux.Vars(r)
+		lang := LangMust(app.LangMatcher, vars["lang"], r)
+		url, err := app.Router.Get("redirects").URL("lang", lang.String())
+		Check(err)
+		http.Redirect(w, r, url.String(), http.StatusSeeOther)
+	})
+}
+
+func adminContributorsHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		lang := LangMust(app.LangMatcher, vars["lang"], r)
+
+		cc, err := app.Store.Contributors.All(r.Context())
+		Check(err)
+
+		page := Page{
+			CurrentUser: app.CurrentUser,
+			Language:    lang,
+			Data: struct {
+				Contributors []*cms.Contributor
+				CreditRoles  []cms.CreditRole
+			}{
+				Contributors: cc,
+				CreditRoles:  cms.CreditRoles,
+			},
+		}
+		Render(app.Templates["admin/contributors/index"], lang, w, page)
+	})
+}
+
+// adminCreateContributorHandler creates a contributor by the name and
+// redirects to the form to fill in the profile.
+func adminCreateContributorHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		lang := LangMust(app.LangMatcher, vars["lang"], r)
+
+		err := r.ParseForm()
+		Check(err)
+
+		cf := new(contributorForm)
+		err = app.FormDecoder.Decode(cf, r.PostForm)
+		Check(err)
+
+		name := strings.TrimSpace(cf.Name)
+		if len(name) == 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		c := &cms.Contributor{
+			ID:      primitive.NewObjectID(),
+			Name:    name,
+			Role:    cf.Role,
+			Created: time.Now(),
+		}
+		err = app.Store.Contributors.Save(r.Context(), c)
+		Check(err)
+
+		http.Redirect(w, r, fmt.Sprintf("/%s/admin/contributors/edit/%s", lang.String(), c.ID.Hex()), http.StatusSeeOther)
+	})
+}
+
+func adminEditContributorHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		lang := LangMust(app.LangMatcher, vars["lang"], r)
+
+		c, err := app.Store.Contributors.Get(r.Context(), objectIDHex(vars["id"]))
+		Check(err)
+
+		if r.Method == "GET" {
+			uu, err := app.Store.Users.All(r.Context())
+			Check(err)
+
+			photos, err := currentPhotos(r.Context(), app.Store.Files, c.PhotoID)
+			Check(err)
+
+			page := Page{
+				CurrentUser: app.CurrentUser,
+				Language:    lang,
+				Data: struct {
+					Contributor        *cms.Contributor
+					CreditRoles        []cms.CreditRole
+					Users              []*user.User
+					Photos             []*file.File
+					AvailableLanguages []language.Tag
+				}{
+					Contributor:        c,
+					CreditRoles:        cms.CreditRoles,
+					Users:              uu,
+					Photos:             photos,
+					AvailableLanguages: app.Langs,
+				},
+			}
+			Render(app.Templates["admin/contributors/edit"], lang, w, page)
+			return
+		}
+
+		// POST
+
+		err = r.ParseForm()
+		Check(err)
+
+		cf := new(contributorForm)
+		err = app.FormDecoder.Decode(cf, r.PostForm)
+		Check(err)
+
+		name := strings.TrimSpace(cf.Name)
+		if len(name) == 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		bio := map[string]string{}
+		for _, v := range cf.Bio {
+			if s := strings.TrimSpace(v.Text); len(s) > 0 {
+				bio[v.Language] = s
+			}
+		}
+
+		var photoID, userID *primitive.ObjectID
+		if cf.PhotoID != nil && !cf.PhotoID.IsZero() {
+			photoID = cf.PhotoID
+		}
+		if cf.UserID != nil && !cf.UserID.IsZero() {
+			userID = cf.UserID
+		}
+
+		c.Name = name
+		c.Role = cf.Role
+		c.Bio = bio
+		c.PhotoID = photoID
+		c.UserID = userID
+		err = app.Store.Contributors.Save(r.Context(), c)
+		Check(err)
+		invalidatePages(app)
+
+		// names of contributors are searchable with the content
+		err = updateSearch(r.Context(), app.Store, app.Search, store.ContentQuery{ContributorIDs: []primitive.ObjectID{c.ID}})
+		Check(err)
+
+		url, err := app.Router.Get("contributors").URL("lang", lang.String())
+		Check(err)
+		http.Redirect(w, r, url.String(), http.StatusSeeOther)
+	})
+}
+
+func signupHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		lang := LangMust(app.LangMatcher, vars["lang"], r)
+		url, err := app.Router.Get("index").URL("lang", lang.String())
+		Check(err)
+
+		if r.Method == "GET" {
+			currentUser, err := LoginUser(app, r)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
@@ -915,17 +1713,10 @@ func signupHandler(app *application) http.Handler {
 				return
 			}
 
-			tt, err := cms.AllTopics(app.Db, bson.M{
-				"language": lang.String(),
-				"public":   true,
-				"$or": []bson.M{
-					bson.M{"page": false},
-					bson.M{"page": nil},
-				},
-			})
+			tt, err := getTopics(r.Context(), app.Store, lang)
 			Check(err)
 
-			pp, err := getPages(app.Db, lang)
+			pp, err := getPages(r.Context(), app.Store, lang)
 			Check(err)
 
 			page := Page{
@@ -964,7 +1755,7 @@ func signupHandler(app *application) http.Handler {
 		if !user.Validate(u) {
 			Check(user.ErrNotValid)
 		}
-		err = mongo.Save(app.Db.C("users"), bson.M{"_id": u.ID}, u)
+		err = app.Store.Users.Save(r.Context(), u)
 		Check(err)
 
 		http.Redirect(w, r, url.String(), http.StatusSeeOther)
@@ -990,17 +1781,10 @@ func loginHandler(app *application) http.Handler {
 				return
 			}
 
-			tt, err := cms.AllTopics(app.Db, bson.M{
-				"language": lang.String(),
-				"public":   true,
-				"$or": []bson.M{
-					bson.M{"page": false},
-					bson.M{"page": nil},
-				},
-			})
+			tt, err := getTopics(r.Context(), app.Store, lang)
 			Check(err)
 
-			pp, err := getPages(app.Db, lang)
+			pp, err := getPages(r.Context(), app.Store, lang)
 			Check(err)
 
 			page := Page{
@@ -1029,8 +1813,7 @@ func loginHandler(app *application) http.Handler {
 			return
 		}
 
-		u := new(user.User)
-		err = mongo.GetOne(app.Db.C("users"), bson.M{"email.address": email}, u)
+		u, err := app.Store.Users.FindByEmail(r.Context(), email)
 		Check(err)
 
 		if !user.Verify(pass, u.PasswordHash, app.Config.Secret) {
@@ -1134,10 +1917,10 @@ func mailchimpHandler(app *application) http.Handler {
 			return
 		}
 
-		tt, err := getTopics(app.Db, lang)
+		tt, err := getTopics(r.Context(), app.Store, lang)
 		Check(err)
 
-		pp, err := getPages(app.Db, lang)
+		pp, err := getPages(r.Context(), app.Store, lang)
 		Check(err)
 
 		page := Page{
@@ -1168,6 +1951,35 @@ func mailchimpHandler(app *application) http.Handler {
 	})
 }
 
+// topicPathHandler resolves nested paths. A path of a topic is served
+// by topicHandler, a path of a topic followed by a content slug is
+// served by contentHandler.
+func topicPathHandler(app *application) http.Handler {
+	topic := topicHandler(app)
+	content := contentHandler(app)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		lang := LangMust(app.LangMatcher, vars["lang"], r)
+		p := strings.Trim(vars["path"], "/")
+
+		_, _, err := app.Store.Topics.FindByPath(r.Context(), lang.String(), p)
+		if err != store.ErrNotFound {
+			Check(err)
+			vars["topic"] = p
+			topic.ServeHTTP(w, r)
+			return
+		}
+
+		i := strings.LastIndex(p, "/")
+		if i < 0 {
+			http.NotFound(w, r)
+			return
+		}
+		vars["topic"], vars["content"] = p[:i], p[i+1:]
+		content.ServeHTTP(w, r)
+	})
+}
+
 func contentHandler(app *application) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -1175,37 +1987,40 @@ func contentHandler(app *application) http.Handler {
 		s1 := vars["topic"]
 		s2 := vars["content"]
 
-		tt, err := getTopics(app.Db, lang)
+		tt, err := getTopics(r.Context(), app.Store, lang)
 		Check(err)
 
-		var t cms.Topic
-		err = mongo.GetOne(app.Db.C("topics"), bson.M{
-			"language": lang.String(),
-			"slug":     s1,
-		}, &t)
+		t, moved, err := app.Store.Topics.FindByPath(r.Context(), lang.String(), s1)
 		Check(err)
+		if moved {
+			// the topic has been renamed or moved
+			http.Redirect(w, r, fmt.Sprintf("/%s/%s/%s/", lang.String(), t.Path, s2), http.StatusMovedPermanently)
+			return
+		}
+		setTopicFamily(t, tt)
 
-		c := new(cms.Content)
-		err = mongo.GetOne(app.Db.C("content"), bson.M{"$and": []bson.M{
-			{"slug": s2},
-			{"topicids": t.ID},
-			{"public": true},
-			{"$or": []bson.M{
-				bson.M{"scheduled": bson.M{"$lt": time.Now()}},
-				bson.M{"scheduled": (time.Time{})},
-			}},
-		}}, c)
+		c, moved, err := findContent(r.Context(), app.Store.Content, t.ID, s2)
 		Check(err)
 
-		c.Topics = []*cms.Topic{&t}
+		// content is available by secondary topics and old slugs too,
+		// but the URL with the primary topic and the current slug is
+		// the canonical one
+		pt := c.PrimaryTopic()
+		if pt == nil {
+			pt = t
+		}
+		if moved || pt.ID != t.ID {
+			http.Redirect(w, r, fmt.Sprintf("/%s/%s/%s/", lang.String(), pt.Path, c.Slug), http.StatusMovedPermanently)
+			return
+		}
 
-		err = cms.GetAuthorsForContent(app.Db, c)
+		err = app.Store.Content.LoadDetails(r.Context(), c)
 		Check(err)
 
-		err = file.GetImagesForContent(app.Db, c)
+		err = app.Store.Content.LoadChildren(r.Context(), []*cms.Content{c})
 		Check(err)
 
-		err = cms.GetChildrenContent(app.Db, c)
+		c.Related, err = getRelated(r.Context(), app.Store, app.Related, c, 3)
 		Check(err)
 
 		u, err := LoginUser(app, r)
@@ -1214,9 +2029,18 @@ func contentHandler(app *application) http.Handler {
 			return
 		}
 
-		pp, err := getPages(app.Db, lang)
+		pp, err := getPages(r.Context(), app.Store, lang)
 		Check(err)
 
+		v := newPageVersion(app, r, lang.String())
+		v.Topic(t)
+		v.Content(c)
+		v.Content(c.Related...)
+		v.Content(pp...)
+		if v.NotModified(w, r) {
+			return
+		}
+
 		page := Page{
 			Language:    lang,
 			CurrentUser: u,
@@ -1229,7 +2053,7 @@ func contentHandler(app *application) http.Handler {
 			}{
 				AvailableLanguages: app.Langs,
 				Topics:             tt,
-				Topic:              &t,
+				Topic:              t,
 				Content:            c,
 				Pages:              pp,
 			},
@@ -1238,6 +2062,226 @@ func contentHandler(app *application) http.Handler {
 	})
 }
 
+func tagHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		lang := LangMust(app.LangMatcher, vars["lang"], r)
+
+		u, err := LoginUser(app, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var pageNo int
+		if s := r.URL.Query().Get("p"); len(s) > 0 {
+			pageNo, err = strconv.Atoi(s)
+			Check(err)
+		} else {
+			pageNo = 1
+		}
+
+		tag, err := app.Store.Tags.FindBySlug(r.Context(), lang.String(), vars["tag"])
+		Check(err)
+
+		cc, prev, next, err := app.Store.Content.Page(r.Context(), store.ContentQuery{
+			Language:  lang.String(),
+			Published: true,
+			TagID:     tag.ID,
+		}, 20, pageNo)
+		Check(err)
+
+		tt, err := getTopics(r.Context(), app.Store, lang)
+		Check(err)
+
+		pp, err := getPages(r.Context(), app.Store, lang)
+		Check(err)
+
+		page := Page{
+			Language:    lang,
+			CurrentUser: u,
+			Data: struct {
+				AvailableLanguages                    []language.Tag
+				Topics                                []*cms.Topic
+				Topic                                 *cms.Topic
+				Pages                                 []*cms.Content
+				Tag                                   *cms.Tag
+				Content                               []*cms.Content
+				CurrentPageNo, NextPageNo, PrevPageNo int
+			}{
+				AvailableLanguages: app.Langs,
+				Topics:             tt,
+				Pages:              pp,
+				Tag:                tag,
+				Content:            cc,
+				CurrentPageNo:      pageNo,
+				NextPageNo:         next,
+				PrevPageNo:         prev,
+			},
+		}
+		Render(app.Templates["tag"], lang, w, page)
+	})
+}
+
+// authorsHandler serves the directory of authors of public content in
+// the language.
+func authorsHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		lang := LangMust(app.LangMatcher, vars["lang"], r)
+
+		u, err := LoginUser(app, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		aa, err := publicAuthors(r.Context(), app.Store, lang.String())
+		Check(err)
+
+		tt, err := getTopics(r.Context(), app.Store, lang)
+		Check(err)
+
+		pp, err := getPages(r.Context(), app.Store, lang)
+		Check(err)
+
+		page := Page{
+			Language:    lang,
+			CurrentUser: u,
+			Data: struct {
+				AvailableLanguages []language.Tag
+				Topics             []*cms.Topic
+				Topic              *cms.Topic
+				Pages              []*cms.Content
+				Authors            []*cms.Author
+			}{
+				AvailableLanguages: app.Langs,
+				Topics:             tt,
+				Pages:              pp,
+				Authors:            aa,
+			},
+		}
+		Render(app.Templates["authors"], lang, w, page)
+	})
+}
+
+// authorHandler serves the public profile of an author with the public
+// content of the author by pages.
+func authorHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		lang := LangMust(app.LangMatcher, vars["lang"], r)
+
+		u, err := LoginUser(app, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var pageNo int
+		if s := r.URL.Query().Get("p"); len(s) > 0 {
+			pageNo, err = strconv.Atoi(s)
+			Check(err)
+		} else {
+			pageNo = 1
+		}
+
+		author, err := getAuthor(r.Context(), app.Store, lang.String(), vars["slug"])
+		Check(err)
+
+		// content credited to contributors linked to the author
+		contributors, err := app.Store.Contributors.ByUser(r.Context(), author.ID)
+		Check(err)
+		ids := make([]primitive.ObjectID, len(contributors))
+		for i, v := range contributors {
+			ids[i] = v.ID
+		}
+
+		cc, prev, next, err := app.Store.Content.Page(r.Context(), store.ContentQuery{
+			Language:       lang.String(),
+			Published:      true,
+			AuthorID:       author.ID,
+			ContributorIDs: ids,
+		}, 20, pageNo)
+		Check(err)
+
+		tt, err := getTopics(r.Context(), app.Store, lang)
+		Check(err)
+
+		pp, err := getPages(r.Context(), app.Store, lang)
+		Check(err)
+
+		page := Page{
+			Language:    lang,
+			CurrentUser: u,
+			Data: struct {
+				AvailableLanguages                    []language.Tag
+				Topics                                []*cms.Topic
+				Topic                                 *cms.Topic
+				Pages                                 []*cms.Content
+				Author                                *cms.Author
+				Content                               []*cms.Content
+				CurrentPageNo, NextPageNo, PrevPageNo int
+			}{
+				AvailableLanguages: app.Langs,
+				Topics:             tt,
+				Pages:              pp,
+				Author:             author,
+				Content:            cc,
+				CurrentPageNo:      pageNo,
+				NextPageNo:         next,
+				PrevPageNo:         prev,
+			},
+		}
+		Render(app.Templates["author"], lang, w, page)
+	})
+}
+
+// adminSuggestTagsHandler returns titles of tags matching the query for
+// the content form as JSON.
+func adminSuggestTagsHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		tags, err := app.Store.Tags.Find(r.Context(), q.Get("language"), strings.TrimSpace(q.Get("q")), 10)
+		Check(err)
+
+		titles := make([]string, len(tags))
+		for i, t := range tags {
+			titles[i] = t.Title
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		err = json.NewEncoder(w).Encode(titles)
+		Check(err)
+	})
+}
+
+// photoSuggestion is an image found by the photo picker.
+type photoSuggestion struct {
+	ID, Title, URL string
+}
+
+// adminSuggestPhotosHandler finds images of the media library for the
+// photo pickers of users and contributors.
+func adminSuggestPhotosHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ff, _, _, _, err := app.Store.Files.Page(r.Context(), store.FileQuery{
+			Text:  strings.TrimSpace(r.URL.Query().Get("q")),
+			Kinds: []int{file.ImageKind},
+		}, 20, 1)
+		Check(err)
+
+		photos := make([]photoSuggestion, len(ff))
+		for i, f := range ff {
+			photos[i] = photoSuggestion{ID: f.ID.Hex(), Title: f.Title, URL: f.URL}
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		err = json.NewEncoder(w).Encode(photos)
+		Check(err)
+	})
+}
+
 func topicHandler(app *application) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -1259,43 +2303,45 @@ func topicHandler(app *application) http.Handler {
 			pageNo = 1
 		}
 
-		tt, err := getTopics(app.Db, lang)
+		tt, err := getTopics(r.Context(), app.Store, lang)
 		Check(err)
 
 		t := new(cms.Topic)
 		for _, v := range tt {
-			if v.Slug == s1 {
+			if v.Path == s1 {
 				t = v
 				break
 			}
 		}
-		if !t.ID.Valid() {
+		if t.ID.IsZero() {
+			// the topic has been renamed or moved
+			for _, v := range tt {
+				for _, old := range v.OldPaths {
+					if old == s1 {
+						http.Redirect(w, r, fmt.Sprintf("/%s/%s/", lang.String(), v.Path), http.StatusMovedPermanently)
+						return
+					}
+				}
+			}
 			http.NotFound(w, r)
 			return
 		}
+		setTopicFamily(t, tt)
 
-		findParams := bson.M{
-			"language": lang.String(),
-			"public":   true,
-			"topicids": t.ID,
-			"$and": []bson.M{
-				bson.M{"$or": []bson.M{
-
-					bson.M{"scheduled": bson.M{"$lt": time.Now()}},
-					bson.M{"scheduled": (time.Time{})},
-				}},
-				bson.M{"$or": []bson.M{
+		// a section shows content of its subsections too
+		topicIDs, err := app.Store.Topics.Descendants(r.Context(), t.ID)
+		Check(err)
+		topicIDs = append(topicIDs, t.ID)
 
-					bson.M{"type": cms.Photoreport},
-					bson.M{"type": cms.Article},
-					bson.M{"type": cms.Banner},
-				}},
-			},
-		}
-		cc, prev, next, err := cms.AllContentByPage(app.Db.C("content"), findParams, 20, pageNo)
+		cc, prev, next, err := app.Store.Content.Page(r.Context(), store.ContentQuery{
+			Language:  lang.String(),
+			Published: true,
+			TopicIDs:  topicIDs,
+			Types:     []cms.ContentType{cms.Photoreport, cms.Article, cms.Banner},
+		}, 20, pageNo)
 		Check(err)
 
-		pages, err := getPages(app.Db, lang)
+		pages, err := getPages(r.Context(), app.Store, lang)
 		Check(err)
 
 		// filter different types of content
@@ -1310,18 +2356,27 @@ func topicHandler(app *application) http.Handler {
 			}
 		}
 
-		series, err := getSeries(app.Db, lang)
+		series, err := getSeries(r.Context(), app.Store, lang)
 		Check(err)
 
-		events, err := getEvents(app.Db, lang)
+		events, err := getEvents(r.Context(), app.Store, lang)
 		Check(err)
 
-		audio, err := getCertainContent(app.Db, lang, cms.Audio)
+		audio, err := getCertainContent(r.Context(), app.Store, lang, cms.Audio)
 		Check(err)
 
-		research, err := getCertainContent(app.Db, lang, cms.Research)
+		research, err := getCertainContent(r.Context(), app.Store, lang, cms.Research)
 		Check(err)
 
+		v := newPageVersion(app, r, lang.String())
+		v.Topic(t)
+		for _, cc := range [][]*cms.Content{mainThread, events, pages, audio, series, research} {
+			v.Content(cc...)
+		}
+		if v.NotModified(w, r) {
+			return
+		}
+
 		page := Page{
 			Language:    lang,
 			CurrentUser: u,
@@ -1374,25 +2429,46 @@ func adminFilesHandler(app *application) http.Handler {
 			pageNo = 1
 		}
 
+		fq, err := fileQueryFromURL(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		// quering
-		files, prev, next, total, err := file.AllFilesByPage(app.Db.C("files"), nil, perpage, pageNo)
+		files, prev, next, total, err := app.Store.Files.Page(r.Context(), fq, perpage, pageNo)
+		Check(err)
+		folders, err := app.Store.Files.Folders(r.Context())
 		Check(err)
 
+		// pages keep the filter
+		pageURL := func(n int) string {
+			if n == 0 {
+				return ""
+			}
+			q.Set("p", strconv.Itoa(n))
+			return r.URL.Path + "?" + q.Encode()
+		}
+
 		page := Page{
 			CurrentUser: app.CurrentUser,
 			Language:    lang,
 			Data: struct {
 				Files         []*file.File
+				Folders       []string
+				Filter        url.Values
 				CurrentPageNo int
-				NextPageNo    int
-				PrevPageNo    int
+				NextPageURL   string
+				PrevPageURL   string
 				CurrentItems  int
 				TotalItems    int
 			}{
 				Files:         files,
+				Folders:       folders,
+				Filter:        r.URL.Query(),
 				CurrentPageNo: pageNo,
-				NextPageNo:    next,
-				PrevPageNo:    prev,
+				NextPageURL:   pageURL(next),
+				PrevPageURL:   pageURL(prev),
 				TotalItems:    total,
 				CurrentItems:  pageNo * perpage,
 			},
@@ -1401,25 +2477,51 @@ func adminFilesHandler(app *application) http.Handler {
 	})
 }
 
+// adminCreateFileHandler adds files of the Files field of the form.
+// Files are streamed to disk, each one may have its own title and
+// credits, see uploadField. Larger files are sent in chunks with
+// adminUploadHandler.
 func adminCreateFileHandler(app *application) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		lang := LangMust(app.LangMatcher, vars["lang"], r)
 
-		err := r.ParseMultipartForm(app.Config.MaxUploadSize)
-		Check(err)
-
-		var optimize bool
+		if r.ContentLength > app.Config.MaxUploadSize {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, app.Config.MaxUploadSize)
+		values, uploads, err := receiveUploads(r, app.Config.FilesDir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer removeUploads(uploads)
 
-		if len(r.MultipartForm.Value["NeedOptimize"]) > 0 {
-			optimize = true
+		var files []tempUpload
+		for _, t := range uploads {
+			if t.field != "Files" {
+				continue
+			}
+			// nothing is added if one of the files is refused
+			if rejectUpload(w, checkUpload(t.Filename, file.Validate(t.name, t.Filename, app.Config.UploadTypes))) {
+				return
+			}
+			files = append(files, t)
+		}
+		if len(files) == 0 {
+			http.Error(w, "no files", http.StatusBadRequest)
+			return
+		}
+		for i, t := range files {
+			u := uploadFromForm(values)
+			u.Filename = t.Filename
+			u.Title = uploadField(values, "Title", i)
+			u.Credits = uploadField(values, "Credits", i)
+			f, err := file.Add(t.name, app.Config.FilesDir, app.Config.UploadTypes, u)
+			Check(err)
+			Check(app.Store.Files.Save(r.Context(), f))
 		}
-		err = file.UploadFromForm(app.Db.C("files"), r.MultipartForm.File["Files"][0],
-			app.Config.FilesDir,
-			r.MultipartForm.Value["Title"][0],
-			r.MultipartForm.Value["Credits"][0],
-			optimize)
-		Check(err)
 
 		url, err := app.Router.Get("files").URL("lang", lang.String())
 		Check(err)
@@ -1432,8 +2534,22 @@ func adminDeleteFileHandler(app *application) http.Handler {
 		vars := mux.Vars(r)
 		lang := LangMust(app.LangMatcher, vars["lang"], r)
 
-		err := file.RemoveFile(app.Db.C("files"), vars["id"], app.Config.FilesDir)
+		// files used by content are kept, the edit page lists it
+		used, err := app.Store.Content.Count(r.Context(), store.ContentQuery{FileID: objectIDHex(vars["id"])})
+		Check(err)
+		if used > 0 {
+			http.Error(w, fmt.Sprintf("the file is used by %d content items", used), http.StatusConflict)
+			return
+		}
+
+		f, err := app.Store.Files.Get(r.Context(), objectIDHex(vars["id"]))
 		Check(err)
+		err = app.Store.Files.Delete(r.Context(), f.ID)
+		Check(err)
+		err = f.Remove(app.Config.FilesDir)
+		Check(err)
+		Check(app.Images.Remove(vars["id"]))
+		invalidatePages(app)
 
 		url, err := app.Router.Get("files").URL("lang", lang.String())
 		Check(err)
@@ -1446,9 +2562,13 @@ func adminEditFileHandler(app *application) http.Handler {
 		vars := mux.Vars(r)
 		lang := LangMust(app.LangMatcher, vars["lang"], r)
 
+		f, err := app.Store.Files.Get(r.Context(), objectIDHex(vars["id"]))
+		Check(err)
+
 		if r.Method == "GET" {
-			f := new(file.File)
-			err := mongo.GetID(app.Db.C("files"), vars["id"], f)
+			usedIn, err := app.Store.Content.Find(r.Context(), store.ContentQuery{FileID: f.ID})
+			Check(err)
+			folders, err := app.Store.Files.Folders(r.Context())
 			Check(err)
 
 			page := Page{
@@ -1456,8 +2576,14 @@ func adminEditFileHandler(app *application) http.Handler {
 				Language:    lang,
 				Data: struct {
 					CurrentFile *file.File
+					Crops       []imaging.Crop
+					UsedIn      []*cms.Content
+					Folders     []string
 				}{
 					CurrentFile: f,
+					Crops:       imaging.Crops,
+					UsedIn:      usedIn,
+					Folders:     folders,
 				},
 			}
 			Render(app.Templates["admin/files/edit"], lang, w, page)
@@ -1466,23 +2592,98 @@ func adminEditFileHandler(app *application) http.Handler {
 
 		// POST
 
-		f := new(file.File)
-		col := app.Db.C("files")
+		f.Title = r.FormValue("Title")
+		f.Credits = r.FormValue("Credits")
+		f.Folder = strings.TrimSpace(r.FormValue("Folder"))
+		if f.Kind == file.ImageKind {
+			if f.Width == 0 {
+				f.Width, f.Height, err = imaging.Size(f.Name(app.Config.FilesDir))
+				Check(err)
+			}
+			f.Focus, f.Crops = imageCropsFromForm(r, f.Width, f.Height)
+			// crops are made again with the new focus
+			Check(app.Images.Remove(f.ID.Hex()))
+		}
+		Check(app.Store.Files.Save(r.Context(), f))
+		app.CropVersions.Set(f)
+		invalidatePages(app)
 
-		err := mongo.GetID(col, vars["id"], f)
+		url, err := app.Router.Get("files").URL("lang", lang.String())
 		Check(err)
-		err = mongo.UpdateID(col, vars["id"], map[string]interface{}{
-			"title":   r.FormValue("Title"),
-			"credits": r.FormValue("Credits"),
-		}, f)
+		http.Redirect(w, r, url.String(), http.StatusSeeOther)
+	})
+}
+
+// adminOrphanedFilesHandler lists files which are not used by any
+// content, see cms.Content.FileIDs.
+func adminOrphanedFilesHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		lang := LangMust(app.LangMatcher, vars["lang"], r)
+
+		content, err := app.Store.Content.Find(r.Context(), store.ContentQuery{})
 		Check(err)
+		used := make(map[string]bool)
+		for _, c := range content {
+			for _, id := range c.FileIDs() {
+				used[id] = true
+			}
+		}
 
-		url, err := app.Router.Get("files").URL("lang", lang.String())
+		ff, err := app.Store.Files.Find(r.Context(), store.FileQuery{})
 		Check(err)
-		http.Redirect(w, r, url.String(), http.StatusSeeOther)
+		orphaned := []*file.File{}
+		var size int64
+		for _, f := range ff {
+			if !used[f.ID.Hex()] {
+				orphaned = append(orphaned, f)
+				size += f.Size
+			}
+		}
+
+		page := Page{
+			CurrentUser: app.CurrentUser,
+			Language:    lang,
+			Data: struct {
+				Files []*file.File
+				Size  int64
+			}{
+				Files: orphaned,
+				Size:  size,
+			},
+		}
+		Render(app.Templates["admin/files/orphaned"], lang, w, page)
 	})
 }
 
+// fileQueryFromURL reads filters of the media library: q is a text to
+// search, kind is a kind of files, folder is a folder, from and to are
+// the first and the last days of uploads in the 2006-01-02 form.
+func fileQueryFromURL(v url.Values) (q store.FileQuery, err error) {
+	q.Text = strings.TrimSpace(v.Get("q"))
+	q.Folder = v.Get("folder")
+	if s := v.Get("kind"); len(s) > 0 {
+		kind, err := strconv.Atoi(s)
+		if err != nil {
+			return q, fmt.Errorf("invalid kind %q", s)
+		}
+		q.Kinds = []int{kind}
+	}
+	if s := v.Get("from"); len(s) > 0 {
+		if q.UploadedAfter, err = time.ParseInLocation("2006-01-02", s, time.Local); err != nil {
+			return q, fmt.Errorf("invalid date %q", s)
+		}
+	}
+	if s := v.Get("to"); len(s) > 0 {
+		to, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			return q, fmt.Errorf("invalid date %q", s)
+		}
+		q.UploadedBefore = to.AddDate(0, 0, 1)
+	}
+	return q, nil
+}
+
 func restoreUserAccessHandler(app *application) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -1490,18 +2691,11 @@ func restoreUserAccessHandler(app *application) http.Handler {
 
 		if r.Method == "GET" {
 			// pages
-			ccpp, err := getPages(app.Db, lang)
+			ccpp, err := getPages(r.Context(), app.Store, lang)
 			Check(err)
 
 			// topics
-			tt, err := cms.AllTopics(app.Db, bson.M{
-				"language": lang.String(),
-				"public":   true,
-				"$or": []bson.M{
-					bson.M{"page": false},
-					bson.M{"page": nil},
-				},
-			})
+			tt, err := getTopics(r.Context(), app.Store, lang)
 			Check(err)
 
 			page := Page{
@@ -1526,8 +2720,7 @@ func restoreUserAccessHandler(app *application) http.Handler {
 
 			email := r.Form.Get("Email.Address")
 
-			u := new(user.User)
-			err = mongo.GetOne(app.Db.C("users"), bson.M{"email.address": email}, u)
+			u, err := app.Store.Users.FindByEmail(r.Context(), email)
 			Check(err)
 
 			if u == nil {
@@ -1541,10 +2734,8 @@ func restoreUserAccessHandler(app *application) http.Handler {
 			passHash, err := user.MakeMAC([]byte(pass), app.Config.Secret)
 			Check(err)
 
-			updatedUser := new(user.User)
-			err = mongo.UpdateID(app.Db.C("users"), u.ID.Hex(), map[string]interface{}{
-				"passwordhash": passHash,
-			}, updatedUser)
+			u.PasswordHash = passHash
+			err = app.Store.Users.Save(r.Context(), u)
 			Check(err)
 
 			// email to the user
@@ -1651,6 +2842,14 @@ func StaticFolderDebug(staticDir, maxAge string, debug bool, remoteStaticDir str
 			return
 		}
 
+		// hidden files, e.g. uploads in progress, aren't served
+		for _, name := range strings.Split(k, "/") {
+			if strings.HasPrefix(name, ".") {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+		}
+
 		// open the file
 		filepath := path.Join(staticDir, k)
 		f, err := os.Open(filepath)
@@ -1692,7 +2891,18 @@ func StaticFolderDebug(staticDir, maxAge string, debug bool, remoteStaticDir str
 
 		etag := CalculateEtag(d)
 
-		// TODO: guess content-type
+		// browsers mustn't run uploaded files as pages
+		contentType, inline := file.ServedType(k)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if inline {
+			w.Header().Set("Content-Disposition", "inline")
+		} else {
+			w.Header().Set("Content-Disposition", "attachment")
+		}
+		if contentType == "image/svg+xml" {
+			w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src data:; sandbox")
+		}
 		w.Header().Set("ETag", etag)
 		w.Header().Set("Cache-Control", "max-age="+maxAge)
 		http.ServeFile(w, r, filepath)
@@ -0,0 +1,834 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bahna/magazine/webserver/cms"
+	"github.com/bahna/magazine/webserver/file"
+	"github.com/bahna/magazine/webserver/locale"
+	"github.com/bahna/magazine/webserver/related"
+	"github.com/bahna/magazine/webserver/search"
+	"github.com/bahna/magazine/webserver/slugifier"
+	"github.com/bahna/magazine/webserver/store"
+	"github.com/bahna/magazine/webserver/user"
+	"github.com/gorilla/securecookie"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+)
+
+// testServer serves the application backed by in-memory stores with
+// the topics "culture" and "culture/muzyka" (formerly "culture/music"),
+// an article in both of them and an administrator.
+type testServer struct {
+	app     *application
+	handler http.Handler
+	// admin is the login cookie of the administrator.
+	admin *http.Cookie
+	log   bytes.Buffer
+
+	culture, music *cms.Topic
+	article        *cms.Content
+}
+
+const testPassword = "password"
+
+func newTestServer(t *testing.T) *testServer {
+	if translations == nil {
+		translations = locale.NewCatalog("../i18n", "en-us", "ru", "be")
+		if err := translations.Reload(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sc := securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	langs := []language.Tag{language.English, language.MustParse("be"), language.Russian}
+	app := &application{
+		Config: &configuration{
+			Scookie:         sc,
+			ScookieDuration: time.Hour,
+			Secret:          []byte("secret"),
+			AdminGroup:      []user.Role{user.Administrator, user.Author},
+			UploadTypes:     &file.DefaultAllowlist,
+		},
+		Store:          store.NewMemory(),
+		Langs:          langs,
+		LangMatcher:    language.NewMatcher(langs),
+		LangNamer:      display.English.Languages(),
+		FormDecoder:    newFormDecoder(),
+		Transliterator: slugifier.NewSlugifier(),
+		Suggester:      search.NewSuggester(),
+		Related: related.NewEngine(func(ctx context.Context, lang string) ([]*related.Item, error) {
+			return nil, nil
+		}),
+	}
+	idx, err := search.OpenIndex("")
+	check(t, err)
+	app.Search = idx
+	// suggestions aren't rebuilt during tests
+	app.SuggestionUpdates = &suggestionUpdates{app: app, delay: time.Hour}
+	app.Pages = newPageCache(time.Hour, app.Store)
+	app.CropVersions, err = loadCropVersions(context.Background(), app.Store.Files)
+	check(t, err)
+	app.Funcs = generateTmplFuncs(app)
+	app.Templates = generateTmpls("../assets/templates", app.Funcs)
+	app.Router = makeRouter(app)
+
+	s := &testServer{
+		app:     app,
+		handler: Recover(Authenticate(app.Router, sc)),
+	}
+	log.SetOutput(&s.log)
+
+	admin, err := user.New(testPassword, "admin@example.com", "Ada", "Admin", []user.Role{user.Administrator}, app.Config.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin.Slug = "ada-admin"
+	check(t, app.Store.Users.Save(context.Background(), admin))
+	rec := httptest.NewRecorder()
+	check(t, user.SetLoginCookie(rec, admin, sc, time.Hour))
+	s.admin = rec.Result().Cookies()[0]
+
+	s.culture = &cms.Topic{ID: primitive.NewObjectID(), Title: "Culture", Slug: "culture", Public: true, Language: "ru", Weight: 2}
+	s.music = &cms.Topic{ID: primitive.NewObjectID(), Title: "Music", Slug: "music", Public: true, Language: "ru", Weight: 1, ParentID: &s.culture.ID}
+	check(t, app.Store.Topics.Save(context.Background(), s.culture))
+	check(t, app.Store.Topics.Save(context.Background(), s.music))
+	check(t, app.Store.Topics.UpdatePaths(context.Background()))
+	// the topic is renamed, so its previous path is kept
+	s.music.Slug = "muzyka"
+	s.music.Path = "culture/music"
+	check(t, app.Store.Topics.Save(context.Background(), s.music))
+	check(t, app.Store.Topics.UpdatePaths(context.Background()))
+
+	s.article = &cms.Content{
+		ID:             primitive.NewObjectID(),
+		Public:         true,
+		Language:       "ru",
+		Type:           cms.Article,
+		Slug:           "concert",
+		OldSlugs:       []string{"old-concert"},
+		Title:          "Concert in the park",
+		Body:           "The orchestra played all night.",
+		Created:        time.Now().Add(-time.Hour),
+		Published:      time.Now().Add(-time.Hour),
+		PrimaryTopicID: s.music.ID,
+		TopicIDs:       []primitive.ObjectID{s.music.ID, s.culture.ID},
+		AuthorIDs:      []primitive.ObjectID{admin.ID},
+	}
+	check(t, app.Store.Content.Save(context.Background(), s.article))
+	// unpublished content must not be visible
+	check(t, app.Store.Content.Save(context.Background(), &cms.Content{
+		ID:             primitive.NewObjectID(),
+		Public:         true,
+		Language:       "ru",
+		Type:           cms.Article,
+		Slug:           "draft",
+		Title:          "Scheduled draft",
+		Scheduled:      time.Now().Add(time.Hour),
+		PrimaryTopicID: s.music.ID,
+		TopicIDs:       []primitive.ObjectID{s.music.ID},
+	}))
+	return s
+}
+
+// close restores the standard logger.
+func (s *testServer) close() {
+	log.SetOutput(os.Stderr)
+}
+
+// do serves the request and fails the test if a template failed to
+// render, because Render only logs such errors.
+func (s *testServer) do(t *testing.T, r *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	s.log.Reset()
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, r)
+	if strings.Contains(s.log.String(), "template:") {
+		t.Errorf("%s %s: %s", r.Method, r.URL, s.log.String())
+	}
+	return rec
+}
+
+func (s *testServer) get(t *testing.T, path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("GET", path, nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	return s.do(t, r)
+}
+
+func (s *testServer) post(t *testing.T, path string, form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	return s.do(t, r)
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expect checks the status code and the location of a redirect or a
+// text which must be in the body.
+func expect(t *testing.T, rec *httptest.ResponseRecorder, code int, s string) {
+	t.Helper()
+	if rec.Code != code {
+		t.Fatalf("status = %d, want %d", rec.Code, code)
+	}
+	if len(s) == 0 {
+		return
+	}
+	if code == http.StatusMovedPermanently || code == http.StatusSeeOther {
+		if loc := rec.Header().Get("Location"); loc != s {
+			t.Errorf("location = %q, want %q", loc, s)
+		}
+		return
+	}
+	if !strings.Contains(rec.Body.String(), s) {
+		t.Errorf("body doesn't contain %q", s)
+	}
+}
+
+func TestPublicPages(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	tests := []struct {
+		name, path string
+		code       int
+		// want is the location of a redirect or a text of the page
+		want string
+	}{
+		{"index", "/ru/", http.StatusOK, "Concert in the park"},
+		{"topic", "/ru/culture/muzyka", http.StatusOK, "Concert in the park"},
+		{"parent topic", "/ru/culture", http.StatusOK, "Concert in the park"},
+		{"content", "/ru/culture/muzyka/concert", http.StatusOK, "The orchestra played all night."},
+		{"login", "/ru/login", http.StatusOK, ""},
+		{"moved topic", "/ru/culture/music", http.StatusMovedPermanently, "/ru/culture/muzyka/"},
+		{"content of moved topic", "/ru/culture/music/concert", http.StatusMovedPermanently, "/ru/culture/muzyka/concert/"},
+		{"old slug", "/ru/culture/muzyka/old-concert", http.StatusMovedPermanently, "/ru/culture/muzyka/concert/"},
+		{"secondary topic", "/ru/culture/concert", http.StatusMovedPermanently, "/ru/culture/muzyka/concert/"},
+		{"unpublished content", "/ru/culture/muzyka/draft", http.StatusNotFound, ""},
+		{"missing content", "/ru/culture/muzyka/missing", http.StatusNotFound, ""},
+		{"missing topic", "/ru/missing", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expect(t, s.get(t, tt.path, nil), tt.code, tt.want)
+		})
+	}
+
+	t.Run("unpublished content in lists", func(t *testing.T) {
+		if strings.Contains(s.get(t, "/ru/", nil).Body.String(), "Scheduled draft") {
+			t.Error("scheduled content is listed")
+		}
+	})
+}
+
+func TestLogin(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	login := func(email, password string) *httptest.ResponseRecorder {
+		return s.post(t, "/ru/login", url.Values{
+			"Email.Address": {email},
+			"Password":      {password},
+		}, nil)
+	}
+
+	rec := login("admin@example.com", testPassword)
+	expect(t, rec, http.StatusSeeOther, "/ru/")
+	cookies := rec.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("login cookie is not set")
+	}
+	expect(t, s.get(t, "/ru/admin/", cookies[0]), http.StatusOK, "")
+
+	expect(t, login("admin@example.com", "wrong"), http.StatusUnauthorized, "")
+	expect(t, login("nobody@example.com", testPassword), http.StatusNotFound, "")
+
+	rec = s.get(t, "/ru/logout", cookies[0])
+	expect(t, rec, http.StatusSeeOther, "/ru/")
+	if c := rec.Result().Cookies(); len(c) == 0 || len(c[0].Value) > 0 {
+		t.Error("login cookie is not removed")
+	}
+}
+
+func TestAdminUnauthorized(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	for _, path := range []string{"/ru/admin/", "/ru/admin/topics/", "/ru/admin/content/"} {
+		expect(t, s.get(t, path, nil), http.StatusUnauthorized, "")
+	}
+
+	reader, err := user.New(testPassword, "reader@example.com", "Rita", "Reader", []user.Role{user.Visitor}, s.app.Config.Secret)
+	check(t, err)
+	check(t, s.app.Store.Users.Save(context.Background(), reader))
+	rec := httptest.NewRecorder()
+	check(t, user.SetLoginCookie(rec, reader, s.app.Config.Scookie, time.Hour))
+	expect(t, s.get(t, "/ru/admin/", rec.Result().Cookies()[0]), http.StatusUnauthorized, "")
+}
+
+func TestAdminPages(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	tests := []struct {
+		name, path, want string
+	}{
+		{"index", "/ru/admin/", ""},
+		{"topics", "/ru/admin/topics/", "Music"},
+		{"new topic", "/ru/admin/topics/new", "culture/muzyka"},
+		{"edit topic", "/ru/admin/topics/edit/" + s.culture.ID.Hex(), "Culture"},
+		{"content", "/ru/admin/content/", "Concert in the park"},
+		{"content of topic", "/ru/admin/content/?topic=" + s.music.ID.Hex(), "Concert in the park"},
+		{"filtered content", "/ru/admin/content/filter?type=" + strconv.Itoa(int(cms.Article)), "Concert in the park"},
+		{"users", "/ru/admin/users/", "admin@example.com"},
+		{"files", "/ru/admin/files/", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expect(t, s.get(t, tt.path, s.admin), http.StatusOK, tt.want)
+		})
+	}
+
+	expect(t, s.get(t, "/ru/admin/topics/edit/"+primitive.NewObjectID().Hex(), s.admin), http.StatusNotFound, "")
+}
+
+func TestAdminOrderTopics(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	rec := s.post(t, "/ru/admin/topics/order", url.Values{
+		"ID": {s.music.ID.Hex(), s.culture.ID.Hex()},
+	}, s.admin)
+	expect(t, rec, http.StatusNoContent, "")
+
+	tt, err := s.app.Store.Topics.All(context.Background(), store.TopicQuery{})
+	check(t, err)
+	if len(tt) != 2 || tt[0].ID != s.music.ID || tt[1].ID != s.culture.ID {
+		t.Errorf("topics are not reordered: %v", tt)
+	}
+
+	rec = s.post(t, "/ru/admin/topics/order", url.Values{"ID": {"invalid"}}, s.admin)
+	expect(t, rec, http.StatusBadRequest, "")
+}
+
+func TestPageCache(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	steps := []struct {
+		name   string
+		cookie *http.Cookie
+		want   string
+	}{
+		{"miss", nil, "MISS"},
+		{"hit", nil, "HIT"},
+		{"logged in", s.admin, ""},
+	}
+	for _, st := range steps {
+		if got := s.get(t, "/ru/", st.cookie).Header().Get("X-Cache"); got != st.want {
+			t.Errorf("%s: X-Cache is %q, want %q", st.name, got, st.want)
+		}
+	}
+
+	rec := s.post(t, "/ru/admin/topics/order", url.Values{
+		"ID": {s.music.ID.Hex(), s.culture.ID.Hex()},
+	}, s.admin)
+	expect(t, rec, http.StatusNoContent, "")
+	if got := s.get(t, "/ru/", nil).Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("X-Cache after topics are reordered is %q, want MISS", got)
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	for _, path := range []string{"/ru/", "/ru/culture", "/ru/culture/muzyka/concert"} {
+		for _, cookie := range []*http.Cookie{nil, s.admin} {
+			rec := s.get(t, path, cookie)
+			expect(t, rec, http.StatusOK, "")
+			etag := rec.Header().Get("ETag")
+			if len(etag) == 0 || len(rec.Header().Get("Last-Modified")) == 0 {
+				t.Fatalf("%s: no validators in %v", path, rec.Header())
+			}
+			if cookie == nil && !strings.Contains(rec.Header().Get("Surrogate-Key"), "lang-ru") {
+				t.Errorf("%s: no surrogate keys in %v", path, rec.Header())
+			}
+
+			r := httptest.NewRequest("GET", path, nil)
+			r.Header.Set("If-None-Match", etag)
+			if cookie != nil {
+				r.AddCookie(cookie)
+			}
+			expect(t, s.do(t, r), http.StatusNotModified, "")
+
+			r = httptest.NewRequest("GET", path, nil)
+			r.Header.Set("If-Modified-Since", rec.Header().Get("Last-Modified"))
+			if cookie != nil {
+				r.AddCookie(cookie)
+			}
+			expect(t, s.do(t, r), http.StatusNotModified, "")
+		}
+	}
+
+	etag := s.get(t, "/ru/culture/muzyka/concert", nil).Header().Get("ETag")
+	c, err := s.app.Store.Content.FindOne(context.Background(), store.ContentQuery{Slug: "concert"})
+	check(t, err)
+	c.Updated = time.Now()
+	check(t, s.app.Store.Content.Save(context.Background(), c))
+	invalidatePages(s.app, c.Language)
+	r := httptest.NewRequest("GET", "/ru/culture/muzyka/concert", nil)
+	r.Header.Set("If-None-Match", etag)
+	expect(t, s.do(t, r), http.StatusOK, "")
+}
+
+func TestAdminContentForms(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	ctx := context.Background()
+
+	expect(t, s.get(t, "/ru/admin/content/new", s.admin), http.StatusOK, "")
+
+	// slugs taken in the topic get a suffix
+	rec := s.post(t, "/ru/admin/content/", url.Values{
+		"Language":       {"ru"},
+		"Type":           {strconv.Itoa(int(cms.Article))},
+		"Title":          {"Concert"},
+		"Body":           {"The choir sang."},
+		"Public":         {"true"},
+		"PrimaryTopicID": {s.music.ID.Hex()},
+		"AuthorIDs":      {s.article.AuthorIDs[0].Hex()},
+		"Tags":           {"Jazz, Choir"},
+	}, s.admin)
+	expect(t, rec, http.StatusSeeOther, "")
+	c, err := s.app.Store.Content.FindOne(ctx, store.ContentQuery{Slug: "concert-2"})
+	check(t, err)
+	if c.PrimaryTopicID != s.music.ID || len(c.TagIDs) != 2 || c.PageTitle != "Concert" {
+		t.Fatalf("created content %+v", c)
+	}
+	path := "/ru/admin/content/edit/" + c.ID.Hex()
+	expect(t, s.get(t, path, s.admin), http.StatusOK, "Choir")
+
+	photo := &file.File{ID: primitive.NewObjectID(), URL: "/files/photo.jpg", Kind: file.ImageKind}
+	check(t, s.app.Store.Files.Save(ctx, photo))
+
+	rec = s.post(t, path, url.Values{
+		"Language":       {"ru"},
+		"Type":           {strconv.Itoa(int(cms.Article))},
+		"Created":        {c.Created.Format("2006-01-02T15:04")},
+		"Title":          {"Choir concert"},
+		"Body":           {"The choir sang again."},
+		"Public":         {"true"},
+		"PrimaryTopicID": {s.culture.ID.Hex()},
+		"TopicIDs":       {s.music.ID.Hex()},
+		"AuthorIDs":      {s.article.AuthorIDs[0].Hex(), ""},
+		"Tags":           {"Choir"},
+		"Images.0.URL":   {"/files/photo.jpg"},
+	}, s.admin)
+	expect(t, rec, http.StatusSeeOther, path)
+	c, err = s.app.Store.Content.Get(ctx, c.ID)
+	check(t, err)
+	if c.Title != "Choir concert" || c.Slug != "choir-concert" || c.PrimaryTopicID != s.culture.ID || len(c.TopicIDs) != 2 ||
+		len(c.AuthorIDs) != 1 || len(c.TagIDs) != 1 || len(c.Images) != 1 || c.Created.IsZero() {
+		t.Fatalf("edited content %+v", c)
+	}
+	if len(c.OldSlugs) != 1 || c.OldSlugs[0] != "concert-2" {
+		t.Errorf("old slugs %v", c.OldSlugs)
+	}
+	expect(t, s.get(t, "/ru/culture/choir-concert", nil), http.StatusOK, "The choir sang again.")
+
+	// content without topics has no primary topic
+	rec = s.post(t, path, url.Values{
+		"Language":  {"ru"},
+		"Type":      {strconv.Itoa(int(cms.Article))},
+		"Created":   {c.Created.Format("2006-01-02T15:04")},
+		"Title":     {"Choir concert"},
+		"Body":      {"The choir sang again."},
+		"AuthorIDs": {s.article.AuthorIDs[0].Hex()},
+	}, s.admin)
+	expect(t, rec, http.StatusSeeOther, path)
+	c, err = s.app.Store.Content.Get(ctx, c.ID)
+	check(t, err)
+	if !c.PrimaryTopicID.IsZero() || len(c.TopicIDs) != 0 {
+		t.Errorf("content without topics %+v", c)
+	}
+	expect(t, s.get(t, "/ru/admin/content/edit/"+primitive.NewObjectID().Hex(), s.admin), http.StatusNotFound, "")
+}
+
+// duplicateContent fails to save content as if the slug has been taken
+// meanwhile.
+type duplicateContent struct {
+	store.ContentStore
+}
+
+func (duplicateContent) Save(ctx context.Context, c *cms.Content) error {
+	return store.ErrDuplicate
+}
+
+func TestTagsOfOtherSchemes(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	ctx := context.Background()
+
+	// the tag was created when slugs were made by another scheme
+	old, err := s.app.Store.Tags.Create(ctx, "ru", []string{"Хор"}, func(string) string { return "old-khor" })
+	check(t, err)
+	ids, err := s.app.Store.Tags.Create(ctx, "ru", []string{"хор", "Jazz"}, s.app.Transliterator.Slugify)
+	check(t, err)
+	if len(ids) != 2 || ids[0] != old[0] {
+		t.Errorf("tags %v, want %v first", ids, old)
+	}
+}
+
+func TestContentSlugsInTopics(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	// the article is in the culture topic as a secondary one
+	expect(t, s.get(t, "/ru/culture/concert", nil), http.StatusMovedPermanently, "/ru/culture/muzyka/concert/")
+	check(t, s.app.Store.Content.Save(context.Background(), &cms.Content{
+		ID:             primitive.NewObjectID(),
+		Public:         true,
+		Language:       "ru",
+		Type:           cms.Article,
+		Slug:           "concert",
+		Title:          "Concert of the season",
+		Published:      time.Now().Add(-time.Hour),
+		PrimaryTopicID: s.culture.ID,
+		TopicIDs:       []primitive.ObjectID{s.culture.ID},
+	}))
+	expect(t, s.get(t, "/ru/culture/concert", nil), http.StatusOK, "Concert of the season")
+	expect(t, s.get(t, "/ru/culture/muzyka/concert", nil), http.StatusOK, "Concert in the park")
+
+	path := "/ru/admin/content/edit/" + s.article.ID.Hex()
+	s.app.Store.Content = duplicateContent{s.app.Store.Content}
+	rec := s.post(t, path, url.Values{
+		"Language":       {"ru"},
+		"Type":           {strconv.Itoa(int(cms.Article))},
+		"Created":        {s.article.Created.Format("2006-01-02T15:04")},
+		"Title":          {"Concert in the park"},
+		"PrimaryTopicID": {s.music.ID.Hex()},
+	}, s.admin)
+	expect(t, rec, http.StatusSeeOther, path+"?error=slug_taken")
+}
+
+func TestAdminUserForms(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	ctx := context.Background()
+
+	expect(t, s.get(t, "/ru/admin/users/new", s.admin), http.StatusOK, "")
+
+	// slugs of namesakes get a suffix
+	rec := s.post(t, "/ru/admin/users/", url.Values{
+		"Email":     {"ada@example.com"},
+		"FirstName": {"Ada"},
+		"LastName":  {"Admin"},
+		"Password":  {"secret"},
+		"Roles":     {strconv.Itoa(int(user.Author))},
+	}, s.admin)
+	expect(t, rec, http.StatusSeeOther, "/ru/admin/users/")
+	u, err := s.app.Store.Users.FindByEmail(ctx, "ada@example.com")
+	check(t, err)
+	if u.Slug != "ada-admin-2" || len(u.Roles) != 1 || u.Roles[0] != user.Author {
+		t.Fatalf("created user %+v", u)
+	}
+	path := "/ru/admin/users/edit/" + u.ID.Hex()
+	expect(t, s.get(t, path, s.admin), http.StatusOK, "ada@example.com")
+
+	rec = s.post(t, path, url.Values{
+		"ID":             {u.ID.Hex()},
+		"Email":          {"ada.lovelace@example.com"},
+		"FirstName":      {"Ada"},
+		"LastName":       {"Lovelace"},
+		"Roles":          {strconv.Itoa(int(user.Author))},
+		"Links":          {"https://example.com\n\n"},
+		"Bio.0.Language": {"ru"},
+		"Bio.0.Text":     {" Mathematician "},
+	}, s.admin)
+	expect(t, rec, http.StatusSeeOther, "")
+	u, err = s.app.Store.Users.Get(ctx, u.ID)
+	check(t, err)
+	if u.Email.Address != "ada.lovelace@example.com" || u.Slug != "ada-lovelace" || u.Bio["ru"] != "Mathematician" ||
+		len(u.Links) != 1 || len(u.PasswordHash) == 0 {
+		t.Fatalf("edited user %+v", u)
+	}
+}
+
+func TestAuthorPages(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	ctx := context.Background()
+
+	expect(t, s.get(t, "/ru/authors/ada-admin", nil), http.StatusOK, "Concert in the park")
+	expect(t, s.get(t, "/ru/authors", nil), http.StatusOK, "/ru/authors/ada-admin")
+	// the administrator has no published content in English
+	expect(t, s.get(t, "/en/authors/ada-admin", nil), http.StatusNotFound, "")
+
+	// visitors and authors without published content have no pages
+	for _, role := range []user.Role{user.Visitor, user.Author} {
+		u, err := user.New(testPassword, role.String()+"@example.com", "Bob", role.String(), []user.Role{role}, s.app.Config.Secret)
+		check(t, err)
+		u.Slug = "bob-" + strings.ToLower(role.String())
+		check(t, s.app.Store.Users.Save(ctx, u))
+		expect(t, s.get(t, "/ru/authors/"+u.Slug, nil), http.StatusNotFound, "")
+	}
+	visitor, err := s.app.Store.Users.FindBySlug(ctx, "bob-visitor")
+	check(t, err)
+	s.article.AuthorIDs = append(s.article.AuthorIDs, visitor.ID)
+	check(t, s.app.Store.Content.Save(ctx, s.article))
+	invalidatePages(s.app)
+	expect(t, s.get(t, "/ru/authors/bob-visitor", nil), http.StatusNotFound, "")
+	if rec := s.get(t, "/ru/authors", nil); strings.Contains(rec.Body.String(), "bob-visitor") {
+		t.Error("visitors are listed as authors")
+	}
+
+	// visitors get no slugs
+	rec := s.post(t, "/ru/admin/users/", url.Values{
+		"Email":     {"eve@example.com"},
+		"FirstName": {"Eve"},
+		"Password":  {"secret"},
+		"Roles":     {strconv.Itoa(int(user.Visitor))},
+	}, s.admin)
+	expect(t, rec, http.StatusSeeOther, "")
+	eve, err := s.app.Store.Users.FindByEmail(ctx, "eve@example.com")
+	check(t, err)
+	if len(eve.Slug) > 0 {
+		t.Errorf("visitor slug %q", eve.Slug)
+	}
+}
+
+func TestAdminPhotoPicker(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	ctx := context.Background()
+
+	photo := &file.File{ID: primitive.NewObjectID(), Title: "Portrait", URL: "/files/portrait.jpg", Kind: file.ImageKind}
+	check(t, s.app.Store.Files.Save(ctx, photo))
+	check(t, s.app.Store.Files.Save(ctx, &file.File{ID: primitive.NewObjectID(), Title: "Poster", URL: "/files/poster.jpg", Kind: file.ImageKind}))
+	check(t, s.app.Store.Files.Save(ctx, &file.File{ID: primitive.NewObjectID(), Title: "Portrait notes", URL: "/files/notes.txt", Kind: file.FileKind}))
+
+	// only the current photo is loaded into the form
+	admin, err := s.app.Store.Users.FindBySlug(ctx, "ada-admin")
+	check(t, err)
+	admin.PhotoID = &photo.ID
+	check(t, s.app.Store.Users.Save(ctx, admin))
+	rec := s.get(t, "/ru/admin/users/edit/"+admin.ID.Hex(), s.admin)
+	expect(t, rec, http.StatusOK, "Portrait")
+	if strings.Contains(rec.Body.String(), "Poster") {
+		t.Error("all photos are loaded")
+	}
+
+	rec = s.get(t, "/ru/admin/files/suggest?q=portrait", s.admin)
+	expect(t, rec, http.StatusOK, photo.ID.Hex())
+	if strings.Contains(rec.Body.String(), "notes") || strings.Contains(rec.Body.String(), "Poster") {
+		t.Errorf("suggested photos %s", rec.Body.String())
+	}
+}
+
+func TestAdminSaveTranslation(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	save := func(lang, value string) *httptest.ResponseRecorder {
+		return s.post(t, "/ru/admin/translations/", url.Values{
+			"Language":  {lang},
+			"MessageID": {"search_reindex"},
+			"Value":     {value},
+		}, s.admin)
+	}
+
+	expect(t, save("xx-invalid-!", "Reindex"), http.StatusBadRequest, "unknown language")
+	expect(t, save("de", "Reindex"), http.StatusBadRequest, "unknown language")
+	expect(t, save("be", "Reindex"), http.StatusSeeOther, "")
+	// the empty value restores the translation from the file
+	expect(t, save("be", ""), http.StatusSeeOther, "")
+}
+
+func TestSearchParams(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	check(t, s.app.Search.Index(searchDocument(s.article)))
+
+	tests := []struct {
+		query string
+		code  int
+		want  string
+	}{
+		{"q=concert", http.StatusOK, "/concert/"},
+		{"q=concert&p=0", http.StatusOK, "/concert/"},
+		{"q=concert&p=-3", http.StatusOK, "/concert/"},
+		{"q=concert&p=100000", http.StatusOK, ""},
+		{"q=concert&p=x", http.StatusBadRequest, ""},
+		{"q=concert&type=1000", http.StatusBadRequest, ""},
+		{"q=concert&type=x", http.StatusBadRequest, ""},
+		{"q=concert&year=99999", http.StatusBadRequest, ""},
+		{"q=concert&year=x", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		rec := s.get(t, "/ru/search?"+tt.query, nil)
+		if rec.Code != tt.code || !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%s: got %d", tt.query, rec.Code)
+		}
+	}
+}
+
+func TestAdminReindex(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	rec := s.post(t, "/ru/admin/search/reindex", url.Values{}, s.admin)
+	expect(t, rec, http.StatusSeeOther, "")
+	if loc := rec.Header().Get("Location"); loc != "/ru/admin/search/misses?indexed=2" {
+		t.Errorf("redirected to %s", loc)
+	}
+	res, err := s.app.Search.Search(context.Background(), &search.Query{Text: "concert", Language: "ru", Limit: 10})
+	check(t, err)
+	if res.Total != 1 {
+		t.Errorf("found %d items after reindex", res.Total)
+	}
+}
+
+func TestAdminTopicForm(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	ctx := context.Background()
+
+	save := func(title, lang, parent string) *httptest.ResponseRecorder {
+		return s.post(t, "/ru/admin/topics/", url.Values{
+			"Title":    {title},
+			"Language": {lang},
+			"ParentID": {parent},
+			"Public":   {"true"},
+		}, s.admin)
+	}
+
+	expect(t, save("Jazz", "be", s.music.ID.Hex()), http.StatusBadRequest, cms.ErrTopicLanguage.Error())
+	expect(t, save("Search", "ru", ""), http.StatusBadRequest, errReservedTopicSlug.Error())
+	// subsections may have reserved slugs
+	expect(t, save("Search", "ru", s.culture.ID.Hex()), http.StatusSeeOther, "")
+
+	// topics with the same titles get unique paths
+	expect(t, save("Music", "ru", s.culture.ID.Hex()), http.StatusSeeOther, "")
+	tt, err := s.app.Store.Topics.All(ctx, store.TopicQuery{ParentID: s.culture.ID})
+	check(t, err)
+	paths := map[string]bool{}
+	for _, v := range tt {
+		if paths[v.Path] {
+			t.Errorf("path %s is taken twice", v.Path)
+		}
+		paths[v.Path] = true
+	}
+	if len(tt) != 3 {
+		t.Errorf("%d subsections, want 3", len(tt))
+	}
+
+	// subsections and content of a topic don't hide each other
+	expect(t, save("Concert", "ru", s.music.ID.Hex()), http.StatusSeeOther, "")
+	expect(t, s.get(t, "/ru/culture/muzyka/concert", nil), http.StatusOK, "Concert in the park")
+	expect(t, s.get(t, "/ru/culture/muzyka/concert-2", nil), http.StatusOK, "")
+	rec := s.post(t, "/ru/admin/content/", url.Values{
+		"Language":       {"ru"},
+		"Type":           {strconv.Itoa(int(cms.Article))},
+		"Title":          {"Muzyka"},
+		"Public":         {"true"},
+		"PrimaryTopicID": {s.culture.ID.Hex()},
+		"AuthorIDs":      {s.article.AuthorIDs[0].Hex()},
+	}, s.admin)
+	expect(t, rec, http.StatusSeeOther, "")
+	_, err = s.app.Store.Content.FindOne(ctx, store.ContentQuery{Slug: "muzyka-2", PrimaryTopicID: s.culture.ID})
+	check(t, err)
+
+	// the language of a topic with subsections can't be changed
+	rec = s.post(t, "/ru/admin/topics/", url.Values{
+		"ID":       {s.culture.ID.Hex()},
+		"Title":    {"Culture"},
+		"Language": {"be"},
+		"Public":   {"true"},
+	}, s.admin)
+	expect(t, rec, http.StatusBadRequest, cms.ErrTopicLanguage.Error())
+}
+
+func TestAdminDeleteTopicWithSubsections(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	rec := s.get(t, "/ru/admin/topics/delete/"+s.culture.ID.Hex(), s.admin)
+	expect(t, rec, http.StatusInternalServerError, ErrDependentContentExist.Error())
+	_, err := s.app.Store.Topics.Get(context.Background(), s.culture.ID)
+	check(t, err)
+}
+
+func TestMediaLibrary(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	ctx := context.Background()
+
+	photo := &file.File{ID: primitive.NewObjectID(), Kind: file.ImageKind, Title: "Orchestra", Created: time.Now()}
+	photo.URL = "/files/" + photo.ID.Hex() + ".jpg"
+	report := &file.File{ID: primitive.NewObjectID(), Kind: file.FileKind, Title: "Annual", Filename: "Report-2019.pdf",
+		Folder: "reports", Created: time.Date(2019, 3, 1, 12, 0, 0, 0, time.Local)}
+	report.URL = "/files/" + report.ID.Hex() + ".pdf"
+	check(t, s.app.Store.Files.Save(ctx, photo))
+	check(t, s.app.Store.Files.Save(ctx, report))
+	// the photo is used in the body by a resized version
+	s.article.Body += "\n\n![](/img/" + photo.ID.Hex() + "/w_800)"
+	check(t, s.app.Store.Content.Save(ctx, s.article))
+
+	tests := []struct {
+		query     string
+		want, not string
+	}{
+		{"q=report", report.URL, photo.URL},
+		{"q=ORCHESTRA", photo.URL, report.URL},
+		{"kind=1", photo.URL, report.URL},
+		{"folder=reports", report.URL, photo.URL},
+		{"from=2019-03-01&to=2019-03-01", report.URL, photo.URL},
+		{"to=2019-02-28", "", report.URL},
+	}
+	for _, tt := range tests {
+		rec := s.get(t, "/ru/admin/files/?"+tt.query, s.admin)
+		expect(t, rec, http.StatusOK, tt.want)
+		if strings.Contains(rec.Body.String(), tt.not) {
+			t.Errorf("%s: %s is found", tt.query, tt.not)
+		}
+	}
+	expect(t, s.get(t, "/ru/admin/files/?from=yesterday", s.admin), http.StatusBadRequest, "")
+
+	expect(t, s.get(t, "/ru/admin/files/edit/"+photo.ID.Hex(), s.admin), http.StatusOK, "Concert in the park")
+	rec := s.get(t, "/ru/admin/files/orphaned", s.admin)
+	expect(t, rec, http.StatusOK, report.URL)
+	if strings.Contains(rec.Body.String(), photo.URL) {
+		t.Error("a used file is reported as orphaned")
+	}
+
+	expect(t, s.get(t, "/ru/admin/files/delete_/"+photo.ID.Hex(), s.admin), http.StatusConflict, "used by 1 content")
+	_, err := s.app.Store.Files.Get(ctx, photo.ID)
+	check(t, err)
+	// the general delete route doesn't bypass the check
+	expect(t, s.get(t, "/ru/admin/files/delete/"+photo.ID.Hex(), s.admin), http.StatusNotFound, "")
+	_, err = s.app.Store.Files.Get(ctx, photo.ID)
+	check(t, err)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bahna/magazine/webserver/file"
+	"github.com/bahna/magazine/webserver/imaging"
+	"github.com/bahna/magazine/webserver/store"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// imageHandler serves resized versions of uploaded images at
+// /img/{id}/{params}, e.g. /img/5c8a1d5b0000000000000000/w_800,fmt_webp.
+// Versions are made on the first request and served from disk later.
+// Crops like c_card are cut around the focus of the image or as chosen
+// by editors, their URLs have versions of the crops, see CropURL.
+func imageHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := primitive.ObjectIDFromHex(vars["id"])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		p, err := imaging.Parse(vars["params"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		f, err := app.Store.Files.Get(r.Context(), id)
+		Check(err)
+		if f.Kind != file.ImageKind || !imaging.Resizable(f.URL) {
+			http.NotFound(w, r)
+			return
+		}
+		if len(p.Format) == 0 {
+			p.Format = imaging.FormatOf(f.URL)
+		}
+		src := f.Name(app.Config.FilesDir)
+		if len(p.Crop) > 0 {
+			if f.Width == 0 {
+				// uploaded before dimensions were recorded
+				f.Width, f.Height, err = imaging.Size(src)
+				Check(err)
+			}
+			p.Area = f.CropArea(p.Crop)
+		}
+
+		name, err := app.Images.Path(id.Hex(), src, p)
+		Check(err)
+
+		// URLs of crops change with their versions, see CropURL
+		w.Header().Set("Content-Type", imaging.ContentType(p.Format))
+		w.Header().Set("Cache-Control", "public, max-age="+app.Config.MaxAge)
+		http.ServeFile(w, r, name)
+	})
+}
+
+// imageURL returns a URL of a resized version of the uploaded image at
+// the URL, ok is false if the URL isn't of an uploaded raster image.
+func imageURL(src string, p imaging.Params) (u string, ok bool) {
+	id, ok := imageID(src)
+	if !ok {
+		return "", false
+	}
+	return "/img/" + id + "/" + p.String(), true
+}
+
+// imageID returns the ID of the uploaded raster image at the URL.
+func imageID(src string) (id string, ok bool) {
+	if !strings.HasPrefix(src, "/files/") || !imaging.Resizable(src) {
+		return "", false
+	}
+	// originals and optimized versions are named by IDs of files
+	name := src[strings.LastIndex(src, "/")+1:]
+	if len(name) < 24 || !primitive.IsValidObjectID(name[:24]) {
+		return "", false
+	}
+	return name[:24], true
+}
+
+// cropVersions keep versions of crops of images by their IDs, see
+// file.File.CropVersion. Only images with the focus or crops set by
+// editors have versions, so all of them are kept in memory.
+type cropVersions struct {
+	mu sync.RWMutex
+	m  map[string]string
+}
+
+// loadCropVersions returns versions of crops of all images.
+func loadCropVersions(ctx context.Context, s store.FileStore) (*cropVersions, error) {
+	ff, err := s.Find(ctx, store.FileQuery{Kinds: []int{file.ImageKind}, Cropped: true})
+	if err != nil {
+		return nil, err
+	}
+	v := &cropVersions{m: make(map[string]string, len(ff))}
+	for _, f := range ff {
+		v.m[f.ID.Hex()] = f.CropVersion()
+	}
+	return v, nil
+}
+
+// Set updates the version of crops of the image after it is saved.
+func (v *cropVersions) Set(f *file.File) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s := f.CropVersion(); len(s) > 0 {
+		v.m[f.ID.Hex()] = s
+	} else {
+		delete(v.m, f.ID.Hex())
+	}
+}
+
+// Get returns the version of crops of the image with the ID.
+func (v *cropVersions) Get(id string) string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.m[id]
+}
+
+// imageCropsFromForm reads the focus and crops of an image of the size
+// from percents in the FocusX, FocusY and Crop.{name}.X, Y, W fields.
+// Heights of crops follow from their ratios, crops without widths are
+// made around the focus.
+func imageCropsFromForm(r *http.Request, width, height int) (focus *imaging.Point, crops map[string]imaging.Rect) {
+	percent := func(name string) (float64, bool) {
+		v, err := strconv.ParseFloat(r.FormValue(name), 64)
+		if err != nil || v < 0 || v > 100 {
+			return 0, false
+		}
+		return v / 100, true
+	}
+
+	x, okX := percent("FocusX")
+	y, okY := percent("FocusY")
+	if okX && okY && (x != imaging.Center.X || y != imaging.Center.Y) {
+		focus = &imaging.Point{X: x, Y: y}
+	}
+
+	for _, c := range imaging.Crops {
+		prefix := "Crop." + c.Name + "."
+		w, ok := percent(prefix + "W")
+		if !ok || w == 0 || width == 0 || height == 0 {
+			continue
+		}
+		rect := imaging.Rect{W: w, H: w * float64(width) / c.Ratio / float64(height)}
+		if rect.H > 1 {
+			// too wide for the image, the full height is taken
+			rect.W, rect.H = rect.W/rect.H, 1
+		}
+		rect.X, _ = percent(prefix + "X")
+		rect.Y, _ = percent(prefix + "Y")
+		rect.X = math.Min(rect.X, 1-rect.W)
+		rect.Y = math.Min(rect.Y, 1-rect.H)
+		if crops == nil {
+			crops = make(map[string]imaging.Rect)
+		}
+		crops[c.Name] = rect
+	}
+	return
+}
+
+// imagesCommand runs the "images" subcommand.
+func imagesCommand(app *application, args []string) error {
+	fs := flag.NewFlagSet("images", flag.ExitOnError)
+	formats := fs.String("formats", "webp,avif", "formats made in advance besides the original ones")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: magazine-server images [-formats webp,avif] regenerate")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.Arg(0) != "regenerate" {
+		fs.Usage()
+		return fmt.Errorf("unknown images command %q", fs.Arg(0))
+	}
+	n, err := regenerateImages(context.Background(), app, strings.Split(*formats, ","))
+	if err != nil {
+		return err
+	}
+	log.Printf("regenerated resized versions of %d images", n)
+	return nil
+}
+
+// regenerateImages strips metadata with locations and names from all
+// images and their optimized versions uploaded before it was done on
+// upload, updates dimensions and colors of images and makes their
+// resized versions again in the formats and the original ones.
+func regenerateImages(ctx context.Context, app *application, formats []string) (int, error) {
+	ff, err := app.Store.Files.Find(ctx, store.FileQuery{Kinds: []int{file.ImageKind}})
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, f := range ff {
+		src := f.Name(app.Config.FilesDir)
+		meta, err := imaging.Sanitize(src)
+		if err != nil {
+			log.Printf("images: %s is skipped: %v", f.URL, err)
+			continue
+		}
+		for _, o := range f.Optimized {
+			optimized := &file.File{URL: o.URL}
+			if _, err = imaging.Sanitize(optimized.Name(app.Config.FilesDir)); err != nil {
+				log.Printf("images: %s is kept: %v", o.URL, err)
+			}
+		}
+		if f.Metadata == nil && meta != nil {
+			f.Metadata = meta
+			if len(f.Credits) == 0 {
+				f.Credits = meta.Credits()
+			}
+		}
+		if f.Width, f.Height, err = imaging.Size(src); err != nil {
+			log.Printf("images: %s is skipped: %v", f.URL, err)
+			continue
+		}
+		if f.Color, err = imaging.Color(src); err != nil {
+			return n, err
+		}
+		if err = app.Store.Files.Save(ctx, f); err != nil {
+			return n, err
+		}
+
+		if err = app.Images.Remove(f.ID.Hex()); err != nil {
+			return n, err
+		}
+		for _, w := range imaging.WidthsUpTo(f.Width) {
+			for _, format := range append([]string{imaging.FormatOf(f.URL)}, formats...) {
+				p := imaging.Params{Width: w, Format: strings.TrimSpace(format)}
+				if _, err = app.Images.Path(f.ID.Hex(), src, p); err != nil {
+					return n, err
+				}
+			}
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bahna/magazine/webserver/cms"
+	"github.com/bahna/magazine/webserver/file"
+	"github.com/bahna/magazine/webserver/imaging"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestImages(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	dir, err := ioutil.TempDir("", "files")
+	check(t, err)
+	defer os.RemoveAll(dir)
+	s.app.Config.FilesDir = dir
+	var area imaging.Rect
+	s.app.Images = imaging.NewCache(filepath.Join(dir, "derivatives"), func(src string, p imaging.Params) ([]byte, error) {
+		area = p.Area
+		return []byte(filepath.Base(src) + " " + p.String()), nil
+	}, 1)
+
+	img := &file.File{ID: primitive.NewObjectID(), Kind: file.ImageKind, Width: 700, Height: 400, Color: "#c80a0a", Credits: "Photographer"}
+	img.URL = "/files/" + img.ID.Hex() + ".jpg"
+	check(t, s.app.Store.Files.Save(context.Background(), img))
+	check(t, ioutil.WriteFile(img.Name(dir), []byte("jpeg"), 0644))
+
+	// SVG images uploaded before they became files have the image kind
+	svg := &file.File{ID: primitive.NewObjectID(), Kind: file.ImageKind}
+	svg.URL = "/files/" + svg.ID.Hex() + ".svg"
+	check(t, s.app.Store.Files.Save(context.Background(), svg))
+
+	prefix := "/img/" + img.ID.Hex() + "/"
+	tests := []struct {
+		path, contentType, body string
+		code                    int
+	}{
+		{prefix + "w_640,fmt_webp", "image/webp", img.ID.Hex() + ".jpg w_640,fmt_webp", 200},
+		{prefix + "w_320", "image/jpeg", img.ID.Hex() + ".jpg w_320,fmt_jpeg", 200},
+		{prefix + "w_700", "", "", 400},
+		{"/img/" + primitive.NewObjectID().Hex() + "/w_320", "", "", 404},
+		{"/img/x/w_320", "", "", 404},
+		{"/img/" + svg.ID.Hex() + "/w_320", "", "", 404},
+	}
+	for _, tt := range tests {
+		rec := s.get(t, tt.path, nil)
+		if rec.Code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.path, rec.Code, tt.code)
+			continue
+		}
+		if tt.code == 200 && (rec.Header().Get("Content-Type") != tt.contentType || rec.Body.String() != tt.body) {
+			t.Errorf("%s: got %s %q", tt.path, rec.Header().Get("Content-Type"), rec.Body.String())
+		}
+	}
+
+	// editors set the focus and crops, which are made again
+	form := url.Values{
+		"Title":       {"Orchestra"},
+		"Credits":     {"Photographer"},
+		"FocusX":      {"10"},
+		"FocusY":      {"50"},
+		"Crop.card.X": {"20"},
+		"Crop.card.Y": {"10"},
+		"Crop.card.W": {"50"},
+	}
+	if rec := s.get(t, "/ru/admin/files/edit/"+img.ID.Hex(), s.admin); rec.Code != 200 {
+		t.Fatalf("edit page: got %d", rec.Code)
+	}
+	cropURL := CropURL(s.app.CropVersions)
+	if u := cropURL(img.URL, "card", 320); u != prefix+"w_320,c_card" {
+		t.Errorf("crop URL before the edit %q", u)
+	}
+	if rec := s.post(t, "/ru/admin/files/edit/"+img.ID.Hex(), form, s.admin); rec.Code != 303 {
+		t.Fatalf("edit: got %d", rec.Code)
+	}
+	// URLs of crops change with them, so caches don't keep old ones
+	edited := cropURL(img.URL, "card", 320)
+	if !strings.HasPrefix(edited, prefix+"w_320,c_card,v_") {
+		t.Errorf("crop URL after the edit %q", edited)
+	}
+	form.Set("FocusX", "20")
+	if rec := s.post(t, "/ru/admin/files/edit/"+img.ID.Hex(), form, s.admin); rec.Code != 303 {
+		t.Fatalf("edit: got %d", rec.Code)
+	}
+	if u := cropURL(img.URL, "card", 320); u == edited {
+		t.Errorf("crop URL %q is kept after the focus is changed", u)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "derivatives", img.ID.Hex())); !os.IsNotExist(err) {
+		t.Errorf("derivatives are kept after the edit: %v", err)
+	}
+	crops := []struct {
+		params string
+		want   imaging.Rect
+	}{
+		{"w_320,c_square,v_1", imaging.Rect{W: 400.0 / 700, H: 1}},
+		{"w_320,c_card", imaging.Rect{X: 0.2, Y: 0.1, W: 0.5, H: 0.5 * 700 / (16.0 / 9) / 400}},
+	}
+	for _, tt := range crops {
+		if rec := s.get(t, prefix+tt.params, nil); rec.Code != 200 {
+			t.Errorf("%s: got %d", tt.params, rec.Code)
+		}
+		if math.Abs(area.X-tt.want.X) > 1e-9 || math.Abs(area.Y-tt.want.Y) > 1e-9 ||
+			math.Abs(area.W-tt.want.W) > 1e-9 || math.Abs(area.H-tt.want.H) > 1e-9 {
+			t.Errorf("%s: area %+v, want %+v", tt.params, area, tt.want)
+		}
+	}
+
+	// material pages offer versions up to the original width
+	s.article.Images = append(s.article.Images, cms.Image{URL: img.URL, Caption: "Orchestra"})
+	check(t, s.app.Store.Content.Save(context.Background(), s.article))
+	body := s.get(t, "/ru/culture/muzyka/concert", nil).Body.String()
+	for _, want := range []string{
+		prefix + "w_640,fmt_avif 640w",
+		prefix + "w_480,fmt_webp 480w",
+		prefix + "w_320 320w",
+		`sizes="(min-width: 52em) 50vw, 100vw"`,
+		`width="700" height="400" style="background-color: #c80a0a"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("material page doesn't contain %q", want)
+		}
+	}
+	if strings.Contains(body, "w_800") {
+		t.Error("material page offers images wider than the original")
+	}
+
+	// vector images are used as is
+	if set := Srcset(svg.URL, 0, ""); len(set) > 0 {
+		t.Errorf("srcset of SVG %q", set)
+	}
+	if u := CropURL(s.app.CropVersions)(svg.URL, "card", 320); u != svg.URL {
+		t.Errorf("crop of SVG %q", u)
+	}
+}
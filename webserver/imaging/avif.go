@@ -0,0 +1,84 @@
+package imaging
+
+// #cgo pkg-config: vips
+// #include <stdlib.h>
+// #include <vips/vips.h>
+//
+// // avif_make rotates the image file upright, crops it to the area
+// // unless its width is zero, resizes it to the target width without
+// // enlarging it and saves it as AVIF. It requires libvips 8.9 built
+// // with libheif.
+// static int avif_make(const char *src, int left, int top, int width, int height,
+// 		int target, int quality, void **buf, size_t *len) {
+// 	VipsImage *in, *out;
+// 	int err;
+//
+// 	if (!(in = vips_image_new_from_file(src, NULL)))
+// 		return -1;
+// 	err = vips_autorot(in, &out, NULL);
+// 	g_object_unref(in);
+// 	if (err)
+// 		return -1;
+// 	in = out;
+// 	if (width > 0) {
+// 		err = vips_extract_area(in, &out, left, top, width, height, NULL);
+// 		g_object_unref(in);
+// 		if (err)
+// 			return -1;
+// 		in = out;
+// 	}
+// 	if (target > 0 && target < in->Xsize) {
+// 		err = vips_resize(in, &out, (double) target / in->Xsize, NULL);
+// 		g_object_unref(in);
+// 		if (err)
+// 			return -1;
+// 		in = out;
+// 	}
+// 	err = vips_heifsave_buffer(in, buf, len,
+// 		"Q", quality,
+// 		"compression", VIPS_FOREIGN_HEIF_COMPRESSION_AV1,
+// 		"strip", TRUE,
+// 		NULL);
+// 	g_object_unref(in);
+// 	return err;
+// }
+//
+// // avif_save calls avif_make and frees vips resources of the thread
+// // it has run on, Go may run the next call on another thread. Errors
+// // are kept in the global error buffer.
+// static int avif_save(const char *src, int left, int top, int width, int height,
+// 		int target, int quality, void **buf, size_t *len) {
+// 	int err = avif_make(src, left, top, width, height, target, quality, buf, len);
+// 	vips_thread_shutdown();
+// 	return err;
+// }
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// avif makes an AVIF derivative of the image file.
+func avif(src string, p Params, quality int) ([]byte, error) {
+	var left, top, width, height int
+	if !p.Area.IsZero() {
+		w, h, err := Size(src)
+		if err != nil {
+			return nil, err
+		}
+		left, top, width, height = p.Area.Pixels(w, h)
+	}
+	cSrc := C.CString(src)
+	defer C.free(unsafe.Pointer(cSrc))
+
+	var buf unsafe.Pointer
+	var size C.size_t
+	if C.avif_save(cSrc, C.int(left), C.int(top), C.int(width), C.int(height),
+		C.int(p.Width), C.int(quality), &buf, &size) != 0 {
+		defer C.vips_error_clear()
+		return nil, errors.New(C.GoString(C.vips_error_buffer()))
+	}
+	defer C.g_free(C.gpointer(buf))
+	return C.GoBytes(buf, C.int(size)), nil
+}
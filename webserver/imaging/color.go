@@ -0,0 +1,47 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// Dominant returns the most common color of the image. Colors are
+// counted in buckets of similar colors, the average color of the
+// largest bucket is returned. Transparent pixels are skipped.
+func Dominant(img image.Image) color.RGBA {
+	type bucket struct {
+		n       int
+		r, g, b int
+	}
+	var buckets [4096]bucket
+	largest := -1
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A < 128 {
+				continue
+			}
+			i := int(c.R>>4)<<8 | int(c.G>>4)<<4 | int(c.B>>4)
+			b := &buckets[i]
+			b.n++
+			b.r += int(c.R)
+			b.g += int(c.G)
+			b.b += int(c.B)
+			if largest < 0 || b.n > buckets[largest].n {
+				largest = i
+			}
+		}
+	}
+	if largest < 0 {
+		return color.RGBA{}
+	}
+	b := buckets[largest]
+	return color.RGBA{uint8(b.r / b.n), uint8(b.g / b.n), uint8(b.b / b.n), 255}
+}
+
+// Hex returns the color in the #rrggbb form of CSS.
+func Hex(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
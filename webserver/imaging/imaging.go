@@ -0,0 +1,383 @@
+// Package imaging makes resized and cropped versions of uploaded
+// images, called derivatives, on the fly and keeps them on disk.
+// Derivatives are requested by parameters like "w_800,c_card,fmt_webp",
+// widths and crops are limited to whitelists, so that the cache doesn't
+// grow with arbitrary requests.
+package imaging
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Widths are the allowed widths of derivatives in pixels.
+var Widths = []int{320, 480, 640, 800, 1024, 1280, 1600, 2048}
+
+// Formats of derivatives.
+const (
+	JPEG = "jpeg"
+	PNG  = "png"
+	WEBP = "webp"
+	AVIF = "avif"
+)
+
+var formats = map[string]struct {
+	ext, contentType string
+}{
+	JPEG: {".jpg", "image/jpeg"},
+	PNG:  {".png", "image/png"},
+	WEBP: {".webp", "image/webp"},
+	AVIF: {".avif", "image/avif"},
+}
+
+// Crop is a named aspect ratio of derivatives, Ratio is width divided
+// by height.
+type Crop struct {
+	Name  string
+	Ratio float64
+}
+
+// Crops are the allowed crops: "card" for content cards, "square" for
+// social networks and "wide" for promoted full-width covers.
+var Crops = []Crop{
+	{"card", 16.0 / 9},
+	{"square", 1},
+	{"wide", 21.0 / 9},
+}
+
+// CropByName returns the allowed crop with the name.
+func CropByName(name string) (Crop, bool) {
+	for _, c := range Crops {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Crop{}, false
+}
+
+// Point is a position in an image relative to its size, {0.5, 0.5} is
+// the center.
+type Point struct {
+	X, Y float64
+}
+
+// Center is the default focus of images.
+var Center = Point{0.5, 0.5}
+
+// Rect is an area of an image relative to its size. The zero Rect
+// means the whole image.
+type Rect struct {
+	X, Y, W, H float64
+}
+
+// IsZero reports whether r is the zero Rect.
+func (r Rect) IsZero() bool {
+	return r == Rect{}
+}
+
+// Pixels returns the area in pixels of an image of the size, it is
+// kept within the image.
+func (r Rect) Pixels(width, height int) (left, top, w, h int) {
+	if r.IsZero() {
+		return 0, 0, width, height
+	}
+	left = clampInt(int(math.Round(r.X*float64(width))), 0, width-1)
+	top = clampInt(int(math.Round(r.Y*float64(height))), 0, height-1)
+	w = clampInt(int(math.Round(r.W*float64(width))), 1, width-left)
+	h = clampInt(int(math.Round(r.H*float64(height))), 1, height-top)
+	return
+}
+
+// Area returns the largest area with the aspect ratio of the crop in an
+// image of the size, which is centered on the focus as much as the
+// image allows. It returns the zero Rect if the size is unknown.
+func (c Crop) Area(width, height int, focus Point) Rect {
+	if width <= 0 || height <= 0 || c.Ratio <= 0 {
+		return Rect{}
+	}
+	r := Rect{W: 1, H: 1}
+	if ratio := float64(width) / float64(height); ratio > c.Ratio {
+		r.W = c.Ratio / ratio
+		r.X = clamp(focus.X-r.W/2, 0, 1-r.W)
+	} else {
+		r.H = ratio / c.Ratio
+		r.Y = clamp(focus.Y-r.H/2, 0, 1-r.H)
+	}
+	return r
+}
+
+func clamp(v, min, max float64) float64 {
+	return math.Max(min, math.Min(max, v))
+}
+
+func clampInt(v, min, max int) int {
+	if v > max {
+		v = max
+	}
+	if v < min {
+		v = min
+	}
+	return v
+}
+
+var (
+	ErrInvalidParams = errors.New("invalid image parameters")
+	ErrInvalidWidth  = errors.New("width is not allowed")
+	ErrInvalidFormat = errors.New("unknown image format")
+	ErrInvalidCrop   = errors.New("unknown crop")
+)
+
+// Params describe a derivative. Zero width keeps the original width,
+// an empty format keeps the original format. Cropped derivatives are
+// cut to Area, which is set by the caller for the crop of the image.
+// Version of the crop only changes URLs after editors change crops.
+type Params struct {
+	Width   int
+	Crop    string
+	Version string
+	Format  string
+	Area    Rect
+}
+
+// Parse parses parameters like "w_800,c_card,fmt_webp".
+func Parse(s string) (p Params, err error) {
+	for _, v := range strings.Split(s, ",") {
+		kv := strings.SplitN(v, "_", 2)
+		if len(kv) != 2 {
+			return p, ErrInvalidParams
+		}
+		switch kv[0] {
+		case "w":
+			if p.Width, err = strconv.Atoi(kv[1]); err != nil || !allowedWidth(p.Width) {
+				return p, ErrInvalidWidth
+			}
+		case "c":
+			if _, ok := CropByName(kv[1]); !ok {
+				return p, ErrInvalidCrop
+			}
+			p.Crop = kv[1]
+		case "v":
+			if !validVersion(kv[1]) {
+				return p, ErrInvalidParams
+			}
+			p.Version = kv[1]
+		case "fmt":
+			if _, ok := formats[kv[1]]; !ok {
+				return p, ErrInvalidFormat
+			}
+			p.Format = kv[1]
+		default:
+			return p, ErrInvalidParams
+		}
+	}
+	return p, nil
+}
+
+// String returns the parameters in the form accepted by Parse.
+func (p Params) String() string {
+	var ss []string
+	if p.Width > 0 {
+		ss = append(ss, fmt.Sprintf("w_%d", p.Width))
+	}
+	if len(p.Crop) > 0 {
+		ss = append(ss, "c_"+p.Crop)
+	}
+	if len(p.Version) > 0 {
+		ss = append(ss, "v_"+p.Version)
+	}
+	if len(p.Format) > 0 {
+		ss = append(ss, "fmt_"+p.Format)
+	}
+	return strings.Join(ss, ",")
+}
+
+// validVersion checks that the version is a short string of lowercase
+// letters and digits, it is a part of file names of derivatives.
+func validVersion(v string) bool {
+	if len(v) == 0 || len(v) > 16 {
+		return false
+	}
+	for _, r := range v {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+func allowedWidth(w int) bool {
+	for _, v := range Widths {
+		if v == w {
+			return true
+		}
+	}
+	return false
+}
+
+// resizable are extensions of images which derivatives are made of.
+var resizable = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".avif": true,
+}
+
+// Resizable checks by the extension if derivatives can be made of the
+// image file. Vector images like SVG are served as is.
+func Resizable(name string) bool {
+	return resizable[strings.ToLower(path.Ext(name))]
+}
+
+// FormatOf returns a format of derivatives of the image file which
+// are requested without a format. Formats which can't be written, like
+// GIF, are converted to PNG.
+func FormatOf(name string) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".jpg", ".jpeg":
+		return JPEG
+	case ".webp":
+		return WEBP
+	case ".avif":
+		return AVIF
+	}
+	return PNG
+}
+
+// ContentType returns a MIME type of the format.
+func ContentType(format string) string {
+	return formats[format].contentType
+}
+
+// WidthsUpTo returns the allowed widths which don't exceed the width
+// of an original image, all widths if it is unknown.
+func WidthsUpTo(width int) []int {
+	if width <= 0 {
+		return Widths
+	}
+	var ww []int
+	for _, v := range Widths {
+		if v <= width {
+			ww = append(ww, v)
+		}
+	}
+	return ww
+}
+
+// Transform makes a derivative of the image file.
+type Transform func(src string, p Params) ([]byte, error)
+
+// Cache keeps derivatives in subdirectories of Dir by IDs of images.
+// A derivative is made once even if it is requested concurrently, and
+// at most as many transforms run at once as the cache has workers.
+type Cache struct {
+	Dir       string
+	Transform Transform
+
+	workers  chan struct{}
+	mu       sync.Mutex
+	inflight map[string]*call
+}
+
+type call struct {
+	done chan struct{}
+	err  error
+}
+
+// NewCache returns a cache in the directory.
+func NewCache(dir string, t Transform, workers int) *Cache {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Cache{
+		Dir:       dir,
+		Transform: t,
+		workers:   make(chan struct{}, workers),
+		inflight:  make(map[string]*call),
+	}
+}
+
+// name returns a path of the derivative, the format must be set.
+func (c *Cache) name(id string, p Params) string {
+	return filepath.Join(c.Dir, id, p.String()+formats[p.Format].ext)
+}
+
+// Path returns a path of the derivative of the image with the ID
+// stored at src. The derivative is made if it doesn't exist yet.
+func (c *Cache) Path(id, src string, p Params) (string, error) {
+	if len(id) == 0 || filepath.Base(id) != id {
+		return "", fmt.Errorf("invalid image ID %q", id)
+	}
+	if len(p.Format) == 0 {
+		p.Format = FormatOf(src)
+	}
+	if _, ok := formats[p.Format]; !ok {
+		return "", ErrInvalidFormat
+	}
+	name := c.name(id, p)
+	if _, err := os.Stat(name); err == nil {
+		return name, nil
+	}
+
+	c.mu.Lock()
+	if cl, ok := c.inflight[name]; ok {
+		c.mu.Unlock()
+		<-cl.done
+		return name, cl.err
+	}
+	cl := &call{done: make(chan struct{})}
+	c.inflight[name] = cl
+	c.mu.Unlock()
+
+	cl.err = c.make(name, src, p)
+
+	c.mu.Lock()
+	delete(c.inflight, name)
+	c.mu.Unlock()
+	close(cl.done)
+	return name, cl.err
+}
+
+// make writes the derivative to a temporary file first, so that
+// readers never get a partially written derivative.
+func (c *Cache) make(name, src string, p Params) error {
+	c.workers <- struct{}{}
+	b, err := c.Transform(src, p)
+	<-c.workers
+	if err != nil {
+		return fmt.Errorf("failed to make %s of %s: %v", p, src, err)
+	}
+	if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), ".derivative")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// Remove deletes derivatives of the image.
+func (c *Cache) Remove(id string) error {
+	if len(id) == 0 || filepath.Base(id) != id {
+		return fmt.Errorf("invalid image ID %q", id)
+	}
+	return os.RemoveAll(filepath.Join(c.Dir, id))
+}
@@ -0,0 +1,126 @@
+package imaging
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Params
+		err  error
+	}{
+		{"w_800,fmt_webp", Params{Width: 800, Format: WEBP}, nil},
+		{"fmt_avif,w_320", Params{Width: 320, Format: AVIF}, nil},
+		{"w_640", Params{Width: 640}, nil},
+		{"fmt_png", Params{Format: PNG}, nil},
+		{"w_320,c_card", Params{Width: 320, Crop: "card"}, nil},
+		{"w_320,c_card,v_1x2y", Params{Width: 320, Crop: "card", Version: "1x2y"}, nil},
+		{"c_card,v_../x", Params{}, ErrInvalidParams},
+		{"c_card,v_", Params{}, ErrInvalidParams},
+		{"c_portrait", Params{}, ErrInvalidCrop},
+		{"w_801", Params{}, ErrInvalidWidth},
+		{"w_x", Params{}, ErrInvalidWidth},
+		{"fmt_bmp", Params{}, ErrInvalidFormat},
+		{"h_800", Params{}, ErrInvalidParams},
+		{"", Params{}, ErrInvalidParams},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.s)
+		if err != tt.err || (err == nil && got != tt.want) {
+			t.Errorf("Parse(%q) = %+v, %v, want %+v, %v", tt.s, got, err, tt.want, tt.err)
+		}
+	}
+	if s := (Params{Width: 800, Crop: "square", Version: "1x2y", Format: WEBP}).String(); s != "w_800,c_square,v_1x2y,fmt_webp" {
+		t.Errorf("String() = %q", s)
+	}
+}
+
+func TestCropArea(t *testing.T) {
+	card, _ := CropByName("card")
+	square, _ := CropByName("square")
+	tests := []struct {
+		crop          Crop
+		width, height int
+		focus         Point
+		want          Rect
+	}{
+		{square, 400, 200, Center, Rect{X: 0.25, W: 0.5, H: 1}},
+		{square, 400, 200, Point{0.1, 0.5}, Rect{W: 0.5, H: 1}},
+		{square, 400, 200, Point{0.9, 0.5}, Rect{X: 0.5, W: 0.5, H: 1}},
+		{square, 200, 400, Point{0.5, 0.3}, Rect{Y: 0.05, W: 1, H: 0.5}},
+		{card, 1600, 900, Center, Rect{W: 1, H: 1}},
+		{card, 1600, 900, Point{}, Rect{W: 1, H: 1}},
+		{card, 0, 0, Center, Rect{}},
+	}
+	for _, tt := range tests {
+		got := tt.crop.Area(tt.width, tt.height, tt.focus)
+		if math.Abs(got.X-tt.want.X) > 1e-9 || math.Abs(got.Y-tt.want.Y) > 1e-9 ||
+			math.Abs(got.W-tt.want.W) > 1e-9 || math.Abs(got.H-tt.want.H) > 1e-9 {
+			t.Errorf("%s of %dx%d at %v = %+v, want %+v", tt.crop.Name, tt.width, tt.height, tt.focus, got, tt.want)
+		}
+	}
+
+	left, top, w, h := Rect{X: 0.25, W: 0.5, H: 1}.Pixels(400, 200)
+	if left != 100 || top != 0 || w != 200 || h != 200 {
+		t.Errorf("Pixels() = %d %d %d %d", left, top, w, h)
+	}
+}
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	transforms := 0
+	c := NewCache(dir, func(src string, p Params) ([]byte, error) {
+		mu.Lock()
+		transforms++
+		mu.Unlock()
+		return []byte(fmt.Sprintf("%s %s", src, p)), nil
+	}, 2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Path("1", "photo.jpg", Params{Width: 320}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	name, err := c.Path("1", "photo.jpg", Params{Width: 320})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transforms != 1 {
+		t.Errorf("made %d times, want once", transforms)
+	}
+	if filepath.Base(name) != "w_320,fmt_jpeg.jpg" {
+		t.Errorf("unexpected name %s", name)
+	}
+	if b, err := ioutil.ReadFile(name); err != nil || string(b) != "photo.jpg w_320,fmt_jpeg" {
+		t.Errorf("got %q, %v", b, err)
+	}
+
+	if _, err = c.Path("../1", "photo.jpg", Params{}); err == nil {
+		t.Error("a path outside the cache is accepted")
+	}
+	if err = c.Remove("1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("removed derivative exists: %v", err)
+	}
+}
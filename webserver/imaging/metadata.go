@@ -0,0 +1,345 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Metadata are read from EXIF of uploaded images before it is stripped.
+type Metadata struct {
+	// Camera is the make and model of the camera.
+	Camera string `bson:",omitempty"`
+	// Taken is when the photo was taken by the clock of the camera,
+	// time zones aren't known.
+	Taken             time.Time
+	Author, Copyright string `bson:",omitempty"`
+
+	// Orientation is the EXIF orientation, values above 1 mean the
+	// image must be rotated or flipped to be upright.
+	Orientation int `bson:"-"`
+	// GPS reports whether the image has a location.
+	GPS bool `bson:"-"`
+}
+
+// Credits returns a source of the image for credits of files, the
+// author or the copyright holder.
+func (m *Metadata) Credits() string {
+	if len(m.Author) > 0 {
+		return m.Author
+	}
+	return m.Copyright
+}
+
+var (
+	ErrUnknownFormat = errors.New("metadata of the image format can't be read")
+	ErrInvalidImage  = errors.New("invalid image file")
+	ErrInvalidEXIF   = errors.New("invalid EXIF")
+)
+
+// ReadMetadata reads EXIF of a JPEG, PNG or WebP image, it returns nil
+// if the image has none.
+func ReadMetadata(b []byte) (*Metadata, error) {
+	ss, err := split(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range ss {
+		if s.exif != nil {
+			return readEXIF(s.exif)
+		}
+	}
+	return nil, nil
+}
+
+// Strip removes metadata which can identify people from a JPEG, PNG or
+// WebP image: EXIF with locations and names, XMP, IPTC and comments.
+// Image data and color profiles are kept as they are.
+func Strip(b []byte) ([]byte, error) {
+	ss, err := split(b)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(b))
+	for _, s := range ss {
+		if !s.private {
+			out = append(out, s.raw...)
+		}
+	}
+	if bytes.HasPrefix(out, []byte("RIFF")) {
+		binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	}
+	return out, nil
+}
+
+// segment is a part of an image file, a JPEG marker segment, a PNG or
+// a WebP chunk.
+type segment struct {
+	raw []byte
+	// private segments may contain personal data
+	private bool
+	// exif is the TIFF structure of EXIF in the segment
+	exif []byte
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// split splits the image file into segments, the concatenation of
+// which is the file.
+func split(b []byte) ([]segment, error) {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xff, 0xd8}):
+		return splitJPEG(b)
+	case bytes.HasPrefix(b, pngSignature):
+		return splitPNG(b)
+	case len(b) >= 12 && string(b[:4]) == "RIFF" && string(b[8:12]) == "WEBP":
+		return splitWebP(b)
+	}
+	return nil, ErrUnknownFormat
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// splitJPEG splits marker segments up to the image data, which is kept
+// in the last segment.
+func splitJPEG(b []byte) ([]segment, error) {
+	ss := []segment{{raw: b[:2]}}
+	for p := 2; p < len(b); {
+		if b[p] != 0xff || p+1 >= len(b) {
+			return nil, ErrInvalidImage
+		}
+		marker := b[p+1]
+		if marker == 0xff {
+			// fill byte
+			ss = append(ss, segment{raw: b[p : p+1]})
+			p++
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 {
+			// start of scan, the rest is image data
+			ss = append(ss, segment{raw: b[p:]})
+			break
+		}
+		if p+4 > len(b) {
+			return nil, ErrInvalidImage
+		}
+		end := p + 2 + int(binary.BigEndian.Uint16(b[p+2:]))
+		if end > len(b) {
+			return nil, ErrInvalidImage
+		}
+		s := segment{raw: b[p:end]}
+		switch marker {
+		case 0xe1:
+			// EXIF or XMP
+			s.private = true
+			if data := b[p+4 : end]; bytes.HasPrefix(data, exifHeader) {
+				s.exif = data[len(exifHeader):]
+			}
+		case 0xed, 0xfe:
+			// IPTC and comments
+			s.private = true
+		}
+		ss = append(ss, s)
+		p = end
+	}
+	return ss, nil
+}
+
+// splitPNG splits chunks, data after the last chunk is dropped.
+func splitPNG(b []byte) ([]segment, error) {
+	ss := []segment{{raw: b[:len(pngSignature)]}}
+	for p := len(pngSignature); p < len(b); {
+		if p+12 > len(b) {
+			return nil, ErrInvalidImage
+		}
+		size := int64(binary.BigEndian.Uint32(b[p:]))
+		if int64(p)+12+size > int64(len(b)) {
+			return nil, ErrInvalidImage
+		}
+		end := p + 12 + int(size)
+		s := segment{raw: b[p:end]}
+		switch typ := string(b[p+4 : p+8]); typ {
+		case "eXIf":
+			s.private = true
+			s.exif = b[p+8 : end-4]
+		case "tEXt", "zTXt", "iTXt":
+			s.private = true
+		case "IEND":
+			return append(ss, s), nil
+		}
+		ss = append(ss, s)
+		p = end
+	}
+	return nil, ErrInvalidImage
+}
+
+// splitWebP splits chunks of the RIFF container, the first segment is
+// the RIFF header. Flags of EXIF and XMP are cleared in the VP8X chunk,
+// so that it is valid without them.
+func splitWebP(b []byte) ([]segment, error) {
+	ss := []segment{{raw: b[:12]}}
+	for p := 12; p < len(b); {
+		if p+8 > len(b) {
+			return nil, ErrInvalidImage
+		}
+		size := int64(binary.LittleEndian.Uint32(b[p+4:]))
+		end64 := int64(p) + 8 + size + size%2
+		if end64 > int64(len(b)) {
+			return nil, ErrInvalidImage
+		}
+		end := int(end64)
+		s := segment{raw: b[p:end]}
+		switch string(b[p : p+4]) {
+		case "EXIF":
+			s.private = true
+			s.exif = bytes.TrimPrefix(b[p+8:p+8+int(size)], exifHeader)
+		case "XMP ":
+			s.private = true
+		case "VP8X":
+			if size > 0 {
+				s.raw = append([]byte(nil), s.raw...)
+				s.raw[8] &^= 0x08 | 0x04
+			}
+		}
+		ss = append(ss, s)
+		p = end
+	}
+	return ss, nil
+}
+
+// EXIF tags.
+const (
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagArtist           = 0x013b
+	tagCopyright        = 0x8298
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+)
+
+// sizes of TIFF field types in bytes.
+var tiffTypeSizes = map[uint16]int64{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// tiffField is a value of a field of a TIFF directory.
+type tiffField struct {
+	typ   uint16
+	value []byte
+}
+
+// readEXIF reads metadata from the TIFF structure of EXIF.
+func readEXIF(b []byte) (*Metadata, error) {
+	if len(b) < 8 {
+		return nil, ErrInvalidEXIF
+	}
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, ErrInvalidEXIF
+	}
+	if order.Uint16(b[2:]) != 42 {
+		return nil, ErrInvalidEXIF
+	}
+	ifd0, err := readIFD(b, order, order.Uint32(b[4:]))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Metadata{
+		Author:    ifd0.string(tagArtist),
+		Copyright: ifd0.string(tagCopyright),
+	}
+	maker, model := ifd0.string(tagMake), ifd0.string(tagModel)
+	if strings.HasPrefix(strings.ToLower(model), strings.ToLower(maker)) {
+		// models are often named with makes
+		m.Camera = model
+	} else {
+		m.Camera = strings.TrimSpace(maker + " " + model)
+	}
+	if v, ok := ifd0.uint(order, tagOrientation); ok && v <= 8 {
+		m.Orientation = int(v)
+	}
+	if off, ok := ifd0.uint(order, tagGPSIFD); ok {
+		gps, err := readIFD(b, order, off)
+		m.GPS = err == nil && len(gps) > 0
+	}
+	if off, ok := ifd0.uint(order, tagExifIFD); ok {
+		if exif, err := readIFD(b, order, off); err == nil {
+			if t, err := time.Parse("2006:01:02 15:04:05", exif.string(tagDateTimeOriginal)); err == nil {
+				m.Taken = t
+			}
+		}
+	}
+	return m, nil
+}
+
+type ifd map[uint16]tiffField
+
+// readIFD reads the image file directory at the offset of the TIFF
+// structure. Fields of unknown types and with invalid offsets are
+// skipped.
+func readIFD(b []byte, order binary.ByteOrder, off uint32) (ifd, error) {
+	if int64(off)+2 > int64(len(b)) {
+		return nil, ErrInvalidEXIF
+	}
+	n := int64(order.Uint16(b[off:]))
+	start := int64(off) + 2
+	if start+n*12 > int64(len(b)) {
+		return nil, ErrInvalidEXIF
+	}
+	fields := make(ifd, n)
+	for i := int64(0); i < n; i++ {
+		e := b[start+i*12 : start+i*12+12]
+		typ := order.Uint16(e[2:])
+		size := tiffTypeSizes[typ] * int64(order.Uint32(e[4:]))
+		if size == 0 {
+			continue
+		}
+		value := e[8:12]
+		if size > 4 {
+			// larger values are stored at offsets
+			valueOff := int64(order.Uint32(e[8:]))
+			if valueOff+size > int64(len(b)) {
+				continue
+			}
+			value = b[valueOff : valueOff+size]
+		}
+		fields[order.Uint16(e)] = tiffField{typ: typ, value: value[:size]}
+	}
+	return fields, nil
+}
+
+// string returns an ASCII field without trailing NULs and spaces.
+func (d ifd) string(tag uint16) string {
+	f, ok := d[tag]
+	if !ok || f.typ != 2 {
+		return ""
+	}
+	if i := bytes.IndexByte(f.value, 0); i >= 0 {
+		f.value = f.value[:i]
+	}
+	return strings.TrimSpace(string(f.value))
+}
+
+// uint returns the first value of a SHORT or LONG field.
+func (d ifd) uint(order binary.ByteOrder, tag uint16) (uint32, bool) {
+	f, ok := d[tag]
+	switch {
+	case !ok:
+		return 0, false
+	case f.typ == 3:
+		return uint32(order.Uint16(f.value)), true
+	case f.typ == 4:
+		return order.Uint32(f.value), true
+	}
+	return 0, false
+}
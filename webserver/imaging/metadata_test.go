@@ -0,0 +1,207 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"time"
+)
+
+type exifEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+	// ifd is an index of a directory the entry points at
+	ifd int
+}
+
+func asciiEntry(tag uint16, s string) exifEntry {
+	return exifEntry{tag: tag, typ: 2, count: uint32(len(s) + 1), value: []byte(s + "\x00")}
+}
+
+// makeTIFF makes a TIFF structure of the directories, the first one is
+// IFD0. Values larger than 4 bytes follow the directories.
+func makeTIFF(order binary.ByteOrder, ifds ...[]exifEntry) []byte {
+	offsets := make([]int, len(ifds))
+	size := 8
+	for i, d := range ifds {
+		offsets[i] = size
+		size += 2 + 12*len(d) + 4
+	}
+	b := make([]byte, size)
+	copy(b, "II")
+	if order == binary.BigEndian {
+		copy(b, "MM")
+	}
+	order.PutUint16(b[2:], 42)
+	order.PutUint32(b[4:], 8)
+	for i, d := range ifds {
+		p := offsets[i]
+		order.PutUint16(b[p:], uint16(len(d)))
+		for j, e := range d {
+			q := p + 2 + 12*j
+			order.PutUint16(b[q:], e.tag)
+			order.PutUint16(b[q+2:], e.typ)
+			order.PutUint32(b[q+4:], e.count)
+			switch {
+			case e.ifd > 0:
+				order.PutUint32(b[q+8:], uint32(offsets[e.ifd]))
+			case len(e.value) > 4:
+				order.PutUint32(b[q+8:], uint32(len(b)))
+				b = append(b, e.value...)
+			default:
+				copy(b[q+8:], e.value)
+			}
+		}
+	}
+	return b
+}
+
+func testEXIF(order binary.ByteOrder) []byte {
+	orientation := make([]byte, 2)
+	order.PutUint16(orientation, 6)
+	return makeTIFF(order,
+		[]exifEntry{
+			asciiEntry(tagMake, "Canon"),
+			asciiEntry(tagModel, "Canon EOS 5D"),
+			{tag: tagOrientation, typ: 3, count: 1, value: orientation},
+			asciiEntry(tagArtist, "Photographer"),
+			asciiEntry(tagCopyright, "Bahna"),
+			{tag: tagExifIFD, typ: 4, count: 1, ifd: 1},
+			{tag: tagGPSIFD, typ: 4, count: 1, ifd: 2},
+		},
+		[]exifEntry{asciiEntry(tagDateTimeOriginal, "2019:03:14 18:30:05")},
+		[]exifEntry{asciiEntry(1, "N")},
+	)
+}
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for i := 0; i < 100; i++ {
+		c := color.RGBA{200, 10, 10, 255}
+		if i >= 60 {
+			c = color.RGBA{0, 0, 255, 255}
+		}
+		img.Set(i%10, i/10, c)
+	}
+	return img
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	b := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(b, uint32(len(data)))
+	copy(b[4:], typ)
+	b = append(b, data...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(b[4:]))
+	return append(b, crc...)
+}
+
+func riffChunk(typ string, data []byte) []byte {
+	b := make([]byte, 8, 9+len(data))
+	copy(b, typ)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(data)))
+	b = append(b, data...)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func webp(chunks ...[]byte) []byte {
+	b := []byte("RIFF\x00\x00\x00\x00WEBP")
+	for _, c := range chunks {
+		b = append(b, c...)
+	}
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)-8))
+	return b
+}
+
+func TestMetadata(t *testing.T) {
+	var jpg, pngFile bytes.Buffer
+	if err := jpeg.Encode(&jpg, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(&pngFile, testImage()); err != nil {
+		t.Fatal(err)
+	}
+
+	// metadata segments follow SOI of JPEG and IHDR of PNG
+	exifSegment := append([]byte{0xff, 0xe1, 0, 0}, append(exifHeader, testEXIF(binary.BigEndian)...)...)
+	binary.BigEndian.PutUint16(exifSegment[2:], uint16(len(exifSegment)-2))
+	withEXIF := append(append(append([]byte{}, jpg.Bytes()[:2]...), exifSegment...),
+		[]byte("\xff\xfe\x00\x07Alice\xff\xe1\x00\x0bhttp://ns")...)
+	withEXIF = append(withEXIF, jpg.Bytes()[2:]...)
+
+	ihdrEnd := len(pngSignature) + 25
+	pngWithEXIF := append([]byte{}, pngFile.Bytes()[:ihdrEnd]...)
+	pngWithEXIF = append(pngWithEXIF, pngChunk("eXIf", testEXIF(binary.LittleEndian))...)
+	pngWithEXIF = append(pngWithEXIF, pngChunk("tEXt", []byte("Author\x00Alice"))...)
+	pngWithEXIF = append(pngWithEXIF, pngFile.Bytes()[ihdrEnd:]...)
+
+	vp8x := []byte{0x10 | 0x08 | 0x04, 0, 0, 0, 9, 0, 0, 9, 0, 0}
+	webpWithEXIF := webp(riffChunk("VP8X", vp8x), riffChunk("VP8L", []byte{1, 2, 3}),
+		riffChunk("EXIF", append(exifHeader, testEXIF(binary.LittleEndian)...)), riffChunk("XMP ", []byte("<x/>")))
+	vp8x[0] = 0x10
+	webpStripped := webp(riffChunk("VP8X", vp8x), riffChunk("VP8L", []byte{1, 2, 3}))
+
+	want := Metadata{
+		Camera:      "Canon EOS 5D",
+		Taken:       time.Date(2019, 3, 14, 18, 30, 5, 0, time.UTC),
+		Author:      "Photographer",
+		Copyright:   "Bahna",
+		Orientation: 6,
+		GPS:         true,
+	}
+	tests := []struct {
+		name        string
+		b, stripped []byte
+		decode      func(r *bytes.Reader) (image.Image, error)
+	}{
+		{"jpeg", withEXIF, jpg.Bytes(), func(r *bytes.Reader) (image.Image, error) { return jpeg.Decode(r) }},
+		{"png", pngWithEXIF, pngFile.Bytes(), func(r *bytes.Reader) (image.Image, error) { return png.Decode(r) }},
+		{"webp", webpWithEXIF, webpStripped, nil},
+	}
+	for _, tt := range tests {
+		m, err := ReadMetadata(tt.b)
+		if err != nil || m == nil || *m != want {
+			t.Errorf("%s: ReadMetadata() = %+v, %v, want %+v", tt.name, m, err, want)
+		}
+		got, err := Strip(tt.b)
+		if err != nil || !bytes.Equal(got, tt.stripped) {
+			t.Errorf("%s: Strip() = %q, %v, want %q", tt.name, got, err, tt.stripped)
+		}
+		if tt.decode != nil {
+			if _, err = tt.decode(bytes.NewReader(got)); err != nil {
+				t.Errorf("%s: stripped image is broken: %v", tt.name, err)
+			}
+		}
+		if m, err = ReadMetadata(got); m != nil || err != nil {
+			t.Errorf("%s: stripped image has metadata %+v, %v", tt.name, m, err)
+		}
+	}
+
+	if _, err := ReadMetadata([]byte("GIF89a")); err != ErrUnknownFormat {
+		t.Errorf("GIF: got %v, want %v", err, ErrUnknownFormat)
+	}
+	if _, err := Strip(withEXIF[:10]); err != ErrInvalidImage {
+		t.Errorf("truncated JPEG: got %v, want %v", err, ErrInvalidImage)
+	}
+	if (&Metadata{Copyright: "Bahna"}).Credits() != "Bahna" {
+		t.Error("copyright isn't credited without an author")
+	}
+}
+
+func TestDominant(t *testing.T) {
+	if c := Hex(Dominant(testImage())); c != "#c80a0a" {
+		t.Errorf("got %s, want #c80a0a", c)
+	}
+	if c := Hex(Dominant(image.NewNRGBA(image.Rect(0, 0, 2, 2)))); c != "#000000" {
+		t.Errorf("transparent image: got %s", c)
+	}
+}
@@ -0,0 +1,217 @@
+package imaging
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/davidbyttow/govips/pkg/vips"
+)
+
+var vipsTypes = map[string]vips.ImageType{
+	JPEG: vips.ImageTypeJPEG,
+	PNG:  vips.ImageTypePNG,
+	WEBP: vips.ImageTypeWEBP,
+}
+
+// quality of lossy formats, AVIF has the same visual quality at lower
+// values.
+var quality = map[string]int{
+	JPEG: 82,
+	WEBP: 80,
+	AVIF: 55,
+}
+
+var startOnce sync.Once
+
+// startup starts libvips once for govips and direct calls.
+func startup() {
+	startOnce.Do(func() {
+		vips.Startup(nil)
+	})
+}
+
+// originalQuality is the quality of originals saved again when they
+// are rotated upright.
+const originalQuality = 92
+
+// Vips makes derivatives with libvips. Images are rotated upright by
+// their EXIF orientation and cropped to the area first, they are never
+// enlarged and their metadata is stripped.
+func Vips(src string, p Params) ([]byte, error) {
+	startup()
+	if len(p.Format) == 0 {
+		p.Format = FormatOf(src)
+	}
+	if p.Format == AVIF {
+		// the vendored govips doesn't know the format, it is saved
+		// with libvips directly
+		return avif(src, p, quality[AVIF])
+	}
+	format, ok := vipsTypes[p.Format]
+	if !ok {
+		return nil, ErrInvalidFormat
+	}
+	if !vips.IsTypeSupported(format) {
+		return nil, fmt.Errorf("libvips doesn't support %s", p.Format)
+	}
+
+	img, err := open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	if !p.Area.IsZero() {
+		if err = img.ExtractArea(p.Area.Pixels(img.Width(), img.Height())); err != nil {
+			return nil, err
+		}
+	}
+	if p.Width > 0 && p.Width < img.Width() {
+		if err = img.Resize(float64(p.Width) / float64(img.Width())); err != nil {
+			return nil, err
+		}
+	}
+	b, _, err := img.Export(vips.ExportParams{
+		Format:        format,
+		Quality:       quality[p.Format],
+		StripMetadata: true,
+	})
+	return b, err
+}
+
+// Size returns dimensions of the image file when it is upright.
+func Size(src string) (width, height int, err error) {
+	img, err := open(src)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer img.Close()
+	return img.Width(), img.Height(), nil
+}
+
+// open loads the image file rotated upright by its EXIF orientation.
+func open(src string) (*vips.ImageRef, error) {
+	startup()
+	img, err := vips.NewImageFromFile(src)
+	if err != nil {
+		return nil, err
+	}
+	if err = img.Autorot(); err != nil {
+		img.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+// Sanitize removes metadata which can identify people, like locations
+// and names in EXIF, from the JPEG, PNG or WebP file and returns
+// metadata read before, nil if there were none. Files are rewritten
+// without loss unless they have to be rotated upright or can't be
+// parsed, in which case they are saved again. Files of other formats
+// are kept as they are.
+func Sanitize(name string) (*Metadata, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	m, err := ReadMetadata(b)
+	if err == ErrUnknownFormat {
+		return nil, nil
+	}
+	var out []byte
+	switch {
+	case err == ErrInvalidImage:
+		// files which can't be split are saved again by libvips
+		out, err = upright(b, FormatOf(name))
+	case err == nil && m != nil && m.Orientation > 1:
+		out, err = upright(b, FormatOf(name))
+	default:
+		// broken EXIF is stripped too
+		if err != nil {
+			m = nil
+		}
+		out, err = Strip(b)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(out, b) {
+		err = replace(name, out)
+	}
+	return m, err
+}
+
+// upright rotates the image by its EXIF orientation and saves it
+// without metadata.
+func upright(b []byte, format string) ([]byte, error) {
+	startup()
+	img, err := vips.NewImageFromBuffer(b)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	if err = img.Autorot(); err != nil {
+		return nil, err
+	}
+	b, _, err = img.Export(vips.ExportParams{
+		Format:        vipsTypes[format],
+		Quality:       originalQuality,
+		StripMetadata: true,
+	})
+	return b, err
+}
+
+// replace writes the file through a temporary file, so that it is
+// never served partially written.
+func replace(name string, b []byte) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), ".sanitized")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err = os.Chmod(f.Name(), fi.Mode()); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// Color returns the dominant color of the image file as #rrggbb. It is
+// found in a small version of the image.
+func Color(src string) (string, error) {
+	img, err := open(src)
+	if err != nil {
+		return "", err
+	}
+	defer img.Close()
+	if img.Width() > 64 {
+		if err = img.Resize(64 / float64(img.Width())); err != nil {
+			return "", err
+		}
+	}
+	b, _, err := img.Export(vips.ExportParams{Format: vips.ImageTypePNG})
+	if err != nil {
+		return "", err
+	}
+	small, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	return Hex(Dominant(small)), nil
+}
@@ -0,0 +1,239 @@
+// Package locale manages UI translations. Translations are loaded from
+// go-i18n files and overlaid with messages edited by administrators and
+// stored in a mongo database.
+package locale
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bahna/magazine/webserver/mongo"
+	"github.com/nicksnyder/go-i18n/i18n/bundle"
+	i18nlang "github.com/nicksnyder/go-i18n/i18n/language"
+	"github.com/nicksnyder/go-i18n/i18n/translation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	mongodb "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Message is a translation of a message ID edited by an administrator.
+// It overlays the translation from a file with the same ID.
+type Message struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	Language  string
+	MessageID string
+	Value     string
+	Updated   time.Time
+}
+
+// Entry describes a message ID with its values in all languages of a
+// catalog. It is used to list translations in the UI.
+type Entry struct {
+	MessageID string
+	Values    []*Value
+}
+
+// Value is a translation of a message for one language.
+type Value struct {
+	Language string
+	Text     string
+	// Untranslated is true if the message is missing, empty or listed
+	// in the *.untranslated.json file of the language.
+	Untranslated bool
+	// Overridden is true if the message is stored in the database.
+	Overridden bool
+}
+
+// Catalog holds translations for a set of languages. Translations are
+// kept in a go-i18n bundle which is replaced as a whole on each
+// reload, so that readers never see partially loaded translations.
+type Catalog struct {
+	// Dir is a folder with <tag>.all.json and <tag>.untranslated.json files.
+	Dir string
+	// Tags are go-i18n language tags, e.g. "en-us", "ru", "be".
+	Tags []string
+
+	mu           sync.RWMutex
+	bundle       *bundle.Bundle
+	untranslated map[string]map[string]bool
+	overridden   map[string]map[string]bool
+}
+
+// NewCatalog returns a catalog for the files of the given languages
+// located in the dir folder. Call Reload to load translations.
+func NewCatalog(dir string, tags ...string) *Catalog {
+	return &Catalog{
+		Dir:    dir,
+		Tags:   tags,
+		bundle: bundle.New(),
+	}
+}
+
+// Reload reads translation files and overlays them with the messages
+// edited by administrators, see AllMessages.
+func (c *Catalog) Reload(messages []*Message) error {
+	b := bundle.New()
+	untranslated := make(map[string]map[string]bool)
+	overridden := make(map[string]map[string]bool)
+
+	for _, tag := range c.Tags {
+		if err := b.LoadTranslationFile(path.Join(c.Dir, tag+".all.json")); err != nil {
+			return err
+		}
+
+		untranslated[tag] = make(map[string]bool)
+		overridden[tag] = make(map[string]bool)
+
+		buf, err := ioutil.ReadFile(path.Join(c.Dir, tag+".untranslated.json"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if len(bytes.TrimSpace(buf)) > 0 {
+			ids := map[string]interface{}{}
+			if err = json.Unmarshal(buf, &ids); err != nil {
+				return fmt.Errorf("failed to parse untranslated messages for %s: %v", tag, err)
+			}
+			for id := range ids {
+				untranslated[tag][id] = true
+			}
+		}
+	}
+
+	for _, m := range messages {
+		if overridden[m.Language] == nil {
+			continue // the language is not in the catalog
+		}
+		t, err := translation.NewTranslation(map[string]interface{}{
+			"id":          m.MessageID,
+			"translation": m.Value,
+		})
+		if err != nil {
+			return fmt.Errorf("invalid translation %s for %s: %v", m.MessageID, m.Language, err)
+		}
+		tags := i18nlang.Parse(m.Language)
+		if len(tags) == 0 {
+			return fmt.Errorf("invalid language %q of translation %s", m.Language, m.MessageID)
+		}
+		b.AddTranslation(tags[0], t)
+		overridden[m.Language][m.MessageID] = true
+	}
+
+	c.mu.Lock()
+	c.bundle = b
+	c.untranslated = untranslated
+	c.overridden = overridden
+	c.mu.Unlock()
+	return nil
+}
+
+// HasTag reports whether the language is in the catalog.
+func (c *Catalog) HasTag(tag string) bool {
+	for _, t := range c.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Tfunc returns a function which translates message IDs into the
+// language that matches the given tag best.
+func (c *Catalog) Tfunc(tag string) (bundle.TranslateFunc, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.bundle.Tfunc(tag)
+}
+
+// Entries returns all message IDs sorted alphabetically with their
+// values in all languages of the catalog.
+func (c *Catalog) Entries() []*Entry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	translations := c.bundle.Translations()
+
+	ids := map[string]bool{}
+	for _, tag := range c.Tags {
+		for id := range translations[tag] {
+			ids[id] = true
+		}
+	}
+
+	entries := make([]*Entry, 0, len(ids))
+	for id := range ids {
+		e := &Entry{MessageID: id}
+		for _, tag := range c.Tags {
+			v := &Value{
+				Language:   tag,
+				Overridden: c.overridden[tag][id],
+			}
+			if t, ok := translations[tag][id]; ok {
+				v.Text = t.Template(i18nlang.Other).String()
+			}
+			v.Untranslated = len(v.Text) == 0 || (c.untranslated[tag][id] && !v.Overridden)
+			e.Values = append(e.Values, v)
+		}
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].MessageID < entries[j].MessageID
+	})
+	return entries
+}
+
+// Export returns translations of the language in the go-i18n flat JSON
+// format which is used by *.all.json files.
+func (c *Catalog) Export(tag string) ([]byte, error) {
+	c.mu.RLock()
+	translations := c.bundle.Translations()[tag]
+	c.mu.RUnlock()
+
+	if translations == nil {
+		return nil, fmt.Errorf("no translations for %s", tag)
+	}
+
+	m := make(map[string]interface{}, len(translations))
+	for id, t := range translations {
+		m[id] = t.MarshalFlatInterface()
+	}
+	return json.MarshalIndent(m, "", "  ")
+}
+
+// AllMessages returns messages from a database.
+func AllMessages(ctx context.Context, col *mongodb.Collection, query interface{}) (items []*Message, err error) {
+	err = mongo.All(ctx, col, query, &items, options.Find().SetSort(mongo.Sort("language", "messageid")))
+	return
+}
+
+// SaveMessage stores the message value for the language. The empty value
+// removes the message from the database, so the translation from a file
+// is used again.
+func SaveMessage(ctx context.Context, col *mongodb.Collection, lang, id, value string) error {
+	selector := bson.M{"language": lang, "messageid": id}
+
+	if len(value) == 0 {
+		_, err := col.DeleteOne(ctx, selector)
+		return err
+	}
+
+	_, err := col.UpdateOne(ctx, selector, bson.M{
+		"$set": bson.M{
+			"value":   value,
+			"updated": time.Now(),
+		},
+		"$setOnInsert": bson.M{
+			"_id": primitive.NewObjectID(),
+		},
+	}, options.Update().SetUpsert(true))
+	return err
+}
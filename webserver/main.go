@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -9,22 +10,31 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/Machiel/slugify"
+	"github.com/bahna/magazine/webserver/file"
+	"github.com/bahna/magazine/webserver/imaging"
+	"github.com/bahna/magazine/webserver/locale"
 	"github.com/bahna/magazine/webserver/mongo"
+	"github.com/bahna/magazine/webserver/pagecache"
+	"github.com/bahna/magazine/webserver/related"
+	"github.com/bahna/magazine/webserver/search"
 	"github.com/bahna/magazine/webserver/slugifier"
+	"github.com/bahna/magazine/webserver/store"
 	"github.com/bahna/magazine/webserver/user"
-	"github.com/globalsign/mgo"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
 	"github.com/gorilla/securecookie"
-	"github.com/nicksnyder/go-i18n/i18n"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	mongodb "go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/text/language"
 	"golang.org/x/text/language/display"
 )
@@ -39,6 +49,9 @@ const (
 // debug specifies if the program is running in the debug mode.
 var debug = false
 
+// translations contains UI translations used by Render.
+var translations *locale.Catalog
+
 var (
 	ErrDependentContentExist = errors.New("delete dependent content first")
 )
@@ -46,21 +59,26 @@ var (
 func main() {
 	// cli flags
 	addr := flag.String("addr", ":8080", "address to listen on")
-	dbhost := flag.String("dbhost", "0.0.0.0", "database host")
+	dbhost := flag.String("dbhost", "0.0.0.0", "database host or mongodb:// URI")
 	dbname := flag.String("dbname", "magazine", "database name")
+	dbtimeout := flag.Duration("dbtimeout", 10*time.Second, "timeout of database operations")
 	timeout := flag.String("timeout", "10m", "server's timeout")
 	logpath := flag.String("log", "~/tmp/log/magazine", "log file path")
 	assets := flag.String("assets", "assets/", "assets folder which contains templates/, static/, files/ folders")
 	globalAssets := flag.String("gassets", "i18n/", "global assets folder")
 	debugflag := flag.Bool("debug", false, "debug mode")
+	searchEngine := flag.String("search", "mongo", "search engine: mongo or index")
+	indexPath := flag.String("index", "search.index", "search index file path for the index search engine")
+	pagecacheTTL := flag.Duration("pagecache", 10*time.Minute, "lifetime of cached public pages, 0 disables the cache")
+	translit := flag.String("translit", "", "transliteration schemes of slugs by languages, e.g. be=be-lacinka,ru=ru-bgn")
+	uploadTypes := flag.String("uploadtypes", "", "JSON file with types of files allowed for uploads by kinds, see file.Allowlist")
 	flag.Parse()
 
 	debug = *debugflag
 
-	// loading UI translations during the package initialization
-	i18n.MustLoadTranslationFile(path.Join(*globalAssets, "en-us.all.json"))
-	i18n.MustLoadTranslationFile(path.Join(*globalAssets, "ru.all.json"))
-	i18n.MustLoadTranslationFile(path.Join(*globalAssets, "be.all.json"))
+	// UI translations are loaded after the database connection is
+	// established because they are overlaid with edited messages
+	translations = locale.NewCatalog(*globalAssets, "en-us", "ru", "be")
 
 	// read environment variables
 	hashKey := MustGetEnv(hashKeyEnv)
@@ -73,35 +91,136 @@ func main() {
 	}
 	secret := MustGetEnv(secretEnv)
 
+	allowlist := &file.DefaultAllowlist
+	if len(*uploadTypes) > 0 {
+		var err error
+		if allowlist, err = file.ReadAllowlist(*uploadTypes); err != nil {
+			log.Fatalf("failed to read upload types: %v", err)
+		}
+	}
+
 	// app setup
 	scookie := securecookie.New(hashKey, blockKey)
 	cfg := configuration{
-		Scookie:          scookie,
-		ScookieDuration:  time.Hour * 24 * 28 * 3,
-		Secret:           secret,
-		DbHost:           *dbhost,
-		DbName:           *dbname,
-		TmplDir:          path.Join(*assets, "templates/"),
-		StaticDir:        path.Join(*assets, "static/"),
-		FilesDir:         path.Join(*assets, "files/"),
-		MaxAge:           "172800",
-		MaxUploadSize:    100 * 1024 * 1024,
-		MailchimpListURI: "https://us14.api.mailchimp.com/3.0/lists/6b4f8d648f/members",
-		MailchimpAPI:     "4c7e261c3764067063cce7967b36f498-us14", // TODO: hide this from public and clean the history
+		Scookie:                scookie,
+		ScookieDuration:        time.Hour * 24 * 28 * 3,
+		Secret:                 secret,
+		DbHost:                 *dbhost,
+		DbName:                 *dbname,
+		DbTimeout:              *dbtimeout,
+		TmplDir:                path.Join(*assets, "templates/"),
+		StaticDir:              path.Join(*assets, "static/"),
+		FilesDir:               path.Join(*assets, "files/"),
+		MaxAge:                 "172800",
+		MaxUploadSize:          100 * 1024 * 1024,
+		MaxResumableUploadSize: 4 * 1024 * 1024 * 1024,
+		UploadTypes:            allowlist,
+		MailchimpListURI:       "https://us14.api.mailchimp.com/3.0/lists/6b4f8d648f/members",
+		MailchimpAPI:           "4c7e261c3764067063cce7967b36f498-us14", // TODO: hide this from public and clean the history
+		SearchEngine:           *searchEngine,
+		IndexPath:              *indexPath,
+		Translit:               *translit,
+		PageCacheTTL:           *pagecacheTTL,
 		AdminGroup: []user.Role{
 			user.Administrator,
 			user.Author,
 		},
 	}
 
+	// migrations are applied before the application is set up, so
+	// that nothing but migrations changes the database of an older
+	// version
+	if flag.Arg(0) == "migrate" {
+		client, err := mongo.Dial(context.Background(), cfg.DbHost, cfg.DbTimeout)
+		if err != nil {
+			log.Fatalf("failed to dial the database %s: %v", cfg.DbHost, err)
+		}
+		defer client.Disconnect(context.Background())
+		if err = migrateCommand(client.Database(cfg.DbName), flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// app initialization
 	app, err := newApplication(&cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if err = reloadTranslations(context.Background(), app.Store); err != nil {
+		log.Fatalf("failed to load translations: %v", err)
+	}
+
+	// subcommands
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+	case "reindex":
+		// the new index is built in memory and replaces the file at
+		// once, a running server keeps its own copy, see README
+		if cfg.SearchEngine != "index" {
+			log.Fatal("only the embedded index is rebuilt, use -search index")
+		}
+		idx, err := search.OpenIndex("")
+		if err != nil {
+			log.Fatal(err)
+		}
+		n, err := rebuildSearchIndex(context.Background(), app.Store, idx)
+		if err != nil {
+			log.Fatalf("failed to rebuild the search index: %v", err)
+		}
+		if err = idx.WriteFile(cfg.IndexPath); err != nil {
+			log.Fatalf("failed to write the search index: %v", err)
+		}
+		log.Printf("indexed %d items", n)
+		return
+	case "duplicates":
+		dd, err := app.Store.Content.DuplicateSlugs(context.Background())
+		if err != nil {
+			log.Fatalf("failed to find duplicate slugs: %v", err)
+		}
+		for _, d := range dd {
+			for _, c := range d.Content {
+				fmt.Printf("%s\t/%s/%s/%s/\t%s\t%s\n", d.Language, d.Language, d.Topic.Path, d.Slug, c.ID.Hex(), c.Title)
+			}
+		}
+		return
+	case "export":
+		if err = checkMigrations(context.Background(), app.Db); err != nil {
+			log.Fatal(err)
+		}
+		if err = exportCommand(app, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "images":
+		if err = imagesCommand(app, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	default:
+		log.Fatalf("unknown command %q", cmd)
+	}
+
+	// the server refuses to start with duplicate slugs or pending
+	// migrations, commands above are used to fix them
+	if err = checkMigrations(context.Background(), app.Db); err != nil {
+		log.Fatal(err)
+	}
+	if err = ensureSlugIndex(context.Background(), app.Db); err != nil {
+		log.Fatal(err)
+	}
+
+	// a new index is built on the first start, later it is rebuilt
+	// from the admin panel or by the reindex command
+	if idx, ok := app.Search.(*search.Index); ok && idx.Len() == 0 {
+		if _, err = rebuildSearchIndex(context.Background(), app.Store, idx); err != nil {
+			log.Fatalf("failed to build the search index: %v", err)
+		}
+	}
+
 	// middleware
-	r := Recover(Authenticate(Log(app.Router), scookie))
+	r := Recover(Authenticate(Log(Redirects(app.Router, app.Redirects)), scookie))
 
 	// logger setup
 	if w, f, err := LogWriters(*logpath); err != nil {
@@ -125,7 +244,28 @@ func main() {
 		ReadTimeout:  t,
 		WriteTimeout: t,
 	}
-	log.Fatal(s.ListenAndServe())
+
+	// pending changes of the search index are written on shutdown
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Printf("failed to shut down the server: %v", err)
+		}
+		if err := app.Search.Close(); err != nil {
+			log.Printf("failed to save the search index: %v", err)
+		}
+		close(done)
+	}()
+
+	if err = s.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
 }
 
 type configuration struct {
@@ -135,18 +275,37 @@ type configuration struct {
 	Secret []byte
 	// DbHost and DbName are used to create a database connection.
 	DbHost, DbName string
+	// DbTimeout limits database operations which don't have their own
+	// deadlines.
+	DbTimeout time.Duration
 	// StaticDir, FilesDir, TmplDir are pathes for static and user files.
 	StaticDir, FilesDir, TmplDir string
 	// MaxAge is age of static files cache-control max-age value in seconds.
 	MaxAge string
-	// MaxUploadSize specifies the maximum size of user files.
+	// MaxUploadSize specifies the maximum size of user files sent in a
+	// single request and of chunks of resumable uploads.
 	MaxUploadSize int64
+	// MaxResumableUploadSize specifies the maximum size of files sent
+	// in chunks and of photos of imported archives.
+	MaxResumableUploadSize int64
+	// UploadTypes are types of files which can be uploaded, they are
+	// sniffed from contents.
+	UploadTypes *file.Allowlist
 	// MailchimpListURI is an URI to register new subscribers.
 	MailchimpListURI string
 	// MailchimpAPI is an API key.
 	MailchimpAPI string
 	// AdminGroup unites roles with an access to administration resources.
 	AdminGroup []user.Role
+	// SearchEngine is "mongo" for the mongo text index or "index" for
+	// the embedded index stored at IndexPath.
+	SearchEngine, IndexPath string
+	// Translit overrides transliteration schemes of slugs, it is a
+	// comma separated list of language=scheme pairs.
+	Translit string
+	// PageCacheTTL is a lifetime of cached public pages, zero disables
+	// the cache.
+	PageCacheTTL time.Duration
 
 	Name, Addr string
 	// Timeout is read and write server's timeouts.
@@ -156,7 +315,7 @@ type configuration struct {
 // application shares resources between handlers and stores the global state of the web application.
 type application struct {
 	Config      *configuration
-	Db          *mgo.Database
+	Db          *mongodb.Database
 	Templates   map[string]*template.Template
 	Funcs       template.FuncMap
 	Langs       []language.Tag
@@ -166,33 +325,110 @@ type application struct {
 	Router      *mux.Router
 	CurrentUser *user.User
 	// transliterator manages slugs generation from titles.
-	Transliterator *slugify.Slugifier
+	Transliterator *slugifier.Slugifier
+	// Search is the full-text search backend for public content.
+	Search search.Backend
+	// Suggester completes search queries and corrects misspellings.
+	Suggester *search.Suggester
+	// SuggestionUpdates rebuild suggestions after edits.
+	SuggestionUpdates *suggestionUpdates
+	// Related recommends content for material pages.
+	Related *related.Engine
+	// Redirects are manual redirect rules set by editors.
+	Redirects *redirectRules
+	// Store gives access to data through repositories, new code uses
+	// it instead of Db.
+	Store *store.Stores
+	// Pages caches public pages rendered for anonymous visitors.
+	Pages *pagecache.Cache
+	// Images makes and keeps resized versions of uploaded images.
+	Images *imaging.Cache
+	// CropVersions are versions of crops changed by editors.
+	CropVersions *cropVersions
+	// Started is when templates and translations were loaded, pages
+	// rendered before are outdated.
+	Started time.Time
 }
 
 func newApplication(cfg *configuration) (app *application, err error) {
-	s, err := mgo.Dial(cfg.DbHost)
+	ctx := context.Background()
+	client, err := mongo.Dial(ctx, cfg.DbHost, cfg.DbTimeout)
 	if err != nil {
 		return app, fmt.Errorf("failed to dial the database %s: %v", cfg.DbHost, err)
 	}
+	db := client.Database(cfg.DbName)
 
-	if err = ensureIndexes(s, cfg.DbName); err != nil {
+	if err = ensureIndexes(ctx, db); err != nil {
 		return app, fmt.Errorf("failed to create database indexes: %v", err)
 	}
 
+	var backend search.Backend
+	switch cfg.SearchEngine {
+	case "mongo":
+		backend = &search.Mongo{Col: db.Collection("content")}
+	case "index":
+		var idx *search.Index
+		if idx, err = search.OpenIndex(cfg.IndexPath); err != nil {
+			return app, fmt.Errorf("failed to open the search index %s: %v", cfg.IndexPath, err)
+		}
+		backend = idx
+	default:
+		return app, fmt.Errorf("%v: %s", search.ErrUnknownEngine, cfg.SearchEngine)
+	}
+
+	transliterator := slugifier.NewSlugifier()
+	for _, v := range strings.Split(cfg.Translit, ",") {
+		if len(v) == 0 {
+			continue
+		}
+		pair := strings.SplitN(v, "=", 2)
+		if len(pair) != 2 {
+			return app, fmt.Errorf("invalid transliteration scheme %q, use language=scheme", v)
+		}
+		if err = transliterator.Use(pair[0], pair[1]); err != nil {
+			return app, fmt.Errorf("%v: %s", err, pair[1])
+		}
+	}
+
 	langs := []language.Tag{
 		language.English, // first language is used as a fallback
 		language.MustParse("be"),
 		language.Russian,
 	}
 
+	stores := store.NewMongo(db)
 	app = &application{
 		Config:         cfg,
-		Db:             s.DB(cfg.DbName),
+		Db:             db,
+		Store:          stores,
+		Pages:          newPageCache(cfg.PageCacheTTL, stores),
+		Images:         imaging.NewCache(filepath.Join(cfg.FilesDir, "derivatives"), imaging.Vips, runtime.NumCPU()),
+		Started:        time.Now(),
 		Langs:          langs,
 		LangMatcher:    language.NewMatcher(langs),
 		LangNamer:      display.English.Languages(),
-		FormDecoder:    schema.NewDecoder(),
-		Transliterator: slugifier.NewSlugifier(),
+		FormDecoder:    newFormDecoder(),
+		Transliterator: transliterator,
+		Search:         backend,
+		Suggester:      search.NewSuggester(),
+		Related:        related.NewEngine(relatedItems(stores)),
+	}
+
+	app.SuggestionUpdates = &suggestionUpdates{app: app, delay: suggestionsDelay}
+	if err = updateSuggestions(ctx, app.Store, app.Suggester, app.Langs); err != nil {
+		return app, fmt.Errorf("failed to load search suggestions: %v", err)
+	}
+
+	if err = restoreInvalidations(ctx, app); err != nil {
+		return app, fmt.Errorf("failed to load page invalidation times: %v", err)
+	}
+
+	if app.CropVersions, err = loadCropVersions(ctx, app.Store.Files); err != nil {
+		return app, fmt.Errorf("failed to load versions of image crops: %v", err)
+	}
+
+	if app.Redirects, err = newRedirectRules(ctx, app.Store.Redirects); err != nil {
+		return app, fmt.Errorf("failed to load redirect rules: %v", err)
 	}
 
 	funcs := generateTmplFuncs(app)
@@ -226,8 +462,10 @@ func LoginUser(app *application, r *http.Request) (u *user.User, err error) {
 	if !ok {
 		return nil, nil
 	}
-	u = new(user.User)
-	if err = mongo.GetID(app.Db.C("users"), id, u); err != nil {
+	if !primitive.IsValidObjectID(id) {
+		return nil, fmt.Errorf("cannot log in user: invalid id: %s", id)
+	}
+	if u, err = app.Store.Users.Get(r.Context(), objectIDHex(id)); err != nil {
 		err = fmt.Errorf("cannot log in user: id: %s error: %v", id, err)
 		return
 	}
@@ -277,7 +515,7 @@ type Page struct {
 }
 
 func Render(tmpl *template.Template, lang language.Tag, w http.ResponseWriter, data interface{}) {
-	T, err := i18n.Tfunc(lang.String())
+	T, err := translations.Tfunc(lang.String())
 	Check(err)
 	tmpl = tmpl.Funcs(map[string]interface{}{
 		"T": T,
@@ -11,9 +11,10 @@ import (
 	"time"
 
 	"github.com/bahna/magazine/webserver/mail"
+	"github.com/bahna/magazine/webserver/store"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
-	"github.com/globalsign/mgo"
+	mongodb "go.mongodb.org/mongo-driver/mongo"
 )
 
 // TODO: fast solution, replace the code below with something more configurable
@@ -107,6 +108,22 @@ func Recover(next http.Handler) http.Handler {
 	})
 }
 
+// Redirects redirects requests matched by manual redirect rules.
+func Redirects(next http.Handler, rules *redirectRules) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			if rd := rules.Match(r.URL.Path); rd != nil {
+				if err := rules.Hit(r.Context(), rd); err != nil {
+					log.Println(err)
+				}
+				http.Redirect(w, r, rd.To, http.StatusMovedPermanently)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func RedirectTrailingSlash(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" && strings.HasSuffix(r.URL.Path, "/") && !strings.HasPrefix(r.URL.Path, "/static") {
@@ -162,7 +179,7 @@ func SetRUCookie(next http.Handler) http.Handler {
 }
 
 func responseStatusFromErr(err error) int {
-	if err == mgo.ErrNotFound {
+	if err == mongodb.ErrNoDocuments || err == store.ErrNotFound {
 		return http.StatusNotFound
 	}
 	return http.StatusInternalServerError
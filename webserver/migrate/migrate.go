@@ -0,0 +1,149 @@
+// Package migrate applies versioned changes of documents to a database.
+// Migrations are registered in Go, applied in the order of their
+// versions and recorded in the "migrations" collection, so that each
+// of them is applied once.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	mongodb "go.mongodb.org/mongo-driver/mongo"
+)
+
+// Collection keeps records of applied migrations.
+const Collection = "migrations"
+
+var (
+	ErrInvalidVersion   = errors.New("migration version must be positive")
+	ErrDuplicateVersion = errors.New("duplicate migration version")
+)
+
+// Migration changes documents of a database. A migration must not be
+// changed after it has been released, further changes are done by new
+// migrations.
+type Migration struct {
+	// Version orders migrations, it is unique and positive.
+	Version int
+	// Name describes the migration.
+	Name string
+	// Up applies the migration and returns an amount of changed
+	// documents. When dry is true, it only counts documents which
+	// would be changed.
+	Up func(ctx context.Context, db *mongodb.Database, dry bool) (int, error)
+}
+
+// Status is a state of a migration, Applied is zero for pending
+// migrations.
+type Status struct {
+	Migration
+	Applied time.Time
+}
+
+// Pending checks if the migration hasn't been applied yet.
+func (s *Status) Pending() bool {
+	return s.Applied.IsZero()
+}
+
+// record is a document of an applied migration.
+type record struct {
+	Version int `bson:"_id"`
+	Name    string
+	Applied time.Time
+}
+
+// Migrator applies migrations to a database.
+type Migrator struct {
+	db         *mongodb.Database
+	migrations []Migration
+}
+
+// New returns a migrator of the database with the migrations sorted
+// by versions.
+func New(db *mongodb.Database, migrations ...Migration) (*Migrator, error) {
+	mm := make([]Migration, len(migrations))
+	copy(mm, migrations)
+	sort.Slice(mm, func(i, j int) bool { return mm[i].Version < mm[j].Version })
+	for i, m := range mm {
+		if m.Version <= 0 {
+			return nil, fmt.Errorf("%v: %d %s", ErrInvalidVersion, m.Version, m.Name)
+		}
+		if i > 0 && mm[i-1].Version == m.Version {
+			return nil, fmt.Errorf("%v: %d %s", ErrDuplicateVersion, m.Version, m.Name)
+		}
+	}
+	return &Migrator{db: db, migrations: mm}, nil
+}
+
+// Status returns states of all migrations in the order of versions.
+func (m *Migrator) Status(ctx context.Context) ([]*Status, error) {
+	cur, err := m.db.Collection(Collection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	rr := []*record{}
+	if err = cur.All(ctx, &rr); err != nil {
+		return nil, err
+	}
+	applied := make(map[int]time.Time, len(rr))
+	for _, r := range rr {
+		applied[r.Version] = r.Applied
+	}
+
+	ss := make([]*Status, len(m.migrations))
+	for i, v := range m.migrations {
+		ss[i] = &Status{Migration: v, Applied: applied[v.Version]}
+	}
+	return ss, nil
+}
+
+// Pending returns migrations which haven't been applied yet.
+func (m *Migrator) Pending(ctx context.Context) ([]*Status, error) {
+	ss, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pending := []*Status{}
+	for _, s := range ss {
+		if s.Pending() {
+			pending = append(pending, s)
+		}
+	}
+	return pending, nil
+}
+
+// Up applies pending migrations in order and stops at the first
+// failed one. The report function is called after each migration with
+// an amount of changed documents. In the dry mode nothing is changed
+// or recorded and the amounts are ones which would be changed.
+func (m *Migrator) Up(ctx context.Context, dry bool, report func(s *Status, n int)) error {
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range pending {
+		n, err := s.Up(ctx, m.db, dry)
+		if err != nil {
+			return fmt.Errorf("migration %d %s: %v", s.Version, s.Name, err)
+		}
+		if !dry {
+			s.Applied = time.Now()
+			_, err = m.db.Collection(Collection).InsertOne(ctx, &record{
+				Version: s.Version,
+				Name:    s.Name,
+				Applied: s.Applied,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to record migration %d %s: %v", s.Version, s.Name, err)
+			}
+		}
+		if report != nil {
+			report(s, n)
+		}
+	}
+	return nil
+}
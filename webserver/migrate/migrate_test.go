@@ -0,0 +1,224 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bahna/magazine/webserver/mongo"
+	mongodb "go.mongodb.org/mongo-driver/mongo"
+)
+
+// Tests of applying migrations need a MongoDB server, e.g.:
+//
+//	MONGO_URL=mongodb://localhost go test ./migrate
+//
+// A temporary database is dropped afterwards.
+
+func testDB(t *testing.T) (db *mongodb.Database, teardown func()) {
+	url := os.Getenv("MONGO_URL")
+	if len(url) == 0 {
+		t.Skip("MONGO_URL is not set")
+	}
+
+	ctx := context.Background()
+	client, err := mongo.Dial(ctx, url, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = client.Database(fmt.Sprintf("magazine_migrate_%d", time.Now().UnixNano()))
+	teardown = func() {
+		db.Drop(ctx)
+		client.Disconnect(ctx)
+	}
+	return
+}
+
+func TestNew(t *testing.T) {
+	m, err := New(nil,
+		Migration{Version: 3, Name: "c"},
+		Migration{Version: 1, Name: "a"},
+		Migration{Version: 2, Name: "b"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, v := range m.migrations {
+		names = append(names, v.Name)
+	}
+	if got := strings.Join(names, ""); got != "abc" {
+		t.Errorf("migrations are ordered as %q, want %q", got, "abc")
+	}
+
+	tests := []struct {
+		name       string
+		migrations []Migration
+		want       error
+	}{
+		{"zero", []Migration{{Version: 0}}, ErrInvalidVersion},
+		{"negative", []Migration{{Version: 1}, {Version: -1}}, ErrInvalidVersion},
+		{"duplicate", []Migration{{Version: 2}, {Version: 1}, {Version: 2}}, ErrDuplicateVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(nil, tt.migrations...)
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want.Error()) {
+				t.Errorf("New() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// runs records versions of migrations run by Up with the dry flag.
+type runs []string
+
+func (r *runs) migration(version int, err error) Migration {
+	return Migration{
+		Version: version,
+		Name:    fmt.Sprintf("m%d", version),
+		Up: func(ctx context.Context, db *mongodb.Database, dry bool) (int, error) {
+			*r = append(*r, fmt.Sprintf("%d %v", version, dry))
+			return version * 10, err
+		},
+	}
+}
+
+func versions(ss []*Status) []int {
+	vv := []int{}
+	for _, s := range ss {
+		vv = append(vv, s.Version)
+	}
+	return vv
+}
+
+func TestUp(t *testing.T) {
+	db, teardown := testDB(t)
+	defer teardown()
+	ctx := context.Background()
+
+	var r runs
+	m, err := New(db, r.migration(2, nil), r.migration(1, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the dry mode neither changes nor records anything
+	reported := []string{}
+	report := func(s *Status, n int) {
+		reported = append(reported, fmt.Sprintf("%d %d", s.Version, n))
+	}
+	if err = m.Up(ctx, true, report); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1 true", "2 true"}; !reflect.DeepEqual([]string(r), want) {
+		t.Errorf("dry Up() runs %v, want %v", r, want)
+	}
+	if want := []string{"1 10", "2 20"}; !reflect.DeepEqual(reported, want) {
+		t.Errorf("dry Up() reports %v, want %v", reported, want)
+	}
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := versions(pending); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("Pending() after a dry run = %v, want [1 2]", got)
+	}
+
+	// migrations are applied in order and recorded
+	r = nil
+	if err = m.Up(ctx, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1 false", "2 false"}; !reflect.DeepEqual([]string(r), want) {
+		t.Errorf("Up() runs %v, want %v", r, want)
+	}
+	ss, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range ss {
+		if s.Pending() {
+			t.Errorf("migration %d is pending after Up()", s.Version)
+		}
+	}
+
+	// applied migrations are skipped, Up stops at the first failure
+	r = nil
+	failure := errors.New("failure")
+	m, err = New(db, r.migration(1, nil), r.migration(2, nil), r.migration(4, nil), r.migration(3, failure))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Up(ctx, false, nil); err == nil || !strings.HasSuffix(err.Error(), failure.Error()) {
+		t.Errorf("Up() error = %v, want %v", err, failure)
+	}
+	if want := []string{"3 false"}; !reflect.DeepEqual([]string(r), want) {
+		t.Errorf("Up() runs %v, want %v", r, want)
+	}
+	pending, err = m.Pending(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := versions(pending); !reflect.DeepEqual(got, []int{3, 4}) {
+		t.Errorf("Pending() after a failure = %v, want [3 4]", got)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	db, teardown := testDB(t)
+	defer teardown()
+	ctx := context.Background()
+
+	var r runs
+	m, err := New(db, r.migration(1, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Up(ctx, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// records of unknown migrations are ignored, e.g. of a newer
+	// version of the website
+	m, err = New(db, r.migration(3, nil), r.migration(2, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := versions(ss); !reflect.DeepEqual(got, []int{2, 3}) {
+		t.Errorf("Status() = %v, want [2 3]", got)
+	}
+	for _, s := range ss {
+		if !s.Pending() {
+			t.Errorf("migration %d is applied", s.Version)
+		}
+	}
+
+	m, err = New(db, r.migration(1, nil), r.migration(2, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err = m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != 2 || ss[0].Pending() || ss[0].Name != "m1" || !ss[1].Pending() {
+		t.Errorf("Status() = %+v %+v", ss[0], ss[1])
+	}
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := versions(pending); !reflect.DeepEqual(got, []int{2}) {
+		t.Errorf("Pending() = %v, want [2]", got)
+	}
+}
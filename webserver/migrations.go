@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/bahna/magazine/webserver/cms"
+	"github.com/bahna/magazine/webserver/migrate"
+	"github.com/bahna/magazine/webserver/mongo"
+	"github.com/bahna/magazine/webserver/slugifier"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	mongodb "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// migrations change documents saved by previous versions of the
+// website. Released migrations must not be changed, append new ones
+// with the next versions.
+var migrations = []migrate.Migration{
+	{
+		Version: 1,
+		Name:    "content pages are marked with the Page type instead of the page flag",
+		Up: func(ctx context.Context, db *mongodb.Database, dry bool) (int, error) {
+			col := db.Collection("content")
+			flagged := bson.M{"page": bson.M{"$exists": true}}
+			n, err := col.CountDocuments(ctx, flagged)
+			if err != nil || dry {
+				return int(n), err
+			}
+			_, err = col.UpdateMany(ctx,
+				bson.M{"page": true, "type": bson.M{"$ne": cms.Page}},
+				bson.M{"$set": bson.M{"type": cms.Page}})
+			if err != nil {
+				return 0, err
+			}
+			_, err = col.UpdateMany(ctx, flagged, bson.M{"$unset": bson.M{"page": ""}})
+			return int(n), err
+		},
+	},
+	{
+		Version: 2,
+		Name:    "Belarusian content and topics are indexed with the Russian language override",
+		Up: func(ctx context.Context, db *mongodb.Database, dry bool) (total int, err error) {
+			// be is unsupported by mongodb text indexes, documents
+			// saved before the override was introduced don't have it
+			query := bson.M{"language": "be", "language_override": bson.M{"$ne": "ru"}}
+			for _, name := range []string{"content", "topics"} {
+				col := db.Collection(name)
+				var n int64
+				if dry {
+					n, err = col.CountDocuments(ctx, query)
+				} else {
+					var res *mongodb.UpdateResult
+					res, err = col.UpdateMany(ctx, query, bson.M{"$set": bson.M{"language_override": "ru"}})
+					if res != nil {
+						n = res.ModifiedCount
+					}
+				}
+				if err != nil {
+					return
+				}
+				total += int(n)
+			}
+			return
+		},
+	},
+	{
+		Version: 3,
+		Name:    "topic slugs are unique among subsections of a parent and don't take paths of other pages and content",
+		Up: func(ctx context.Context, db *mongodb.Database, dry bool) (int, error) {
+			// first segments of paths taken by routes at the release
+			reserved := map[string]bool{
+				"admin": true, "signup": true, "login": true, "logout": true, "restore": true,
+				"mailchimp": true, "search": true, "tag": true, "authors": true,
+			}
+			col := db.Collection("topics")
+			items := []*cms.Topic{}
+			// older topics keep their slugs
+			if err := mongo.All(ctx, col, nil, &items, options.Find().SetSort(mongo.Sort("_id"))); err != nil {
+				return 0, err
+			}
+			// taken are slugs by languages and parents, parents of
+			// subsections are collected to check their content
+			taken := map[string]bool{}
+			parents := []primitive.ObjectID{}
+			n := 0
+			for _, t := range items {
+				parent := ""
+				if t.ParentID != nil {
+					parent = t.ParentID.Hex()
+					parents = append(parents, *t.ParentID)
+				}
+				slug := t.Slug
+				for i := 2; taken[t.Language+"/"+parent+"/"+slug] || (len(parent) == 0 && reserved[slug]); i++ {
+					slug = fmt.Sprintf("%s-%d", t.Slug, i)
+				}
+				taken[t.Language+"/"+parent+"/"+slug] = true
+				if slug == t.Slug {
+					continue
+				}
+				n++
+				if dry {
+					continue
+				}
+				if _, err := col.UpdateByID(ctx, t.ID, bson.M{"$set": bson.M{"slug": slug}}); err != nil {
+					return n, err
+				}
+			}
+			if !dry && n > 0 {
+				if err := cms.UpdateTopicPaths(ctx, db); err != nil {
+					return n, err
+				}
+			}
+
+			// content with the slug of a subsection of its primary
+			// topic is hidden by the subsection, the content gets a
+			// free slug and keeps the old one in its history; content
+			// saved before primary topics has the first topic instead
+			col = db.Collection("content")
+			cc := []*cms.Content{}
+			err := mongo.All(ctx, col, bson.M{"$or": []bson.M{
+				{"primarytopicid": bson.M{"$in": parents}},
+				{"primarytopicid": bson.M{"$exists": false}, "topicids.0": bson.M{"$in": parents}},
+			}}, &cc, options.Find().
+				SetProjection(bson.M{"language": 1, "primarytopicid": 1, "topicids": 1, "slug": 1}).
+				SetSort(mongo.Sort("_id")))
+			if err != nil {
+				return n, err
+			}
+			slugs := map[string]bool{}
+			for _, c := range cc {
+				slugs[c.Language+"/"+c.CanonicalTopicID().Hex()+"/"+c.Slug] = true
+			}
+			for _, c := range cc {
+				key := c.Language + "/" + c.CanonicalTopicID().Hex() + "/"
+				if !taken[key+c.Slug] {
+					continue
+				}
+				slug := c.Slug
+				for i := 2; taken[key+slug] || slugs[key+slug]; i++ {
+					slug = fmt.Sprintf("%s-%d", c.Slug, i)
+				}
+				slugs[key+slug] = true
+				n++
+				if dry {
+					continue
+				}
+				_, err = col.UpdateByID(ctx, c.ID, bson.M{
+					"$set":      bson.M{"slug": slug},
+					"$addToSet": bson.M{"oldslugs": c.Slug},
+				})
+				if err != nil {
+					return n, err
+				}
+			}
+			return n, nil
+		},
+	},
+	{
+		Version: 4,
+		Name:    "content saved before the full-text search has names of authors and titles of topics",
+		Up: func(ctx context.Context, db *mongodb.Database, dry bool) (int, error) {
+			query := bson.M{"authornames": bson.M{"$exists": false}}
+			n, err := db.Collection("content").CountDocuments(ctx, query)
+			if err != nil || dry {
+				return int(n), err
+			}
+			return int(n), cms.UpdateSearchFields(ctx, db, query)
+		},
+	},
+	{
+		Version: 5,
+		Name:    "topics saved before nesting have paths",
+		Up: func(ctx context.Context, db *mongodb.Database, dry bool) (int, error) {
+			n, err := db.Collection("topics").CountDocuments(ctx, bson.M{"path": bson.M{"$in": []interface{}{nil, ""}}})
+			if err != nil || dry {
+				return int(n), err
+			}
+			return int(n), cms.UpdateTopicPaths(ctx, db)
+		},
+	},
+	{
+		Version: 6,
+		Name:    "authors saved before author pages have slugs",
+		Up: func(ctx context.Context, db *mongodb.Database, dry bool) (int, error) {
+			n, err := db.Collection("users").CountDocuments(ctx, bson.M{
+				"slug":  bson.M{"$in": []interface{}{nil, ""}},
+				"roles": bson.M{"$in": cms.AuthorRoles},
+			})
+			if err != nil || dry {
+				return int(n), err
+			}
+			return int(n), cms.SetUserSlugs(ctx, db, slugifier.NewSlugifier().Slugify)
+		},
+	},
+	{
+		Version: 7,
+		Name:    "content saved before primary topics has the first topic as the primary one",
+		Up: func(ctx context.Context, db *mongodb.Database, dry bool) (int, error) {
+			n, err := db.Collection("content").CountDocuments(ctx, bson.M{
+				"primarytopicid": bson.M{"$exists": false},
+				"topicids.0":     bson.M{"$exists": true},
+			})
+			if err != nil || dry {
+				return int(n), err
+			}
+			return int(n), cms.SetPrimaryTopics(ctx, db)
+		},
+	},
+}
+
+// migrateCommand runs "migrate up" and "migrate status" subcommands.
+func migrateCommand(db *mongodb.Database, args []string) error {
+	m, err := migrate.New(db, migrations...)
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dry := fs.Bool("dry", false, "count documents to be changed without changing them")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: magazine-server migrate [-dry] up|status")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	ctx := context.Background()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+
+	switch cmd := fs.Arg(0); cmd {
+	case "up":
+		if *dry {
+			fmt.Fprintln(w, "dry run, nothing is changed")
+		}
+		return m.Up(ctx, *dry, func(s *migrate.Status, n int) {
+			fmt.Fprintf(w, "%d\t%s\t%d documents\n", s.Version, s.Name, n)
+		})
+	case "status":
+		ss, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range ss {
+			applied := "pending"
+			if !s.Pending() {
+				applied = s.Applied.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return nil
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown migrate command %q", cmd)
+	}
+}
+
+// checkMigrations returns an error if some migrations haven't been
+// applied, the server doesn't work with documents of older versions.
+func checkMigrations(ctx context.Context, db *mongodb.Database) error {
+	m, err := migrate.New(db, migrations...)
+	if err != nil {
+		return err
+	}
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range pending {
+		log.Printf("migration %d is pending: %s", s.Version, s.Name)
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%d migrations are pending, run \"magazine-server migrate up\" to apply them", len(pending))
+	}
+	return nil
+}
@@ -2,67 +2,141 @@
 package mongo
 
 import (
+	"context"
 	"errors"
+	"strings"
+	"time"
 
-	"github.com/globalsign/mgo"
-	"github.com/globalsign/mgo/bson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	mongodb "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
 	ErrInvalidID = errors.New("invalid ID")
 )
 
-func Save(col *mgo.Collection, selector interface{}, item interface{}) error {
-	col.Database.Session.Refresh()
-	_, err := col.Upsert(selector, item)
+// Dial connects to the server at the host, which is either a host name
+// or a "mongodb://" URI. Operations which contexts have no deadlines
+// time out after the timeout. Documents are encoded the same way the
+// mgo driver did, so that data saved before the migration to the
+// official driver stays compatible.
+func Dial(ctx context.Context, host string, timeout time.Duration, opts ...*options.ClientOptions) (*mongodb.Client, error) {
+	if !strings.Contains(host, "://") {
+		host = "mongodb://" + host
+	}
+	o := options.Client().
+		ApplyURI(host).
+		SetTimeout(timeout).
+		SetBSONOptions(&options.BSONOptions{
+			IntMinSize:       true,
+			NilSliceAsEmpty:  true,
+			NilMapAsEmpty:    true,
+			DefaultDocumentM: true,
+			UseLocalTimeZone: true,
+		})
+	client, err := mongodb.Connect(ctx, append([]*options.ClientOptions{o}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	if err = client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+	return client, nil
+}
+
+// Query returns the query or an empty document if the query is nil,
+// because the driver doesn't accept nil queries.
+func Query(query interface{}) interface{} {
+	switch q := query.(type) {
+	case nil:
+		return bson.M{}
+	case bson.M:
+		if q == nil {
+			return bson.M{}
+		}
+	}
+	return query
+}
+
+// Sort converts field names like "-weight" into a sort document, the
+// minus sign means the descending order.
+func Sort(fields ...string) bson.D {
+	d := make(bson.D, 0, len(fields))
+	for _, f := range fields {
+		if strings.HasPrefix(f, "-") {
+			d = append(d, bson.E{Key: f[1:], Value: -1})
+		} else {
+			d = append(d, bson.E{Key: f, Value: 1})
+		}
+	}
+	return d
+}
+
+// All fetches documents matched by the query into the slice pointed by
+// dst.
+func All(ctx context.Context, col *mongodb.Collection, query, dst interface{}, opts ...*options.FindOptions) error {
+	cur, err := col.Find(ctx, Query(query), opts...)
+	if err != nil {
+		return err
+	}
+	return cur.All(ctx, dst)
+}
+
+// Count returns an amount of documents matched by the query.
+func Count(ctx context.Context, col *mongodb.Collection, query interface{}) (int, error) {
+	n, err := col.CountDocuments(ctx, Query(query))
+	return int(n), err
+}
+
+func Save(ctx context.Context, col *mongodb.Collection, selector interface{}, item interface{}) error {
+	_, err := col.ReplaceOne(ctx, selector, item, options.Replace().SetUpsert(true))
 	return err
 }
 
-func Delete(col *mgo.Collection, idStr string) error {
-	id := bson.ObjectIdHex(idStr)
-	if !id.Valid() {
+func Delete(ctx context.Context, col *mongodb.Collection, idStr string) error {
+	id, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
 		return ErrInvalidID
 	}
-	col.Database.Session.Refresh()
-	return col.RemoveId(id)
+	res, err := col.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongodb.ErrNoDocuments
+	}
+	return nil
 }
 
 // GetID fetches a document from a database into the provided interface.
-func GetID(col *mgo.Collection, idStr string, dst interface{}) error {
-	var id bson.ObjectId
-	if id = bson.ObjectIdHex(idStr); !id.Valid() {
+func GetID(ctx context.Context, col *mongodb.Collection, idStr string, dst interface{}) error {
+	id, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
 		return ErrInvalidID
 	}
-	col.Database.Session.Refresh()
-	return col.FindId(id).One(dst)
+	return col.FindOne(ctx, bson.M{"_id": id}).Decode(dst)
 }
 
 // GetOne fetches an item from a database.
-func GetOne(col *mgo.Collection, query, dst interface{}) error {
-	col.Database.Session.Refresh()
-	return col.Find(query).One(dst)
+func GetOne(ctx context.Context, col *mongodb.Collection, query, dst interface{}, opts ...*options.FindOneOptions) error {
+	return col.FindOne(ctx, Query(query), opts...).Decode(dst)
 }
 
-// UpdateID updates a database by the specified ID with the provided mgo.Change.
-func UpdateID(col *mgo.Collection, idStr string, set interface{}, dst interface{}) error {
-	id := bson.ObjectIdHex(idStr)
-	if !id.Valid() {
+// UpdateID sets the fields of the document with the specified ID and
+// fetches the updated document into dst.
+func UpdateID(ctx context.Context, col *mongodb.Collection, idStr string, set interface{}, dst interface{}) error {
+	id, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
 		return ErrInvalidID
 	}
-	col.Database.Session.Refresh()
-	_, err := col.FindId(id).Apply(mgo.Change{
-		Update:    bson.M{"$set": set},
-		ReturnNew: true,
-	}, dst)
-	return err
+	return UpdateOne(ctx, col, bson.M{"_id": id}, set, dst)
 }
 
 // UpdateOne updates a record found by a query.
-func UpdateOne(col *mgo.Collection, query, set, dst interface{}) error {
-	col.Database.Session.Refresh()
-	_, err := col.Find(query).Apply(mgo.Change{
-		Update:    bson.M{"$set": set},
-		ReturnNew: true,
-	}, dst)
-	return err
+func UpdateOne(ctx context.Context, col *mongodb.Collection, query, set, dst interface{}) error {
+	return col.FindOneAndUpdate(ctx, Query(query), bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(dst)
 }
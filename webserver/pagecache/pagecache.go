@@ -0,0 +1,325 @@
+// Package pagecache keeps rendered pages in memory, so that pages are
+// rendered once until data they show is changed.
+package pagecache
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache keeps successful responses to GET requests by paths and page
+// numbers. Pages are removed when they are invalidated, when their TTL
+// is over and at the next change returned by NextChange.
+type Cache struct {
+	// TTL limits the age of pages, it bounds staleness of data which
+	// changes without edits, e.g. of past events. Zero TTL disables
+	// the cache.
+	TTL time.Duration
+	// MaxEntries limits an amount of pages, expired pages and then the
+	// least recently used ones are removed when the limit is reached.
+	MaxEntries int
+	// NextChange returns the moment when cached pages become outdated
+	// by themselves, e.g. when scheduled content is published. It is
+	// called after invalidations, zero time means never.
+	NextChange func() (time.Time, error)
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	// lru orders keys of entries from the most recently used.
+	lru *list.List
+	// gen is incremented by invalidations, so that pages rendered
+	// before an invalidation are not stored after it.
+	gen     uint64
+	next    time.Time
+	nextSet bool
+	stats   Stats
+	// cleared is the time when all pages were invalidated, modified
+	// are times when pages were invalidated by prefixes.
+	cleared  time.Time
+	modified map[string]time.Time
+}
+
+type entry struct {
+	header  http.Header
+	body    []byte
+	expires time.Time
+	elem    *list.Element
+}
+
+// Stats are counters of requests to the cache.
+type Stats struct {
+	// Hits and Misses count requests served from the cache and
+	// rendered, Bypasses count requests which are never cached.
+	Hits, Misses, Bypasses int64
+	// Entries is an amount of cached pages.
+	Entries int
+}
+
+// HitPercent returns a percentage of cacheable requests served from
+// the cache.
+func (s Stats) HitPercent() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return 100 * float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// New returns an empty cache.
+func New(ttl time.Duration, maxEntries int, nextChange func() (time.Time, error)) *Cache {
+	return &Cache{
+		TTL:        ttl,
+		MaxEntries: maxEntries,
+		NextChange: nextChange,
+		entries:    make(map[string]*entry),
+		lru:        list.New(),
+		modified:   make(map[string]time.Time),
+	}
+}
+
+// Key returns a key of the page requested by r. Pages differ by paths
+// and page numbers of lists, other query parameters are ignored. The
+// first page has no number, an empty key is returned for invalid page
+// numbers, such pages are not cached.
+func Key(r *http.Request) string {
+	p := r.URL.Query().Get("p")
+	if len(p) == 0 {
+		return r.URL.Path
+	}
+	n, err := strconv.Atoi(p)
+	if err != nil || n < 1 {
+		return ""
+	}
+	if n == 1 {
+		return r.URL.Path
+	}
+	return r.URL.Path + "?p=" + strconv.Itoa(n)
+}
+
+// Handler serves pages from the cache and caches pages rendered by
+// next. Requests matched by bypass are passed to next as is.
+func (c *Cache) Handler(next http.Handler, bypass func(r *http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := Key(r)
+		if c.TTL <= 0 || r.Method != "GET" || len(key) == 0 || (bypass != nil && bypass(r)) {
+			c.mu.Lock()
+			c.stats.Bypasses++
+			c.mu.Unlock()
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		e, gen := c.get(key, time.Now())
+		if e != nil {
+			for k, v := range e.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("X-Cache", "HIT")
+			if NotModified(r, e.header) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write(e.body)
+			return
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		rec := &recorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if rec.code != http.StatusOK || len(w.Header()["Set-Cookie"]) > 0 {
+			return
+		}
+		header := make(http.Header, len(w.Header()))
+		for k, v := range w.Header() {
+			if k != "X-Cache" {
+				header[k] = append([]string(nil), v...)
+			}
+		}
+		c.put(key, gen, &entry{header: header, body: rec.body.Bytes()})
+	})
+}
+
+// get returns a fresh page or nil with the current generation.
+func (c *Cache) get(key string, now time.Time) (*entry, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.nextSet && !c.next.IsZero() && !now.Before(c.next) {
+		c.clear()
+	}
+	if e, ok := c.entries[key]; ok {
+		if now.Before(e.expires) {
+			c.stats.Hits++
+			c.lru.MoveToFront(e.elem)
+			return e, c.gen
+		}
+		c.remove(key)
+	}
+	c.stats.Misses++
+	return nil, c.gen
+}
+
+// put stores the page rendered at the generation unless the cache has
+// been invalidated since then.
+func (c *Cache) put(key string, gen uint64, e *entry) {
+	c.mu.Lock()
+	nextSet := c.nextSet
+	c.mu.Unlock()
+
+	var next time.Time
+	if !nextSet && c.NextChange != nil {
+		var err error
+		if next, err = c.NextChange(); err != nil {
+			// pages are not cached until it is known when they
+			// become outdated
+			return
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if !c.nextSet {
+		c.next, c.nextSet = next, true
+	}
+	c.remove(key)
+	// expired pages aren't requested and become the least recently
+	// used ones
+	for c.MaxEntries > 0 && len(c.entries) >= c.MaxEntries {
+		c.remove(c.lru.Back().Value.(string))
+	}
+	e.expires = time.Now().Add(c.TTL)
+	e.elem = c.lru.PushFront(key)
+	c.entries[key] = e
+}
+
+// remove removes the page by its key, c.mu must be locked.
+func (c *Cache) remove(key string) {
+	if e, ok := c.entries[key]; ok {
+		c.lru.Remove(e.elem)
+		delete(c.entries, key)
+	}
+}
+
+// Invalidate removes pages which paths start with any of the prefixes
+// or all pages if no prefixes are given. Call it after data shown on
+// pages is changed.
+func (c *Cache) Invalidate(prefixes ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(prefixes) == 0 {
+		c.clear()
+		return
+	}
+	c.gen++
+	c.nextSet = false
+	now := time.Now()
+	for _, p := range prefixes {
+		c.modified[p] = now
+	}
+	for key := range c.entries {
+		for _, p := range prefixes {
+			if strings.HasPrefix(key, p) {
+				c.remove(key)
+				break
+			}
+		}
+	}
+}
+
+// clear removes all pages, c.mu must be locked.
+func (c *Cache) clear() {
+	c.gen++
+	c.nextSet = false
+	c.entries = make(map[string]*entry)
+	c.lru.Init()
+	c.cleared = time.Now()
+	c.modified = make(map[string]time.Time)
+}
+
+// Restore sets the time of an invalidation made before the cache was
+// created, e.g. by another process. The empty prefix stands for all
+// pages.
+func (c *Cache) Restore(prefix string, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(prefix) == 0 {
+		if t.After(c.cleared) {
+			c.cleared = t
+		}
+		return
+	}
+	if t.After(c.modified[prefix]) {
+		c.modified[prefix] = t
+	}
+}
+
+// Modified returns the time of the latest invalidation of the page at
+// the path or zero time if it hasn't been invalidated.
+func (c *Cache) Modified(path string) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.cleared
+	for p, m := range c.modified {
+		if m.After(t) && strings.HasPrefix(path, p) {
+			t = m
+		}
+	}
+	return t
+}
+
+// NotModified checks if the client has the version of the page
+// described by the ETag and Last-Modified headers. If-None-Match takes
+// precedence over If-Modified-Since, ETags are compared weakly.
+func NotModified(r *http.Request, h http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); len(inm) > 0 {
+		etag := strings.TrimPrefix(h.Get("ETag"), "W/")
+		if len(etag) == 0 {
+			return false
+		}
+		for _, v := range strings.Split(inm, ",") {
+			v = strings.TrimSpace(v)
+			if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(h.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// Stats returns the current counters.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = len(c.entries)
+	return s
+}
+
+// recorder copies a response written to the underlying writer.
+type recorder struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,123 @@
+package pagecache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	renders := 0
+	next := time.Time{}
+	c := New(time.Hour, 10, func() (time.Time, error) { return next, nil })
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/be/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		renders++
+		fmt.Fprintf(w, "%s %d", r.URL.Path, renders)
+	}), func(r *http.Request) bool {
+		_, err := r.Cookie("auth")
+		return err == nil
+	})
+
+	get := func(target string, cookie bool) string {
+		r := httptest.NewRequest("GET", target, nil)
+		if cookie {
+			r.AddCookie(&http.Cookie{Name: "auth", Value: "1"})
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	steps := []struct {
+		name   string
+		target string
+		cookie bool
+		before func()
+		want   string
+	}{
+		{"miss", "/be/", false, nil, "/be/ 1"},
+		{"hit", "/be/", false, nil, "/be/ 1"},
+		{"page number", "/be/?p=2", false, nil, "/be/ 2"},
+		{"other parameters", "/be/?p=2&utm=x", false, nil, "/be/ 2"},
+		{"bypass", "/be/", true, nil, "/be/ 3"},
+		{"other language", "/ru/", false, nil, "/ru/ 4"},
+		{"invalidated language", "/be/", false, func() { c.Invalidate("/be/") }, "/be/ 5"},
+		{"kept language", "/ru/", false, nil, "/ru/ 4"},
+		{"invalidated all", "/ru/", false, func() { c.Invalidate() }, "/ru/ 6"},
+		{"next change", "/ru/", false, func() {
+			next = time.Now().Add(-time.Second)
+			c.Invalidate()
+		}, "/ru/ 7"},
+		{"next change passed", "/ru/", false, nil, "/ru/ 8"},
+	}
+	for _, s := range steps {
+		if s.before != nil {
+			s.before()
+		}
+		if got := get(s.target, s.cookie); got != s.want {
+			t.Errorf("%s: got %q, want %q", s.name, got, s.want)
+		}
+	}
+
+	next = time.Time{}
+	c.Invalidate()
+	get("/be/", false)
+	get("/be/missing", false)
+	get("/be/missing", false)
+	if st := c.Stats(); st.Bypasses != 1 || st.Entries != 1 {
+		t.Errorf("stats %+v, want 1 bypass and 1 entry", st)
+	}
+}
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		target, want string
+	}{
+		{"/be/", "/be/"},
+		{"/be/?p=1", "/be/"},
+		{"/be/?p=02&utm=x", "/be/?p=2"},
+		{"/be/?p=0", ""},
+		{"/be/?p=-1", ""},
+		{"/be/?p=x", ""},
+	}
+	for _, tt := range tests {
+		if got := Key(httptest.NewRequest("GET", tt.target, nil)); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestEviction(t *testing.T) {
+	renders := 0
+	c := New(time.Hour, 2, nil)
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		renders++
+		fmt.Fprintf(w, "%s %d", r.URL.Path, renders)
+	}), nil)
+	get := func(target string) string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w.Body.String()
+	}
+
+	get("/a")
+	get("/b")
+	get("/a")
+	// /b is the least recently used page
+	get("/c")
+	if got := get("/a"); got != "/a 1" {
+		t.Errorf("got %q, the recently used page is evicted", got)
+	}
+	if got := get("/b"); got != "/b 4" {
+		t.Errorf("got %q, the least recently used page is kept", got)
+	}
+	if st := c.Stats(); st.Entries != 2 {
+		t.Errorf("%d entries, want 2", st.Entries)
+	}
+}
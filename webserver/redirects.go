@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/bahna/magazine/webserver/cms"
+	"github.com/bahna/magazine/webserver/store"
+)
+
+// redirectRules keeps manual redirect rules in memory to not query the
+// database on every request.
+type redirectRules struct {
+	store store.RedirectStore
+	mu    sync.RWMutex
+	rules map[string]*cms.Redirect
+}
+
+// newRedirectRules returns rules loaded from the store.
+func newRedirectRules(ctx context.Context, s store.RedirectStore) (*redirectRules, error) {
+	rr := &redirectRules{store: s}
+	return rr, rr.Reload(ctx)
+}
+
+// Reload reads the rules from the database. Call it after the rules
+// are changed.
+func (rr *redirectRules) Reload(ctx context.Context) error {
+	items, err := rr.store.All(ctx)
+	if err != nil {
+		return err
+	}
+
+	rules := make(map[string]*cms.Redirect, len(items))
+	for _, v := range items {
+		rules[redirectPath(v.From)] = v
+	}
+
+	rr.mu.Lock()
+	rr.rules = rules
+	rr.mu.Unlock()
+	return nil
+}
+
+// Match returns a rule for the path or nil.
+func (rr *redirectRules) Match(path string) *cms.Redirect {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+	return rr.rules[redirectPath(path)]
+}
+
+// Hit counts a redirect by the rule.
+func (rr *redirectRules) Hit(ctx context.Context, rd *cms.Redirect) error {
+	return rr.store.Hit(ctx, rd.ID)
+}
+
+// redirectPath normalizes the path of a redirect rule, so that paths
+// with and without trailing slashes are matched.
+func redirectPath(s string) string {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "/") {
+		s = "/" + s
+	}
+	if len(s) > 1 {
+		s = strings.TrimRight(s, "/")
+	}
+	return s
+}
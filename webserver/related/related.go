@@ -0,0 +1,300 @@
+// Package related recommends content similar to a given piece of
+// content. Candidates are scored by shared topics and authors, TF-IDF
+// similarity of texts and recency.
+package related
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bahna/magazine/webserver/search"
+)
+
+// Score weights.
+const (
+	topicWeight   = 3.0
+	authorWeight  = 2.0
+	textWeight    = 6.0
+	recencyWeight = 1.0
+	// recencyHalfLife is the age of content which halves its recency score.
+	recencyHalfLife = 180 * 24 * time.Hour
+)
+
+// TTL is how long related items are cached. It lets scheduled content
+// appear among related items without an explicit invalidation.
+var TTL = time.Hour
+
+// Item is a piece of content considered for recommendations. Only
+// public content should be loaded as items.
+type Item struct {
+	ID        string
+	Title     string
+	Lede      string
+	Body      string
+	TopicIDs  []string
+	AuthorIDs []string
+	Published time.Time
+	Scheduled time.Time
+}
+
+// LoadFunc returns all public items of the language.
+type LoadFunc func(ctx context.Context, lang string) ([]*Item, error)
+
+// Engine computes and caches related items. Items are loaded and
+// scored without holding the lock, the lock only guards the caches.
+type Engine struct {
+	load LoadFunc
+
+	mu      sync.Mutex
+	corpora map[string]*corpus
+	cache   map[string]*cached
+	// loading are corpora being built, concurrent requests of a
+	// language wait for one load.
+	loading map[string]*loading
+	// gen is incremented by invalidations, so that results computed
+	// before an invalidation are not cached after it.
+	gen uint64
+}
+
+type loading struct {
+	done chan struct{}
+	cp   *corpus
+	err  error
+	// cancelled is true if the load failed with the context of the
+	// request which started it.
+	cancelled bool
+}
+
+type cached struct {
+	ids     []string
+	expires time.Time
+}
+
+// corpus contains items of one language with their TF-IDF vectors.
+type corpus struct {
+	items   map[string]*Item
+	vectors map[string]map[string]float64
+	expires time.Time
+}
+
+// NewEngine returns an engine which loads items with the load function.
+func NewEngine(load LoadFunc) *Engine {
+	return &Engine{
+		load:    load,
+		corpora: make(map[string]*corpus),
+		cache:   make(map[string]*cached),
+		loading: make(map[string]*loading),
+	}
+}
+
+// Invalidate drops all cached results. Call it after content is saved
+// or deleted.
+func (e *Engine) Invalidate() {
+	e.mu.Lock()
+	e.gen++
+	e.corpora = make(map[string]*corpus)
+	e.cache = make(map[string]*cached)
+	e.loading = make(map[string]*loading)
+	e.mu.Unlock()
+}
+
+// Related returns IDs of up to n items related to the item with the id.
+// Pinned IDs go first in the given order, excluded IDs are never
+// returned.
+func (e *Engine) Related(ctx context.Context, lang, id string, pinned, excluded []string, n int) ([]string, error) {
+	now := time.Now()
+	e.mu.Lock()
+	c, ok := e.cache[id]
+	gen := e.gen
+	e.mu.Unlock()
+
+	if !ok || now.After(c.expires) {
+		cp, err := e.corpus(ctx, lang, now)
+		if err != nil {
+			return nil, err
+		}
+		c = &cached{ids: cp.related(id, now), expires: now.Add(TTL)}
+		e.mu.Lock()
+		if gen == e.gen {
+			e.cache[id] = c
+		}
+		e.mu.Unlock()
+	}
+
+	skip := map[string]bool{id: true}
+	for _, v := range excluded {
+		skip[v] = true
+	}
+
+	ids := []string{}
+	for _, list := range [][]string{pinned, c.ids} {
+		for _, v := range list {
+			if len(ids) == n {
+				return ids, nil
+			}
+			if skip[v] {
+				continue
+			}
+			skip[v] = true
+			ids = append(ids, v)
+		}
+	}
+	return ids, nil
+}
+
+// corpus returns the corpus of the language, it is built once by the
+// first request while others wait for it. If the first request is
+// cancelled, a waiting one builds the corpus again.
+func (e *Engine) corpus(ctx context.Context, lang string, now time.Time) (*corpus, error) {
+	e.mu.Lock()
+	if cp, ok := e.corpora[lang]; ok && now.Before(cp.expires) {
+		e.mu.Unlock()
+		return cp, nil
+	}
+	l, ok := e.loading[lang]
+	if ok {
+		e.mu.Unlock()
+		select {
+		case <-l.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if l.cancelled {
+			return e.corpus(ctx, lang, now)
+		}
+		return l.cp, l.err
+	}
+	l = &loading{done: make(chan struct{})}
+	e.loading[lang] = l
+	gen := e.gen
+	e.mu.Unlock()
+
+	l.cp, l.err = e.build(ctx, lang, now)
+	l.cancelled = l.err != nil && ctx.Err() != nil
+
+	e.mu.Lock()
+	if e.loading[lang] == l {
+		delete(e.loading, lang)
+	}
+	if l.err == nil && gen == e.gen {
+		e.corpora[lang] = l.cp
+	}
+	e.mu.Unlock()
+	close(l.done)
+	return l.cp, l.err
+}
+
+// build loads items of the language and computes their vectors.
+func (e *Engine) build(ctx context.Context, lang string, now time.Time) (*corpus, error) {
+	items, err := e.load(ctx, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &corpus{
+		items:   make(map[string]*Item, len(items)),
+		vectors: make(map[string]map[string]float64, len(items)),
+		expires: now.Add(TTL),
+	}
+
+	a := search.AnalyzerFor(lang)
+	df := make(map[string]int)
+	for _, v := range items {
+		tf := make(map[string]float64)
+		// the title and the lede describe the content better than the body
+		for _, f := range []struct {
+			text   string
+			weight float64
+		}{{v.Title, 3}, {v.Lede, 2}, {v.Body, 1}} {
+			for _, t := range a.Terms(f.text) {
+				tf[t] += f.weight
+			}
+		}
+		for t := range tf {
+			df[t]++
+		}
+		cp.items[v.ID] = v
+		cp.vectors[v.ID] = tf
+	}
+
+	// weight terms by inverse document frequency and normalize vectors
+	total := float64(len(items))
+	for _, vec := range cp.vectors {
+		var norm float64
+		for t, tf := range vec {
+			w := (1 + math.Log(tf)) * math.Log(1+total/float64(df[t]))
+			vec[t] = w
+			norm += w * w
+		}
+		if norm == 0 {
+			continue
+		}
+		norm = math.Sqrt(norm)
+		for t := range vec {
+			vec[t] /= norm
+		}
+	}
+	return cp, nil
+}
+
+// related returns IDs of visible items sorted by their score relative
+// to the item with the id.
+func (cp *corpus) related(id string, now time.Time) []string {
+	item, ok := cp.items[id]
+	if !ok {
+		return nil
+	}
+
+	scores := make(map[string]float64)
+	for _, v := range cp.items {
+		if v.ID == id || (!v.Scheduled.IsZero() && v.Scheduled.After(now)) {
+			continue
+		}
+		score := topicWeight*float64(shared(item.TopicIDs, v.TopicIDs)) +
+			authorWeight*float64(shared(item.AuthorIDs, v.AuthorIDs)) +
+			textWeight*cosine(cp.vectors[id], cp.vectors[v.ID])
+		if score == 0 {
+			continue
+		}
+		age := now.Sub(v.Published)
+		score += recencyWeight * math.Pow(0.5, float64(age)/float64(recencyHalfLife))
+		scores[v.ID] = score
+	}
+
+	ids := make([]string, 0, len(scores))
+	for k := range scores {
+		ids = append(ids, k)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] > ids[j]
+	})
+	return ids
+}
+
+func shared(a, b []string) (n int) {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				n++
+				break
+			}
+		}
+	}
+	return
+}
+
+func cosine(a, b map[string]float64) (sum float64) {
+	if len(b) < len(a) {
+		a, b = b, a
+	}
+	for t, w := range a {
+		sum += w * b[t]
+	}
+	return
+}
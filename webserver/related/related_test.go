@@ -0,0 +1,125 @@
+package related
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRelated(t *testing.T) {
+	now := time.Now()
+	items := []*Item{
+		{ID: "1", Title: "Беларуская мова ў школах", TopicIDs: []string{"edu"}, Published: now},
+		{ID: "2", Title: "Мова і школа", TopicIDs: []string{"edu"}, Published: now},
+		{ID: "3", Title: "Беларуская мова", TopicIDs: []string{"culture"}, Published: now},
+		{ID: "4", Title: "Спорт", TopicIDs: []string{"sport"}, Published: now},
+		{ID: "5", Title: "Школа будучыні", TopicIDs: []string{"edu"}, Scheduled: now.Add(time.Hour)},
+	}
+	e := NewEngine(func(ctx context.Context, lang string) ([]*Item, error) { return items, nil })
+
+	tests := []struct {
+		name     string
+		pinned   []string
+		excluded []string
+		want     []string
+	}{
+		{"scored", nil, nil, []string{"2", "3"}},
+		{"pinned", []string{"4"}, nil, []string{"4", "2", "3"}},
+		{"excluded", nil, []string{"2"}, []string{"3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := e.Related(context.Background(), "be", "1", tt.pinned, tt.excluded, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Related() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelatedLoadsWithoutLock(t *testing.T) {
+	loading, release := make(chan bool), make(chan bool)
+	loads, block := 0, true
+	e := NewEngine(func(ctx context.Context, lang string) ([]*Item, error) {
+		loads++
+		if block {
+			loading <- true
+			<-release
+		}
+		return []*Item{{ID: "1", Title: "Мова"}, {ID: "2", Title: "Мова"}}, nil
+	})
+
+	done := make(chan []string)
+	go func() {
+		ids, _ := e.Related(context.Background(), "be", "1", nil, nil, 3)
+		done <- ids
+	}()
+	<-loading
+
+	// the engine is usable while items are loaded
+	invalidated := make(chan bool)
+	go func() {
+		e.Invalidate()
+		invalidated <- true
+	}()
+	select {
+	case <-invalidated:
+	case <-time.After(time.Second):
+		t.Fatal("Invalidate waits for the load")
+	}
+
+	release <- true
+	if ids := <-done; !reflect.DeepEqual(ids, []string{"2"}) {
+		t.Errorf("Related() = %v, want [2]", ids)
+	}
+	// the result computed before the invalidation isn't cached
+	block = false
+	if _, err := e.Related(context.Background(), "be", "1", nil, nil, 3); err != nil {
+		t.Fatal(err)
+	}
+	if loads != 2 {
+		t.Errorf("items are loaded %d times, want 2", loads)
+	}
+}
+
+func TestRelatedRetriesCancelledLoad(t *testing.T) {
+	started := make(chan bool)
+	first := true
+	e := NewEngine(func(ctx context.Context, lang string) ([]*Item, error) {
+		if first {
+			first = false
+			started <- true
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return []*Item{{ID: "1", Title: "Мова"}, {ID: "2", Title: "Мова"}}, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	failed := make(chan error)
+	go func() {
+		_, err := e.Related(ctx, "be", "1", nil, nil, 3)
+		failed <- err
+	}()
+	<-started
+
+	done := make(chan []string)
+	go func() {
+		ids, _ := e.Related(context.Background(), "be", "1", nil, nil, 3)
+		done <- ids
+	}()
+	// let the second request wait for the first load
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	if err := <-failed; err == nil {
+		t.Error("Related() of the cancelled request succeeded")
+	}
+	if ids := <-done; !reflect.DeepEqual(ids, []string{"2"}) {
+		t.Errorf("Related() = %v, want [2]", ids)
+	}
+}
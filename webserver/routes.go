@@ -7,6 +7,13 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// reservedSlugs are first segments of paths of languages taken by
+// routes, root topics can't have them.
+var reservedSlugs = map[string]bool{
+	"admin": true, "signup": true, "login": true, "logout": true, "restore": true,
+	"mailchimp": true, "search": true, "tag": true, "authors": true,
+}
+
 func makeRouter(a *application) *mux.Router {
 	r := mux.NewRouter()
 	r.StrictSlash(true)
@@ -23,11 +30,16 @@ func makeRouter(a *application) *mux.Router {
 	admin.Handle("/topics/new", adminNewTopicHandler(a)).Methods("GET")
 	admin.Handle("/topics/", adminListTopicsHandler(a)).Methods("GET").Name("topics")
 	admin.Handle("/topics/", adminSaveTopicHandler(a)).Methods("POST")
+	admin.Handle("/topics/order", adminOrderTopicsHandler(a)).Methods("POST")
 	admin.Handle("/content/filter", adminFilterContentHandler(a)).Methods("GET", "POST")
+	admin.Handle("/content/duplicates", adminDuplicateSlugsHandler(a)).Methods("GET")
 	admin.Handle("/content/edit/{id}", adminEditContentHandler(a)).Methods("GET", "POST")
 	admin.Handle("/content/new", adminNewContentHandler(a)).Methods("GET")
 	admin.Handle("/content/", adminCreateContentHandler(a)).Methods("POST")
 	admin.Handle("/content/", adminListContentHandler(a)).Methods("GET", "POST").Name("content")
+	admin.Handle("/contributors/edit/{id}", adminEditContributorHandler(a)).Methods("GET", "POST")
+	admin.Handle("/contributors/", adminContributorsHandler(a)).Methods("GET").Name("contributors")
+	admin.Handle("/contributors/", adminCreateContributorHandler(a)).Methods("POST")
 	admin.Handle("/users/passchange/{id}", adminUserPassChangeHandler(a)).Methods("GET", "POST")
 	admin.Handle("/users/edit/{id}", adminEditUserHandler(a)).Methods("GET", "POST")
 	admin.Handle("/users/new", adminNewUserHandler(a)).Methods("GET")
@@ -35,8 +47,22 @@ func makeRouter(a *application) *mux.Router {
 	admin.Handle("/users/", adminCreateUserHandler(a)).Methods("POST")
 	admin.Handle("/files/delete_/{id}", adminDeleteFileHandler(a)).Methods("GET")
 	admin.Handle("/files/edit/{id}", adminEditFileHandler(a)).Methods("GET", "POST")
+	admin.Handle("/files/orphaned", adminOrphanedFilesHandler(a)).Methods("GET")
+	admin.Handle("/files/suggest", adminSuggestPhotosHandler(a)).Methods("GET")
+	admin.Handle("/files/uploads/{id}", adminUploadHandler(a)).Methods("HEAD", "PATCH", "DELETE")
+	admin.Handle("/files/uploads", adminStartUploadHandler(a)).Methods("POST")
+	admin.Handle("/files/photoreport", adminImportPhotoreportHandler(a)).Methods("POST")
 	admin.Handle("/files/", adminFilesHandler(a)).Methods("GET").Name("files")
 	admin.Handle("/files/", adminCreateFileHandler(a)).Methods("POST")
+	admin.Handle("/translations/export/{tag}", adminExportTranslationsHandler(a)).Methods("GET")
+	admin.Handle("/translations/reload", adminReloadTranslationsHandler(a)).Methods("POST")
+	admin.Handle("/translations/", adminTranslationsHandler(a)).Methods("GET").Name("translations")
+	admin.Handle("/translations/", adminSaveTranslationHandler(a)).Methods("POST")
+	admin.Handle("/search/misses", adminSearchMissesHandler(a)).Methods("GET").Name("searchMisses")
+	admin.Handle("/search/reindex", adminReindexHandler(a)).Methods("POST")
+	admin.Handle("/tags/suggest", adminSuggestTagsHandler(a)).Methods("GET")
+	admin.Handle("/redirects/", adminRedirectsHandler(a)).Methods("GET").Name("redirects")
+	admin.Handle("/redirects/", adminSaveRedirectHandler(a)).Methods("POST")
 	admin.Handle("/", adminIndexHandler(a)).Methods("GET").Name("adminIndex")
 
 	// user handlers
@@ -46,15 +72,22 @@ func makeRouter(a *application) *mux.Router {
 	withLang.Handle("/logout", logoutHandler(a)).Methods("GET")
 	withLang.Handle("/restore", restoreUserAccessHandler(a)).Methods("GET", "POST")
 	withLang.Handle("/mailchimp", mailchimpHandler(a))
+	withLang.Handle("/search/suggest", searchSuggestHandler(a)).Methods("GET")
 	withLang.Handle("/search", searchHandler(a))
-	withLang.Handle("/{topic}/{content}", contentHandler(a)).Methods("GET")
-	withLang.Handle("/{topic}", topicHandler(a)).Methods("GET")
-	withLang.Handle("/", indexHandler(a)).Name("index")
+
+	// public pages are served to anonymous visitors from the cache
+	cached := CachePages(a)
+	withLang.Handle("/tag/{tag}", cached(tagHandler(a))).Methods("GET")
+	withLang.Handle("/authors/{slug}", cached(authorHandler(a))).Methods("GET")
+	withLang.Handle("/authors", cached(authorsHandler(a))).Methods("GET")
+	withLang.Handle("/{path:.+}", cached(topicPathHandler(a))).Methods("GET")
+	withLang.Handle("/", cached(indexHandler(a))).Name("index")
 
 	// static files
 	r.Handle("/static/{key:.*}", StaticFolder(a.Config.StaticDir, a.Config.MaxAge)).Methods("GET")
 	r.Handle("/files/{key:.*}", StaticFolderDebug(
 		a.Config.FilesDir, a.Config.MaxAge, debug, "https://bahna.land/files/")).Methods("GET")
+	r.Handle("/img/{id}/{params}", imageHandler(a)).Methods("GET")
 	r.Handle("/sitemap.xml", ServeFile(path.Join(a.Config.StaticDir, "sitemap.xml"), "application/xml"))
 	r.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(robotsTxt))
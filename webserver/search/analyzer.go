@@ -0,0 +1,123 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/bahna/magazine/webserver/slugifier"
+)
+
+// Analyzer splits a text into terms which are stored in the index.
+// The same analyzer must be used for documents and queries in the
+// same language.
+type Analyzer interface {
+	Terms(text string) []string
+}
+
+// AnalyzerFor returns an analyzer for the language. Belarusian and
+// Russian analyzers stem words and transliterate Latin input, so that
+// a query typed in Latin letters matches Cyrillic content.
+func AnalyzerFor(lang string) Analyzer {
+	switch lang {
+	case "be":
+		return &slavicAnalyzer{lang: lang, stem: belarusianEndings.stem}
+	case "ru":
+		return &slavicAnalyzer{lang: lang, stem: russianEndings.stem}
+	}
+	return englishAnalyzer{}
+}
+
+// tokenize splits a text into lowercased words dropping apostrophes
+// inside words, e.g. "сям'я" becomes "сямя".
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !isApostrophe(r)
+	})
+	tokens := words[:0]
+	for _, w := range words {
+		w = strings.Map(func(r rune) rune {
+			if isApostrophe(r) {
+				return -1
+			}
+			return r
+		}, w)
+		if len(w) > 0 {
+			tokens = append(tokens, w)
+		}
+	}
+	return tokens
+}
+
+func isApostrophe(r rune) bool {
+	return r == '\'' || r == '’' || r == 'ʼ'
+}
+
+type englishAnalyzer struct{}
+
+func (englishAnalyzer) Terms(text string) []string {
+	tokens := tokenize(text)
+	for i, t := range tokens {
+		if len(t) > 3 && strings.HasSuffix(t, "s") && !strings.HasSuffix(t, "ss") {
+			tokens[i] = strings.TrimSuffix(t, "s")
+		}
+	}
+	return tokens
+}
+
+// slavicAnalyzer stems Cyrillic words and reduces them to a Latin
+// skeleton, which is the same for the Cyrillic and transliterated
+// spelling of a word.
+type slavicAnalyzer struct {
+	lang string
+	stem func([]rune) []rune
+}
+
+func (a *slavicAnalyzer) Terms(text string) []string {
+	tokens := tokenize(text)
+	for i, t := range tokens {
+		rr := []rune(t)
+		if isLatin(rr) {
+			rr = []rune(slugifier.ToCyrillic(t, a.lang))
+		}
+		tokens[i] = skeleton(a.stem(rr))
+	}
+	return tokens
+}
+
+func isLatin(rr []rune) bool {
+	var latin bool
+	for _, r := range rr {
+		if unicode.Is(unicode.Cyrillic, r) {
+			return false
+		}
+		if unicode.Is(unicode.Latin, r) {
+			latin = true
+		}
+	}
+	return latin
+}
+
+// skeletonLetters maps Cyrillic letters to Latin. Letters which differ
+// in Belarusian and Russian spelling of similar words are mapped to the
+// same string.
+var skeletonLetters = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "h", 'ґ': "g", 'д': "d",
+	'е': "e", 'ё': "e", 'є': "e", 'ж': "zh", 'з': "z", 'и': "i",
+	'і': "i", 'ї': "i", 'й': "j", 'к': "k", 'л': "l", 'м': "m",
+	'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t",
+	'у': "u", 'ў': "u", 'ф': "f", 'х': "x", 'ц': "c", 'ч': "ch",
+	'ш': "sh", 'щ': "sh", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e",
+	'ю': "ju", 'я': "ja",
+}
+
+func skeleton(rr []rune) string {
+	var b strings.Builder
+	for _, r := range rr {
+		if s, ok := skeletonLetters[r]; ok {
+			b.WriteString(s)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,338 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fieldWeights are multipliers of term frequencies per document field.
+var fieldWeights = struct {
+	Title, Authors, Topics, Lede, Body float64
+}{10, 5, 5, 3, 1}
+
+// BM25 parameters.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// saveDelay is how long changes of the index are collected before
+// the index is written to its file.
+const saveDelay = 5 * time.Second
+
+// Index is an embedded inverted index which is persisted to a file
+// shortly after changes. Terms are produced by the analyzer of the
+// document language.
+type Index struct {
+	path string
+
+	mu   sync.RWMutex
+	data indexData
+
+	// saving guards the timer of a pending save and serializes writes
+	// of the file.
+	saving sync.Mutex
+	timer  *time.Timer
+}
+
+// indexData is the part of the index stored on disk.
+type indexData struct {
+	// Postings map a term to weighted term frequencies per document.
+	Postings map[string]map[string]float64
+	// Lengths are weighted lengths of documents.
+	Lengths map[string]float64
+	Docs    map[string]*Document
+}
+
+// OpenIndex loads the index from the file at path or creates an empty
+// index if the file does not exist. An empty path creates an index
+// kept in memory only.
+func OpenIndex(path string) (*Index, error) {
+	idx := &Index{
+		path: path,
+		data: indexData{
+			Postings: make(map[string]map[string]float64),
+			Lengths:  make(map[string]float64),
+			Docs:     make(map[string]*Document),
+		},
+	}
+	if len(path) == 0 {
+		return idx, nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err = gob.NewDecoder(f).Decode(&idx.data); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Len returns the amount of indexed documents.
+func (idx *Index) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.data.Docs)
+}
+
+func (idx *Index) Index(docs ...*Document) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, d := range docs {
+		idx.remove(d.ID)
+		idx.add(d)
+	}
+	idx.changed()
+	return nil
+}
+
+func (idx *Index) Delete(ids ...string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, id := range ids {
+		idx.remove(id)
+	}
+	idx.changed()
+	return nil
+}
+
+func (idx *Index) Reset() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.data.Postings = make(map[string]map[string]float64)
+	idx.data.Lengths = make(map[string]float64)
+	idx.data.Docs = make(map[string]*Document)
+	idx.changed()
+	return nil
+}
+
+// Close writes pending changes to the file.
+func (idx *Index) Close() error {
+	idx.saving.Lock()
+	defer idx.saving.Unlock()
+	if idx.timer == nil {
+		return nil
+	}
+	idx.timer.Stop()
+	idx.timer = nil
+	return idx.save()
+}
+
+// Search returns documents containing all terms of the query sorted by
+// BM25 score.
+func (idx *Index) Search(ctx context.Context, q *Query) (*Result, error) {
+	terms := unique(AnalyzerFor(q.Language).Terms(q.Text))
+	if len(terms) == 0 {
+		return nil, ErrEmptyQuery
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	n := float64(len(idx.data.Docs))
+	var avg float64
+	for _, l := range idx.data.Lengths {
+		avg += l
+	}
+	if n > 0 {
+		avg /= n
+	}
+
+	now := time.Now()
+	scores := make(map[string]float64)
+	for i, t := range terms {
+		postings := idx.data.Postings[t]
+		idf := math.Log(1 + (n-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+		for id, tf := range postings {
+			// all terms must match
+			if _, ok := scores[id]; !ok && i > 0 {
+				continue
+			}
+			d := idx.data.Docs[id]
+			if !d.visible(now) || !q.match(d) {
+				continue
+			}
+			norm := 1 - bm25B + bm25B*idx.data.Lengths[id]/avg
+			scores[id] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+		// drop documents which do not contain the term
+		if i > 0 {
+			for id := range scores {
+				if _, ok := postings[id]; !ok {
+					delete(scores, id)
+				}
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		si, sj := scores[ids[i]], scores[ids[j]]
+		if si != sj {
+			return si > sj
+		}
+		return idx.data.Docs[ids[i]].Published.After(idx.data.Docs[ids[j]].Published)
+	})
+
+	return page(ids, q), nil
+}
+
+// Terms returns the distinct terms of the language with the amount of
+// documents containing them.
+func (idx *Index) Terms(lang string) map[string]int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	terms := make(map[string]int)
+	for t, postings := range idx.data.Postings {
+		for id := range postings {
+			if idx.data.Docs[id].Language == lang {
+				terms[t]++
+			}
+		}
+	}
+	return terms
+}
+
+func (idx *Index) add(d *Document) {
+	a := AnalyzerFor(d.Language)
+	tf := make(map[string]float64)
+	var length float64
+	for _, f := range []struct {
+		text   string
+		weight float64
+	}{
+		{d.Title, fieldWeights.Title},
+		{d.Authors, fieldWeights.Authors},
+		{d.Topics, fieldWeights.Topics},
+		{d.Lede, fieldWeights.Lede},
+		{d.Body, fieldWeights.Body},
+	} {
+		for _, t := range a.Terms(f.text) {
+			tf[t] += f.weight
+			length += f.weight
+		}
+	}
+
+	for t, v := range tf {
+		if idx.data.Postings[t] == nil {
+			idx.data.Postings[t] = make(map[string]float64)
+		}
+		idx.data.Postings[t][d.ID] = v
+	}
+	idx.data.Lengths[d.ID] = length
+	idx.data.Docs[d.ID] = d
+}
+
+func (idx *Index) remove(id string) {
+	d, ok := idx.data.Docs[id]
+	if !ok {
+		return
+	}
+	a := AnalyzerFor(d.Language)
+	for _, text := range []string{d.Title, d.Authors, d.Topics, d.Lede, d.Body} {
+		for _, t := range a.Terms(text) {
+			if postings, ok := idx.data.Postings[t]; ok {
+				delete(postings, id)
+				if len(postings) == 0 {
+					delete(idx.data.Postings, t)
+				}
+			}
+		}
+	}
+	delete(idx.data.Lengths, id)
+	delete(idx.data.Docs, id)
+}
+
+// changed schedules a save of the index unless one is pending, so
+// the file is written once for a burst of changes.
+func (idx *Index) changed() {
+	if len(idx.path) == 0 {
+		return
+	}
+	idx.saving.Lock()
+	defer idx.saving.Unlock()
+	if idx.timer != nil {
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(saveDelay, func() {
+		idx.saving.Lock()
+		defer idx.saving.Unlock()
+		// the save is already done by Close
+		if idx.timer != t {
+			return
+		}
+		idx.timer = nil
+		if err := idx.save(); err != nil {
+			log.Printf("failed to save the search index %s: %v", idx.path, err)
+		}
+	})
+	idx.timer = t
+}
+
+func (idx *Index) save() error {
+	return idx.WriteFile(idx.path)
+}
+
+// WriteFile encodes a snapshot of the index and writes it to a
+// temporary file which is renamed to path, so a reader never sees a
+// partially written index. Only encoding holds the read lock, searches
+// aren't blocked.
+func (idx *Index) WriteFile(path string) error {
+	var buf bytes.Buffer
+	idx.mu.RLock()
+	err := gob.NewEncoder(&buf).Encode(&idx.data)
+	idx.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = buf.WriteTo(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func unique(ss []string) []string {
+	seen := make(map[string]bool, len(ss))
+	res := ss[:0]
+	for _, s := range ss {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 || seen[s] {
+			continue
+		}
+		seen[s] = true
+		res = append(res, s)
+	}
+	return res
+}
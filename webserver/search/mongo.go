@@ -0,0 +1,87 @@
+package search
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	mongodb "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Mongo searches the content collection using its text index. The
+// collection is indexed by the database itself, so Index, Delete,
+// Reset and Close do nothing.
+type Mongo struct {
+	Col *mongodb.Collection
+}
+
+func (m *Mongo) Index(docs ...*Document) error { return nil }
+func (m *Mongo) Delete(ids ...string) error    { return nil }
+func (m *Mongo) Reset() error                  { return nil }
+func (m *Mongo) Close() error                  { return nil }
+
+// Search runs the query until the context is done, queries without a
+// deadline are bounded by the timeout of the database client.
+func (m *Mongo) Search(ctx context.Context, q *Query) (*Result, error) {
+	if len(q.Text) == 0 {
+		return nil, ErrEmptyQuery
+	}
+
+	and := []bson.M{
+		bson.M{"$text": bson.M{"$search": q.Text}},
+		bson.M{"public": true},
+		bson.M{"$or": []bson.M{
+			bson.M{"scheduled": bson.M{"$lt": time.Now()}},
+			bson.M{"scheduled": (time.Time{})},
+		}},
+	}
+	if len(q.Language) > 0 {
+		and = append(and, bson.M{"language": q.Language})
+	}
+	if id, err := primitive.ObjectIDFromHex(q.TopicID); err == nil {
+		and = append(and, bson.M{"topicids": id})
+	}
+	if id, err := primitive.ObjectIDFromHex(q.AuthorID); err == nil {
+		and = append(and, bson.M{"authorids": id})
+	}
+	if q.Type != nil {
+		and = append(and, bson.M{"type": *q.Type})
+	}
+	if q.Year > 0 {
+		and = append(and, bson.M{"published": bson.M{
+			"$gte": time.Date(q.Year, time.January, 1, 0, 0, 0, 0, time.Local),
+			"$lt":  time.Date(q.Year+1, time.January, 1, 0, 0, 0, 0, time.Local),
+		}})
+	}
+
+	query := bson.M{"$and": and}
+
+	total, err := m.Col.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	score := bson.M{"$meta": "textScore"}
+	cur, err := m.Col.Find(ctx, query, options.Find().
+		SetProjection(bson.M{"_id": 1, "score": score}).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "published", Value: -1}}).
+		SetSkip(int64(q.Offset)).
+		SetLimit(int64(q.Limit)))
+	if err != nil {
+		return nil, err
+	}
+	if err = cur.All(ctx, &items); err != nil {
+		return nil, err
+	}
+
+	r := &Result{Total: int(total), IDs: make([]string, 0, len(items))}
+	for _, v := range items {
+		r.IDs = append(r.IDs, v.ID.Hex())
+	}
+	return r, nil
+}
@@ -0,0 +1,121 @@
+// Package search provides full-text search over the site content. The
+// search is done by a Backend: either by the mongo text index or by the
+// embedded inverted index with analyzers for Belarusian and Russian.
+package search
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrEmptyQuery    = errors.New("empty search query")
+	ErrUnknownEngine = errors.New("unknown search engine")
+)
+
+// Backend indexes documents and searches among them.
+type Backend interface {
+	// Index adds or replaces documents in the index.
+	Index(docs ...*Document) error
+	// Delete removes documents from the index by their IDs.
+	Delete(ids ...string) error
+	// Reset removes all documents from the index, it is used to
+	// rebuild the index from scratch.
+	Reset() error
+	// Search returns IDs of matched documents sorted by relevance.
+	Search(ctx context.Context, q *Query) (*Result, error)
+	// Close writes pending changes, it is called when the server
+	// stops.
+	Close() error
+}
+
+// Document is a piece of content prepared for indexing. Only public
+// content should be indexed.
+type Document struct {
+	ID       string
+	Language string
+
+	Title   string
+	Lede    string
+	Body    string
+	Authors string
+	Topics  string
+
+	// Fields used by filters.
+	TopicIDs  []string
+	AuthorIDs []string
+	Type      int
+	Scheduled time.Time
+	Published time.Time
+}
+
+// Query describes a search request.
+type Query struct {
+	Text     string
+	Language string
+
+	// Filters are applied if non-zero values are set.
+	TopicID  string
+	AuthorID string
+	Type     *int
+	Year     int
+
+	Offset, Limit int
+}
+
+// Result contains IDs of found documents for the requested page and
+// the total amount of matched documents.
+type Result struct {
+	IDs   []string
+	Total int
+}
+
+// visible checks if the document is published at the moment.
+func (d *Document) visible(now time.Time) bool {
+	return d.Scheduled.IsZero() || d.Scheduled.Before(now)
+}
+
+// match checks if the document satisfies the query filters.
+func (q *Query) match(d *Document) bool {
+	if len(q.Language) > 0 && d.Language != q.Language {
+		return false
+	}
+	if len(q.TopicID) > 0 && !contains(d.TopicIDs, q.TopicID) {
+		return false
+	}
+	if len(q.AuthorID) > 0 && !contains(d.AuthorIDs, q.AuthorID) {
+		return false
+	}
+	if q.Type != nil && d.Type != *q.Type {
+		return false
+	}
+	if q.Year > 0 && d.Published.Year() != q.Year {
+		return false
+	}
+	return true
+}
+
+func contains(s []string, v string) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// page cuts the IDs according to the query offset and limit.
+func page(ids []string, q *Query) *Result {
+	r := &Result{Total: len(ids)}
+	if q.Offset >= len(ids) {
+		r.IDs = []string{}
+		return r
+	}
+	ids = ids[q.Offset:]
+	if q.Limit > 0 && len(ids) > q.Limit {
+		ids = ids[:q.Limit]
+	}
+	r.IDs = ids
+	return r
+}
@@ -0,0 +1,161 @@
+package search
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAnalyzerTerms(t *testing.T) {
+	tests := []struct {
+		name string
+		lang string
+		a, b string
+	}{
+		{"be word forms", "be", "беларуская мова", "беларускай мовы"},
+		{"be latin", "be", "Biełaruskaja mova", "беларуская мова"},
+		{"be official latin", "be", "Hrodna", "Гродна"},
+		{"be apostrophe", "be", "сям’я", "сям'і"},
+		{"ru word forms", "ru", "новые книги", "новых книгах"},
+		{"ru latin", "ru", "Moskva", "Москва"},
+		{"en plural", "en", "books", "book"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := AnalyzerFor(tt.lang).Terms(tt.a)
+			b := AnalyzerFor(tt.lang).Terms(tt.b)
+			if len(a) != len(b) {
+				t.Fatalf("Terms() = %v and %v", a, b)
+			}
+			for i := range a {
+				if a[i] != b[i] {
+					t.Errorf("Terms() = %v and %v", a, b)
+				}
+			}
+		})
+	}
+}
+
+func TestIndexSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "search.index")
+	idx, err := OpenIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = idx.Index(
+		&Document{ID: "1", Language: "be", Title: "Беларуская мова ў школах", Published: time.Now()},
+		&Document{ID: "2", Language: "be", Title: "Гісторыя горада", Body: "Пра беларускую мову", Published: time.Now()},
+		&Document{ID: "3", Language: "ru", Title: "Белорусский язык", Published: time.Now()},
+		&Document{ID: "4", Language: "be", Title: "Будучая мова", Scheduled: time.Now().Add(time.Hour)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen the index to check it is persisted
+	if err = idx.Close(); err != nil {
+		t.Fatal(err)
+	}
+	idx, err = OpenIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		q    Query
+		want []string
+	}{
+		{"title is more relevant", Query{Text: "беларускай мове", Language: "be"}, []string{"1", "2"}},
+		{"latin query", Query{Text: "mova", Language: "be"}, []string{"1", "2"}},
+		{"all terms", Query{Text: "мова горада", Language: "be"}, []string{"2"}},
+		{"language", Query{Text: "язык", Language: "be"}, []string{}},
+		{"limit", Query{Text: "мова", Language: "be", Offset: 1, Limit: 1}, []string{"2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := idx.Search(context.Background(), &tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res.IDs) != len(tt.want) {
+				t.Fatalf("Search() = %v, want %v", res.IDs, tt.want)
+			}
+			for i := range tt.want {
+				if res.IDs[i] != tt.want[i] {
+					t.Errorf("Search() = %v, want %v", res.IDs, tt.want)
+				}
+			}
+		})
+	}
+
+	if err = idx.Delete("1"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := idx.Search(context.Background(), &Query{Text: "мова", Language: "be"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 1 {
+		t.Errorf("Search() after Delete() = %v, want 1 item", res.IDs)
+	}
+
+	// a copy is written by the reindex command
+	cp := filepath.Join(dir, "copy.index")
+	if err = idx.WriteFile(cp); err != nil {
+		t.Fatal(err)
+	}
+	idx, err = OpenIndex(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := idx.Len(); n != 3 {
+		t.Errorf("Len() of the copy = %d, want 3", n)
+	}
+}
+
+func TestDidYouMean(t *testing.T) {
+	s := NewSuggester()
+	s.Update("be", []*Completion{
+		{Title: "Янка Купала", URL: "/be/people/janka-kupala/"},
+		{Title: "Купалле", URL: "/be/kupalle/", Topic: true},
+	}, []string{
+		"Янка Купала і Якуб Колас",
+		"Купала, Купалле, Купала",
+	})
+
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"typo", "Купла", "купала"},
+		{"transposition", "Якбу Колас", "якуб колас"},
+		{"latin", "Kupala", "купала"},
+		{"known words", "Янка Купала", ""},
+		{"long words", "купалаааааааааааааааааааааааааа Купла", "купалаааааааааааааааааааааааааа купала"},
+		{"many words", "я я я я я я я я Купла", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.DidYouMean("be", tt.query); got != tt.want {
+				t.Errorf("DidYouMean() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	cc := s.Complete("be", "kup", 10)
+	if len(cc) != 2 || !cc[0].Topic {
+		t.Errorf("Complete() = %v, want the topic first", cc)
+	}
+}
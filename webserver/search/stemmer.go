@@ -0,0 +1,110 @@
+package search
+
+import (
+	"sort"
+	"strings"
+)
+
+// endings is a light suffix-stripping stemmer. It removes a reflexive
+// suffix and then the longest inflectional ending found after the first
+// vowel of a word. It does not try to be a full morphological analyzer:
+// the goal is to match different forms of the same word in the index.
+type endings struct {
+	vowels    string
+	reflexive []string
+	// inflections are sorted by length in descending order
+	inflections []string
+}
+
+func newEndings(vowels string, reflexive []string, inflections ...[]string) *endings {
+	e := &endings{vowels: vowels, reflexive: reflexive}
+	for _, v := range inflections {
+		e.inflections = append(e.inflections, v...)
+	}
+	sort.SliceStable(e.inflections, func(i, j int) bool {
+		return len([]rune(e.inflections[i])) > len([]rune(e.inflections[j]))
+	})
+	return e
+}
+
+// minStem is the minimal length of a stem in runes.
+const minStem = 2
+
+func (e *endings) stem(word []rune) []rune {
+	// RV is the region after the first vowel
+	rv := -1
+	for i, r := range word {
+		if strings.ContainsRune(e.vowels, r) {
+			rv = i + 1
+			break
+		}
+	}
+	if rv < 0 || len(word) <= minStem+1 {
+		return word
+	}
+
+	word = e.strip(word, rv, e.reflexive)
+	word = e.strip(word, rv, e.inflections)
+	if n := len(word); n > minStem && (word[n-1] == 'ь' || word[n-1] == 'ъ') {
+		word = word[:n-1]
+	}
+	return word
+}
+
+func (e *endings) strip(word []rune, rv int, suffixes []string) []rune {
+	for _, s := range suffixes {
+		suffix := []rune(s)
+		n := len(word) - len(suffix)
+		if n < rv || n < minStem {
+			continue
+		}
+		if string(word[n:]) == s {
+			return word[:n]
+		}
+	}
+	return word
+}
+
+var belarusianEndings = newEndings("аеёіоуыэюя",
+	[]string{"ся", "цца"},
+	// adjectives and participles
+	[]string{
+		"ага", "яга", "аму", "яму", "ая", "яя", "ую", "юю", "ой", "ый",
+		"ій", "ае", "ое", "ее", "ыя", "ія", "ых", "іх", "ымі", "імі",
+		"ым", "ім", "ай", "яй", "ейшы", "эйшы",
+	},
+	// nouns
+	[]string{
+		"аў", "яў", "оў", "ёў", "ам", "ям", "амі", "ямі", "ах", "ях",
+		"ем", "ом", "ём", "эй", "ей", "ёй", "ою", "аю", "яю", "ею",
+		"ы", "і", "а", "я", "у", "ю", "е", "о", "э",
+	},
+	// verbs
+	[]string{
+		"аць", "яць", "ець", "іць", "ыць", "уць", "юць", "ўшы", "ла",
+		"лі", "ло", "ем", "еш", "ім", "іш", "ыце", "іце", "ець", "ць",
+		"ці", "чы",
+	},
+)
+
+var russianEndings = newEndings("аеёиоуыэюя",
+	[]string{"ся", "сь"},
+	// adjectives and participles
+	[]string{
+		"ого", "его", "ому", "ему", "ая", "яя", "ую", "юю", "ой", "ый",
+		"ий", "ое", "ее", "ые", "ие", "ых", "их", "ыми", "ими", "ым",
+		"им", "ей", "ейш", "ейший",
+	},
+	// nouns
+	[]string{
+		"ов", "ев", "ёв", "ам", "ям", "ами", "ями", "ах", "ях", "ом",
+		"ем", "ём", "ой", "ою", "ею", "ию", "ия", "ие", "ии", "ью",
+		"ы", "и", "а", "я", "у", "ю", "е", "о", "ь",
+	},
+	// verbs
+	[]string{
+		"ать", "ять", "еть", "ить", "ыть", "уть", "ут", "ют", "ат",
+		"ят", "ла", "ли", "ло", "ем", "ешь", "ет", "им", "ишь", "ит",
+		"ете", "ите", "ть", "ти", "вши", "в",
+	},
+)
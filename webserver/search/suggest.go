@@ -0,0 +1,239 @@
+package search
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bahna/magazine/webserver/slugifier"
+)
+
+// Completion is a title of content or a topic suggested while a user
+// types a query.
+type Completion struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+	Topic bool   `json:"topic"`
+	// Scheduled completions are hidden until the time.
+	Scheduled time.Time `json:"-"`
+}
+
+// Suggester completes queries and corrects misspelled words using a
+// dictionary of words from published content.
+type Suggester struct {
+	mu    sync.RWMutex
+	langs map[string]*dictionary
+}
+
+type dictionary struct {
+	completions []*Completion
+	// words map a lowercased word to its frequency
+	words map[string]int
+	// lengths group words by their length in runes, corrections
+	// are looked up among words of close lengths only
+	lengths map[int][]known
+}
+
+type known struct {
+	runes []rune
+	freq  int
+}
+
+// Limits of corrections, longer words and words after the limit are
+// left as is.
+const (
+	maxCorrectedLen   = 30
+	maxCorrectedWords = 8
+)
+
+func NewSuggester() *Suggester {
+	return &Suggester{langs: make(map[string]*dictionary)}
+}
+
+// Update replaces completions and the dictionary of the language. The
+// dictionary is composed of words of the texts.
+func (s *Suggester) Update(lang string, completions []*Completion, texts []string) {
+	d := &dictionary{
+		completions: completions,
+		words:       make(map[string]int),
+	}
+	for _, text := range texts {
+		for _, w := range tokenize(text) {
+			if len([]rune(w)) > 2 {
+				d.words[w]++
+			}
+		}
+	}
+	d.lengths = make(map[int][]known)
+	for w, freq := range d.words {
+		r := []rune(w)
+		d.lengths[len(r)] = append(d.lengths[len(r)], known{r, freq})
+	}
+
+	s.mu.Lock()
+	s.langs[lang] = d
+	s.mu.Unlock()
+}
+
+// Complete returns up to limit completions which contain a word
+// beginning with the prefix. Topics go first.
+func (s *Suggester) Complete(lang, prefix string, limit int) []*Completion {
+	variants := queryVariants(lang, strings.ToLower(strings.TrimSpace(prefix)))
+	res := []*Completion{}
+	if len(variants) == 0 {
+		return res
+	}
+
+	s.mu.RLock()
+	d := s.langs[lang]
+	s.mu.RUnlock()
+	if d == nil {
+		return res
+	}
+
+	now := time.Now()
+	for _, c := range d.completions {
+		if !c.Scheduled.IsZero() && c.Scheduled.After(now) {
+			continue
+		}
+		title := strings.ToLower(c.Title)
+		for _, v := range variants {
+			if strings.HasPrefix(title, v) || strings.Contains(title, " "+v) {
+				res = append(res, c)
+				break
+			}
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Topic && !res[j].Topic
+	})
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	return res
+}
+
+// DidYouMean returns the query with unknown words replaced by the most
+// frequent dictionary words within a small edit distance. It returns
+// an empty string if there is nothing to correct.
+func (s *Suggester) DidYouMean(lang, query string) string {
+	s.mu.RLock()
+	d := s.langs[lang]
+	s.mu.RUnlock()
+	if d == nil {
+		return ""
+	}
+
+	words := tokenize(query)
+	var corrected bool
+	for i, w := range words {
+		if i == maxCorrectedWords {
+			break
+		}
+		if d.words[w] > 0 || len([]rune(w)) > maxCorrectedLen {
+			continue
+		}
+		if c, ok := d.correct(lang, w); ok {
+			words[i] = c
+			corrected = true
+		}
+	}
+	if !corrected {
+		return ""
+	}
+	return strings.Join(words, " ")
+}
+
+// correct finds the best replacement of the word among the word itself
+// and its Cyrillic transliteration.
+func (d *dictionary) correct(lang, word string) (string, bool) {
+	var best string
+	var bestDist, bestFreq int
+	for _, v := range queryVariants(lang, word) {
+		if d.words[v] > 0 {
+			return v, true
+		}
+		r := []rune(v)
+		max := 1
+		if len(r) > 5 {
+			max = 2
+		}
+		for n := len(r) - max; n <= len(r)+max; n++ {
+			for _, w := range d.lengths[n] {
+				dist := distance(r, w.runes, max)
+				if dist > max {
+					continue
+				}
+				s := string(w.runes)
+				if len(best) == 0 || dist < bestDist || (dist == bestDist && w.freq > bestFreq) ||
+					(dist == bestDist && w.freq == bestFreq && s < best) {
+					best, bestDist, bestFreq = s, dist, w.freq
+				}
+			}
+		}
+	}
+	return best, len(best) > 0
+}
+
+// queryVariants returns the text and its Cyrillic transliteration for
+// Belarusian and Russian if the text is Latin.
+func queryVariants(lang, text string) []string {
+	if len(text) == 0 {
+		return nil
+	}
+	variants := []string{text}
+	if (lang == "be" || lang == "ru") && isLatin([]rune(text)) {
+		variants = append(variants, slugifier.ToCyrillic(text, lang))
+	}
+	return variants
+}
+
+// distance is the Damerau-Levenshtein distance (optimal string
+// alignment) between a and b. It stops early and returns max+1 if the
+// distance is bigger than max.
+func distance(a, b []rune, max int) int {
+	if d := len(a) - len(b); d > max || -d > max {
+		return max + 1
+	}
+
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && prev2[j-2]+1 < cur[j] {
+				cur[j] = prev2[j-2] + 1
+			}
+			if cur[j] < rowMin {
+				rowMin = cur[j]
+			}
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,159 @@
+package slugifier
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// ErrUnknownScheme is returned for a name of a transliteration scheme
+// which is not in Schemes.
+var ErrUnknownScheme = errors.New("unknown transliteration scheme")
+
+// Scheme is a transliteration scheme from Cyrillic into Latin. Letters
+// are looked up in Context, Iotated and Letters in this order.
+type Scheme struct {
+	Name string
+	// Letters maps lowercase letters to their Latin spelling.
+	Letters map[rune]string
+	// Iotated is the spelling of vowels which sound with [j] at the
+	// beginning of a word and after vowels, signs and apostrophes.
+	Iotated map[rune]string
+	// Context returns the spelling of a letter which depends on its
+	// neighbours, false is returned to use other rules. The letters
+	// are lowercase, absent neighbours are zero.
+	Context func(prev, r, next rune) (string, bool)
+}
+
+// Transliterate converts Cyrillic letters of the text into Latin.
+// Capital letters stay capital, other characters are kept as is.
+func (s *Scheme) Transliterate(text string) string {
+	rr := []rune(text)
+	var b strings.Builder
+	for i, r := range rr {
+		var prev, next rune
+		if i > 0 {
+			prev = unicode.ToLower(rr[i-1])
+		}
+		if i < len(rr)-1 {
+			next = unicode.ToLower(rr[i+1])
+		}
+
+		lat, ok := s.spell(prev, unicode.ToLower(r), next)
+		if !ok {
+			b.WriteRune(r)
+			continue
+		}
+		if unicode.IsUpper(r) && len(lat) > 0 {
+			lr := []rune(lat)
+			lr[0] = unicode.ToUpper(lr[0])
+			lat = string(lr)
+		}
+		b.WriteString(lat)
+	}
+	return b.String()
+}
+
+func (s *Scheme) spell(prev, r, next rune) (string, bool) {
+	if s.Context != nil {
+		if lat, ok := s.Context(prev, r, next); ok {
+			return lat, true
+		}
+	}
+	if lat, ok := s.Iotated[r]; ok && iotating(prev) {
+		return lat, true
+	}
+	lat, ok := s.Letters[r]
+	return lat, ok
+}
+
+// iotating checks if a vowel after the letter sounds with [j].
+func iotating(prev rune) bool {
+	return prev == 0 || !unicode.IsLetter(prev) || strings.ContainsRune("аеёиоуыэюяіьъйў", prev)
+}
+
+// Schemes are available transliteration schemes by their names.
+var Schemes = map[string]*Scheme{
+	RussianGOST.Name:        RussianGOST,
+	RussianBGN.Name:         RussianBGN,
+	BelarusianOfficial.Name: BelarusianOfficial,
+	BelarusianLacinka.Name:  BelarusianLacinka,
+}
+
+// RussianGOST is the Russian scheme of GOST R 52535.1-2006 used in
+// passports.
+var RussianGOST = &Scheme{
+	Name: "ru-gost",
+	Letters: map[rune]string{
+		'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e",
+		'ё': "e", 'ж': "zh", 'з': "z", 'и': "i", 'й': "i", 'к': "k",
+		'л': "l", 'м': "m", 'н': "n", 'о': "o", 'п': "p", 'р': "r",
+		'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+		'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "ie", 'ы': "y", 'ь': "",
+		'э': "e", 'ю': "iu", 'я': "ia",
+	},
+}
+
+// RussianBGN is the Russian scheme of BGN/PCGN 1947.
+var RussianBGN = &Scheme{
+	Name: "ru-bgn",
+	Letters: map[rune]string{
+		'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e",
+		'ё': "ë", 'ж': "zh", 'з': "z", 'и': "i", 'й': "y", 'к': "k",
+		'л': "l", 'м': "m", 'н': "n", 'о': "o", 'п': "p", 'р': "r",
+		'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+		'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "”", 'ы': "y", 'ь': "’",
+		'э': "e", 'ю': "yu", 'я': "ya",
+	},
+	Iotated: map[rune]string{'е': "ye", 'ё': "yë"},
+}
+
+// BelarusianOfficial is the Belarusian scheme of the 2023 rules of
+// transliteration of geographical names.
+var BelarusianOfficial = &Scheme{
+	Name: "be-official",
+	Letters: map[rune]string{
+		'а': "a", 'б': "b", 'в': "v", 'г': "h", 'ґ': "g", 'д': "d",
+		'е': "ie", 'ё': "io", 'ж': "zh", 'з': "z", 'і': "i", 'й': "y",
+		'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o", 'п': "p",
+		'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ў': "w", 'ф': "f",
+		'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'ы': "y", 'ь': "",
+		'э': "e", 'ю': "iu", 'я': "ia", '’': "", '\'': "", 'ʼ': "",
+	},
+	Iotated: map[rune]string{'е': "ye", 'ё': "yo", 'ю': "yu", 'я': "ya"},
+}
+
+// BelarusianLacinka is the classical Belarusian Latin alphabet.
+var BelarusianLacinka = &Scheme{
+	Name: "be-lacinka",
+	Letters: map[rune]string{
+		'а': "a", 'б': "b", 'в': "v", 'г': "h", 'ґ': "g", 'д': "d",
+		'е': "ie", 'ё': "io", 'ж': "ž", 'з': "z", 'і': "i", 'й': "j",
+		'к': "k", 'л': "ł", 'м': "m", 'н': "n", 'о': "o", 'п': "p",
+		'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ў': "ŭ", 'ф': "f",
+		'х': "ch", 'ц': "c", 'ч': "č", 'ш': "š", 'ы': "y", 'ь': "",
+		'э': "e", 'ю': "iu", 'я': "ia", '’': "", '\'': "", 'ʼ': "",
+	},
+	Iotated: map[rune]string{'е': "je", 'ё': "jo", 'ю': "ju", 'я': "ja"},
+	Context: lacinka,
+}
+
+// lacinka softens consonants before the soft sign, makes "л" hard
+// unless it is followed by a soft vowel and drops "i" of soft vowels
+// after "л".
+func lacinka(prev, r, next rune) (string, bool) {
+	switch {
+	case r == 'л' && strings.ContainsRune("еёюяіь", next):
+		return "l", true
+	case prev == 'л' && strings.ContainsRune("еёюя", r):
+		return lacinkaAfterL[r], true
+	case next == 'ь':
+		lat, ok := lacinkaSoft[r]
+		return lat, ok
+	}
+	return "", false
+}
+
+var lacinkaAfterL = map[rune]string{'е': "e", 'ё': "o", 'ю': "u", 'я': "a"}
+
+var lacinkaSoft = map[rune]string{'з': "ź", 'н': "ń", 'с': "ś", 'ц': "ć"}
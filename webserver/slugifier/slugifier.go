@@ -1,14 +1,192 @@
-// Package slugifier provides a custom slugifier from Russian into
-// Translit with the package's own dictionary.
+// Package slugifier provides a custom slugifier from Cyrillic into
+// Latin with the package's own dictionary and transliteration schemes
+// of languages.
 package slugifier
 
 import (
+	"sort"
+	"strings"
+	"unicode"
+
 	"github.com/Machiel/slugify"
 )
 
-// NewSlugifier returns a custom slugifier.
-func NewSlugifier() *slugify.Slugifier {
-	return slugify.New(slugify.Configuration{ReplacementMap: CyrillicLatin})
+// Slugifier makes slugs of texts in several languages.
+type Slugifier struct {
+	// Languages maps language codes to transliteration schemes of
+	// texts in the languages. Other texts are transliterated with
+	// CyrillicLatin.
+	Languages map[string]*Scheme
+
+	latin *slugify.Slugifier
+}
+
+// NewSlugifier returns a custom slugifier with the Russian GOST and
+// the official Belarusian transliteration schemes.
+func NewSlugifier() *Slugifier {
+	return &Slugifier{
+		Languages: map[string]*Scheme{
+			"ru": RussianGOST,
+			"be": BelarusianOfficial,
+		},
+		latin: slugify.New(slugify.Configuration{ReplacementMap: CyrillicLatin}),
+	}
+}
+
+// Use sets the transliteration scheme with the name for the language.
+func (s *Slugifier) Use(lang, scheme string) error {
+	sc, ok := Schemes[scheme]
+	if !ok {
+		return ErrUnknownScheme
+	}
+	s.Languages[lang] = sc
+	return nil
+}
+
+// Slugify makes a slug of the text with CyrillicLatin.
+func (s *Slugifier) Slugify(text string) string {
+	return s.latin.Slugify(text)
+}
+
+// SlugifyLang makes a slug of the text in the language. Latin letters
+// with diacritics produced by the scheme of the language are replaced
+// with plain ones.
+func (s *Slugifier) SlugifyLang(lang, text string) string {
+	if sc, ok := s.Languages[lang]; ok {
+		text = apostrophes.Replace(sc.Transliterate(text))
+	}
+	return s.latin.Slugify(text)
+}
+
+// For returns SlugifyLang for the language.
+func (s *Slugifier) For(lang string) func(string) string {
+	return func(text string) string {
+		return s.SlugifyLang(lang, text)
+	}
+}
+
+// apostrophes are removed from slugs instead of splitting words.
+var apostrophes = strings.NewReplacer("’", "", "”", "", "'", "", "ʼ", "")
+
+// preferred letters are used by ToCyrillic when several Cyrillic
+// letters have the same Latin spelling, e.g. "i" is "і" in Belarusian.
+// Otherwise the first letter in the alphabetical order is used.
+var preferred = map[string]string{
+	"be": "і",
+}
+
+// LatinCyrillic is the reversed CyrillicLatin dictionary for lowercase
+// Cyrillic letters. A Latin spelling can match several letters.
+var LatinCyrillic = reverse(CyrillicLatin)
+
+func reverse(m map[rune]string) map[string][]rune {
+	res := make(map[string][]rune)
+	for r, s := range m {
+		if !unicode.Is(unicode.Cyrillic, r) || len(s) == 0 {
+			continue
+		}
+		r = unicode.ToLower(r)
+		if strings.ContainsRune(string(res[s]), r) {
+			continue
+		}
+		res[s] = append(res[s], r)
+	}
+	for _, rr := range res {
+		sort.Slice(rr, func(i, j int) bool { return rr[i] < rr[j] })
+	}
+	return res
+}
+
+// latinSpellings are spellings of Cyrillic letters used by common
+// transliteration schemes and missing in LatinCyrillic.
+var latinSpellings = map[string]string{
+	"shch": "щ", "sch": "щ", "zh": "ж", "kh": "х", "ch": "ч", "sh": "ш",
+	"ts": "ц", "ya": "я", "yu": "ю", "yo": "ё", "ye": "е", "ja": "я",
+	"ju": "ю", "jo": "ё", "je": "е", "ia": "я", "iu": "ю", "ie": "е",
+	"c": "ц", "j": "й", "q": "к", "w": "в", "x": "кс", "y": "ы",
+}
+
+// languageSpellings are spellings of the language alphabets, e.g.
+// Łacinka and the official Belarusian romanization where "h" stands
+// for "г" and "i" for "і".
+var languageSpellings = map[string]map[string]string{
+	"be": {
+		"h": "г", "i": "і", "w": "ў", "š": "ш", "č": "ч", "ž": "ж", "ŭ": "ў",
+		"ł": "л", "ć": "ць", "ś": "сь", "ź": "зь", "ń": "нь",
+	},
+	"ru": {
+		"h": "х", "i": "и", "š": "ш", "č": "ч", "ž": "ж", "ĭ": "й",
+	},
+}
+
+// cyrillicSpellings are LatinCyrillic, latinSpellings and spellings of
+// languages merged for ToCyrillic, "" keys spellings of other
+// languages.
+var cyrillicSpellings = func() map[string]map[string]string {
+	res := make(map[string]map[string]string)
+	for _, lang := range []string{"", "be", "ru"} {
+		m := make(map[string]string)
+		for k, rr := range LatinCyrillic {
+			m[k] = string(pick(rr, preferred[lang]))
+		}
+		for _, spellings := range []map[string]string{latinSpellings, languageSpellings[lang]} {
+			for k, v := range spellings {
+				m[k] = v
+			}
+		}
+		res[lang] = m
+	}
+	return res
+}()
+
+// ToCyrillic converts a Latin text into Cyrillic with the longest match
+// of letter combinations of LatinCyrillic and common transliteration
+// schemes. Ambiguous letters are resolved in favour of the language
+// alphabet. The result is only a guess because the conversion loses
+// letters such as 'ь' and 'ъ'.
+func ToCyrillic(text, lang string) string {
+	spellings, ok := cyrillicSpellings[lang]
+	if !ok {
+		spellings = cyrillicSpellings[""]
+	}
+	var maxLen int
+	for k := range spellings {
+		if len(k) > maxLen {
+			maxLen = len(k)
+		}
+	}
+
+	s := strings.ToLower(text)
+	var b strings.Builder
+	for len(s) > 0 {
+		n := maxLen
+		if n > len(s) {
+			n = len(s)
+		}
+		for ; n > 0; n-- {
+			if v, ok := spellings[s[:n]]; ok {
+				b.WriteString(v)
+				break
+			}
+		}
+		if n == 0 {
+			// not a Latin letter from the dictionary
+			r := []rune(s)[0]
+			b.WriteRune(r)
+			n = len(string(r))
+		}
+		s = s[n:]
+	}
+	return b.String()
+}
+
+func pick(rr []rune, preferred string) rune {
+	for _, r := range rr {
+		if strings.ContainsRune(preferred, r) {
+			return r
+		}
+	}
+	return rr[0]
 }
 
 // CyrillicLatin is a dictionary from Cyrillic into Translit. Be aware
@@ -25,3 +25,84 @@ func TestMakeSlug(t *testing.T) {
 		})
 	}
 }
+
+func TestToCyrillic(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		lang string
+		want string
+	}{
+		{"ru", "Moskva", "ru", "москва"},
+		{"ru digraphs", "shchuka zhuk", "ru", "щука жук"},
+		{"be i", "Minsk", "be", "мінск"},
+		{"be ya", "Kupalle i Yanka", "be", "купалле і янка"},
+		{"cyrillic", "Мінск", "be", "мінск"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ToCyrillic(tt.text, tt.lang); got != tt.want {
+				t.Errorf("ToCyrillic() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchemes(t *testing.T) {
+	tests := []struct {
+		scheme string
+		text   string
+		want   string
+	}{
+		{"ru-gost", "Щукин Юрий", "Shchukin Iurii"},
+		{"ru-gost", "Ёлкин объект", "Elkin obieekt"},
+		{"ru-bgn", "Ельцин", "Yel’tsin"},
+		{"ru-bgn", "Подъезд к морю", "Pod”yezd k moryu"},
+		{"ru-bgn", "Ёж и маёвка", "Yëzh i mayëvka"},
+		{"be-official", "Гродна", "Hrodna"},
+		{"be-official", "Ваўкавыск", "Vawkavysk"},
+		{"be-official", "Мёры і Заслаўе", "Miory i Zaslawye"},
+		{"be-official", "Сям’я", "Siamya"},
+		{"be-lacinka", "Беларусь", "Biełaruś"},
+		{"be-lacinka", "Ляхавічы", "Lachavičy"},
+		{"be-lacinka", "Вільня", "Vilnia"},
+		{"be-lacinka", "Сям’я", "Siamja"},
+		{"be-lacinka", "Шчучын і жыццё", "Ščučyn i žyccio"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scheme+" "+tt.text, func(t *testing.T) {
+			if got := Schemes[tt.scheme].Transliterate(tt.text); got != tt.want {
+				t.Errorf("Transliterate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlugifyLang(t *testing.T) {
+	tests := []struct {
+		lang   string
+		scheme string
+		text   string
+		want   string
+	}{
+		{"ru", "", "Твердые обложки А4", "tverdye-oblozhki-a4"},
+		{"ru", "ru-bgn", "Подъезд к морю", "podyezd-k-moryu"},
+		{"be", "", "Ваўкавыск і Гродна", "vawkavysk-i-hrodna"},
+		{"be", "be-lacinka", "Беларусь і Вільня", "bielarus-i-vilnia"},
+		{"be", "be-lacinka", "Сям’я", "siamja"},
+		{"en", "", "Minsk & Brest", "minsk-and-brest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.lang+" "+tt.text, func(t *testing.T) {
+			s := NewSlugifier()
+			if len(tt.scheme) > 0 {
+				if err := s.Use(tt.lang, tt.scheme); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := s.SlugifyLang(tt.lang, tt.text); got != tt.want {
+				t.Errorf("SlugifyLang() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
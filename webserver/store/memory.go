@@ -0,0 +1,1093 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bahna/magazine/webserver/cms"
+	"github.com/bahna/magazine/webserver/file"
+	"github.com/bahna/magazine/webserver/locale"
+	"github.com/bahna/magazine/webserver/user"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// NewMemory returns empty repositories keeping data in memory. They are
+// meant for tests. Saved and returned items are copies, so changes of
+// them don't affect the repositories until they are saved.
+func NewMemory() *Stores {
+	m := &memory{
+		content:       map[primitive.ObjectID]*cms.Content{},
+		topics:        map[primitive.ObjectID]*cms.Topic{},
+		users:         map[primitive.ObjectID]*user.User{},
+		files:         map[primitive.ObjectID]*file.File{},
+		messages:      map[primitive.ObjectID]*cms.Message{},
+		contributors:  map[primitive.ObjectID]*cms.Contributor{},
+		tags:          map[primitive.ObjectID]*cms.Tag{},
+		redirects:     map[primitive.ObjectID]*cms.Redirect{},
+		translations:  map[[2]string]*locale.Message{},
+		searchMisses:  map[[2]string]*cms.SearchMiss{},
+		invalidations: map[string]time.Time{},
+	}
+	return &Stores{
+		Content:       &memoryContent{m},
+		Topics:        &memoryTopics{m},
+		Users:         &memoryUsers{m},
+		Files:         &memoryFiles{m},
+		Messages:      &memoryMessages{m},
+		Contributors:  &memoryContributors{m},
+		Tags:          &memoryTags{m},
+		Redirects:     &memoryRedirects{m},
+		Translations:  &memoryTranslations{m},
+		SearchMisses:  &memorySearchMisses{m},
+		Invalidations: &memoryInvalidations{m},
+	}
+}
+
+// memory is shared by the repositories, because content refers to
+// users, topics and files.
+type memory struct {
+	mu           sync.RWMutex
+	content      map[primitive.ObjectID]*cms.Content
+	topics       map[primitive.ObjectID]*cms.Topic
+	users        map[primitive.ObjectID]*user.User
+	files        map[primitive.ObjectID]*file.File
+	messages     map[primitive.ObjectID]*cms.Message
+	contributors map[primitive.ObjectID]*cms.Contributor
+	tags         map[primitive.ObjectID]*cms.Tag
+	redirects    map[primitive.ObjectID]*cms.Redirect
+	// translations and search misses are keyed by languages and
+	// message IDs or queries
+	translations map[[2]string]*locale.Message
+	searchMisses map[[2]string]*cms.SearchMiss
+	// invalidations are keyed by path prefixes
+	invalidations map[string]time.Time
+}
+
+// copyContent returns a copy of the content without loaded relations.
+func copyContent(c *cms.Content) *cms.Content {
+	cp := *c
+	cp.Related, cp.Children, cp.Topics, cp.Tags, cp.Authors = nil, nil, nil, nil, nil
+	cp.Images = append(cp.Images[:0:0], c.Images...)
+	cp.Credits = make([]*cms.Credit, len(c.Credits))
+	for i, v := range c.Credits {
+		cr := *v
+		cr.Contributor = nil
+		cp.Credits[i] = &cr
+	}
+	return &cp
+}
+
+func copyTopic(t *cms.Topic) *cms.Topic {
+	cp := *t
+	cp.Ancestors, cp.Children = nil, nil
+	cp.OldPaths = append(cp.OldPaths[:0:0], t.OldPaths...)
+	return &cp
+}
+
+func copyUser(u *user.User) *user.User {
+	cp := *u
+	return &cp
+}
+
+func copyContributor(c *cms.Contributor) *cms.Contributor {
+	cp := *c
+	cp.AuthorSlug = ""
+	return &cp
+}
+
+// loadRelations sets authors and topics of the items like
+// cms.LoadRelations. The lock must be held.
+func (m *memory) loadRelations(items []*cms.Content) {
+	for _, c := range items {
+		c.Authors = make([]*user.User, 0, len(c.AuthorIDs))
+		for _, id := range c.AuthorIDs {
+			if u, ok := m.users[id]; ok {
+				c.Authors = append(c.Authors, copyUser(u))
+			}
+		}
+		c.Topics = make([]*cms.Topic, 0, len(c.TopicIDs))
+		for _, id := range c.TopicIDs {
+			if t, ok := m.topics[id]; ok {
+				c.Topics = append(c.Topics, copyTopic(t))
+			}
+		}
+	}
+}
+
+// find returns sorted copies of content matched by the query without
+// relations. The lock must be held.
+func (m *memory) find(q ContentQuery) []*cms.Content {
+	now := time.Now()
+	items := []*cms.Content{}
+	for _, c := range m.content {
+		if q.Match(c, now) {
+			items = append(items, copyContent(c))
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if q.Order == ByEventStart {
+			if !a.EventStart.Equal(b.EventStart) {
+				return a.EventStart.Before(b.EventStart)
+			}
+			return a.ID.Hex() < b.ID.Hex()
+		}
+		if a.Weight != b.Weight {
+			return a.Weight > b.Weight
+		}
+		ta, tb := a.Published, b.Published
+		if q.Order == ByCreated {
+			ta, tb = a.Created, b.Created
+		}
+		if !ta.Equal(tb) {
+			return ta.After(tb)
+		}
+		return a.ID.Hex() < b.ID.Hex()
+	})
+
+	if q.Limit > 0 && len(items) > q.Limit {
+		items = items[:q.Limit]
+	}
+	return items
+}
+
+type memoryContent struct {
+	*memory
+}
+
+func (s *memoryContent) Get(ctx context.Context, id primitive.ObjectID) (*cms.Content, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.content[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyContent(c), nil
+}
+
+func (s *memoryContent) FindOne(ctx context.Context, q ContentQuery) (*cms.Content, error) {
+	q.Limit = 1
+	items, err := s.Find(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, ErrNotFound
+	}
+	return items[0], nil
+}
+
+func (s *memoryContent) Find(ctx context.Context, q ContentQuery) ([]*cms.Content, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := s.find(q)
+	s.loadRelations(items)
+	return items, nil
+}
+
+func (s *memoryContent) Page(ctx context.Context, q ContentQuery, perpage, page int) (items []*cms.Content, prev, next int, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	q.Order, q.Limit = ByWeight, 0
+	all := s.find(q)
+
+	viewed := (page - 1) * perpage
+	if len(all) > viewed+perpage {
+		next = page + 1
+	}
+	if page > 1 {
+		prev = page - 1
+	}
+
+	items = []*cms.Content{}
+	if viewed < len(all) {
+		items = all[viewed:]
+		if len(items) > perpage {
+			items = items[:perpage]
+		}
+	}
+	s.loadRelations(items)
+	return
+}
+
+func (s *memoryContent) Count(ctx context.Context, q ContentQuery) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	q.Limit = 0
+	return len(s.find(q)), nil
+}
+
+func (s *memoryContent) ByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*cms.Content, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := make([]*cms.Content, 0, len(ids))
+	for _, id := range ids {
+		if c, ok := s.content[id]; ok {
+			items = append(items, copyContent(c))
+		}
+	}
+	s.loadRelations(items)
+	return items, nil
+}
+
+func (s *memoryContent) Titles(ctx context.Context, q ContentQuery) ([]*cms.Content, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	q.Limit = 0
+	items := s.find(q)
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Published.After(items[j].Published) })
+	for i, c := range items {
+		items[i] = &cms.Content{ID: c.ID, Title: c.Title, Language: c.Language}
+	}
+	return items, nil
+}
+
+func (s *memoryContent) Years(ctx context.Context, q ContentQuery) ([]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	q.Limit = 0
+	var years []int
+	for _, c := range s.find(q) {
+		if !hasInt(years, c.Published.Year()) {
+			years = append(years, c.Published.Year())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(years)))
+	return years, nil
+}
+
+func (s *memoryContent) AuthorCounts(ctx context.Context, q ContentQuery) (map[primitive.ObjectID]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	q.Limit = 0
+	counts := map[primitive.ObjectID]int{}
+	for _, c := range s.find(q) {
+		for _, id := range c.AuthorIDs {
+			counts[id]++
+		}
+	}
+	return counts, nil
+}
+
+func (s *memoryContent) DuplicateSlugs(ctx context.Context) ([]*cms.DuplicateSlug, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	type key struct {
+		lang, slug string
+		topicID    primitive.ObjectID
+	}
+	byKey := map[key]*cms.DuplicateSlug{}
+	for _, c := range s.find(ContentQuery{Order: ByCreated}) {
+		if c.PrimaryTopicID.IsZero() {
+			continue
+		}
+		k := key{c.Language, c.Slug, c.PrimaryTopicID}
+		d, ok := byKey[k]
+		if !ok {
+			d = &cms.DuplicateSlug{Language: c.Language, Slug: c.Slug, Topic: new(cms.Topic)}
+			if t, ok := s.topics[c.PrimaryTopicID]; ok {
+				d.Topic = copyTopic(t)
+			}
+			byKey[k] = d
+		}
+		d.Content = append(d.Content, &cms.Content{ID: c.ID, Title: c.Title, Language: c.Language})
+	}
+
+	items := []*cms.DuplicateSlug{}
+	for _, d := range byKey {
+		if len(d.Content) > 1 {
+			items = append(items, d)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Language != items[j].Language {
+			return items[i].Language < items[j].Language
+		}
+		return items[i].Slug < items[j].Slug
+	})
+	return items, nil
+}
+
+func (s *memoryContent) Save(ctx context.Context, c *cms.Content) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// slugs are unique in primary topics like in the mongo index
+	if !c.PrimaryTopicID.IsZero() {
+		for _, v := range s.content {
+			if v.ID != c.ID && v.Language == c.Language && v.PrimaryTopicID == c.PrimaryTopicID && v.Slug == c.Slug {
+				return ErrDuplicate
+			}
+		}
+	}
+	s.content[c.ID] = copyContent(c)
+	return nil
+}
+
+func (s *memoryContent) Delete(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.content[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.content, id)
+	return nil
+}
+
+func (s *memoryContent) UpdateSearchFields(ctx context.Context, q ContentQuery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, c := range s.content {
+		if !q.Match(c, now) {
+			continue
+		}
+		var names, titles []string
+		for _, id := range c.AuthorIDs {
+			if u, ok := s.users[id]; ok {
+				names = append(names, u.FirstName+" "+u.LastName)
+			}
+		}
+		for _, id := range c.ContributorIDs() {
+			if v, ok := s.contributors[id]; ok {
+				names = append(names, v.Name)
+			}
+		}
+		for _, id := range c.TopicIDs {
+			if t, ok := s.topics[id]; ok {
+				titles = append(titles, t.Title)
+			}
+		}
+		c.AuthorNames = strings.Join(names, " ")
+		c.TopicTitles = strings.Join(titles, " ")
+	}
+	return nil
+}
+
+func (s *memoryContent) LoadChildren(ctx context.Context, items []*cms.Content) error {
+	// empty ParentIDs would match all content
+	if len(items) == 0 {
+		return nil
+	}
+	ids := make([]primitive.ObjectID, len(items))
+	for i, c := range items {
+		ids[i] = c.ID
+	}
+	children, err := s.Find(ctx, ContentQuery{Published: true, ParentIDs: ids})
+	if err != nil {
+		return err
+	}
+
+	byParent := map[primitive.ObjectID][]*cms.Content{}
+	for _, v := range children {
+		byParent[*v.ParentID] = append(byParent[*v.ParentID], v)
+	}
+	for _, c := range items {
+		c.Children = byParent[c.ID]
+	}
+	return nil
+}
+
+func (s *memoryContent) NextScheduled(ctx context.Context, now time.Time) (next time.Time, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, c := range s.content {
+		if c.Public && c.Scheduled.After(now) && (next.IsZero() || c.Scheduled.Before(next)) {
+			next = c.Scheduled
+		}
+	}
+	return
+}
+
+func (s *memoryContent) LoadDetails(ctx context.Context, c *cms.Content) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c.Tags = []*cms.Tag{}
+	for _, id := range c.TagIDs {
+		if t, ok := s.tags[id]; ok {
+			cp := *t
+			c.Tags = append(c.Tags, &cp)
+		}
+	}
+	sort.Slice(c.Tags, func(i, j int) bool { return c.Tags[i].Title < c.Tags[j].Title })
+
+	// credits of removed contributors are skipped
+	credits := make([]*cms.Credit, 0, len(c.Credits))
+	for _, v := range c.Credits {
+		cr, ok := s.contributors[v.ContributorID]
+		if !ok {
+			continue
+		}
+		v.Contributor = copyContributor(cr)
+		if cr.UserID != nil {
+			if u, ok := s.users[*cr.UserID]; ok {
+				v.Contributor.AuthorSlug = u.Slug
+			}
+		}
+		credits = append(credits, v)
+	}
+	c.Credits = credits
+
+	for i, v := range c.Images {
+		var img *file.File
+		for _, f := range s.files {
+			if f.URL == v.URL {
+				img = f
+				break
+			}
+			for _, o := range f.Optimized {
+				if o.URL == v.URL {
+					img = f
+				}
+			}
+		}
+		if img == nil {
+			return fmt.Errorf("image %v not found: %v", v.URL, ErrNotFound)
+		}
+		c.Images[i].Credits = img.Credits
+		c.Images[i].Width = img.Width
+		c.Images[i].Height = img.Height
+		c.Images[i].Color = img.Color
+	}
+	return nil
+}
+
+type memoryTopics struct {
+	*memory
+}
+
+func (s *memoryTopics) Get(ctx context.Context, id primitive.ObjectID) (*cms.Topic, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.topics[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyTopic(t), nil
+}
+
+func (s *memoryTopics) All(ctx context.Context, q TopicQuery) ([]*cms.Topic, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := []*cms.Topic{}
+	for _, t := range s.topics {
+		if q.Match(t) {
+			items = append(items, copyTopic(t))
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Weight != items[j].Weight {
+			return items[i].Weight > items[j].Weight
+		}
+		return items[i].ID.Hex() < items[j].ID.Hex()
+	})
+	return items, nil
+}
+
+func (s *memoryTopics) FindByPath(ctx context.Context, lang, path string) (*cms.Topic, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, t := range s.topics {
+		if t.Language == lang && t.Path == path {
+			return copyTopic(t), false, nil
+		}
+	}
+	for _, t := range s.topics {
+		if t.Language == lang && hasString(t.OldPaths, path) {
+			return copyTopic(t), true, nil
+		}
+	}
+	return nil, false, ErrNotFound
+}
+
+func (s *memoryTopics) Save(ctx context.Context, t *cms.Topic) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.topics[t.ID] = copyTopic(t)
+	return nil
+}
+
+func (s *memoryTopics) Delete(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.topics[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.topics, id)
+	return nil
+}
+
+func (s *memoryTopics) Order(ctx context.Context, ids []primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, id := range ids {
+		if t, ok := s.topics[id]; ok {
+			t.Weight = len(ids) - i
+		}
+	}
+	return nil
+}
+
+func (s *memoryTopics) UpdatePaths(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.topics {
+		path := cms.TopicPath(t, s.topics)
+		if path != t.Path {
+			// paths are made of slugs, so the change doesn't
+			// affect paths of the other topics
+			t.OldPaths = cms.OldTopicPaths(t, path)
+			t.Path = path
+		}
+	}
+	return nil
+}
+
+func (s *memoryTopics) Descendants(ctx context.Context, id primitive.ObjectID) (ids []primitive.ObjectID, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	seen := map[primitive.ObjectID]bool{id: true}
+	queue := []primitive.ObjectID{id}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		for _, t := range s.topics {
+			if t.ParentID != nil && *t.ParentID == parent && !seen[t.ID] {
+				seen[t.ID] = true
+				ids = append(ids, t.ID)
+				queue = append(queue, t.ID)
+			}
+		}
+	}
+	return
+}
+
+type memoryUsers struct {
+	*memory
+}
+
+func (s *memoryUsers) Get(ctx context.Context, id primitive.ObjectID) (*user.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyUser(u), nil
+}
+
+func (s *memoryUsers) FindByEmail(ctx context.Context, address string) (*user.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, u := range s.users {
+		if u.Email.Address == address {
+			return copyUser(u), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryUsers) FindBySlug(ctx context.Context, slug string) (*user.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, u := range s.users {
+		if len(slug) > 0 && u.Slug == slug {
+			return copyUser(u), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryUsers) ByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*user.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := []*user.User{}
+	for _, id := range ids {
+		if u, ok := s.users[id]; ok {
+			items = append(items, copyUser(u))
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].LastName != items[j].LastName {
+			return items[i].LastName < items[j].LastName
+		}
+		return items[i].FirstName < items[j].FirstName
+	})
+	return items, nil
+}
+
+func (s *memoryUsers) All(ctx context.Context) ([]*user.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := []*user.User{}
+	for _, u := range s.users {
+		items = append(items, copyUser(u))
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ID.Hex() < items[j].ID.Hex() })
+	return items, nil
+}
+
+func (s *memoryUsers) Save(ctx context.Context, u *user.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[u.ID] = copyUser(u)
+	return nil
+}
+
+func (s *memoryUsers) Delete(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.users, id)
+	return nil
+}
+
+type memoryFiles struct {
+	*memory
+}
+
+func (s *memoryFiles) Get(ctx context.Context, id primitive.ObjectID) (*file.File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.files[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	cp := *f
+	return &cp, nil
+}
+
+// sorted returns copies of files matched by the filter starting from
+// the latest ones. The lock must be held.
+func (s *memoryFiles) sorted(match func(*file.File) bool) []*file.File {
+	items := []*file.File{}
+	for _, f := range s.files {
+		if match(f) {
+			cp := *f
+			items = append(items, &cp)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].Created.Equal(items[j].Created) {
+			return items[i].Created.After(items[j].Created)
+		}
+		return items[i].ID.Hex() > items[j].ID.Hex()
+	})
+	return items
+}
+
+func (s *memoryFiles) Find(ctx context.Context, q FileQuery) ([]*file.File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sorted(q.Match), nil
+}
+
+func (s *memoryFiles) Page(ctx context.Context, q FileQuery, perpage, page int) (items []*file.File, prev, next, total int, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	all := s.sorted(q.Match)
+
+	total = len(all)
+	viewed := (page - 1) * perpage
+	if total > viewed+perpage {
+		next = page + 1
+	}
+	if page > 1 {
+		prev = page - 1
+	}
+
+	items = []*file.File{}
+	if viewed < total {
+		items = all[viewed:]
+		if len(items) > perpage {
+			items = items[:perpage]
+		}
+	}
+	return
+}
+
+func (s *memoryFiles) Folders(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	folders := []string{}
+	for _, f := range s.files {
+		if len(f.Folder) > 0 && !hasString(folders, f.Folder) {
+			folders = append(folders, f.Folder)
+		}
+	}
+	sort.Strings(folders)
+	return folders, nil
+}
+
+func (s *memoryFiles) Save(ctx context.Context, f *file.File) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp := *f
+	s.files[f.ID] = &cp
+	return nil
+}
+
+func (s *memoryFiles) Delete(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.files, id)
+	return nil
+}
+
+type memoryMessages struct {
+	*memory
+}
+
+func (s *memoryMessages) Get(ctx context.Context, id primitive.ObjectID) (*cms.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.messages[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	cp := *m
+	return &cp, nil
+}
+
+func (s *memoryMessages) All(ctx context.Context) ([]*cms.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := []*cms.Message{}
+	for _, m := range s.messages {
+		cp := *m
+		items = append(items, &cp)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Created.After(items[j].Created) })
+	return items, nil
+}
+
+func (s *memoryMessages) Save(ctx context.Context, m *cms.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp := *m
+	s.messages[m.ID] = &cp
+	return nil
+}
+
+func (s *memoryMessages) SetStatus(ctx context.Context, id primitive.ObjectID, status cms.MessageStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.messages[id]
+	if !ok {
+		return ErrNotFound
+	}
+	m.Status = status
+	return nil
+}
+
+type memoryContributors struct {
+	*memory
+}
+
+func (s *memoryContributors) Get(ctx context.Context, id primitive.ObjectID) (*cms.Contributor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.contributors[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyContributor(c), nil
+}
+
+// sorted returns copies of contributors matched by the filter sorted by
+// names. The lock must be held.
+func (s *memoryContributors) sorted(match func(*cms.Contributor) bool) []*cms.Contributor {
+	items := []*cms.Contributor{}
+	for _, c := range s.contributors {
+		if match(c) {
+			items = append(items, copyContributor(c))
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return items
+}
+
+func (s *memoryContributors) All(ctx context.Context) ([]*cms.Contributor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sorted(func(*cms.Contributor) bool { return true }), nil
+}
+
+func (s *memoryContributors) ByUser(ctx context.Context, userID primitive.ObjectID) ([]*cms.Contributor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sorted(func(c *cms.Contributor) bool { return c.UserID != nil && *c.UserID == userID }), nil
+}
+
+func (s *memoryContributors) Save(ctx context.Context, c *cms.Contributor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.contributors[c.ID] = copyContributor(c)
+	return nil
+}
+
+func (s *memoryContributors) Delete(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.contributors[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.contributors, id)
+	return nil
+}
+
+type memoryTags struct {
+	*memory
+}
+
+func (s *memoryTags) FindBySlug(ctx context.Context, lang, slug string) (*cms.Tag, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, t := range s.tags {
+		if t.Language == lang && t.Slug == slug {
+			cp := *t
+			return &cp, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// sorted returns copies of tags matched by the filter sorted by titles.
+// The lock must be held.
+func (s *memoryTags) sorted(match func(*cms.Tag) bool) []*cms.Tag {
+	items := []*cms.Tag{}
+	for _, t := range s.tags {
+		if match(t) {
+			cp := *t
+			items = append(items, &cp)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Title < items[j].Title })
+	return items
+}
+
+func (s *memoryTags) ByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*cms.Tag, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sorted(func(t *cms.Tag) bool { return hasAnyID(ids, []primitive.ObjectID{t.ID}) }), nil
+}
+
+func (s *memoryTags) Find(ctx context.Context, lang, prefix string, limit int) ([]*cms.Tag, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	prefix = strings.ToLower(prefix)
+	items := s.sorted(func(t *cms.Tag) bool {
+		if t.Language != lang {
+			return false
+		}
+		for _, w := range strings.Fields(strings.ToLower(t.Title)) {
+			if strings.HasPrefix(w, prefix) {
+				return true
+			}
+		}
+		return len(prefix) == 0
+	})
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	return items, nil
+}
+
+func (s *memoryTags) Create(ctx context.Context, lang string, titles []string, slugify func(string) string) (ids []primitive.ObjectID, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := map[string]bool{}
+	seenIDs := map[primitive.ObjectID]bool{}
+	for _, title := range titles {
+		title = strings.TrimSpace(title)
+		slug := slugify(title)
+		if len(slug) == 0 || seen[slug] {
+			continue
+		}
+		seen[slug] = true
+
+		var tag *cms.Tag
+		for _, t := range s.tags {
+			if t.Language == lang && strings.EqualFold(t.Title, title) {
+				tag = t
+				break
+			}
+		}
+		for _, t := range s.tags {
+			if tag == nil && t.Language == lang && t.Slug == slug {
+				tag = t
+				break
+			}
+		}
+		if tag == nil {
+			tag = &cms.Tag{ID: primitive.NewObjectID(), Language: lang, Title: title, Slug: slug}
+			s.tags[tag.ID] = tag
+		}
+		if !seenIDs[tag.ID] {
+			seenIDs[tag.ID] = true
+			ids = append(ids, tag.ID)
+		}
+	}
+	return
+}
+
+type memoryRedirects struct {
+	*memory
+}
+
+func (s *memoryRedirects) All(ctx context.Context) ([]*cms.Redirect, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := []*cms.Redirect{}
+	for _, r := range s.redirects {
+		cp := *r
+		items = append(items, &cp)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].From < items[j].From })
+	return items, nil
+}
+
+func (s *memoryRedirects) Save(ctx context.Context, from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.redirects {
+		if r.From == from {
+			r.To = to
+			return nil
+		}
+	}
+	r := &cms.Redirect{ID: primitive.NewObjectID(), From: from, To: to, Created: time.Now()}
+	s.redirects[r.ID] = r
+	return nil
+}
+
+func (s *memoryRedirects) Delete(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.redirects[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.redirects, id)
+	return nil
+}
+
+func (s *memoryRedirects) Hit(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.redirects[id]; ok {
+		r.Hits++
+		r.LastHit = time.Now()
+	}
+	return nil
+}
+
+type memoryTranslations struct {
+	*memory
+}
+
+func (s *memoryTranslations) All(ctx context.Context) ([]*locale.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := []*locale.Message{}
+	for _, m := range s.translations {
+		cp := *m
+		items = append(items, &cp)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Language != items[j].Language {
+			return items[i].Language < items[j].Language
+		}
+		return items[i].MessageID < items[j].MessageID
+	})
+	return items, nil
+}
+
+func (s *memoryTranslations) Save(ctx context.Context, lang, id, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := [2]string{lang, id}
+	if len(value) == 0 {
+		delete(s.translations, k)
+		return nil
+	}
+	m, ok := s.translations[k]
+	if !ok {
+		m = &locale.Message{ID: primitive.NewObjectID(), Language: lang, MessageID: id}
+		s.translations[k] = m
+	}
+	m.Value = value
+	m.Updated = time.Now()
+	return nil
+}
+
+type memorySearchMisses struct {
+	*memory
+}
+
+func (s *memorySearchMisses) Log(ctx context.Context, lang, query string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	query = strings.ToLower(strings.TrimSpace(query))
+	k := [2]string{lang, query}
+	m, ok := s.searchMisses[k]
+	if !ok {
+		m = &cms.SearchMiss{ID: primitive.NewObjectID(), Language: lang, Query: query, First: now}
+		s.searchMisses[k] = m
+	}
+	m.Count++
+	m.Last = now
+	return nil
+}
+
+func (s *memorySearchMisses) All(ctx context.Context, limit int) ([]*cms.SearchMiss, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := []*cms.SearchMiss{}
+	for _, m := range s.searchMisses {
+		cp := *m
+		items = append(items, &cp)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count != items[j].Count {
+			return items[i].Count > items[j].Count
+		}
+		return items[i].Last.After(items[j].Last)
+	})
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	return items, nil
+}
+
+type memoryInvalidations struct {
+	*memory
+}
+
+func (s *memoryInvalidations) All(ctx context.Context) (map[string]time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make(map[string]time.Time, len(s.invalidations))
+	for p, t := range s.invalidations {
+		res[p] = t
+	}
+	return res, nil
+}
+
+func (s *memoryInvalidations) Save(ctx context.Context, prefix string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.After(s.invalidations[prefix]) {
+		s.invalidations[prefix] = t
+	}
+	return nil
+}
@@ -0,0 +1,609 @@
+package store
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/bahna/magazine/webserver/cms"
+	"github.com/bahna/magazine/webserver/file"
+	"github.com/bahna/magazine/webserver/locale"
+	"github.com/bahna/magazine/webserver/mongo"
+	"github.com/bahna/magazine/webserver/user"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	mongodb "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NewMongo returns repositories backed by the database. They wrap the
+// functions of the cms, file and mongo packages.
+func NewMongo(db *mongodb.Database) *Stores {
+	return &Stores{
+		Content:       &mongoContent{db},
+		Topics:        &mongoTopics{db},
+		Users:         &mongoUsers{db},
+		Files:         &mongoFiles{db},
+		Messages:      &mongoMessages{db},
+		Contributors:  &mongoContributors{db},
+		Tags:          &mongoTags{db},
+		Redirects:     &mongoRedirects{db},
+		Translations:  &mongoTranslations{db},
+		SearchMisses:  &mongoSearchMisses{db},
+		Invalidations: &mongoInvalidations{db},
+	}
+}
+
+// notFound replaces mongodb.ErrNoDocuments with ErrNotFound.
+func notFound(err error) error {
+	if err == mongodb.ErrNoDocuments {
+		return ErrNotFound
+	}
+	return err
+}
+
+// getID fetches the document with the ID into dst.
+func getID(ctx context.Context, col *mongodb.Collection, id primitive.ObjectID, dst interface{}) error {
+	return notFound(col.FindOne(ctx, bson.M{"_id": id}).Decode(dst))
+}
+
+// deleteID removes the document with the ID.
+func deleteID(ctx context.Context, col *mongodb.Collection, id primitive.ObjectID) error {
+	res, err := col.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// contentFilter converts the query into a mongo query.
+func contentFilter(q ContentQuery) bson.M {
+	m := bson.M{}
+	and := []bson.M{}
+	if len(q.IDs) > 0 {
+		m["_id"] = bson.M{"$in": q.IDs}
+	}
+	if len(q.Language) > 0 {
+		m["language"] = q.Language
+	}
+	if q.Public {
+		m["public"] = true
+	}
+	if q.Published {
+		m["public"] = true
+		and = append(and, bson.M{"$or": []bson.M{
+			{"scheduled": bson.M{"$lt": time.Now()}},
+			{"scheduled": time.Time{}},
+		}})
+	}
+	if len(q.Types) > 0 {
+		m["type"] = bson.M{"$in": q.Types}
+	}
+	if len(q.TopicIDs) > 0 {
+		m["topicids"] = bson.M{"$in": q.TopicIDs}
+	}
+	if !q.PrimaryTopicID.IsZero() {
+		m["primarytopicid"] = q.PrimaryTopicID
+	}
+	if !q.TagID.IsZero() {
+		m["tagids"] = q.TagID
+	}
+	switch {
+	case !q.AuthorID.IsZero() && len(q.ContributorIDs) > 0:
+		and = append(and, bson.M{"$or": []bson.M{
+			{"authorids": q.AuthorID},
+			{"credits.contributorid": bson.M{"$in": q.ContributorIDs}},
+		}})
+	case !q.AuthorID.IsZero():
+		m["authorids"] = q.AuthorID
+	case len(q.ContributorIDs) > 0:
+		m["credits.contributorid"] = bson.M{"$in": q.ContributorIDs}
+	}
+	if len(q.ParentIDs) > 0 {
+		m["parentid"] = bson.M{"$in": q.ParentIDs}
+	}
+	if len(q.Slug) > 0 {
+		m["slug"] = q.Slug
+	}
+	if len(q.OldSlug) > 0 {
+		and = append(and, bson.M{"$or": []bson.M{
+			{"oldslugs": q.OldSlug},
+			{"pageslug": q.OldSlug},
+		}})
+	}
+	if !q.EventsAfter.IsZero() {
+		m["eventstart"] = bson.M{"$gte": q.EventsAfter}
+	}
+	if !q.FileID.IsZero() {
+		// the same URLs as found by cms.Content.FileIDs
+		re := primitive.Regex{Pattern: "/(files/(optimized/)?|img/)" + q.FileID.Hex()}
+		and = append(and, bson.M{"$or": []bson.M{
+			{"coverexternal": re},
+			{"coverinternal": re},
+			{"lede": re},
+			{"body": re},
+			{"images.url": re},
+		}})
+	}
+	if len(and) > 0 {
+		m["$and"] = and
+	}
+	return m
+}
+
+func contentSort(o Order) bson.D {
+	switch o {
+	case ByCreated:
+		return mongo.Sort("-weight", "-created")
+	case ByEventStart:
+		return mongo.Sort("eventstart")
+	}
+	return mongo.Sort("-weight", "-published")
+}
+
+type mongoContent struct {
+	db *mongodb.Database
+}
+
+func (s *mongoContent) Get(ctx context.Context, id primitive.ObjectID) (*cms.Content, error) {
+	c := new(cms.Content)
+	if err := getID(ctx, s.db.Collection("content"), id, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *mongoContent) FindOne(ctx context.Context, q ContentQuery) (*cms.Content, error) {
+	q.Limit = 1
+	items, err := s.Find(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, ErrNotFound
+	}
+	return items[0], nil
+}
+
+func (s *mongoContent) Find(ctx context.Context, q ContentQuery) (items []*cms.Content, err error) {
+	items = []*cms.Content{}
+	opts := options.Find().SetSort(contentSort(q.Order)).SetLimit(int64(q.Limit))
+	if err = mongo.All(ctx, s.db.Collection("content"), contentFilter(q), &items, opts); err != nil {
+		return
+	}
+	err = cms.LoadRelations(ctx, s.db, items)
+	return
+}
+
+func (s *mongoContent) Page(ctx context.Context, q ContentQuery, perpage, page int) ([]*cms.Content, int, int, error) {
+	return cms.AllContentByPage(ctx, s.db.Collection("content"), contentFilter(q), perpage, page)
+}
+
+func (s *mongoContent) Count(ctx context.Context, q ContentQuery) (int, error) {
+	return mongo.Count(ctx, s.db.Collection("content"), contentFilter(q))
+}
+
+func (s *mongoContent) ByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*cms.Content, error) {
+	return cms.ContentByIDs(ctx, s.db, ids)
+}
+
+func (s *mongoContent) Titles(ctx context.Context, q ContentQuery) ([]*cms.Content, error) {
+	items, err := cms.AllContentTitles(ctx, s.db.Collection("content"), contentFilter(q))
+	if items == nil {
+		items = []*cms.Content{}
+	}
+	return items, err
+}
+
+func (s *mongoContent) Years(ctx context.Context, q ContentQuery) ([]int, error) {
+	return cms.ContentYears(ctx, s.db.Collection("content"), contentFilter(q))
+}
+
+func (s *mongoContent) AuthorCounts(ctx context.Context, q ContentQuery) (map[primitive.ObjectID]int, error) {
+	return cms.AuthorCounts(ctx, s.db.Collection("content"), contentFilter(q))
+}
+
+func (s *mongoContent) DuplicateSlugs(ctx context.Context) ([]*cms.DuplicateSlug, error) {
+	return cms.DuplicateSlugs(ctx, s.db)
+}
+
+func (s *mongoContent) Save(ctx context.Context, c *cms.Content) error {
+	err := mongo.Save(ctx, s.db.Collection("content"), bson.M{"_id": c.ID}, c)
+	if mongodb.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (s *mongoContent) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return deleteID(ctx, s.db.Collection("content"), id)
+}
+
+func (s *mongoContent) UpdateSearchFields(ctx context.Context, q ContentQuery) error {
+	return cms.UpdateSearchFields(ctx, s.db, contentFilter(q))
+}
+
+func (s *mongoContent) LoadChildren(ctx context.Context, items []*cms.Content) error {
+	return cms.LoadChildren(ctx, s.db, items)
+}
+
+func (s *mongoContent) LoadDetails(ctx context.Context, c *cms.Content) error {
+	if err := cms.GetTagsForContent(ctx, s.db, c); err != nil {
+		return err
+	}
+	if err := cms.GetCreditsForContent(ctx, s.db, c); err != nil {
+		return err
+	}
+	return file.GetImagesForContent(ctx, s.db, c)
+}
+
+func (s *mongoContent) NextScheduled(ctx context.Context, now time.Time) (time.Time, error) {
+	c := new(cms.Content)
+	err := mongo.GetOne(ctx, s.db.Collection("content"),
+		bson.M{"public": true, "scheduled": bson.M{"$gt": now}}, c,
+		options.FindOne().SetSort(mongo.Sort("scheduled")).SetProjection(bson.M{"scheduled": 1}))
+	if err == mongodb.ErrNoDocuments {
+		return time.Time{}, nil
+	}
+	return c.Scheduled, err
+}
+
+type mongoTopics struct {
+	db *mongodb.Database
+}
+
+func (s *mongoTopics) Get(ctx context.Context, id primitive.ObjectID) (*cms.Topic, error) {
+	t := new(cms.Topic)
+	if err := getID(ctx, s.db.Collection("topics"), id, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *mongoTopics) All(ctx context.Context, q TopicQuery) ([]*cms.Topic, error) {
+	m := bson.M{}
+	if len(q.Language) > 0 {
+		m["language"] = q.Language
+	}
+	if q.Public {
+		m["public"] = true
+		// topics saved before pages were introduced don't have the field
+		m["page"] = bson.M{"$ne": true}
+	}
+	if !q.ParentID.IsZero() {
+		m["parentid"] = q.ParentID
+	}
+	return cms.AllTopics(ctx, s.db, m)
+}
+
+func (s *mongoTopics) FindByPath(ctx context.Context, lang, path string) (*cms.Topic, bool, error) {
+	t := new(cms.Topic)
+	err := mongo.GetOne(ctx, s.db.Collection("topics"), bson.M{"language": lang, "path": path}, t)
+	if err == mongodb.ErrNoDocuments {
+		err = mongo.GetOne(ctx, s.db.Collection("topics"), bson.M{"language": lang, "oldpaths": path}, t)
+		if err != nil {
+			return nil, false, notFound(err)
+		}
+		return t, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return t, false, nil
+}
+
+func (s *mongoTopics) Save(ctx context.Context, t *cms.Topic) error {
+	return mongo.Save(ctx, s.db.Collection("topics"), bson.M{"_id": t.ID}, t)
+}
+
+func (s *mongoTopics) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return deleteID(ctx, s.db.Collection("topics"), id)
+}
+
+func (s *mongoTopics) Order(ctx context.Context, ids []primitive.ObjectID) error {
+	return cms.OrderTopics(ctx, s.db.Collection("topics"), ids)
+}
+
+func (s *mongoTopics) UpdatePaths(ctx context.Context) error {
+	return cms.UpdateTopicPaths(ctx, s.db)
+}
+
+func (s *mongoTopics) Descendants(ctx context.Context, id primitive.ObjectID) ([]primitive.ObjectID, error) {
+	return cms.DescendantTopicIDs(ctx, s.db, id)
+}
+
+type mongoUsers struct {
+	db *mongodb.Database
+}
+
+func (s *mongoUsers) Get(ctx context.Context, id primitive.ObjectID) (*user.User, error) {
+	u := new(user.User)
+	if err := getID(ctx, s.db.Collection("users"), id, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *mongoUsers) FindByEmail(ctx context.Context, address string) (*user.User, error) {
+	u := new(user.User)
+	if err := mongo.GetOne(ctx, s.db.Collection("users"), bson.M{"email.address": address}, u); err != nil {
+		return nil, notFound(err)
+	}
+	return u, nil
+}
+
+func (s *mongoUsers) FindBySlug(ctx context.Context, slug string) (*user.User, error) {
+	if len(slug) == 0 {
+		return nil, ErrNotFound
+	}
+	u := new(user.User)
+	if err := mongo.GetOne(ctx, s.db.Collection("users"), bson.M{"slug": slug}, u); err != nil {
+		return nil, notFound(err)
+	}
+	return u, nil
+}
+
+func (s *mongoUsers) All(ctx context.Context) ([]*user.User, error) {
+	return cms.AllUsers(ctx, s.db.Collection("users"), nil)
+}
+
+func (s *mongoUsers) ByIDs(ctx context.Context, ids []primitive.ObjectID) (items []*user.User, err error) {
+	items = []*user.User{}
+	err = mongo.All(ctx, s.db.Collection("users"), bson.M{"_id": bson.M{"$in": ids}}, &items,
+		options.Find().SetSort(mongo.Sort("lastname", "firstname")))
+	return
+}
+
+func (s *mongoUsers) Save(ctx context.Context, u *user.User) error {
+	return mongo.Save(ctx, s.db.Collection("users"), bson.M{"_id": u.ID}, u)
+}
+
+func (s *mongoUsers) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return deleteID(ctx, s.db.Collection("users"), id)
+}
+
+type mongoFiles struct {
+	db *mongodb.Database
+}
+
+func (s *mongoFiles) Get(ctx context.Context, id primitive.ObjectID) (*file.File, error) {
+	f := new(file.File)
+	if err := getID(ctx, s.db.Collection("files"), id, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// fileFilter converts the query into a mongo query.
+func fileFilter(q FileQuery) bson.M {
+	m := bson.M{}
+	if len(q.Text) > 0 {
+		re := primitive.Regex{Pattern: regexp.QuoteMeta(q.Text), Options: "i"}
+		m["$or"] = []bson.M{
+			{"title": re},
+			{"credits": re},
+			{"filename": re},
+			{"url": re},
+		}
+	}
+	if len(q.Kinds) > 0 {
+		m["kind"] = bson.M{"$in": q.Kinds}
+	}
+	if len(q.Folder) > 0 {
+		m["folder"] = q.Folder
+	}
+	created := bson.M{}
+	if !q.UploadedAfter.IsZero() {
+		created["$gte"] = q.UploadedAfter
+	}
+	if !q.UploadedBefore.IsZero() {
+		created["$lt"] = q.UploadedBefore
+	}
+	if len(created) > 0 {
+		m["created"] = created
+	}
+	if q.Cropped {
+		m["$and"] = []bson.M{{"$or": []bson.M{
+			{"focus": bson.M{"$exists": true}},
+			{"crops": bson.M{"$exists": true}},
+		}}}
+	}
+	return m
+}
+
+func (s *mongoFiles) Find(ctx context.Context, q FileQuery) ([]*file.File, error) {
+	return file.AllFiles(ctx, s.db.Collection("files"), fileFilter(q), options.Find().SetSort(mongo.Sort("-created")))
+}
+
+func (s *mongoFiles) Page(ctx context.Context, q FileQuery, perpage, page int) ([]*file.File, int, int, int, error) {
+	return file.AllFilesByPage(ctx, s.db.Collection("files"), fileFilter(q), perpage, page)
+}
+
+func (s *mongoFiles) Folders(ctx context.Context) ([]string, error) {
+	vv, err := s.db.Collection("files").Distinct(ctx, "folder", bson.M{"folder": bson.M{"$gt": ""}})
+	if err != nil {
+		return nil, err
+	}
+	folders := []string{}
+	for _, v := range vv {
+		if name, ok := v.(string); ok {
+			folders = append(folders, name)
+		}
+	}
+	sort.Strings(folders)
+	return folders, nil
+}
+
+func (s *mongoFiles) Save(ctx context.Context, f *file.File) error {
+	return mongo.Save(ctx, s.db.Collection("files"), bson.M{"_id": f.ID}, f)
+}
+
+func (s *mongoFiles) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return deleteID(ctx, s.db.Collection("files"), id)
+}
+
+type mongoMessages struct {
+	db *mongodb.Database
+}
+
+func (s *mongoMessages) Get(ctx context.Context, id primitive.ObjectID) (*cms.Message, error) {
+	m := new(cms.Message)
+	if err := getID(ctx, s.db.Collection("messages"), id, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (s *mongoMessages) All(ctx context.Context) (items []*cms.Message, err error) {
+	items = []*cms.Message{}
+	err = mongo.All(ctx, s.db.Collection("messages"), nil, &items, options.Find().SetSort(mongo.Sort("-created")))
+	return
+}
+
+func (s *mongoMessages) Save(ctx context.Context, m *cms.Message) error {
+	return mongo.Save(ctx, s.db.Collection("messages"), bson.M{"_id": m.ID}, m)
+}
+
+func (s *mongoMessages) SetStatus(ctx context.Context, id primitive.ObjectID, status cms.MessageStatus) error {
+	res, err := s.db.Collection("messages").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"status": status}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type mongoContributors struct {
+	db *mongodb.Database
+}
+
+func (s *mongoContributors) Get(ctx context.Context, id primitive.ObjectID) (*cms.Contributor, error) {
+	c := new(cms.Contributor)
+	if err := getID(ctx, s.db.Collection("contributors"), id, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *mongoContributors) All(ctx context.Context) ([]*cms.Contributor, error) {
+	return cms.AllContributors(ctx, s.db.Collection("contributors"), nil)
+}
+
+func (s *mongoContributors) ByUser(ctx context.Context, userID primitive.ObjectID) ([]*cms.Contributor, error) {
+	return cms.AllContributors(ctx, s.db.Collection("contributors"), bson.M{"userid": userID})
+}
+
+func (s *mongoContributors) Save(ctx context.Context, c *cms.Contributor) error {
+	return mongo.Save(ctx, s.db.Collection("contributors"), bson.M{"_id": c.ID}, c)
+}
+
+func (s *mongoContributors) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return deleteID(ctx, s.db.Collection("contributors"), id)
+}
+
+type mongoTags struct {
+	db *mongodb.Database
+}
+
+func (s *mongoTags) FindBySlug(ctx context.Context, lang, slug string) (*cms.Tag, error) {
+	t := new(cms.Tag)
+	if err := mongo.GetOne(ctx, s.db.Collection("tags"), bson.M{"language": lang, "slug": slug}, t); err != nil {
+		return nil, notFound(err)
+	}
+	return t, nil
+}
+
+func (s *mongoTags) ByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*cms.Tag, error) {
+	c := &cms.Content{TagIDs: ids}
+	err := cms.GetTagsForContent(ctx, s.db, c)
+	return c.Tags, err
+}
+
+func (s *mongoTags) Find(ctx context.Context, lang, prefix string, limit int) ([]*cms.Tag, error) {
+	return cms.FindTags(ctx, s.db.Collection("tags"), lang, prefix, limit)
+}
+
+func (s *mongoTags) Create(ctx context.Context, lang string, titles []string, slugify func(string) string) ([]primitive.ObjectID, error) {
+	return cms.SaveTags(ctx, s.db.Collection("tags"), lang, titles, slugify)
+}
+
+type mongoRedirects struct {
+	db *mongodb.Database
+}
+
+func (s *mongoRedirects) All(ctx context.Context) ([]*cms.Redirect, error) {
+	return cms.AllRedirects(ctx, s.db.Collection("redirects"))
+}
+
+func (s *mongoRedirects) Save(ctx context.Context, from, to string) error {
+	return cms.SaveRedirect(ctx, s.db.Collection("redirects"), from, to)
+}
+
+func (s *mongoRedirects) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return deleteID(ctx, s.db.Collection("redirects"), id)
+}
+
+func (s *mongoRedirects) Hit(ctx context.Context, id primitive.ObjectID) error {
+	return cms.HitRedirect(ctx, s.db.Collection("redirects"), id)
+}
+
+type mongoTranslations struct {
+	db *mongodb.Database
+}
+
+func (s *mongoTranslations) All(ctx context.Context) ([]*locale.Message, error) {
+	return locale.AllMessages(ctx, s.db.Collection("translations"), nil)
+}
+
+func (s *mongoTranslations) Save(ctx context.Context, lang, id, value string) error {
+	return locale.SaveMessage(ctx, s.db.Collection("translations"), lang, id, value)
+}
+
+type mongoSearchMisses struct {
+	db *mongodb.Database
+}
+
+func (s *mongoSearchMisses) Log(ctx context.Context, lang, query string) error {
+	return cms.LogSearchMiss(ctx, s.db.Collection("searchmisses"), lang, query)
+}
+
+func (s *mongoSearchMisses) All(ctx context.Context, limit int) ([]*cms.SearchMiss, error) {
+	return cms.AllSearchMisses(ctx, s.db.Collection("searchmisses"), nil, limit)
+}
+
+type mongoInvalidations struct {
+	db *mongodb.Database
+}
+
+func (s *mongoInvalidations) All(ctx context.Context) (map[string]time.Time, error) {
+	cur, err := s.db.Collection("invalidations").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var docs []struct {
+		Prefix string    `bson:"_id"`
+		Time   time.Time `bson:"time"`
+	}
+	if err = cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	res := make(map[string]time.Time, len(docs))
+	for _, d := range docs {
+		res[d.Prefix] = d.Time
+	}
+	return res, nil
+}
+
+func (s *mongoInvalidations) Save(ctx context.Context, prefix string, t time.Time) error {
+	_, err := s.db.Collection("invalidations").UpdateOne(ctx,
+		bson.M{"_id": prefix},
+		bson.M{"$max": bson.M{"time": t}},
+		options.Update().SetUpsert(true))
+	return err
+}
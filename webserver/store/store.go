@@ -0,0 +1,406 @@
+// Package store defines repositories of the CMS data, so that handlers
+// don't depend on a particular database. NewMongo returns repositories
+// backed by MongoDB, NewMemory returns ones keeping data in memory for
+// tests.
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/bahna/magazine/webserver/cms"
+	"github.com/bahna/magazine/webserver/file"
+	"github.com/bahna/magazine/webserver/locale"
+	"github.com/bahna/magazine/webserver/user"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrNotFound is returned when a requested item does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrDuplicate is returned when an item is saved with a unique key of
+// another item, e.g. content with a slug taken in its primary topic.
+var ErrDuplicate = errors.New("duplicate key")
+
+// Stores unites repositories of all kinds of items.
+type Stores struct {
+	Content       ContentStore
+	Topics        TopicStore
+	Users         UserStore
+	Files         FileStore
+	Messages      MessageStore
+	Contributors  ContributorStore
+	Tags          TagStore
+	Redirects     RedirectStore
+	Translations  TranslationStore
+	SearchMisses  SearchMissStore
+	Invalidations InvalidationStore
+}
+
+// ContentStore keeps content. Content returned by lists has authors and
+// topics loaded.
+type ContentStore interface {
+	// Get returns the content by ID without loaded relations.
+	Get(ctx context.Context, id primitive.ObjectID) (*cms.Content, error)
+	// FindOne returns the first content matched by the query.
+	FindOne(ctx context.Context, q ContentQuery) (*cms.Content, error)
+	// Find returns content matched by the query.
+	Find(ctx context.Context, q ContentQuery) ([]*cms.Content, error)
+	// Page returns content matched by the query by pages in the
+	// ByWeight order with numbers of the previous and the next pages,
+	// which are zero if there are no such pages.
+	Page(ctx context.Context, q ContentQuery, perpage, page int) (items []*cms.Content, prev, next int, err error)
+	// Count returns an amount of content matched by the query.
+	Count(ctx context.Context, q ContentQuery) (int, error)
+	// ByIDs returns content with the IDs in the same order, missing
+	// IDs are skipped.
+	ByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*cms.Content, error)
+	// Titles returns content matched by the query with only IDs,
+	// titles and languages loaded starting from the latest published.
+	// It is used to list content in forms.
+	Titles(ctx context.Context, q ContentQuery) ([]*cms.Content, error)
+	// Years returns years of publication of content matched by the
+	// query in descending order.
+	Years(ctx context.Context, q ContentQuery) ([]int, error)
+	// AuthorCounts returns amounts of content matched by the query by
+	// IDs of its authors.
+	AuthorCounts(ctx context.Context, q ContentQuery) (map[primitive.ObjectID]int, error)
+	// DuplicateSlugs returns slugs used by several items of content of
+	// the same language and primary topic.
+	DuplicateSlugs(ctx context.Context) ([]*cms.DuplicateSlug, error)
+	// Save creates or replaces the content. It returns ErrDuplicate
+	// if the slug is taken in the language and the primary topic.
+	Save(ctx context.Context, c *cms.Content) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// UpdateSearchFields recalculates names of authors and titles of
+	// topics stored with content matched by the query, see
+	// cms.UpdateSearchFields.
+	UpdateSearchFields(ctx context.Context, q ContentQuery) error
+	// LoadChildren sets public dependent content of the items.
+	LoadChildren(ctx context.Context, items []*cms.Content) error
+	// LoadDetails sets tags, credits and credits of images of the
+	// content for its page.
+	LoadDetails(ctx context.Context, c *cms.Content) error
+	// NextScheduled returns the earliest time after now when public
+	// content is scheduled to be published or zero time.
+	NextScheduled(ctx context.Context, now time.Time) (time.Time, error)
+}
+
+// Order is a sort order of content.
+type Order int
+
+const (
+	// ByWeight sorts the most important and recently published
+	// content first.
+	ByWeight Order = iota
+	// ByCreated sorts the most important and recently created content
+	// first.
+	ByCreated
+	// ByEventStart sorts events by their start.
+	ByEventStart
+)
+
+// ContentQuery selects content. Zero fields don't restrict the
+// selection.
+type ContentQuery struct {
+	// IDs selects content with any of the IDs.
+	IDs      []primitive.ObjectID
+	Language string
+	// Public selects public content including content scheduled for
+	// later, Published selects public content which is not scheduled.
+	Public, Published bool
+	Types             []cms.ContentType
+	// TopicIDs selects content of any of the topics.
+	TopicIDs       []primitive.ObjectID
+	PrimaryTopicID primitive.ObjectID
+	TagID          primitive.ObjectID
+	AuthorID       primitive.ObjectID
+	// ContributorIDs selects content crediting any of the
+	// contributors. Together with AuthorID it selects content either
+	// written by the author or crediting the contributors.
+	ContributorIDs []primitive.ObjectID
+	// ParentIDs selects dependent content of any of the parents.
+	ParentIDs []primitive.ObjectID
+	// Slug selects content by the current slug, OldSlug by one of
+	// the previous slugs or the page slug.
+	Slug, OldSlug string
+	// EventsAfter selects content with events starting after the time.
+	EventsAfter time.Time
+	// FileID selects content using the uploaded file, see
+	// cms.Content.FileIDs.
+	FileID primitive.ObjectID
+
+	Order Order
+	Limit int
+}
+
+// Match checks if the content is selected by the query at the time.
+func (q *ContentQuery) Match(c *cms.Content, now time.Time) bool {
+	byAuthor := !q.AuthorID.IsZero() && hasAnyID(c.AuthorIDs, []primitive.ObjectID{q.AuthorID})
+	credited := len(q.ContributorIDs) > 0 && hasAnyID(c.ContributorIDs(), q.ContributorIDs)
+	switch {
+	case len(q.IDs) > 0 && !hasAnyID(q.IDs, []primitive.ObjectID{c.ID}):
+		return false
+	case len(q.Language) > 0 && c.Language != q.Language:
+		return false
+	case q.Public && !c.Public:
+		return false
+	case q.Published && (!c.Public || !(c.Scheduled.IsZero() || c.Scheduled.Before(now))):
+		return false
+	case len(q.Types) > 0 && !hasType(q.Types, c.Type):
+		return false
+	case len(q.TopicIDs) > 0 && !hasAnyID(c.TopicIDs, q.TopicIDs):
+		return false
+	case !q.PrimaryTopicID.IsZero() && c.PrimaryTopicID != q.PrimaryTopicID:
+		return false
+	case !q.TagID.IsZero() && !hasAnyID(c.TagIDs, []primitive.ObjectID{q.TagID}):
+		return false
+	case (!q.AuthorID.IsZero() || len(q.ContributorIDs) > 0) && !byAuthor && !credited:
+		return false
+	case len(q.ParentIDs) > 0 && (c.ParentID == nil || !hasAnyID(q.ParentIDs, []primitive.ObjectID{*c.ParentID})):
+		return false
+	case len(q.Slug) > 0 && c.Slug != q.Slug:
+		return false
+	case len(q.OldSlug) > 0 && c.PageSlug != q.OldSlug && !hasString(c.OldSlugs, q.OldSlug):
+		return false
+	case !q.EventsAfter.IsZero() && c.EventStart.Before(q.EventsAfter):
+		return false
+	case !q.FileID.IsZero() && !hasString(c.FileIDs(), q.FileID.Hex()):
+		return false
+	}
+	return true
+}
+
+// TopicStore keeps topics. Topics are listed by their weights.
+type TopicStore interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*cms.Topic, error)
+	All(ctx context.Context, q TopicQuery) ([]*cms.Topic, error)
+	// FindByPath returns the topic of the language by its current
+	// path or by one of its previous paths, moved is true in the
+	// latter case.
+	FindByPath(ctx context.Context, lang, path string) (t *cms.Topic, moved bool, err error)
+	// Save creates or replaces the topic. Call UpdatePaths after
+	// slugs or parents are changed.
+	Save(ctx context.Context, t *cms.Topic) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// Order sets weights of the topics, so that they are listed in
+	// the given order.
+	Order(ctx context.Context, ids []primitive.ObjectID) error
+	// UpdatePaths recalculates paths of all topics, see
+	// cms.UpdateTopicPaths.
+	UpdatePaths(ctx context.Context) error
+	// Descendants returns IDs of subsections of the topic at any depth.
+	Descendants(ctx context.Context, id primitive.ObjectID) ([]primitive.ObjectID, error)
+}
+
+// TopicQuery selects topics. Zero fields don't restrict the selection.
+type TopicQuery struct {
+	Language string
+	// Public selects public topics which are not pages.
+	Public   bool
+	ParentID primitive.ObjectID
+}
+
+// Match checks if the topic is selected by the query.
+func (q *TopicQuery) Match(t *cms.Topic) bool {
+	switch {
+	case len(q.Language) > 0 && t.Language != q.Language:
+		return false
+	case q.Public && (!t.Public || t.Page):
+		return false
+	case !q.ParentID.IsZero() && (t.ParentID == nil || *t.ParentID != q.ParentID):
+		return false
+	}
+	return true
+}
+
+// UserStore keeps users.
+type UserStore interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*user.User, error)
+	FindByEmail(ctx context.Context, address string) (*user.User, error)
+	// FindBySlug returns the user with the slug of the author page.
+	FindBySlug(ctx context.Context, slug string) (*user.User, error)
+	All(ctx context.Context) ([]*user.User, error)
+	// ByIDs returns users with the IDs sorted by last and first names,
+	// missing IDs are skipped.
+	ByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*user.User, error)
+	Save(ctx context.Context, u *user.User) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+// FileStore keeps records of uploaded files. Files themselves are
+// stored in the file system.
+type FileStore interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*file.File, error)
+	// Find returns files matched by the query starting from the
+	// latest ones.
+	Find(ctx context.Context, q FileQuery) ([]*file.File, error)
+	// Page returns files matched by the query by pages starting from
+	// the latest ones, see file.AllFilesByPage.
+	Page(ctx context.Context, q FileQuery, perpage, page int) (items []*file.File, prev, next, total int, err error)
+	// Folders returns names of folders with files in alphabetical
+	// order.
+	Folders(ctx context.Context) ([]string, error)
+	Save(ctx context.Context, f *file.File) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+// FileQuery selects files. Zero fields don't restrict the selection.
+type FileQuery struct {
+	// Text selects files with the text in titles, credits, names of
+	// uploaded files or URLs ignoring case.
+	Text   string
+	Kinds  []int
+	Folder string
+	// UploadedAfter and UploadedBefore select files uploaded in the
+	// period, the latter is excluded.
+	UploadedAfter, UploadedBefore time.Time
+	// Cropped selects images with the focus or crops set by editors.
+	Cropped bool
+}
+
+// Match checks if the file is selected by the query.
+func (q *FileQuery) Match(f *file.File) bool {
+	switch {
+	case len(q.Text) > 0 && !containsFold([]string{f.Title, f.Credits, f.Filename, f.URL}, q.Text):
+		return false
+	case len(q.Kinds) > 0 && !hasInt(q.Kinds, f.Kind):
+		return false
+	case len(q.Folder) > 0 && f.Folder != q.Folder:
+		return false
+	case !q.UploadedAfter.IsZero() && f.Created.Before(q.UploadedAfter):
+		return false
+	case !q.UploadedBefore.IsZero() && !f.Created.Before(q.UploadedBefore):
+		return false
+	case q.Cropped && f.Focus == nil && len(f.Crops) == 0:
+		return false
+	}
+	return true
+}
+
+// MessageStore keeps messages from website users.
+type MessageStore interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*cms.Message, error)
+	// All returns messages starting from the latest ones.
+	All(ctx context.Context) ([]*cms.Message, error)
+	Save(ctx context.Context, m *cms.Message) error
+	SetStatus(ctx context.Context, id primitive.ObjectID, status cms.MessageStatus) error
+}
+
+// ContributorStore keeps contributors. Contributors are listed by
+// names.
+type ContributorStore interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*cms.Contributor, error)
+	All(ctx context.Context) ([]*cms.Contributor, error)
+	// ByUser returns contributors linked to the user account.
+	ByUser(ctx context.Context, userID primitive.ObjectID) ([]*cms.Contributor, error)
+	Save(ctx context.Context, c *cms.Contributor) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+// TagStore keeps tags of content.
+type TagStore interface {
+	// FindBySlug returns the tag of the language by its slug.
+	FindBySlug(ctx context.Context, lang, slug string) (*cms.Tag, error)
+	// ByIDs returns tags with the IDs sorted by titles.
+	ByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*cms.Tag, error)
+	// Find returns up to limit tags of the language with a word
+	// beginning with the prefix sorted by titles.
+	Find(ctx context.Context, lang, prefix string, limit int) ([]*cms.Tag, error)
+	// Create creates missing tags of the language by their titles and
+	// returns IDs of all given tags, see cms.SaveTags.
+	Create(ctx context.Context, lang string, titles []string, slugify func(string) string) ([]primitive.ObjectID, error)
+}
+
+// RedirectStore keeps manual redirect rules.
+type RedirectStore interface {
+	// All returns rules sorted by source paths.
+	All(ctx context.Context) ([]*cms.Redirect, error)
+	// Save creates a rule or changes the target of the rule with the
+	// same source path.
+	Save(ctx context.Context, from, to string) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// Hit counts a redirect by the rule.
+	Hit(ctx context.Context, id primitive.ObjectID) error
+}
+
+// TranslationStore keeps UI messages edited by administrators.
+type TranslationStore interface {
+	// All returns messages sorted by languages and message IDs.
+	All(ctx context.Context) ([]*locale.Message, error)
+	// Save stores the message value for the language, the empty value
+	// removes the message, see locale.SaveMessage.
+	Save(ctx context.Context, lang, id, value string) error
+}
+
+// SearchMissStore keeps search queries which have found nothing.
+type SearchMissStore interface {
+	// Log stores the query or increments its counter if the query has
+	// been stored before.
+	Log(ctx context.Context, lang, query string) error
+	// All returns up to limit queries, the most frequent first.
+	All(ctx context.Context, limit int) ([]*cms.SearchMiss, error)
+}
+
+// InvalidationStore keeps times when cached pages were invalidated, so
+// that versions of pages are known after restarts and to the exporter.
+type InvalidationStore interface {
+	// All returns invalidation times by path prefixes, the empty
+	// prefix is the time when all pages were invalidated.
+	All(ctx context.Context) (map[string]time.Time, error)
+	// Save sets the invalidation time of pages with the path prefix
+	// unless it is older than the saved one.
+	Save(ctx context.Context, prefix string, t time.Time) error
+}
+
+func hasType(types []cms.ContentType, t cms.ContentType) bool {
+	for _, v := range types {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyID(ids, any []primitive.ObjectID) bool {
+	for _, v := range ids {
+		for _, id := range any {
+			if v == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasInt(ints []int, n int) bool {
+	for _, v := range ints {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFold reports whether any of the strings contains the
+// substring ignoring case.
+func containsFold(ss []string, substr string) bool {
+	substr = strings.ToLower(substr)
+	for _, v := range ss {
+		if strings.Contains(strings.ToLower(v), substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -78,6 +78,16 @@ func generateTmpls(tmplDir string, funcMap template.FuncMap) map[string]*templat
 			path.Join(tmplDir, "admin_sidebar.html"),
 			path.Join(tmplDir, "admin_new_user.html"),
 		},
+		"admin/contributors/index": []string{
+			path.Join(tmplDir, "admin_header.html"),
+			path.Join(tmplDir, "admin_sidebar.html"),
+			path.Join(tmplDir, "admin_contributors.html"),
+		},
+		"admin/contributors/edit": []string{
+			path.Join(tmplDir, "admin_header.html"),
+			path.Join(tmplDir, "admin_sidebar.html"),
+			path.Join(tmplDir, "admin_edit_contributor.html"),
+		},
 		"admin/users/edit": []string{
 			path.Join(tmplDir, "admin_header.html"),
 			path.Join(tmplDir, "admin_sidebar.html"),
@@ -98,6 +108,31 @@ func generateTmpls(tmplDir string, funcMap template.FuncMap) map[string]*templat
 			path.Join(tmplDir, "admin_sidebar.html"),
 			path.Join(tmplDir, "admin_edit_file.html"),
 		},
+		"admin/files/orphaned": []string{
+			path.Join(tmplDir, "admin_header.html"),
+			path.Join(tmplDir, "admin_sidebar.html"),
+			path.Join(tmplDir, "admin_orphaned_files.html"),
+		},
+		"admin/translations/index": []string{
+			path.Join(tmplDir, "admin_header.html"),
+			path.Join(tmplDir, "admin_sidebar.html"),
+			path.Join(tmplDir, "admin_translations.html"),
+		},
+		"admin/content/duplicates": []string{
+			path.Join(tmplDir, "admin_header.html"),
+			path.Join(tmplDir, "admin_sidebar.html"),
+			path.Join(tmplDir, "admin_duplicates.html"),
+		},
+		"admin/redirects": []string{
+			path.Join(tmplDir, "admin_header.html"),
+			path.Join(tmplDir, "admin_sidebar.html"),
+			path.Join(tmplDir, "admin_redirects.html"),
+		},
+		"admin/search/misses": []string{
+			path.Join(tmplDir, "admin_header.html"),
+			path.Join(tmplDir, "admin_sidebar.html"),
+			path.Join(tmplDir, "admin_search_misses.html"),
+		},
 	}
 
 	tmpls := map[string][]string{
@@ -136,6 +171,26 @@ func generateTmpls(tmplDir string, funcMap template.FuncMap) map[string]*templat
 			path.Join(tmplDir, "footer.html"),
 			path.Join(tmplDir, "topic.html"),
 		},
+		"search": []string{
+			path.Join(tmplDir, "header.html"),
+			path.Join(tmplDir, "footer.html"),
+			path.Join(tmplDir, "search.html"),
+		},
+		"tag": []string{
+			path.Join(tmplDir, "header.html"),
+			path.Join(tmplDir, "footer.html"),
+			path.Join(tmplDir, "tag.html"),
+		},
+		"authors": []string{
+			path.Join(tmplDir, "header.html"),
+			path.Join(tmplDir, "footer.html"),
+			path.Join(tmplDir, "authors.html"),
+		},
+		"author": []string{
+			path.Join(tmplDir, "header.html"),
+			path.Join(tmplDir, "footer.html"),
+			path.Join(tmplDir, "author.html"),
+		},
 		"subscription_done": []string{
 			path.Join(tmplDir, "header.html"),
 			path.Join(tmplDir, "footer.html"),
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bahna/magazine/webserver/cms"
+	"github.com/bahna/magazine/webserver/file"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxFormValueSize limits values of fields of upload forms, which are
+// read into memory unlike files.
+const maxFormValueSize = 1 << 20
+
+// staleUploadAge is the time after which resumable uploads without new
+// chunks are removed.
+const staleUploadAge = 24 * time.Hour
+
+// tempUpload is a file of a form written to the uploads directory.
+type tempUpload struct {
+	// name is the name of the temporary file.
+	name string
+	// field is the name of the form field.
+	field string
+	file.Upload
+}
+
+// receiveUploads streams files of the multipart form of the request to
+// temporary files, so that large files aren't kept in memory. Values of
+// other fields are returned. Temporary files are removed on errors.
+func receiveUploads(r *http.Request, filesDir string) (url.Values, []tempUpload, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+	values := make(url.Values)
+	var uploads []tempUpload
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return values, uploads, nil
+		}
+		if err != nil {
+			removeUploads(uploads)
+			return nil, nil, err
+		}
+		field := part.FormName()
+		if len(part.FileName()) == 0 {
+			b, err := ioutil.ReadAll(io.LimitReader(part, maxFormValueSize+1))
+			if err == nil && len(b) > maxFormValueSize {
+				err = fmt.Errorf("value of %s is too large", field)
+			}
+			if err != nil {
+				removeUploads(uploads)
+				return nil, nil, err
+			}
+			values.Add(field, string(b))
+			continue
+		}
+		name, err := file.WriteTemp(filesDir, part)
+		if err != nil {
+			removeUploads(uploads)
+			return nil, nil, err
+		}
+		uploads = append(uploads, tempUpload{
+			name:   name,
+			field:  field,
+			Upload: file.Upload{Filename: path.Base(part.FileName())},
+		})
+	}
+}
+
+// removeUploads removes temporary files which weren't added.
+func removeUploads(uploads []tempUpload) {
+	for _, u := range uploads {
+		os.Remove(u.name)
+	}
+}
+
+// rejectedFile is an uploaded file of a type which isn't allowed.
+type rejectedFile struct {
+	name string
+	err  error
+}
+
+func (e *rejectedFile) Error() string {
+	return e.name + ": " + e.err.Error()
+}
+
+// checkUpload returns rejectedFile if the error is a failed validation
+// of the uploaded file, see file.Validate.
+func checkUpload(name string, err error) error {
+	switch err {
+	case file.ErrTypeNotAllowed, file.ErrExtensionMismatch, file.ErrInvalidSVG:
+		return &rejectedFile{name, err}
+	}
+	return err
+}
+
+// rejectUpload responds with the Unsupported Media Type status if the
+// error is rejectedFile, it reports whether it did.
+func rejectUpload(w http.ResponseWriter, err error) bool {
+	if _, ok := err.(*rejectedFile); ok {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return true
+	}
+	return false
+}
+
+// uploadField returns the value of the field for the i-th file of the
+// form, e.g. Title.2 for the third file. The value shared by all files
+// is returned if the file has none.
+func uploadField(values url.Values, name string, i int) string {
+	if v := values.Get(name + "." + strconv.Itoa(i)); len(v) > 0 {
+		return v
+	}
+	return values.Get(name)
+}
+
+// uploadFromForm returns the description of the files of the form
+// except for names of files.
+func uploadFromForm(values url.Values) file.Upload {
+	return file.Upload{
+		Title:    values.Get("Title"),
+		Credits:  values.Get("Credits"),
+		Folder:   strings.TrimSpace(values.Get("Folder")),
+		Optimize: len(values.Get("NeedOptimize")) > 0,
+	}
+}
+
+// adminStartUploadHandler starts a resumable upload of a file, which is
+// sent in chunks by adminUploadHandler afterwards. The form describes the
+// file: Filename, Length in bytes, Title, Credits, Folder and
+// NeedOptimize. Files with extensions which aren't allowed are refused
+// before they are sent. The upload URL is returned in the Location
+// header.
+func adminStartUploadHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		length, err := strconv.ParseInt(r.FormValue("Length"), 10, 64)
+		if err != nil || length <= 0 || len(r.FormValue("Filename")) == 0 {
+			http.Error(w, "file name and length are required", http.StatusBadRequest)
+			return
+		}
+		if length > app.Config.MaxResumableUploadSize {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if _, ok := app.Config.UploadTypes.Kind(r.FormValue("Filename")); !ok {
+			http.Error(w, (&rejectedFile{r.FormValue("Filename"), file.ErrTypeNotAllowed}).Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		// abandoned uploads are removed when others begin
+		Check(file.RemoveStaleUploads(app.Config.FilesDir, staleUploadAge))
+
+		u := uploadFromForm(r.Form)
+		u.Filename = path.Base(r.FormValue("Filename"))
+		up, err := file.NewResumable(app.Config.FilesDir, length, u)
+		Check(err)
+
+		w.Header().Set("Location", path.Join(r.URL.Path, up.ID))
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct{ ID string }{up.ID})
+	})
+}
+
+// adminUploadHandler receives chunks of a resumable upload. Chunks are
+// sent with PATCH requests with the Upload-Offset header, which is the
+// amount of bytes received before. HEAD requests report the offset to
+// resume the upload after a failure, DELETE requests cancel it. The file
+// is added when the last chunk is received if its contents are allowed.
+func adminUploadHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		up, err := file.OpenResumable(app.Config.FilesDir, mux.Vars(r)["id"])
+		if err == file.ErrUploadNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		Check(err)
+		w.Header().Set("Cache-Control", "no-store")
+
+		switch r.Method {
+		case "HEAD":
+			w.Header().Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+			w.Header().Set("Upload-Length", strconv.FormatInt(up.Length, 10))
+			return
+		case "DELETE":
+			Check(up.Cancel())
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// PATCH
+
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid Upload-Offset", http.StatusBadRequest)
+			return
+		}
+		err = up.Append(offset, http.MaxBytesReader(w, r.Body, app.Config.MaxUploadSize))
+		switch err {
+		case nil:
+		case file.ErrOffsetMismatch:
+			w.Header().Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case file.ErrUploadTooLarge:
+			Check(up.Cancel())
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		default:
+			// the received part is kept, the chunk is resent from
+			// the offset
+			w.Header().Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !up.Done() {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		f, err := up.Complete(app.Config.FilesDir, app.Config.UploadTypes)
+		if rejectUpload(w, checkUpload(up.Filename, err)) {
+			return
+		}
+		Check(err)
+		Check(app.Store.Files.Save(r.Context(), f))
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct{ ID, URL string }{f.ID.Hex(), f.URL})
+	})
+}
+
+// adminImportPhotoreportHandler makes a draft photoreport of photos of
+// the zip archive sent in the Archive field. Title, Credits and Folder
+// are shared by the photos, the folder is the title by default.
+func adminImportPhotoreportHandler(app *application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		lang := LangMust(app.LangMatcher, vars["lang"], r)
+
+		if r.ContentLength > app.Config.MaxUploadSize {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, app.Config.MaxUploadSize)
+		values, uploads, err := receiveUploads(r, app.Config.FilesDir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer removeUploads(uploads)
+
+		u := uploadFromForm(values)
+		if len(u.Title) == 0 || len(uploads) == 0 || uploads[0].field != "Archive" {
+			http.Error(w, "title and archive are required", http.StatusBadRequest)
+			return
+		}
+		if len(u.Folder) == 0 {
+			u.Folder = u.Title
+		}
+		c, err := importPhotoreport(r.Context(), app, uploads[0].name, lang.String(), u)
+		if err == errNoPhotos || err == zip.ErrFormat {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if rejectUpload(w, err) {
+			return
+		}
+		Check(err)
+		invalidatePages(app)
+
+		http.Redirect(w, r, fmt.Sprintf("/%s/admin/content/edit/%s", lang.String(), c.ID.Hex()), http.StatusSeeOther)
+	})
+}
+
+var errNoPhotos = errors.New("the archive has no photos")
+
+// importPhotoreport adds photos of the zip archive in the order of their
+// names and saves a draft photoreport of the language with them. The
+// first photo is the cover.
+func importPhotoreport(ctx context.Context, app *application, archive, lang string, u file.Upload) (*cms.Content, error) {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var photos []*zip.File
+	for _, f := range zr.File {
+		name := path.Base(f.Name)
+		if f.FileInfo().IsDir() || strings.HasPrefix(name, ".") || strings.HasPrefix(f.Name, "__MACOSX/") {
+			// skip folders and files of archivers
+			continue
+		}
+		if kind, ok := app.Config.UploadTypes.Kind(name); ok && kind == file.ImageKind {
+			photos = append(photos, f)
+		}
+	}
+	if len(photos) == 0 {
+		return nil, errNoPhotos
+	}
+	sort.Slice(photos, func(i, j int) bool { return photos[i].Name < photos[j].Name })
+
+	// all photos are unpacked and validated before they are added,
+	// sizes in archives may be forged, so they are limited as they
+	// are unpacked
+	temps := make([]string, 0, len(photos))
+	defer func() {
+		for _, name := range temps {
+			os.Remove(name)
+		}
+	}()
+	budget := &io.LimitedReader{N: app.Config.MaxResumableUploadSize + 1}
+	for _, p := range photos {
+		rc, err := p.Open()
+		if err != nil {
+			return nil, err
+		}
+		budget.R = rc
+		temp, err := file.WriteTemp(app.Config.FilesDir, budget)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		temps = append(temps, temp)
+		if budget.N <= 0 {
+			return nil, errors.New("the archive is too large")
+		}
+		if err = file.Validate(temp, p.Name, app.Config.UploadTypes); err != nil {
+			return nil, checkUpload(p.Name, err)
+		}
+	}
+
+	c := &cms.Content{
+		ID:        primitive.NewObjectID(),
+		Type:      cms.Photoreport,
+		Language:  lang,
+		Title:     u.Title,
+		PageTitle: u.Title,
+		Slug:      app.Transliterator.SlugifyLang(lang, u.Title),
+		Created:   time.Now(),
+	}
+	c.Published = c.Created
+	if lang == "be" {
+		c.LanguageOverride = "ru"
+	}
+	if app.CurrentUser != nil {
+		c.AuthorIDs = []primitive.ObjectID{app.CurrentUser.ID}
+	}
+	for i, p := range photos {
+		photo := u
+		photo.Filename = path.Base(p.Name)
+		f, err := file.Add(temps[i], app.Config.FilesDir, app.Config.UploadTypes, photo)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p.Name, err)
+		}
+		if err = app.Store.Files.Save(ctx, f); err != nil {
+			return nil, err
+		}
+		c.Images = append(c.Images, cms.Image{URL: f.URL, Caption: f.Title, Credits: f.Credits})
+	}
+	c.CoverExternal = c.Images[0].URL
+	c.CoverInternal = c.Images[0].URL
+
+	return c, app.Store.Content.Save(ctx, c)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bahna/magazine/webserver/cms"
+	"github.com/bahna/magazine/webserver/file"
+	"github.com/bahna/magazine/webserver/store"
+)
+
+// testFile is a file of a multipart form.
+type testFile struct {
+	field, name, contentType string
+	data                     []byte
+}
+
+func (s *testServer) postMultipart(t *testing.T, path string, form url.Values, files ...testFile) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, vv := range form {
+		for _, v := range vv {
+			check(t, mw.WriteField(k, v))
+		}
+	}
+	for _, f := range files {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="`+f.field+`"; filename="`+f.name+`"`)
+		h.Set("Content-Type", f.contentType)
+		w, err := mw.CreatePart(h)
+		check(t, err)
+		w.Write(f.data)
+	}
+	check(t, mw.Close())
+	r := httptest.NewRequest("POST", path, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.AddCookie(s.admin)
+	return s.do(t, r)
+}
+
+// filesDir sets a temporary files directory, files are served from it.
+func (s *testServer) filesDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "files")
+	check(t, err)
+	s.app.Config.FilesDir = dir
+	s.app.Router = makeRouter(s.app)
+	s.handler = Recover(Authenticate(s.app.Router, s.app.Config.Scookie))
+	return dir
+}
+
+func TestUploads(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	ctx := context.Background()
+
+	dir := s.filesDir(t)
+	defer os.RemoveAll(dir)
+	s.app.Config.MaxUploadSize = 1 << 20
+	s.app.Config.MaxResumableUploadSize = 1 << 30
+
+	// files of a form have their own titles or share one
+	rec := s.postMultipart(t, "/ru/admin/files/", url.Values{"Title": {"Program"}, "Title.1": {"Lyrics"}, "Folder": {" concert "}},
+		testFile{"Files", "program.txt", "text/plain", []byte("Overture")},
+		testFile{"Files", "lyrics.TXT", "text/plain", []byte("La-la-la")})
+	expect(t, rec, http.StatusSeeOther, "")
+	files, err := s.app.Store.Files.Find(ctx, store.FileQuery{Folder: "concert"})
+	check(t, err)
+	titles := map[string]string{}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f.Name(dir))
+		check(t, err)
+		titles[f.Title] = string(b)
+		if !strings.HasSuffix(f.URL, ".txt") {
+			t.Errorf("%s: extension isn't kept", f.URL)
+		}
+	}
+	if len(titles) != 2 || titles["Program"] != "Overture" || titles["Lyrics"] != "La-la-la" {
+		t.Errorf("files of the form: %v", titles)
+	}
+	expect(t, s.postMultipart(t, "/ru/admin/files/", url.Values{"Title": {"Nothing"}}), http.StatusBadRequest, "no files")
+
+	// types are sniffed from contents, nothing is added if a file is
+	// refused
+	rejected := []testFile{
+		{"Files", "page.html", "text/html", []byte("<html><script>alert(1)</script></html>")},
+		{"Files", "photo.png", "image/png", []byte("Overture")},
+		{"Files", "notes.txt", "text/plain", []byte("\x89PNG\r\n\x1a\n")},
+	}
+	for _, f := range rejected {
+		rec = s.postMultipart(t, "/ru/admin/files/", nil, testFile{"Files", "ok.txt", "text/plain", []byte("ok")}, f)
+		expect(t, rec, http.StatusUnsupportedMediaType, f.name)
+	}
+	if files, _ = s.app.Store.Files.Find(ctx, store.FileQuery{}); len(files) != 2 {
+		t.Errorf("%d files are added", len(files))
+	}
+
+	// large files are sent in chunks
+	expect(t, s.post(t, "/ru/admin/files/uploads", url.Values{"Filename": {"concert.mp3"}, "Length": {"2000000000"}}, s.admin),
+		http.StatusRequestEntityTooLarge, "")
+	expect(t, s.post(t, "/ru/admin/files/uploads", url.Values{"Filename": {"setup.exe"}, "Length": {"10"}}, s.admin),
+		http.StatusUnsupportedMediaType, "setup.exe")
+	rec = s.post(t, "/ru/admin/files/uploads", url.Values{
+		"Filename":    {"concert.mp3"},
+		"ContentType": {"audio/mpeg"},
+		"Length":      {"10"},
+		"Title":       {"Recording"},
+	}, s.admin)
+	expect(t, rec, http.StatusCreated, "")
+	location := rec.Header().Get("Location")
+	chunk := func(method string, offset, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, location, strings.NewReader(body))
+		if len(offset) > 0 {
+			r.Header.Set("Upload-Offset", offset)
+		}
+		r.AddCookie(s.admin)
+		return s.do(t, r)
+	}
+	tests := []struct {
+		method, offset, body string
+		code                 int
+		received             string
+	}{
+		{"PATCH", "0", "ID3ab", http.StatusNoContent, "5"},
+		// resent chunks are refused with the received offset
+		{"PATCH", "0", "ID3ab", http.StatusConflict, "5"},
+		{"PATCH", "", "ID3ab", http.StatusBadRequest, ""},
+		{"HEAD", "", "", http.StatusOK, "5"},
+		{"PATCH", "5", "world", http.StatusCreated, ""},
+		{"HEAD", "", "", http.StatusNotFound, ""},
+	}
+	var added struct{ ID, URL string }
+	for _, tt := range tests {
+		rec = chunk(tt.method, tt.offset, tt.body)
+		if rec.Code != tt.code || rec.Header().Get("Upload-Offset") != tt.received {
+			t.Fatalf("%s at %s: got %d at %q, want %d at %q", tt.method, tt.offset, rec.Code,
+				rec.Header().Get("Upload-Offset"), tt.code, tt.received)
+		}
+		if rec.Code == http.StatusCreated {
+			check(t, json.Unmarshal(rec.Body.Bytes(), &added))
+		}
+	}
+	f, err := s.app.Store.Files.Get(ctx, objectIDHex(added.ID))
+	check(t, err)
+	if b, _ := ioutil.ReadFile(f.Name(dir)); string(b) != "ID3abworld" || f.Title != "Recording" || f.URL != added.URL {
+		t.Errorf("uploaded file %+v: %q", f, b)
+	}
+
+	// uploads larger than declared are cancelled
+	rec = s.post(t, "/ru/admin/files/uploads", url.Values{"Filename": {"a.mp3"}, "Length": {"3"}}, s.admin)
+	location = rec.Header().Get("Location")
+	expect(t, chunk("PATCH", "0", "hello"), http.StatusRequestEntityTooLarge, "")
+	expect(t, chunk("HEAD", "", ""), http.StatusNotFound, "")
+	if ff, _ := ioutil.ReadDir(file.UploadsDir(dir)); len(ff) != 0 {
+		t.Errorf("%d temporary files are kept", len(ff))
+	}
+	// uploads in progress aren't served
+	check(t, ioutil.WriteFile(filepath.Join(file.UploadsDir(dir), "upload1"), []byte("draft"), 0644))
+	expect(t, s.get(t, "/files/.uploads/upload1", nil), http.StatusNotFound, "")
+}
+
+func TestServeUploads(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	dir := s.filesDir(t)
+	defer os.RemoveAll(dir)
+	s.app.Config.MaxUploadSize = 1 << 20
+
+	// scripts are removed from SVG images, which are sandboxed
+	rec := s.postMultipart(t, "/ru/admin/files/", url.Values{"Title": {"Logo"}}, testFile{"Files", "logo.svg", "image/svg+xml",
+		[]byte(`<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"><script>alert(2)</script><circle r="5"/></svg>`)})
+	expect(t, rec, http.StatusSeeOther, "")
+	files, err := s.app.Store.Files.Find(context.Background(), store.FileQuery{})
+	check(t, err)
+	if len(files) != 1 || files[0].Kind != file.FileKind {
+		t.Fatalf("files %+v", files)
+	}
+	rec = s.get(t, files[0].URL, nil)
+	expect(t, rec, http.StatusOK, `<circle r="5"></circle>`)
+	if strings.Contains(rec.Body.String(), "alert") {
+		t.Errorf("scripts are kept: %s", rec.Body.String())
+	}
+	if h := rec.Header(); h.Get("Content-Type") != "image/svg+xml" || !strings.Contains(h.Get("Content-Security-Policy"), "sandbox") {
+		t.Errorf("SVG headers %v", h)
+	}
+
+	// files uploaded before validation are downloaded
+	check(t, ioutil.WriteFile(filepath.Join(dir, "page.html"), []byte("<script>alert(1)</script>"), 0644))
+	rec = s.get(t, "/files/page.html", nil)
+	h := rec.Header()
+	if h.Get("Content-Type") != "application/octet-stream" || h.Get("Content-Disposition") != "attachment" ||
+		h.Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("HTML headers %v", h)
+	}
+}
+
+func TestImportPhotoreport(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	ctx := context.Background()
+
+	dir := s.filesDir(t)
+	defer os.RemoveAll(dir)
+	s.app.Config.MaxUploadSize = 1 << 20
+	s.app.Config.MaxResumableUploadSize = 1 << 20
+
+	var photo bytes.Buffer
+	check(t, png.Encode(&photo, image.NewRGBA(image.Rect(0, 0, 4, 3))))
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, name := range []string{"spring/02.png", "spring/01.png", "__MACOSX/spring/._01.png", "spring/notes.txt"} {
+		w, err := zw.Create(name)
+		check(t, err)
+		w.Write(photo.Bytes())
+	}
+	check(t, zw.Close())
+
+	form := url.Values{"Title": {"Spring"}, "Credits": {"Photographer"}}
+	expect(t, s.postMultipart(t, "/ru/admin/files/photoreport", form,
+		testFile{"Archive", "spring.zip", "application/zip", []byte("not a zip")}), http.StatusBadRequest, "")
+	rec := s.postMultipart(t, "/ru/admin/files/photoreport", form,
+		testFile{"Archive", "spring.zip", "application/zip", archive.Bytes()})
+	expect(t, rec, http.StatusSeeOther, "")
+	id := strings.TrimPrefix(rec.Header().Get("Location"), "/ru/admin/content/edit/")
+	c, err := s.app.Store.Content.Get(ctx, objectIDHex(id))
+	check(t, err)
+	if c.Type != cms.Photoreport || c.Public || c.Slug != "spring" || len(c.Images) != 2 || c.CoverInternal != c.Images[0].URL {
+		t.Fatalf("photoreport %+v", c)
+	}
+	files, err := s.app.Store.Files.Find(ctx, store.FileQuery{Folder: "Spring"})
+	check(t, err)
+	for _, f := range files {
+		if f.Credits != "Photographer" || !strings.Contains(c.Images[0].URL+c.Images[1].URL, f.URL) {
+			t.Errorf("photo %+v", f)
+		}
+		if f.Filename == "01.png" && f.URL != c.Images[0].URL {
+			t.Error("photos aren't in the order of names")
+		}
+	}
+	if len(files) != 2 {
+		t.Errorf("%d photos are added", len(files))
+	}
+}
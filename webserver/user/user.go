@@ -13,8 +13,7 @@ import (
 	"time"
 
 	"github.com/gorilla/securecookie"
-
-	"github.com/globalsign/mgo/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 var (
@@ -26,7 +25,7 @@ var (
 
 // User represents a user of a system.
 type User struct {
-	ID           bson.ObjectId `bson:"_id"`
+	ID           primitive.ObjectID `bson:"_id"`
 	FirstName    string
 	LastName     string
 	Created      time.Time
@@ -34,6 +33,16 @@ type User struct {
 	Email        mail.Address
 	PasswordHash []byte
 	Roles        []Role
+
+	// Public profile of an author. Only these fields and names are
+	// shown on public pages, see cms.Author.
+	Slug string
+	// Bio is a biography by language codes.
+	Bio map[string]string
+	// PhotoID refers to an image file.
+	PhotoID *primitive.ObjectID
+	// Links are URLs of social network profiles.
+	Links []string
 }
 
 // Role represents a user's role. It's a mean for access control.
@@ -85,7 +94,7 @@ func New(password, email, firstName, lastName string, roles []Role, key []byte)
 		return u, fmt.Errorf("user roles must be specified")
 	}
 	return &User{
-		ID:           bson.NewObjectId(),
+		ID:           primitive.NewObjectID(),
 		FirstName:    firstName,
 		LastName:     lastName,
 		Created:      time.Now(),
@@ -121,7 +130,7 @@ func MakeMAC(msg, key []byte) ([]byte, error) {
 // Validate checks if all compulsory fields are present.
 func Validate(u *User) bool {
 	switch {
-	case u.ID == bson.ObjectId(""):
+	case u.ID.IsZero():
 		fallthrough
 	case u.Email == mail.Address{}:
 		fallthrough